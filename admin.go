@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// sessionInfo describes a connected MCP session in the admin API.
+type sessionInfo struct {
+	ID             string                  `json:"id"`
+	MCPIdentity    string                  `json:"mcp_identity,omitempty"`
+	Client         *mcp.Implementation     `json:"client,omitempty"`
+	Capabilities   *mcp.ClientCapabilities `json:"capabilities,omitempty"`
+	Ollama         []string                `json:"ollama_capabilities"`
+	ConnectedAt    time.Time               `json:"connected_at"`
+	InFlight       int                     `json:"in_flight"`
+	RequestsServed int64                   `json:"requests_served"`
+	LastError      string                  `json:"last_error,omitempty"`
+	LastErrorAt    *time.Time              `json:"last_error_at,omitempty"`
+	Draining       bool                    `json:"draining"`
+	Pinned         bool                    `json:"pinned"`
+}
+
+// sessionInfos returns the connected sessions ordered by ID.
+func (h *sessionHolder) sessionInfos() []sessionInfo {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	infos := []sessionInfo{}
+	for _, id := range slices.Sorted(maps.Keys(h.sessions)) {
+		s := h.sessions[id]
+		info := sessionInfo{
+			ID:          id,
+			MCPIdentity: h.identities[id],
+			Client:      sessionClientInfo(s),
+			Ollama:      sessionCapabilities(s),
+			Pinned:      h.pinned == id,
+		}
+		if p := sessionInitializeParams(s); p != nil {
+			info.Capabilities = p.Capabilities
+		}
+		if st := h.stats[id]; st != nil {
+			info.ConnectedAt = st.connectedAt
+			info.InFlight = st.inFlight
+			info.RequestsServed = st.served
+			info.LastError = st.lastError
+			info.Draining = st.draining
+			if !st.lastErrorAt.IsZero() {
+				at := st.lastErrorAt
+				info.LastErrorAt = &at
+			}
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// routingState is how requests are currently routed to sessions.
+type routingState struct {
+	// Default is the session serving clients not bound to an MCP identity.
+	Default string `json:"default_session,omitempty"`
+	Pinned  string `json:"pinned_session,omitempty"`
+	Latest  string `json:"latest_session,omitempty"`
+	// Identities maps each authenticated MCP identity to its sessions.
+	Identities map[string][]string `json:"identities"`
+	Draining   []string            `json:"draining"`
+}
+
+func (h *sessionHolder) routing() routingState {
+	st := routingState{Identities: map[string][]string{}, Draining: []string{}}
+	if s := h.get(); s != nil {
+		st.Default = s.ID()
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	st.Pinned = h.pinned
+	if h.latest != nil {
+		st.Latest = h.latest.ID()
+	}
+	for _, id := range slices.Sorted(maps.Keys(h.sessions)) {
+		if identity := h.identities[id]; identity != "" {
+			st.Identities[identity] = append(st.Identities[identity], id)
+		}
+		if s := h.stats[id]; s != nil && s.draining {
+			st.Draining = append(st.Draining, id)
+		}
+	}
+	return st
+}
+
+// adminConfig is the configuration reported by GET /admin/config.
+type adminConfig struct {
+	Version string            `json:"version"`
+	Flags   map[string]string `json:"flags"`
+	Models  []modelEntry      `json:"models"`
+}
+
+// newAdminHandler serves the admin API. It is meant for its own listener,
+// behind clientAuth with the -admin-keys store. The returned mux can be
+// given further authenticated routes.
+func newAdminHandler(holder *sessionHolder, models *modelRegistry, limits *rateLimiter, flags map[string]string, logger *slog.Logger) *http.ServeMux {
+	mux := http.NewServeMux()
+	writeJSON := func(w http.ResponseWriter, status int, v any) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(v)
+	}
+	// action runs an operation on the session named in the path.
+	action := func(verb string, op func(id string) error) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			id := r.PathValue("id")
+			if err := op(id); errors.Is(err, errStdioSession) {
+				writeError(w, logger, http.StatusConflict, err.Error())
+				return
+			} else if err != nil {
+				writeError(w, logger, http.StatusNotFound, err.Error())
+				return
+			}
+			logger.Info("Admin session action", "action", verb, "session_id", id, "client", clientLabel(r.Context()))
+			writeJSON(w, http.StatusAccepted, map[string]string{"status": verb, "session_id": id})
+		}
+	}
+
+	mux.HandleFunc("GET /admin/sessions", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{"sessions": holder.sessionInfos()})
+	})
+	mux.HandleFunc("GET /admin/sessions/{id}", func(w http.ResponseWriter, r *http.Request) {
+		for _, info := range holder.sessionInfos() {
+			if info.ID == r.PathValue("id") {
+				writeJSON(w, http.StatusOK, info)
+				return
+			}
+		}
+		writeError(w, logger, http.StatusNotFound, "session not found")
+	})
+	mux.HandleFunc("POST /admin/sessions/{id}/drain", action("draining", holder.drain))
+	mux.HandleFunc("POST /admin/sessions/{id}/kick", action("kicked", holder.kick))
+	mux.HandleFunc("POST /admin/sessions/{id}/pin", action("pinned", holder.pin))
+	mux.HandleFunc("DELETE /admin/pin", func(w http.ResponseWriter, r *http.Request) {
+		holder.pin("")
+		logger.Info("Admin session action", "action", "unpinned", "client", clientLabel(r.Context()))
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /admin/routing", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, holder.routing())
+	})
+	mux.HandleFunc("GET /admin/limits", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, limits.state())
+	})
+	mux.HandleFunc("GET /admin/config", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, adminConfig{Version: version, Flags: flags, Models: models.list()})
+	})
+	return mux
+}
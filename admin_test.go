@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// closableSession records Close calls, standing in for *mcp.ServerSession.
+type closableSession struct {
+	mockSession
+	closed atomic.Bool
+}
+
+func (s *closableSession) Close() error {
+	s.closed.Store(true)
+	return nil
+}
+
+func TestSessionHolderDrainAndPin(t *testing.T) {
+	h := newSessionHolder()
+	a := &closableSession{mockSession: mockSession{id: "a"}}
+	b := &closableSession{mockSession: mockSession{id: "b"}}
+	h.set(a)
+	h.set(b)
+
+	if h.pin("a") != nil || h.get() != a {
+		t.Fatal("pinned session a is not the default")
+	}
+	if h.pin("missing") != errSessionNotFound {
+		t.Error("pinned a session that does not exist")
+	}
+
+	// A draining session with a request in flight gets no new requests
+	// and closes when the request completes.
+	release := make(chan struct{})
+	started := make(chan struct{})
+	a.createMessageFunc = func(ctx context.Context, params *mcp.CreateMessageParams) (*mcp.CreateMessageResult, error) {
+		close(started)
+		<-release
+		return &mcp.CreateMessageResult{}, nil
+	}
+	done := make(chan struct{})
+	go func() {
+		h.createMessage(context.Background(), a, hookParams("hi"))
+		close(done)
+	}()
+	<-started
+	h.drain("a")
+	if h.get() != b {
+		t.Error("draining session a still receives requests")
+	}
+	if a.closed.Load() {
+		t.Error("session a closed with a request in flight")
+	}
+	close(release)
+	<-done
+	if !a.closed.Load() {
+		t.Error("drained session a was not closed once idle")
+	}
+
+	h.remove("a")
+	if h.routing().Pinned != "" {
+		t.Error("pin survived the removal of its session")
+	}
+	if h.kick("b") != nil || !b.closed.Load() {
+		t.Error("kick did not close session b")
+	}
+
+	// Closing the stdio session would stop samplellama.
+	stdio := &closableSession{mockSession: mockSession{id: "stdio"}}
+	h.setStdio(stdio)
+	if h.drain("stdio") != errStdioSession || h.kick("stdio") != errStdioSession {
+		t.Error("drain and kick accepted the stdio session")
+	}
+	if stdio.closed.Load() || h.get() != stdio {
+		t.Error("the stdio session was closed or stopped receiving requests")
+	}
+}
+
+func TestAdminAPI(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	h := newSessionHolder()
+	h.set(&mockSession{id: "s1", createMessageFunc: func(ctx context.Context, params *mcp.CreateMessageParams) (*mcp.CreateMessageResult, error) {
+		if extractTextContent(params.Messages[0].Content) == "fail" {
+			return nil, errors.New("host unavailable")
+		}
+		return &mcp.CreateMessageResult{Content: &mcp.TextContent{Text: "ok"}}, nil
+	}})
+	h.set(&mockSession{id: "s2"})
+	h.setIdentity("s2", "key:desktop")
+	b := testBridge(h, logger)
+	b.limits = newRateLimiter(limitConfig{Model: limitSpec{RequestsPerMinute: 10}}, &budgetStore{usage: map[string]*budgetUsage{}}, logger)
+	h.pin("s1")
+	for _, content := range []string{"hi", "fail"} {
+		handleChat(b)(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/api/chat", strings.NewReader(`{"model":"llama3","messages":[{"role":"user","content":"`+content+`"}],"stream":false}`)))
+	}
+
+	keys, err := newAPIKeyStore([]apiKey{{Key: "admin-secret", Label: "ops"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := clientAuth(keys, false, logger, newAdminHandler(h, b.models, b.limits, map[string]string{"port": "11434"}, logger))
+	do := func(method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer admin-secret")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/sessions", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("unauthenticated request: got %d, want 401", w.Code)
+	}
+
+	var list struct {
+		Sessions []sessionInfo `json:"sessions"`
+	}
+	if err := json.NewDecoder(do(http.MethodGet, "/admin/sessions").Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Sessions) != 2 {
+		t.Fatalf("got %d sessions, want 2", len(list.Sessions))
+	}
+	s1 := list.Sessions[0]
+	if s1.ID != "s1" || s1.RequestsServed != 2 || s1.LastError != "host unavailable" || !s1.Pinned || s1.ConnectedAt.IsZero() {
+		t.Errorf("unexpected s1 %+v", s1)
+	}
+	if list.Sessions[1].MCPIdentity != "key:desktop" {
+		t.Errorf("unexpected s2 %+v", list.Sessions[1])
+	}
+
+	if w := do(http.MethodPost, "/admin/sessions/s1/drain"); w.Code != http.StatusAccepted {
+		t.Errorf("drain: got %d", w.Code)
+	}
+	if w := do(http.MethodPost, "/admin/sessions/nope/kick"); w.Code != http.StatusNotFound {
+		t.Errorf("kick of an unknown session: got %d, want 404", w.Code)
+	}
+	var routing routingState
+	json.NewDecoder(do(http.MethodGet, "/admin/routing").Body).Decode(&routing)
+	if routing.Default != "s2" || routing.Pinned != "s1" || len(routing.Draining) != 1 || routing.Identities["key:desktop"][0] != "s2" {
+		t.Errorf("unexpected routing %+v", routing)
+	}
+	if w := do(http.MethodDelete, "/admin/pin"); w.Code != http.StatusNoContent || h.routing().Pinned != "" {
+		t.Errorf("unpin: got %d", w.Code)
+	}
+	stdio := &closableSession{mockSession: mockSession{id: "stdio"}}
+	h.setStdio(stdio)
+	for _, verb := range []string{"drain", "kick"} {
+		if w := do(http.MethodPost, "/admin/sessions/stdio/"+verb); w.Code != http.StatusConflict || stdio.closed.Load() {
+			t.Errorf("%s of the stdio session: got %d, want 409", verb, w.Code)
+		}
+	}
+
+	var limits limiterState
+	json.NewDecoder(do(http.MethodGet, "/admin/limits").Body).Decode(&limits)
+	if len(limits.Scopes) != 1 || limits.Scopes[0].Scope != "model:llama3" || *limits.Scopes[0].RequestsRemaining != 8 {
+		t.Errorf("unexpected limits %+v", limits)
+	}
+	var cfg adminConfig
+	json.NewDecoder(do(http.MethodGet, "/admin/config").Body).Decode(&cfg)
+	if cfg.Flags["port"] != "11434" || len(cfg.Models) != 1 {
+		t.Errorf("unexpected config %+v", cfg)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// auditEntry is one line of the audit log. Prompt and Response are only
+// filled in when full text is enabled; the hashes are present whenever the
+// request got that far, so that a disputed exchange can be matched against
+// a client's own copy. Status is the HTTP status returned to the client.
+type auditEntry struct {
+	Time           time.Time       `json:"time"`
+	Endpoint       string          `json:"endpoint"`
+	Client         string          `json:"client,omitempty"`
+	ClientIP       string          `json:"client_ip,omitempty"`
+	Model          string          `json:"model"`
+	ModelUsed      string          `json:"model_used,omitempty"`
+	Status         int             `json:"status"`
+	Summary        bool            `json:"summary,omitempty"`
+	SessionID      string          `json:"session_id,omitempty"`
+	MCPIdentity    string          `json:"mcp_identity,omitempty"`
+	Host           string          `json:"host,omitempty"`
+	HostVersion    string          `json:"host_version,omitempty"`
+	PromptSHA256   string          `json:"prompt_sha256,omitempty"`
+	ResponseSHA256 string          `json:"response_sha256,omitempty"`
+	Prompt         json.RawMessage `json:"prompt,omitempty"`
+	Response       string          `json:"response,omitempty"`
+	PromptTokens   int             `json:"prompt_tokens"`
+	EvalTokens     int             `json:"eval_tokens"`
+	LatencyMS      int64           `json:"latency_ms"`
+	StopReason     string          `json:"stop_reason,omitempty"`
+	Error          string          `json:"error,omitempty"`
+}
+
+// auditLog appends an auditEntry per sampling request to a JSONL file.
+// The file is rotated once it would grow beyond maxBytes or has been open
+// for maxAge; rotated files keep the path's name with the rotation time
+// inserted before the extension. A nil auditLog records nothing.
+type auditLog struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int64
+	maxAge   time.Duration
+	text     bool
+	file     *os.File
+	size     int64
+	opened   time.Time
+	logger   *slog.Logger
+	now      func() time.Time
+	// feed receives each entry for the dashboard.
+	feed *activityFeed
+}
+
+// newAuditLog opens the audit log at path. Zero maxBytes or maxAge
+// disables that rotation trigger. With text, entries include the full
+// prompt and response.
+func newAuditLog(path string, maxBytes int64, maxAge time.Duration, text bool, logger *slog.Logger) (*auditLog, error) {
+	a := &auditLog{path: path, maxBytes: maxBytes, maxAge: maxAge, text: text, logger: logger, now: time.Now}
+	if err := a.openLocked(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *auditLog) openLocked() error {
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return fmt.Errorf("opening audit log: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("opening audit log: %w", err)
+	}
+	a.file, a.size, a.opened = f, info.Size(), a.now()
+	return nil
+}
+
+// rotatedName returns the name the current file is renamed to on rotation,
+// e.g. audit-2026-03-01T12-00-00.000.jsonl for audit.jsonl.
+func (a *auditLog) rotatedName(t time.Time) string {
+	ext := filepath.Ext(a.path)
+	return strings.TrimSuffix(a.path, ext) + "-" + t.UTC().Format("2006-01-02T15-04-05.000") + ext
+}
+
+func (a *auditLog) rotateLocked(now time.Time) error {
+	a.file.Close()
+	a.file = nil
+	// If the rename fails, keep appending to the current file rather than
+	// losing entries.
+	renameErr := os.Rename(a.path, a.rotatedName(now))
+	if err := a.openLocked(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return fmt.Errorf("rotating audit log: %w", renameErr)
+	}
+	return nil
+}
+
+// write appends e to the log, rotating first if needed. Each entry is
+// synced to disk before write returns.
+func (a *auditLog) write(e *auditEntry) {
+	line, err := json.Marshal(e)
+	if err != nil {
+		a.logger.Error("Failed to encode audit entry", "error", err)
+		return
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		return
+	}
+	now := a.now()
+	if a.size > 0 && (a.maxBytes > 0 && a.size+int64(len(line)) > a.maxBytes || a.maxAge > 0 && now.Sub(a.opened) >= a.maxAge) {
+		if err := a.rotateLocked(now); err != nil {
+			a.logger.Error("Failed to rotate audit log", "error", err)
+			if a.file == nil {
+				return
+			}
+		}
+	}
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	if err == nil {
+		err = a.file.Sync()
+	}
+	if err != nil {
+		a.logger.Error("Failed to write audit log", "error", err)
+	}
+}
+
+func (a *auditLog) close() error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		return nil
+	}
+	err := a.file.Close()
+	a.file = nil
+	return err
+}
+
+// auditRecord is an audit entry under construction for one request.
+type auditRecord struct {
+	log   *auditLog
+	entry auditEntry
+	start time.Time
+}
+
+// start begins the audit record of a request to endpoint, as soon as the
+// request is decoded, so that requests refused before sampling are
+// recorded too. The session and prompt are added once they are known.
+func (a *auditLog) start(r *http.Request, endpoint, model string) *auditRecord {
+	if a == nil {
+		return nil
+	}
+	return &auditRecord{log: a, start: a.now(), entry: auditEntry{
+		Endpoint: endpoint,
+		Client:   clientLabel(r.Context()),
+		ClientIP: clientIP(r),
+		Model:    model,
+	}}
+}
+
+// setSession records the MCP session serving the request.
+func (rec *auditRecord) setSession(session SamplingSession, identity string) {
+	if rec == nil {
+		return
+	}
+	rec.entry.SessionID, rec.entry.MCPIdentity = session.ID(), identity
+	if info := sessionClientInfo(session); info != nil {
+		rec.entry.Host, rec.entry.HostVersion = info.Name, info.Version
+	}
+}
+
+// setSummary marks the record as that of a chat history summary, sampled
+// before the chat request itself.
+func (rec *auditRecord) setSummary() {
+	if rec != nil {
+		rec.entry.Summary = true
+	}
+}
+
+// setPrompt records the prompt to be sent to the MCP host.
+func (rec *auditRecord) setPrompt(params *mcp.CreateMessageParams) {
+	if rec == nil {
+		return
+	}
+	prompt, _ := json.Marshal(struct {
+		SystemPrompt string                 `json:"systemPrompt,omitempty"`
+		Messages     []*mcp.SamplingMessage `json:"messages"`
+	}{params.SystemPrompt, params.Messages})
+	rec.entry.PromptSHA256 = sha256Hex(prompt)
+	rec.entry.PromptTokens = estimatePromptTokens(params)
+	if rec.log.text {
+		rec.entry.Prompt = prompt
+	}
+}
+
+// finish completes the record with the status returned to the client and
+// the outcome of the call, text being the response as the host saw it,
+// redacted like the prompt, and writes it. Refused requests have no result.
+func (rec *auditRecord) finish(status int, result *mcp.CreateMessageResult, text string, err error) {
+	if rec == nil {
+		return
+	}
+	e := &rec.entry
+	e.Time = rec.start.UTC()
+	e.Status = status
+	e.LatencyMS = rec.log.now().Sub(rec.start).Milliseconds()
+	if err != nil {
+		e.Error = err.Error()
+	}
+	if result != nil {
+		e.ModelUsed = result.Model
+		e.StopReason = result.StopReason
+		e.ResponseSHA256 = sha256Hex([]byte(text))
+		e.EvalTokens = estimateTokens(text)
+		if promptTokens, evalTokens, ok := hostUsage(result); ok {
+			e.PromptTokens, e.EvalTokens = promptTokens, evalTokens
+		}
+		if rec.log.text {
+			e.Response = text
+		}
+	}
+	rec.log.write(e)
+	rec.log.feed.audit(e)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+func readAuditEntries(t *testing.T, path string) []auditEntry {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var entries []auditEntry
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var e auditEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			t.Fatalf("invalid audit line %q: %v", sc.Text(), err)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func TestAuditChat(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	audit, err := newAuditLog(path, 0, 0, false, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer audit.close()
+
+	h := newSessionHolder()
+	calls := 0
+	h.set(&mockSession{id: "s1", createMessageFunc: func(ctx context.Context, params *mcp.CreateMessageParams) (*mcp.CreateMessageResult, error) {
+		calls++
+		if calls == 2 {
+			return nil, errors.New("host went away")
+		}
+		return &mcp.CreateMessageResult{Model: "claude-x", StopReason: "endTurn", Content: &mcp.TextContent{Text: "hello there"}}, nil
+	}})
+	b := testBridge(h, logger)
+	b.audit = audit
+	handler := handleChat(b)
+	for range 2 {
+		req := httptest.NewRequest(http.MethodPost, "/api/chat", strings.NewReader(`{"model":"llama3","messages":[{"role":"user","content":"secret question"}],"stream":false}`))
+		req = req.WithContext(withClient(req.Context(), &clientIdentity{Label: "ci"}))
+		handler(httptest.NewRecorder(), req)
+	}
+
+	entries := readAuditEntries(t, path)
+	if len(entries) != 2 {
+		t.Fatalf("got %d entries, want 2", len(entries))
+	}
+	e := entries[0]
+	if e.Endpoint != "/api/chat" || e.Client != "ci" || e.Model != "llama3" || e.ModelUsed != "claude-x" || e.Status != http.StatusOK || e.SessionID != "s1" || e.StopReason != "endTurn" {
+		t.Errorf("unexpected entry %+v", e)
+	}
+	if e.ResponseSHA256 != sha256Hex([]byte("hello there")) || len(e.PromptSHA256) != 64 || e.EvalTokens != 2 || e.PromptTokens == 0 {
+		t.Errorf("unexpected hashes or token counts %+v", e)
+	}
+	if e.Prompt != nil || e.Response != "" {
+		t.Error("full text recorded without -audit-log-text")
+	}
+	if entries[1].Error != "host went away" || entries[1].Status != http.StatusBadGateway || entries[1].ResponseSHA256 != "" || entries[1].PromptSHA256 != e.PromptSHA256 {
+		t.Errorf("unexpected error entry %+v", entries[1])
+	}
+	data, _ := os.ReadFile(path)
+	if strings.Contains(string(data), "secret question") {
+		t.Error("audit log contains the prompt text")
+	}
+}
+
+// TestAuditRejections checks that requests refused before sampling are
+// audited with the status they got.
+func TestAuditRejections(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	audit, err := newAuditLog(path, 0, 0, false, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer audit.close()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req hookRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if strings.Contains(extractTextContent(req.Params.Messages[len(req.Params.Messages)-1].Content), "weapons") {
+			json.NewEncoder(w).Encode(hookResponse{Action: "reject", Message: "topic not allowed"})
+		}
+	}))
+	defer srv.Close()
+	hooks, err := newHooks(hooksConfig{PreSample: []hookConfig{{Name: "topics", URL: srv.URL}}}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := newSessionHolder()
+	b := testBridge(h, logger)
+	b.audit = audit
+	b.hooks = hooks
+	b.truncation = truncateReject
+	b.limits = newRateLimiter(limitConfig{Key: limitSpec{RequestsPerMinute: 1}}, &budgetStore{}, logger)
+	send := func(path, body string, client *clientIdentity) int {
+		handler := handleChat(b)
+		if path == "/api/generate" {
+			handler = handleGenerate(b)
+		}
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req = req.WithContext(withClient(req.Context(), client))
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w.Code
+	}
+	ci := &clientIdentity{Label: "ci"}
+	chat := func(content string, options string) string {
+		return `{"model":"llama3","stream":false,"options":` + options + `,"messages":[{"role":"user","content":"` + content + `"}]}`
+	}
+
+	// Without a session.
+	send("/api/chat", chat("hello", "{}"), ci)
+	h.set(&mockSession{id: "s1", createMessageFunc: func(ctx context.Context, params *mcp.CreateMessageParams) (*mcp.CreateMessageResult, error) {
+		return &mcp.CreateMessageResult{Model: "claude-x", StopReason: "endTurn", Content: &mcp.TextContent{Text: "hi"}}, nil
+	}})
+	send("/api/generate", `{"model":`, ci)
+	send("/api/chat", chat("hello", "{}"), &clientIdentity{Label: "narrow", Models: []string{"other"}})
+	send("/api/chat", chat(strings.Repeat("word ", 100), `{"num_ctx":16}`), ci)
+	send("/api/chat", chat("weapons", "{}"), ci)
+	send("/api/chat", chat("hello", "{}"), ci)
+	send("/api/generate", `{"model":"llama3","prompt":"hello again","stream":false}`, ci)
+
+	want := []struct {
+		endpoint string
+		status   int
+		client   string
+		session  string
+		prompt   bool
+	}{
+		{"/api/chat", http.StatusServiceUnavailable, "ci", "", false},
+		{"/api/generate", http.StatusBadRequest, "ci", "", false},
+		{"/api/chat", http.StatusForbidden, "narrow", "", false},
+		{"/api/chat", http.StatusBadRequest, "ci", "s1", false},
+		{"/api/chat", http.StatusForbidden, "ci", "s1", true},
+		{"/api/chat", http.StatusOK, "ci", "s1", true},
+		{"/api/generate", http.StatusTooManyRequests, "ci", "s1", true},
+	}
+	entries := readAuditEntries(t, path)
+	if len(entries) != len(want) {
+		t.Fatalf("got %d entries, want %d: %+v", len(entries), len(want), entries)
+	}
+	for i, w := range want {
+		e := entries[i]
+		if e.Endpoint != w.endpoint || e.Status != w.status || e.Client != w.client || e.SessionID != w.session || (e.PromptSHA256 != "") != w.prompt {
+			t.Errorf("entry %d: %+v, want %+v", i, e, w)
+		}
+		if w.status != http.StatusOK && e.Error == "" {
+			t.Errorf("entry %d: refusal without an error", i)
+		}
+	}
+}
+
+func TestAuditText(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	audit, err := newAuditLog(path, 0, 0, true, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer audit.close()
+	r := httptest.NewRequest(http.MethodPost, "/api/generate", nil)
+	params := &mcp.CreateMessageParams{Messages: []*mcp.SamplingMessage{{Role: "user", Content: &mcp.TextContent{Text: "why?"}}}}
+	rec := audit.start(r, "/api/generate", "llama3")
+	rec.setSession(&mockSession{id: "s1"}, "")
+	rec.setPrompt(params)
+	rec.finish(http.StatusOK, &mcp.CreateMessageResult{}, "because", nil)
+
+	entries := readAuditEntries(t, path)
+	if len(entries) != 1 || entries[0].Response != "because" || !strings.Contains(string(entries[0].Prompt), "why?") {
+		t.Errorf("unexpected entries %+v", entries)
+	}
+}
+
+func TestAuditRotation(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.jsonl")
+	audit, err := newAuditLog(path, 500, time.Hour, false, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer audit.close()
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	audit.now = func() time.Time { return now }
+	audit.opened = now
+
+	write := func() {
+		now = now.Add(time.Second)
+		audit.write(&auditEntry{Endpoint: "/api/chat", PromptSHA256: strings.Repeat("0", 64)})
+	}
+	write()
+	write() // Still below 500 bytes.
+	write() // Rotates by size.
+	if _, err := os.Stat(filepath.Join(dir, "audit-2026-03-01T12-00-03.000.jsonl")); err != nil {
+		t.Errorf("expected a file rotated by size: %v", err)
+	}
+	now = now.Add(time.Hour)
+	write() // Rotates by age.
+	matches, _ := filepath.Glob(filepath.Join(dir, "audit-*.jsonl"))
+	if len(matches) != 2 {
+		t.Errorf("got rotated files %v, want 2", matches)
+	}
+	if n := len(readAuditEntries(t, path)); n != 1 {
+		t.Errorf("current file has %d entries, want 1", n)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+)
+
+// apiKey is an entry of the -api-keys file. A client is identified either
+// by its bearer token (Key) or by the subject name of its verified TLS
+// client certificate (Subject).
+type apiKey struct {
+	Key     string   `json:"key,omitempty"`
+	Subject string   `json:"subject,omitempty"`
+	Label   string   `json:"label"`
+	Models  []string `json:"models,omitempty"`
+	// MCPIdentity routes the client's requests only to MCP sessions
+	// authenticated as this identity, such as "key:desktop",
+	// "jwt:https://issuer.example/host" or "cert:host.example".
+	MCPIdentity string `json:"mcp_identity,omitempty"`
+	// RequestsPerMinute, TokensPerMinute, DailyTokens and MonthlyTokens
+	// override the matching "key" limits of the -limits file for this key.
+	RequestsPerMinute int   `json:"requests_per_minute,omitempty"`
+	TokensPerMinute   int   `json:"tokens_per_minute,omitempty"`
+	DailyTokens       int64 `json:"daily_tokens,omitempty"`
+	MonthlyTokens     int64 `json:"monthly_tokens,omitempty"`
+}
+
+// clientIdentity is an authenticated client of the Ollama API.
+type clientIdentity struct {
+	// Label names the client in logs.
+	Label string
+	// Models restricts the models the client may use. Empty allows all.
+	Models []string
+	// MCPIdentity restricts the client to MCP sessions of this identity.
+	// Empty allows any session.
+	MCPIdentity string
+	// id names the client's rate limit and budget scopes. Unlike Label it
+	// is unique to one key file entry and stays the same across restarts.
+	id string
+	// limits overrides the default per-key limits field by field, if set.
+	limits *limitSpec
+	// playground marks an admin key using the dashboard playground, which
+	// is limited in its own scope.
+	playground bool
+}
+
+// allowsModel reports whether the client may use the named model.
+func (c *clientIdentity) allowsModel(name string) bool {
+	return len(c.Models) == 0 || slices.Contains(c.Models, name)
+}
+
+type clientContextKey struct{}
+
+func withClient(ctx context.Context, c *clientIdentity) context.Context {
+	return context.WithValue(ctx, clientContextKey{}, c)
+}
+
+// clientFromContext returns the authenticated client, or nil when
+// authentication is disabled.
+func clientFromContext(ctx context.Context) *clientIdentity {
+	c, _ := ctx.Value(clientContextKey{}).(*clientIdentity)
+	return c
+}
+
+// clientLabel returns the label of the authenticated client, or "" when
+// authentication is disabled.
+func clientLabel(ctx context.Context) string {
+	if c := clientFromContext(ctx); c != nil {
+		return c.Label
+	}
+	return ""
+}
+
+// apiKeyStore holds the accepted API keys and certificate subjects. Keys
+// are kept as SHA-256 hashes and compared in constant time.
+type apiKeyStore struct {
+	keys     []storedKey
+	subjects map[string]*clientIdentity
+}
+
+type storedKey struct {
+	hash     [sha256.Size]byte
+	identity *clientIdentity
+}
+
+// loadAPIKeys reads a JSON array of apiKey entries.
+func loadAPIKeys(path string) (*apiKeyStore, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading API keys: %w", err)
+	}
+	var keys []apiKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("parsing API keys %s: %w", path, err)
+	}
+	return newAPIKeyStore(keys)
+}
+
+func newAPIKeyStore(keys []apiKey) (*apiKeyStore, error) {
+	s := &apiKeyStore{subjects: make(map[string]*clientIdentity)}
+	for i, k := range keys {
+		if k.Key == "" && k.Subject == "" {
+			return nil, fmt.Errorf("API key %d has neither a key nor a subject", i)
+		}
+		if k.MCPIdentity != "" && !validMCPIdentity(k.MCPIdentity) {
+			return nil, fmt.Errorf("API key %d: mcp_identity %q must start with key:, jwt: or cert:", i, k.MCPIdentity)
+		}
+		label := k.Label
+		switch {
+		case label != "":
+		case k.Subject != "":
+			label = k.Subject
+		default:
+			label = fmt.Sprintf("key-%d", i)
+		}
+		id := &clientIdentity{Label: label, Models: k.Models, MCPIdentity: k.MCPIdentity}
+		if k.Key != "" {
+			id.id = clientID("key:" + k.Key)
+		} else {
+			id.id = clientID("subject:" + k.Subject)
+		}
+		if k.RequestsPerMinute > 0 || k.TokensPerMinute > 0 || k.DailyTokens > 0 || k.MonthlyTokens > 0 {
+			id.limits = &limitSpec{
+				RequestsPerMinute: k.RequestsPerMinute,
+				TokensPerMinute:   k.TokensPerMinute,
+				DailyTokens:       k.DailyTokens,
+				MonthlyTokens:     k.MonthlyTokens,
+			}
+		}
+		if k.Key != "" {
+			s.keys = append(s.keys, storedKey{hash: sha256.Sum256([]byte(k.Key)), identity: id})
+		}
+		if k.Subject != "" {
+			s.subjects[k.Subject] = id
+		}
+	}
+	return s, nil
+}
+
+// clientID derives a stable scope ID from a key or certificate subject.
+// It is a truncated hash so that quota files and the dashboard never hold
+// the key itself.
+func clientID(secret string) string {
+	h := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(h[:6])
+}
+
+// authenticate returns the client owning token, or nil. Every stored key is
+// compared so that the time taken does not depend on which key matched.
+func (s *apiKeyStore) authenticate(token string) *clientIdentity {
+	h := sha256.Sum256([]byte(token))
+	var found *clientIdentity
+	for _, k := range s.keys {
+		if subtle.ConstantTimeCompare(h[:], k.hash[:]) == 1 {
+			found = k.identity
+		}
+	}
+	return found
+}
+
+// authenticateSubject returns the client configured for a certificate
+// subject, or nil.
+func (s *apiKeyStore) authenticateSubject(subject string) *clientIdentity {
+	return s.subjects[subject]
+}
+
+// bearerToken extracts the token from an "Authorization: Bearer" header.
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+// clientAuth identifies the client of each request by its verified TLS
+// client certificate or, failing that, its bearer token. Rates and budgets
+// are enforced afterwards by the rateLimiter. With keys set, requests identified by neither
+// are rejected; without keys, certificate subjects are accepted as is and
+// other requests pass anonymously. When allowHealth is set, the health
+// check at "/" stays reachable without credentials.
+func clientAuth(keys *apiKeyStore, allowHealth bool, logger *slog.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if allowHealth && r.URL.Path == "/" && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		var client *clientIdentity
+		if subject := certSubject(r); subject != "" {
+			if keys != nil {
+				client = keys.authenticateSubject(subject)
+			} else {
+				client = &clientIdentity{Label: subject, id: clientID("subject:" + subject)}
+			}
+		}
+		if client == nil && keys != nil {
+			if token, ok := bearerToken(r); ok {
+				client = keys.authenticate(token)
+			}
+			if client == nil {
+				logger.Warn("Unauthorized request", "method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr)
+				w.Header().Set("WWW-Authenticate", `Bearer realm="samplellama"`)
+				writeError(w, logger, http.StatusUnauthorized, "unauthorized")
+				return
+			}
+		}
+		if client == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(withClient(r.Context(), client)))
+	})
+}
+
+// errModelNotAllowed is audited for requests authorizeModel refused.
+var errModelNotAllowed = errors.New("model not allowed for this API key")
+
+// authorizeModel writes a 403 response and returns false if the
+// authenticated client may not use the named model.
+func authorizeModel(w http.ResponseWriter, r *http.Request, logger *slog.Logger, name string) bool {
+	c := clientFromContext(r.Context())
+	if c == nil || c.allowsModel(name) {
+		return true
+	}
+	writeError(w, logger, http.StatusForbidden, fmt.Sprintf("model %q is not allowed for this API key", name))
+	return false
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadAPIKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	data := `[{"key": "secret-1", "label": "ci", "models": ["llama3"]}, {"key": "secret-2"}]`
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := loadAPIKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := keys.authenticate("secret-1")
+	if c == nil || c.Label != "ci" {
+		t.Fatalf("expected client 'ci', got %+v", c)
+	}
+	if !c.allowsModel("llama3") || c.allowsModel("codellama") {
+		t.Error("expected access to llama3 only")
+	}
+	if c := keys.authenticate("secret-2"); c == nil || c.Label != "key-1" || !c.allowsModel("anything") {
+		t.Errorf("expected unrestricted default-labelled client, got %+v", c)
+	}
+	if keys.authenticate("secret-3") != nil || keys.authenticate("") != nil {
+		t.Error("expected unknown keys to be rejected")
+	}
+
+	subjects, err := newAPIKeyStore([]apiKey{{Subject: "alice", Models: []string{"llama3"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := subjects.authenticateSubject("alice"); c == nil || c.Label != "alice" || c.allowsModel("codellama") {
+		t.Errorf("expected restricted client labelled by subject, got %+v", c)
+	}
+	if subjects.authenticateSubject("bob") != nil {
+		t.Error("expected unknown subjects to be rejected")
+	}
+
+	if _, err := newAPIKeyStore([]apiKey{{Label: "empty"}}); err == nil {
+		t.Error("expected an error for an entry without key or subject")
+	}
+}
+
+func TestClientAuth(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	keys, err := newAPIKeyStore([]apiKey{
+		{Key: "good", Label: "ci", Models: []string{"llama3"}},
+		{Key: "slow", Label: "slow", RequestsPerMinute: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	models, _ := newModelRegistry(modelsFromNames([]string{"llama3", "codellama"}), "")
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", handleHealth)
+	mux.HandleFunc("GET /api/tags", handleTags(models))
+	mux.HandleFunc("POST /api/show", handleShow(&bridge{models: models, holder: newSessionHolder(), logger: logger}))
+
+	do := func(handler http.Handler, method, path, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	public := clientAuth(keys, true, logger, mux)
+	private := clientAuth(keys, false, logger, mux)
+
+	if rr := do(public, "GET", "/", "", ""); rr.Code != http.StatusOK {
+		t.Errorf("expected public health check, got %d", rr.Code)
+	}
+	if rr := do(private, "GET", "/", "", ""); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected health check to require a key, got %d", rr.Code)
+	}
+	rr := do(public, "GET", "/api/tags", "", "")
+	if rr.Code != http.StatusUnauthorized || rr.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("expected 401 with WWW-Authenticate, got %d", rr.Code)
+	}
+	if rr := do(public, "GET", "/api/tags", "wrong", ""); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a wrong key, got %d", rr.Code)
+	}
+
+	rr = do(public, "GET", "/api/tags", "good", "")
+	var tags TagsResponse
+	json.NewDecoder(rr.Body).Decode(&tags)
+	if len(tags.Models) != 1 || tags.Models[0].Name != "llama3" {
+		t.Errorf("expected tags filtered to llama3, got %+v", tags.Models)
+	}
+	if rr := do(public, "POST", "/api/show", "good", `{"model": "codellama"}`); rr.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for a disallowed model, got %d", rr.Code)
+	}
+	if rr := do(public, "POST", "/api/show", "good", `{"model": "llama3"}`); rr.Code != http.StatusOK {
+		t.Errorf("expected 200 for an allowed model, got %d", rr.Code)
+	}
+
+	// A key's request rate is left to the rate limiter, as one of its
+	// limits.
+	for range 2 {
+		if rr := do(public, "GET", "/api/tags", "slow", ""); rr.Code != http.StatusOK {
+			t.Errorf("expected clientAuth to leave rates to the limiter, got %d", rr.Code)
+		}
+	}
+	if slow := keys.authenticate("slow"); slow.limits == nil || *slow.limits != (limitSpec{RequestsPerMinute: 1}) {
+		t.Errorf("requests_per_minute not carried into the key's limits: %+v", slow.limits)
+	}
+}
+
+func TestClientIDs(t *testing.T) {
+	keys, err := newAPIKeyStore([]apiKey{
+		{Key: "a", Label: "shared"},
+		{Key: "b", Label: "shared"},
+		{Subject: "host.example", Label: "shared"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b, c := keys.authenticate("a"), keys.authenticate("b"), keys.authenticateSubject("host.example")
+	if a.id == b.id || a.id == c.id || b.id == c.id {
+		t.Errorf("keys sharing a label share an ID: %s %s %s", a.id, b.id, c.id)
+	}
+	// The ID depends on the key alone, so it survives relabeling and
+	// restarts.
+	again, _ := newAPIKeyStore([]apiKey{{Key: "a", Label: "renamed"}})
+	if again.authenticate("a").id != a.id {
+		t.Error("the ID changed with the label")
+	}
+}
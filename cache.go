@@ -0,0 +1,387 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// cacheStore holds serialized sampling results by cache key. The
+// responseCache in front of it decides what to keep.
+type cacheStore interface {
+	read(key string) ([]byte, error)
+	write(key string, data []byte) error
+	remove(key string)
+}
+
+// memoryStore keeps results in memory.
+type memoryStore struct {
+	mu   sync.Mutex
+	data map[string][]byte
+}
+
+func (s *memoryStore) read(key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.data[key]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return data, nil
+}
+
+func (s *memoryStore) write(key string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data[key] = data
+	return nil
+}
+
+func (s *memoryStore) remove(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.data, key)
+}
+
+// diskStore keeps each result in a file named after its key, so that the
+// cache survives restarts.
+type diskStore struct {
+	dir string
+}
+
+func (s *diskStore) path(key string) string {
+	return filepath.Join(s.dir, key+".json")
+}
+
+func (s *diskStore) read(key string) ([]byte, error) {
+	return os.ReadFile(s.path(key))
+}
+
+// write replaces the file through a rename, so that readers never see a
+// partial result.
+func (s *diskStore) write(key string, data []byte) error {
+	f, err := os.CreateTemp(s.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), s.path(key)); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+func (s *diskStore) remove(key string) {
+	os.Remove(s.path(key))
+}
+
+// cacheEntry is the bookkeeping for one stored result.
+type cacheEntry struct {
+	key    string
+	size   int64
+	stored time.Time
+}
+
+// responseCache answers repeated sampling requests without a round trip
+// to the MCP host. Entries expire after ttl, and the least recently used
+// are evicted to stay within maxEntries and maxBytes; zero means no limit.
+type responseCache struct {
+	mu         sync.Mutex
+	store      cacheStore
+	ttl        time.Duration
+	maxEntries int
+	maxBytes   int64
+	order      *list.List // of *cacheEntry, most recently used first
+	entries    map[string]*list.Element
+	bytes      int64
+	now        func() time.Time
+	logger     *slog.Logger
+
+	hits, misses, bypasses atomic.Int64
+}
+
+func newResponseCache(store cacheStore, ttl time.Duration, maxEntries int, maxBytes int64, logger *slog.Logger) *responseCache {
+	return &responseCache{
+		store:      store,
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		order:      list.New(),
+		entries:    make(map[string]*list.Element),
+		now:        time.Now,
+		logger:     logger,
+	}
+}
+
+// newMemoryCache creates a cache that lives as long as the process.
+func newMemoryCache(ttl time.Duration, maxEntries int, maxBytes int64, logger *slog.Logger) *responseCache {
+	return newResponseCache(&memoryStore{data: make(map[string][]byte)}, ttl, maxEntries, maxBytes, logger)
+}
+
+// newDiskCache creates a cache in dir, picking up the results a previous
+// run left there. Their modification times stand in for both the time
+// they were stored and when they were last used.
+func newDiskCache(dir string, ttl time.Duration, maxEntries int, maxBytes int64, logger *slog.Logger) (*responseCache, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("creating cache directory: %w", err)
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading cache directory: %w", err)
+	}
+	store := &diskStore{dir: dir}
+	c := newResponseCache(store, ttl, maxEntries, maxBytes, logger)
+	var found []*cacheEntry
+	for _, f := range files {
+		key, ok := strings.CutSuffix(f.Name(), ".json")
+		if !ok || !f.Type().IsRegular() || !validCacheKey(key) {
+			continue
+		}
+		info, err := f.Info()
+		if err != nil {
+			continue
+		}
+		found = append(found, &cacheEntry{key: key, size: info.Size(), stored: info.ModTime()})
+	}
+	slices.SortFunc(found, func(a, b *cacheEntry) int { return a.stored.Compare(b.stored) })
+	c.mu.Lock()
+	for _, e := range found {
+		c.entries[e.key] = c.order.PushFront(e)
+		c.bytes += e.size
+	}
+	evicted := c.evictLocked()
+	c.mu.Unlock()
+	for _, key := range evicted {
+		store.remove(key)
+	}
+	return c, nil
+}
+
+func validCacheKey(key string) bool {
+	_, err := hex.DecodeString(key)
+	return err == nil && len(key) == 2*sha256.Size
+}
+
+// expiredLocked reports whether an entry has outlived the TTL.
+func (c *responseCache) expiredLocked(e *cacheEntry) bool {
+	return c.ttl > 0 && c.now().Sub(e.stored) > c.ttl
+}
+
+// evictLocked drops expired entries and then the least recently used ones
+// until the limits are met. It returns the keys to remove from the store.
+func (c *responseCache) evictLocked() []string {
+	var keys []string
+	for el := c.order.Back(); el != nil; {
+		prev := el.Prev()
+		e := el.Value.(*cacheEntry)
+		over := c.maxEntries > 0 && c.order.Len() > c.maxEntries || c.maxBytes > 0 && c.bytes > c.maxBytes
+		if over || c.expiredLocked(e) {
+			c.dropLocked(el)
+			keys = append(keys, e.key)
+		}
+		el = prev
+	}
+	return keys
+}
+
+// get returns the result stored under key and when it was stored.
+func (c *responseCache) get(key string) (*mcp.CreateMessageResult, time.Time, bool) {
+	c.mu.Lock()
+	el, ok := c.entries[key]
+	if !ok {
+		c.mu.Unlock()
+		return nil, time.Time{}, false
+	}
+	e := el.Value.(*cacheEntry)
+	if c.expiredLocked(e) {
+		c.dropLocked(el)
+		c.mu.Unlock()
+		c.store.remove(key)
+		return nil, time.Time{}, false
+	}
+	c.order.MoveToFront(el)
+	c.mu.Unlock()
+
+	data, err := c.store.read(key)
+	var result mcp.CreateMessageResult
+	if err == nil {
+		err = json.Unmarshal(data, &result)
+	}
+	if err != nil {
+		c.logger.Warn("Dropping unreadable cache entry", "key", key, "error", err)
+		c.mu.Lock()
+		if el, ok := c.entries[key]; ok {
+			c.dropLocked(el)
+		}
+		c.mu.Unlock()
+		c.store.remove(key)
+		return nil, time.Time{}, false
+	}
+	return &result, e.stored, true
+}
+
+func (c *responseCache) dropLocked(el *list.Element) {
+	e := el.Value.(*cacheEntry)
+	c.order.Remove(el)
+	delete(c.entries, e.key)
+	c.bytes -= e.size
+}
+
+// put stores a result under key.
+func (c *responseCache) put(key string, result *mcp.CreateMessageResult) {
+	data, err := json.Marshal(result)
+	if err != nil {
+		c.logger.Error("Failed to encode result for the cache", "error", err)
+		return
+	}
+	if c.maxBytes > 0 && int64(len(data)) > c.maxBytes {
+		return
+	}
+	if err := c.store.write(key, data); err != nil {
+		c.logger.Error("Failed to write cache entry", "error", err)
+		return
+	}
+	c.mu.Lock()
+	if el, ok := c.entries[key]; ok {
+		c.dropLocked(el)
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, size: int64(len(data)), stored: c.now()})
+	c.bytes += int64(len(data))
+	evicted := c.evictLocked()
+	c.mu.Unlock()
+	for _, k := range evicted {
+		c.store.remove(k)
+	}
+}
+
+// size returns the number of entries and their total size in bytes.
+func (c *responseCache) size() (entries int, bytes int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len(), c.bytes
+}
+
+// cacheKey hashes what determines a sampling result: the parameters as
+// sent to the host, the resolved model, the MCP identity of the hosts
+// that may serve the request, and the options that the parameters do not
+// carry faithfully. Temperature 0 is omitted from the parameters, and the
+// seed has no MCP equivalent. The request's _meta is left out, since it
+// carries per-request trace context.
+func cacheKey(params *mcp.CreateMessageParams, model, identity string, opts *Options) string {
+	p := *params
+	p.Meta = nil
+	k := struct {
+		Model       string                   `json:"model"`
+		Identity    string                   `json:"identity,omitempty"`
+		Temperature *float64                 `json:"temperature,omitempty"`
+		Seed        *int                     `json:"seed,omitempty"`
+		Params      *mcp.CreateMessageParams `json:"params"`
+	}{Model: model, Identity: identity, Params: &p}
+	if opts != nil {
+		k.Temperature, k.Seed = opts.Temperature, opts.Seed
+	}
+	data, _ := json.Marshal(k)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// cachePolicy decides whether a request may be answered from the cache
+// and whether its result may be stored. By default only deterministic
+// requests, with temperature 0 or a seed, are cached. The cache option
+// overrides that either way, and Cache-Control: no-cache or no-store in
+// the request skip the lookup or the cache altogether.
+func cachePolicy(r *http.Request, opts *Options) (lookup, store bool) {
+	switch {
+	case opts != nil && opts.Cache != nil:
+		store = *opts.Cache
+	case opts != nil:
+		store = opts.Seed != nil || opts.Temperature != nil && *opts.Temperature == 0
+	}
+	lookup = store
+	for _, v := range r.Header.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			switch strings.ToLower(strings.TrimSpace(d)) {
+			case "no-cache":
+				lookup = false
+			case "no-store":
+				lookup, store = false, false
+			}
+		}
+	}
+	return lookup, store
+}
+
+// cacheLookup is the outcome of looking a request up in the cache.
+type cacheLookup struct {
+	c      *responseCache
+	key    string
+	store  bool
+	result *mcp.CreateMessageResult
+}
+
+// lookup checks the cache for a request's result, marking the response
+// with X-Cache: HIT, MISS or BYPASS, and Age on a hit. A nil cache
+// returns a nil lookup, which stores nothing.
+func (c *responseCache) lookup(w http.ResponseWriter, r *http.Request, opts *Options, params *mcp.CreateMessageParams, model, identity string) *cacheLookup {
+	if c == nil {
+		return nil
+	}
+	lookup, store := cachePolicy(r, opts)
+	if !lookup && !store {
+		c.bypasses.Add(1)
+		w.Header().Set("X-Cache", "BYPASS")
+		return nil
+	}
+	l := &cacheLookup{c: c, key: cacheKey(params, model, identity, opts), store: store}
+	if lookup {
+		if result, stored, ok := c.get(l.key); ok {
+			c.hits.Add(1)
+			w.Header().Set("X-Cache", "HIT")
+			w.Header().Set("Age", strconv.Itoa(int(c.now().Sub(stored).Seconds())))
+			l.result = result
+			return l
+		}
+	}
+	c.misses.Add(1)
+	w.Header().Set("X-Cache", "MISS")
+	return l
+}
+
+// hit returns the cached result, or nil.
+func (l *cacheLookup) hit() *mcp.CreateMessageResult {
+	if l == nil {
+		return nil
+	}
+	return l.result
+}
+
+// save stores the result of a sampling call made after a miss.
+func (l *cacheLookup) save(result *mcp.CreateMessageResult) {
+	if l == nil || !l.store || l.result != nil {
+		return
+	}
+	l.c.put(l.key, result)
+}
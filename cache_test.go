@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+func TestCachePolicy(t *testing.T) {
+	zero, warm := 0.0, 0.7
+	seed := 42
+	on, off := true, false
+	for _, tc := range []struct {
+		name          string
+		opts          *Options
+		cacheControl  string
+		lookup, store bool
+	}{
+		{"no options", nil, "", false, false},
+		{"default temperature", &Options{}, "", false, false},
+		{"temperature 0", &Options{Temperature: &zero}, "", true, true},
+		{"seed", &Options{Temperature: &warm, Seed: &seed}, "", true, true},
+		{"warm", &Options{Temperature: &warm}, "", false, false},
+		{"opt in", &Options{Temperature: &warm, Cache: &on}, "", true, true},
+		{"opt out", &Options{Temperature: &zero, Cache: &off}, "", false, false},
+		{"no-cache", &Options{Temperature: &zero}, "no-cache", false, true},
+		{"no-store", &Options{Temperature: &zero}, "max-age=0, No-Store", false, false},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/api/chat", nil)
+		if tc.cacheControl != "" {
+			r.Header.Set("Cache-Control", tc.cacheControl)
+		}
+		lookup, store := cachePolicy(r, tc.opts)
+		if lookup != tc.lookup || store != tc.store {
+			t.Errorf("%s: got lookup %v, store %v", tc.name, lookup, store)
+		}
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	zero := 0.0
+	seed := 1
+	params := func() *mcp.CreateMessageParams {
+		return &mcp.CreateMessageParams{MaxTokens: 100, Messages: []*mcp.SamplingMessage{{Role: "user", Content: &mcp.TextContent{Text: "hi"}}}}
+	}
+	base := cacheKey(params(), "llama3", "", &Options{Temperature: &zero})
+	traced := params()
+	traced.Meta = mcp.Meta{"traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}
+	if cacheKey(traced, "llama3", "", &Options{Temperature: &zero}) != base {
+		t.Error("_meta changed the key")
+	}
+	for name, key := range map[string]string{
+		"model":       cacheKey(params(), "mistral", "", &Options{Temperature: &zero}),
+		"identity":    cacheKey(params(), "llama3", "team-a", &Options{Temperature: &zero}),
+		"temperature": cacheKey(params(), "llama3", "", &Options{Seed: &seed}),
+		"prompt": cacheKey(&mcp.CreateMessageParams{MaxTokens: 100, Messages: []*mcp.SamplingMessage{{Role: "user", Content: &mcp.TextContent{Text: "hello"}}}},
+			"llama3", "", &Options{Temperature: &zero}),
+	} {
+		if key == base {
+			t.Errorf("changing the %s kept the key", name)
+		}
+	}
+}
+
+func TestCacheChat(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	h := newSessionHolder()
+	calls := 0
+	h.set(&mockSession{id: "s1", createMessageFunc: func(ctx context.Context, params *mcp.CreateMessageParams) (*mcp.CreateMessageResult, error) {
+		calls++
+		return &mcp.CreateMessageResult{Model: "host-model", StopReason: "endTurn", Content: &mcp.TextContent{Text: "four"}}, nil
+	}})
+	b := testBridge(h, logger)
+	b.cache = newMemoryCache(time.Hour, 0, 0, logger)
+	handler := handleChat(b)
+
+	for i, tc := range []struct {
+		body, cacheControl, xCache string
+		calls                      int
+	}{
+		{`{"model":"llama3","messages":[{"role":"user","content":"2+2?"}],"stream":false,"options":{"temperature":0}}`, "", "MISS", 1},
+		{`{"model":"llama3","messages":[{"role":"user","content":"2+2?"}],"stream":false,"options":{"temperature":0}}`, "", "HIT", 1},
+		{`{"model":"llama3","messages":[{"role":"user","content":"2+2?"}],"stream":false,"options":{"temperature":0}}`, "no-cache", "MISS", 2},
+		{`{"model":"llama3","messages":[{"role":"user","content":"2+2?"}],"stream":false,"options":{"temperature":0,"cache":false}}`, "", "BYPASS", 3},
+		{`{"model":"llama3","messages":[{"role":"user","content":"2+2?"}],"stream":false}`, "", "BYPASS", 4},
+		{`{"model":"llama3","messages":[{"role":"user","content":"2+3?"}],"stream":false,"options":{"seed":7}}`, "", "MISS", 5},
+		{`{"model":"llama3","messages":[{"role":"user","content":"2+3?"}],"stream":false,"options":{"seed":7}}`, "", "HIT", 5},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/api/chat", strings.NewReader(tc.body))
+		if tc.cacheControl != "" {
+			req.Header.Set("Cache-Control", tc.cacheControl)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"content":"four"`) {
+			t.Fatalf("request %d: got %d: %s", i, w.Code, w.Body)
+		}
+		if got := w.Header().Get("X-Cache"); got != tc.xCache {
+			t.Errorf("request %d: X-Cache = %q, want %q", i, got, tc.xCache)
+		}
+		if tc.xCache == "HIT" && w.Header().Get("Age") != "0" {
+			t.Errorf("request %d: Age = %q", i, w.Header().Get("Age"))
+		}
+		if calls != tc.calls {
+			t.Errorf("request %d: %d CreateMessage calls, want %d", i, calls, tc.calls)
+		}
+	}
+	if b.cache.hits.Load() != 2 || b.cache.misses.Load() != 3 || b.cache.bypasses.Load() != 2 {
+		t.Errorf("hits %d, misses %d, bypasses %d", b.cache.hits.Load(), b.cache.misses.Load(), b.cache.bypasses.Load())
+	}
+}
+
+func cacheResult(text string) *mcp.CreateMessageResult {
+	return &mcp.CreateMessageResult{Model: "m", Role: "assistant", Content: &mcp.TextContent{Text: text}}
+}
+
+func TestResponseCacheEviction(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	c := newMemoryCache(time.Hour, 2, 0, logger)
+	c.now = func() time.Time { return now }
+
+	c.put("a", cacheResult("a"))
+	c.put("b", cacheResult("b"))
+	if _, _, ok := c.get("a"); !ok {
+		t.Fatal("a missing")
+	}
+	c.put("c", cacheResult("c"))
+	if _, _, ok := c.get("b"); ok {
+		t.Error("least recently used entry b was kept")
+	}
+	if result, _, ok := c.get("a"); !ok || extractTextContent(result.Content) != "a" {
+		t.Errorf("a: got %v, %v", result, ok)
+	}
+
+	now = now.Add(2 * time.Hour)
+	if _, _, ok := c.get("c"); ok {
+		t.Error("expired entry c was returned")
+	}
+
+	_, size := c.size()
+	c.maxBytes = size + 1
+	c.put("d", cacheResult("d"))
+	if entries, bytes := c.size(); entries != 1 || bytes > c.maxBytes {
+		t.Errorf("after byte limit: %d entries, %d bytes", entries, bytes)
+	}
+}
+
+func TestDiskCache(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	dir := t.TempDir()
+	key := cacheKey(&mcp.CreateMessageParams{MaxTokens: 1}, "llama3", "", nil)
+	c, err := newDiskCache(dir, time.Hour, 0, 0, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.put(key, cacheResult("persisted"))
+	if err := os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not an entry"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := newDiskCache(dir, time.Hour, 0, 0, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := reopened.size(); entries != 1 {
+		t.Fatalf("reopened cache has %d entries", entries)
+	}
+	result, _, ok := reopened.get(key)
+	if !ok || extractTextContent(result.Content) != "persisted" {
+		t.Fatalf("got %v, %v", result, ok)
+	}
+
+	// Entries older than the TTL are removed when the cache is opened.
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, key+".json"), old, old); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newDiskCache(dir, time.Hour, 0, 0, logger); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, key+".json")); !os.IsNotExist(err) {
+		t.Errorf("expired entry still on disk: %v", err)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// captureHeaders are the request headers kept in a capture. Credentials
+// are left out so that captures can be shared.
+var captureHeaders = []string{"Content-Type", "User-Agent", "Accept"}
+
+// captureSample is one CreateMessage call made while serving a request.
+type captureSample struct {
+	Params json.RawMessage `json:"params"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// captureEntry is one line of a capture file: an Ollama API request, the
+// sampling calls it caused and the response.
+type captureEntry struct {
+	Time     time.Time       `json:"time"`
+	Method   string          `json:"method"`
+	Path     string          `json:"path"`
+	Header   http.Header     `json:"header,omitempty"`
+	Body     json.RawMessage `json:"body,omitempty"`
+	BodyText string          `json:"body_text,omitempty"` // a body that is not JSON
+	Samples  []captureSample `json:"samples,omitempty"`
+	Status   int             `json:"status"`
+	Response string          `json:"response"`
+}
+
+// captureLog records /api/chat and /api/generate traffic to a JSONL file
+// for samplellama replay. A nil captureLog records nothing.
+type captureLog struct {
+	mu     sync.Mutex
+	file   *os.File
+	logger *slog.Logger
+}
+
+func newCaptureLog(path string, logger *slog.Logger) (*captureLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("opening capture file: %w", err)
+	}
+	return &captureLog{file: f, logger: logger}, nil
+}
+
+func (c *captureLog) close() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.file.Close()
+}
+
+func (c *captureLog) write(e *captureEntry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err = c.file.Write(append(line, '\n'))
+	return err
+}
+
+type captureKey struct{}
+
+// captureRecord collects the sampling calls of a request being captured.
+type captureRecord struct {
+	mu      sync.Mutex
+	samples []captureSample
+}
+
+// capturing returns the capture record of the request, or nil.
+func capturing(ctx context.Context) *captureRecord {
+	rec, _ := ctx.Value(captureKey{}).(*captureRecord)
+	return rec
+}
+
+// sample records a CreateMessage call as it went to the MCP host.
+func (rec *captureRecord) sample(params *mcp.CreateMessageParams, result *mcp.CreateMessageResult, err error) {
+	if rec == nil {
+		return
+	}
+	s := captureSample{}
+	s.Params, _ = json.Marshal(params)
+	if result != nil {
+		s.Result, _ = json.Marshal(result)
+	}
+	if err != nil {
+		s.Error = err.Error()
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.samples = append(rec.samples, s)
+}
+
+// captureWriter keeps a copy of the response body.
+type captureWriter struct {
+	statusRecorder
+	body bytes.Buffer
+}
+
+func (w *captureWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.statusRecorder.Write(b)
+}
+
+// wrap captures the sampling requests served by next.
+func (c *captureLog) wrap(next http.Handler) http.Handler {
+	if c == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/api/chat" && r.URL.Path != "/api/generate" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, c.logger, http.StatusBadRequest, fmt.Sprintf("reading request: %v", err))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		rec := &captureRecord{}
+		cw := &captureWriter{statusRecorder: statusRecorder{ResponseWriter: w}}
+		start := time.Now()
+		next.ServeHTTP(cw, r.WithContext(context.WithValue(r.Context(), captureKey{}, rec)))
+
+		e := &captureEntry{
+			Time:     start.UTC(),
+			Method:   r.Method,
+			Path:     r.URL.Path,
+			Header:   http.Header{},
+			Samples:  rec.samples,
+			Status:   cw.status,
+			Response: cw.body.String(),
+		}
+		if json.Valid(body) {
+			e.Body = body
+		} else {
+			e.BodyText = string(body)
+		}
+		for _, h := range captureHeaders {
+			if v := r.Header.Values(h); len(v) > 0 {
+				e.Header[h] = v
+			}
+		}
+		if e.Status == 0 {
+			e.Status = http.StatusOK
+		}
+		if err := c.write(e); err != nil {
+			c.logger.Error("Failed to write capture", "error", err)
+		}
+	})
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// captureTraffic serves requests, each a path and a body, through a
+// capturing bridge and returns the capture file. $CONTEXT in a body
+// stands for the context of the previous response.
+func captureTraffic(t *testing.T, bodies ...string) string {
+	t.Helper()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	c, err := newCaptureLog(path, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+	h := newSessionHolder()
+	h.set(&mockSession{id: "s1", createMessageFunc: func(ctx context.Context, params *mcp.CreateMessageParams) (*mcp.CreateMessageResult, error) {
+		text := extractTextContent(params.Messages[len(params.Messages)-1].Content)
+		return &mcp.CreateMessageResult{Model: "host-model", StopReason: "endTurn", Content: &mcp.TextContent{Text: "echo: " + text}}, nil
+	}})
+	b := testBridge(h, logger)
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/chat", handleChat(b))
+	mux.HandleFunc("POST /api/generate", handleGenerate(b))
+	mux.HandleFunc("GET /api/tags", handleTags(b.models))
+	handler := c.wrap(mux)
+	var last []int
+	for _, body := range bodies {
+		path, body, _ := strings.Cut(body, " ")
+		lastJSON, _ := json.Marshal(last)
+		body = strings.ReplaceAll(body, "$CONTEXT", string(lastJSON))
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		last = responseContext(w.Body.String())
+	}
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/tags", nil))
+	return path
+}
+
+func TestCapture(t *testing.T) {
+	path := captureTraffic(t,
+		`/api/chat {"model":"llama3","messages":[{"role":"user","content":"hi"}],"stream":false}`,
+		`/api/chat {not json`,
+	)
+	entries, err := readCapture(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("got %d entries, want 2 (tags are not captured)", len(entries))
+	}
+	e := entries[0]
+	if e.Method != http.MethodPost || e.Path != "/api/chat" || e.Status != http.StatusOK {
+		t.Errorf("unexpected entry %+v", e)
+	}
+	if e.Header.Get("Content-Type") != "application/json" || e.Header.Get("Authorization") != "" {
+		t.Errorf("headers %v: want Content-Type kept and credentials dropped", e.Header)
+	}
+	if len(e.Samples) != 1 {
+		t.Fatalf("got %d samples, want 1", len(e.Samples))
+	}
+	var params mcp.CreateMessageParams
+	var result mcp.CreateMessageResult
+	if err := json.Unmarshal(e.Samples[0].Params, &params); err != nil || extractTextContent(params.Messages[0].Content) != "hi" {
+		t.Errorf("params %s: %v", e.Samples[0].Params, err)
+	}
+	if err := json.Unmarshal(e.Samples[0].Result, &result); err != nil || result.Model != "host-model" {
+		t.Errorf("result %s: %v", e.Samples[0].Result, err)
+	}
+	if !strings.Contains(e.Response, `"content":"echo: hi"`) {
+		t.Errorf("response %q", e.Response)
+	}
+
+	bad := entries[1]
+	if bad.Body != nil || bad.BodyText != "{not json" || bad.Status != http.StatusBadRequest || len(bad.Samples) != 0 {
+		t.Errorf("unexpected entry for an invalid body %+v", bad)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("capture file mode %v, %v", info.Mode(), err)
+	}
+}
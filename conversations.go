@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// contextMagic marks a generate "context" array produced by samplellama.
+// Ollama clients treat the array as opaque tokens and send it back as is.
+const contextMagic = 0x534c
+
+// conversationStore keeps the prior turns of /api/generate exchanges so
+// that the opaque "context" value returned to clients can be turned back
+// into sampling messages on the next request.
+type conversationStore struct {
+	mu         sync.Mutex
+	entries    map[uint64]*conversation
+	ttl        time.Duration
+	maxEntries int
+	maxBytes   int
+	now        func() time.Time
+}
+
+type conversation struct {
+	messages []*mcp.SamplingMessage
+	expires  time.Time
+}
+
+// newConversationStore creates a store whose entries expire after ttl.
+// At most maxEntries conversations are kept, each trimmed to roughly
+// maxBytes of text by dropping the oldest exchanges.
+func newConversationStore(ttl time.Duration, maxEntries, maxBytes int) *conversationStore {
+	return &conversationStore{
+		entries:    make(map[uint64]*conversation),
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		now:        time.Now,
+	}
+}
+
+// load returns the messages stored for an encoded context. ok is false if
+// the context was not produced by this store or has expired.
+func (s *conversationStore) load(ctx []int) (messages []*mcp.SamplingMessage, ok bool) {
+	id, ok := decodeContext(ctx)
+	if !ok {
+		return nil, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.entries[id]
+	if !ok || s.now().After(c.expires) {
+		delete(s.entries, id)
+		return nil, false
+	}
+	return append([]*mcp.SamplingMessage(nil), c.messages...), true
+}
+
+// save stores the messages of a conversation and returns the context value
+// that refers to them.
+func (s *conversationStore) save(messages []*mcp.SamplingMessage) []int {
+	messages = trimConversation(messages, s.maxBytes)
+	var buf [8]byte
+	rand.Read(buf[:])
+	id := binary.BigEndian.Uint64(buf[:])
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.evictLocked()
+	s.entries[id] = &conversation{
+		messages: messages,
+		expires:  s.now().Add(s.ttl),
+	}
+	return encodeContext(id)
+}
+
+// evictLocked drops expired entries and, if the store is still full, the
+// entries closest to expiry.
+func (s *conversationStore) evictLocked() {
+	now := s.now()
+	for id, c := range s.entries {
+		if now.After(c.expires) {
+			delete(s.entries, id)
+		}
+	}
+	for s.maxEntries > 0 && len(s.entries) >= s.maxEntries {
+		var oldest uint64
+		var oldestExpiry time.Time
+		for id, c := range s.entries {
+			if oldestExpiry.IsZero() || c.expires.Before(oldestExpiry) {
+				oldest, oldestExpiry = id, c.expires
+			}
+		}
+		delete(s.entries, oldest)
+	}
+}
+
+// trimConversation drops the oldest user/assistant exchanges until the
+// text fits in maxBytes. The most recent exchange is always kept.
+func trimConversation(messages []*mcp.SamplingMessage, maxBytes int) []*mcp.SamplingMessage {
+	if maxBytes <= 0 {
+		return messages
+	}
+	size := 0
+	for _, m := range messages {
+		size += len(extractTextContent(m.Content))
+	}
+	for size > maxBytes && len(messages) > 2 {
+		for _, m := range messages[:2] {
+			size -= len(extractTextContent(m.Content))
+		}
+		messages = messages[2:]
+	}
+	return messages
+}
+
+func encodeContext(id uint64) []int {
+	return []int{
+		contextMagic,
+		int(id >> 48 & 0xffff),
+		int(id >> 32 & 0xffff),
+		int(id >> 16 & 0xffff),
+		int(id & 0xffff),
+	}
+}
+
+func decodeContext(ctx []int) (uint64, bool) {
+	if len(ctx) != 5 || ctx[0] != contextMagic {
+		return 0, false
+	}
+	var id uint64
+	for _, v := range ctx[1:] {
+		if v < 0 || v > 0xffff {
+			return 0, false
+		}
+		id = id<<16 | uint64(v)
+	}
+	return id, true
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+func textMessages(texts ...string) []*mcp.SamplingMessage {
+	var msgs []*mcp.SamplingMessage
+	for i, t := range texts {
+		role := mcp.Role("user")
+		if i%2 == 1 {
+			role = mcp.Role("assistant")
+		}
+		msgs = append(msgs, &mcp.SamplingMessage{Role: role, Content: &mcp.TextContent{Text: t}})
+	}
+	return msgs
+}
+
+func TestContextEncoding(t *testing.T) {
+	for _, id := range []uint64{0, 1, 0xdeadbeefcafef00d, ^uint64(0)} {
+		got, ok := decodeContext(encodeContext(id))
+		if !ok || got != id {
+			t.Errorf("round trip of %x: got %x, %v", id, got, ok)
+		}
+	}
+	for _, ctx := range [][]int{nil, {1, 2, 3}, {contextMagic, 1, 2, 3}, {contextMagic, 1, 2, 3, 0x10000}} {
+		if _, ok := decodeContext(ctx); ok {
+			t.Errorf("expected %v to be rejected", ctx)
+		}
+	}
+}
+
+func TestConversationStoreExpiry(t *testing.T) {
+	now := time.Now()
+	s := newConversationStore(time.Minute, 10, 0)
+	s.now = func() time.Time { return now }
+
+	ctx := s.save(textMessages("hi", "hello"))
+	msgs, ok := s.load(ctx)
+	if !ok || len(msgs) != 2 {
+		t.Fatalf("expected 2 stored messages, got %d (%v)", len(msgs), ok)
+	}
+
+	now = now.Add(2 * time.Minute)
+	if _, ok := s.load(ctx); ok {
+		t.Error("expected context to expire")
+	}
+}
+
+func TestConversationStoreLimits(t *testing.T) {
+	s := newConversationStore(time.Hour, 2, 10)
+
+	first := s.save(textMessages("a", "b"))
+	s.save(textMessages("c", "d"))
+	s.save(textMessages("e", "f"))
+	if len(s.entries) != 2 {
+		t.Errorf("expected 2 entries, got %d", len(s.entries))
+	}
+	if _, ok := s.load(first); ok {
+		t.Error("expected the oldest context to be evicted")
+	}
+
+	ctx := s.save(textMessages("aaaa", "bbbb", "cccc", "dddd"))
+	msgs, _ := s.load(ctx)
+	if len(msgs) != 2 || extractTextContent(msgs[0].Content) != "cccc" {
+		t.Errorf("expected oldest exchange to be trimmed, got %d messages", len(msgs))
+	}
+
+	ctx = s.save(textMessages(strings.Repeat("x", 50), "y"))
+	if msgs, _ := s.load(ctx); len(msgs) != 2 {
+		t.Errorf("expected the latest exchange to be kept, got %d messages", len(msgs))
+	}
+}
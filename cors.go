@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+)
+
+// corsAllowedHeaders are the request headers browsers may send, as in
+// Ollama.
+var corsAllowedHeaders = []string{
+	"Authorization",
+	"Content-Type",
+	"User-Agent",
+	"Accept",
+	"X-Requested-With",
+	"OpenAI-Beta",
+	"x-stainless-arch",
+	"x-stainless-async",
+	"x-stainless-custom-poll-interval",
+	"x-stainless-helper-method",
+	"x-stainless-lang",
+	"x-stainless-os",
+	"x-stainless-package-version",
+	"x-stainless-poll-helper",
+	"x-stainless-retry-count",
+	"x-stainless-runtime",
+	"x-stainless-runtime-version",
+	"x-stainless-timeout",
+}
+
+// corsExposedHeaders are the response headers browsers let pages read.
+var corsExposedHeaders = []string{
+	"Age",
+	"Retry-After",
+	"Server-Timing",
+	"X-Cache",
+	"X-RateLimit-Limit-Requests",
+	"X-RateLimit-Remaining-Requests",
+	"X-RateLimit-Limit-Tokens",
+	"X-RateLimit-Remaining-Tokens",
+	"X-RateLimit-Limit-Tokens-Day",
+	"X-RateLimit-Remaining-Tokens-Day",
+	"X-RateLimit-Limit-Tokens-Month",
+	"X-RateLimit-Remaining-Tokens-Month",
+}
+
+const corsAllowedMethods = "GET, POST, PUT, PATCH, DELETE, HEAD, OPTIONS"
+
+// corsMaxAge is how long, in seconds, browsers may cache a preflight result.
+const corsMaxAge = "43200"
+
+// browserExtensionSchemes are always allowed, as in Ollama.
+var browserExtensionSchemes = []string{"chrome-extension://", "safari-extension://", "moz-extension://", "ms-browser-extension://"}
+
+// defaultOrigins returns the origins Ollama allows without configuration:
+// local pages on any port and desktop or editor web views.
+func defaultOrigins() []string {
+	var origins []string
+	for _, host := range []string{"localhost", "127.0.0.1", "0.0.0.0"} {
+		origins = append(origins,
+			"http://"+host,
+			"https://"+host,
+			"http://"+net.JoinHostPort(host, "*"),
+			"https://"+net.JoinHostPort(host, "*"),
+		)
+	}
+	return append(origins, "app://*", "file://*", "tauri://*", "vscode-webview://*", "vscode-file://*")
+}
+
+// corsPolicy decides which browser origins may call the Ollama API. Origin
+// patterns may contain one "*" wildcard, and a lone "*" allows every
+// origin.
+type corsPolicy struct {
+	patterns []string
+	allowAll bool
+}
+
+// newCORSPolicy builds the allowlist from comma-separated extra origins,
+// such as the value of OLLAMA_ORIGINS, and Ollama's defaults.
+func newCORSPolicy(extra string) *corsPolicy {
+	p := &corsPolicy{}
+	for _, o := range append(parseModels(extra), defaultOrigins()...) {
+		o = strings.ToLower(o)
+		if o == "*" {
+			p.allowAll = true
+		}
+		p.patterns = append(p.patterns, o)
+	}
+	return p
+}
+
+// allows reports whether origin may make cross-origin requests.
+func (p *corsPolicy) allows(origin string) bool {
+	if p.allowAll {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	for _, scheme := range browserExtensionSchemes {
+		if strings.HasPrefix(origin, scheme) {
+			return true
+		}
+	}
+	for _, pattern := range p.patterns {
+		prefix, suffix, wildcard := strings.Cut(pattern, "*")
+		if !wildcard && origin == pattern {
+			return true
+		}
+		if wildcard && len(origin) >= len(prefix)+len(suffix) && strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// withCORS answers preflight requests and adds CORS headers for allowed
+// origins. Requests from other origins are rejected with 403, so that a
+// website cannot drive the API through the user's browser. Requests
+// without an Origin header pass unchanged, and so do same-origin requests
+// when the Host names this machine or one of the extra names in hosts. A
+// rebound DNS name is same-origin with itself, so it must go through the
+// allowlist instead.
+func withCORS(p *corsPolicy, hosts []string, logger *slog.Logger, next http.Handler) http.Handler {
+	allowHeaders := strings.Join(corsAllowedHeaders, ", ")
+	exposeHeaders := strings.Join(corsExposedHeaders, ", ")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		sameOrigin := origin == "http://"+r.Host || origin == "https://"+r.Host
+		if origin == "" || sameOrigin && knownHost(r.Host, hosts) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !p.allows(origin) {
+			logger.Warn("Rejected cross-origin request", "origin", origin, "method", r.Method, "path", r.URL.Path)
+			writeError(w, logger, http.StatusForbidden, fmt.Sprintf("origin %q is not allowed", origin))
+			return
+		}
+		h := w.Header()
+		h.Add("Vary", "Origin")
+		if p.allowAll {
+			h.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			h.Set("Access-Control-Allow-Origin", origin)
+		}
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			h.Add("Vary", "Access-Control-Request-Method")
+			h.Add("Vary", "Access-Control-Request-Headers")
+			h.Set("Access-Control-Allow-Methods", corsAllowedMethods)
+			h.Set("Access-Control-Allow-Headers", allowHeaders)
+			h.Set("Access-Control-Max-Age", corsMaxAge)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		h.Set("Access-Control-Expose-Headers", exposeHeaders)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allowedHost reports whether a Host name names this machine. Like
+// Ollama, it accepts localhost, the machine's hostname and names under the
+// .localhost, .local and .internal domains, plus any extra names given. An
+// extra "*" accepts every name.
+func allowedHost(host string, extra []string) bool {
+	host = strings.ToLower(host)
+	if host == "" || host == "localhost" || slices.ContainsFunc(extra, func(e string) bool { return e == "*" || strings.EqualFold(e, host) }) {
+		return true
+	}
+	if hostname, err := os.Hostname(); err == nil && host == strings.ToLower(hostname) {
+		return true
+	}
+	for _, tld := range []string{"localhost", "local", "internal"} {
+		if strings.HasSuffix(host, "."+tld) {
+			return true
+		}
+	}
+	return false
+}
+
+// isLocalIP reports whether ip is assigned to one of this machine's
+// interfaces.
+func isLocalIP(ip netip.Addr) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if prefix, err := netip.ParsePrefix(a.String()); err == nil && prefix.Addr().Unmap() == ip.Unmap() {
+			return true
+		}
+	}
+	return false
+}
+
+// knownHost reports whether a Host header, with or without a port, names
+// this machine: by an allowed name, or by a loopback, private or local
+// address.
+func knownHost(hostport string, extra []string) bool {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport
+	}
+	if ip, err := netip.ParseAddr(strings.Trim(host, "[]")); err == nil {
+		return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || isLocalIP(ip) || slices.Contains(extra, "*")
+	}
+	return allowedHost(host, extra)
+}
+
+// hostGuard protects a loopback listener against DNS rebinding: a website
+// whose name resolves to 127.0.0.1 must not reach the API, so requests
+// whose Host header names another machine get 403. As in Ollama, the check
+// only applies when listening on a loopback address; a listener on the
+// network, including the default one on all interfaces, is reached under
+// names of its own. Browsers on a rebound name are still stopped by
+// withCORS. Extra names in hosts are accepted too, and "*" disables the
+// check.
+func hostGuard(addr net.Addr, hosts []string, logger *slog.Logger, next http.Handler) http.Handler {
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil || !ap.Addr().IsLoopback() || slices.Contains(hosts, "*") {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if knownHost(r.Host, hosts) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		logger.Warn("Rejected request for unknown host", "host", r.Host, "method", r.Method, "path", r.URL.Path)
+		writeError(w, logger, http.StatusForbidden, fmt.Sprintf("host %q is not allowed", r.Host))
+	})
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORSPolicy(t *testing.T) {
+	p := newCORSPolicy("https://chat.example.com, http://*.corp.example")
+	for origin, want := range map[string]bool{
+		"http://localhost":                 true,
+		"http://localhost:3000":            true,
+		"https://127.0.0.1:8443":           true,
+		"app://obsidian.md":                true,
+		"vscode-webview://abc":             true,
+		"chrome-extension://abcdef":        true,
+		"https://chat.example.com":         true,
+		"HTTPS://Chat.Example.com":         true,
+		"http://ui.corp.example":           true,
+		"https://chat.example.com.evil.io": false,
+		"http://localhost.evil.io":         false,
+		"https://evil.example":             false,
+		"null":                             false,
+	} {
+		if got := p.allows(origin); got != want {
+			t.Errorf("allows(%q) = %v, want %v", origin, got, want)
+		}
+	}
+	if !newCORSPolicy("*").allows("https://anything.example") {
+		t.Error("expected * to allow every origin")
+	}
+}
+
+func TestWithCORS(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	called := false
+	h := withCORS(newCORSPolicy(""), nil, logger, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+
+	// Preflight from an allowed origin is answered without reaching the API.
+	req := httptest.NewRequest(http.MethodOptions, "/api/chat", nil)
+	req.Header.Set("Origin", "http://localhost:3000")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusNoContent || called {
+		t.Fatalf("preflight: status %d, called %v", w.Code, called)
+	}
+	if w.Header().Get("Access-Control-Allow-Origin") != "http://localhost:3000" || w.Header().Get("Access-Control-Allow-Headers") == "" {
+		t.Errorf("unexpected preflight headers: %v", w.Header())
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/api/chat", nil)
+	req.Header.Set("Origin", "http://localhost:3000")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if !called || w.Header().Get("Access-Control-Allow-Origin") != "http://localhost:3000" {
+		t.Errorf("expected allowed request to pass with CORS headers")
+	}
+
+	called = false
+	req = httptest.NewRequest(http.MethodPost, "/api/chat", nil)
+	req.Header.Set("Origin", "https://evil.example")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden || called {
+		t.Errorf("disallowed origin: status %d, called %v", w.Code, called)
+	}
+
+	// Non-browser clients and same-origin requests to this machine are not
+	// affected. A page on a rebound name is same-origin with itself, yet
+	// still needs an allowed origin.
+	for _, tc := range []struct {
+		url, origin string
+		want        int
+	}{
+		{"http://example.com/api/chat", "", http.StatusOK},
+		{"http://box.local:11434/api/chat", "http://box.local:11434", http.StatusOK},
+		{"http://192.168.1.5:11434/api/chat", "http://192.168.1.5:11434", http.StatusOK},
+		{"http://evil.example:11434/api/chat", "http://evil.example:11434", http.StatusForbidden},
+	} {
+		called = false
+		req = httptest.NewRequest(http.MethodPost, tc.url, nil)
+		if tc.origin != "" {
+			req.Header.Set("Origin", tc.origin)
+		}
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != tc.want || called != (tc.want == http.StatusOK) {
+			t.Errorf("origin %q to %s: status %d, called %v", tc.origin, tc.url, w.Code, called)
+		}
+	}
+}
+
+func TestHostGuard(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	loopback := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 11434}
+	h := hostGuard(loopback, []string{"ollama.lan"}, logger, ok)
+
+	for host, want := range map[string]int{
+		"localhost:11434":     http.StatusOK,
+		"127.0.0.1:11434":     http.StatusOK,
+		"[::1]:11434":         http.StatusOK,
+		"192.168.1.5":         http.StatusOK,
+		"box.local":           http.StatusOK,
+		"ollama.lan:11434":    http.StatusOK,
+		"evil.example:11434":  http.StatusForbidden,
+		"rebind.attacker.com": http.StatusForbidden,
+		"8.8.8.8":             http.StatusForbidden,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/api/tags", nil)
+		req.Host = host
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != want {
+			t.Errorf("Host %q: got %d, want %d", host, w.Code, want)
+		}
+	}
+
+	// A listener on a network address, or on all interfaces as by
+	// default, accepts any name, as LAN clients use names of their own.
+	for _, ip := range []net.IP{net.IPv4(192, 168, 1, 5), net.IPv4zero, net.IPv6unspecified} {
+		lan := hostGuard(&net.TCPAddr{IP: ip, Port: 11434}, nil, logger, ok)
+		req := httptest.NewRequest(http.MethodGet, "/api/tags", nil)
+		req.Host = "gpu-box.lan:11434"
+		w := httptest.NewRecorder()
+		lan.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Errorf("expected no host check listening on %s, got %d", ip, w.Code)
+		}
+	}
+}
+
+// TestDNSRebinding drives the default listener, on all interfaces, the way
+// a page on a rebound name would: its Origin matches its Host. Clients
+// without an Origin, such as LAN clients using a DNS name, pass.
+func TestDNSRebinding(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	for _, addr := range []net.Addr{
+		&net.TCPAddr{IP: net.IPv4zero, Port: 11434},
+		&net.TCPAddr{IP: net.IPv6unspecified, Port: 11434},
+	} {
+		h := hostGuard(addr, nil, logger, withCORS(newCORSPolicy(""), nil, logger, ok))
+		for _, tc := range []struct {
+			host, origin string
+			want         int
+		}{
+			{"evil.example:11434", "http://evil.example:11434", http.StatusForbidden},
+			{"gpu-box.lan:11434", "", http.StatusOK},
+			{"localhost:11434", "http://localhost:11434", http.StatusOK},
+			{"192.168.1.5:11434", "", http.StatusOK},
+		} {
+			req := httptest.NewRequest(http.MethodPost, "/api/chat", nil)
+			req.Host = tc.host
+			if tc.origin != "" {
+				req.Header.Set("Origin", tc.origin)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			if w.Code != tc.want {
+				t.Errorf("%s: Host %q, Origin %q: got %d, want %d", addr, tc.host, tc.origin, w.Code, tc.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+// Sizes of the event history sent to a dashboard when it connects.
+const (
+	feedRequestHistory = 500
+	feedAuditHistory   = 50
+)
+
+// dashboardStatusInterval is how often the dashboard receives the session
+// list and gauges.
+const dashboardStatusInterval = 2 * time.Second
+
+// requestEvent is a completed sampling request, as shown on the dashboard.
+type requestEvent struct {
+	Time         time.Time `json:"time"`
+	Endpoint     string    `json:"endpoint"`
+	Model        string    `json:"model"`
+	Client       string    `json:"client,omitempty"`
+	Status       int       `json:"status"`
+	StopReason   string    `json:"stop_reason,omitempty"`
+	DurationMS   int64     `json:"duration_ms"`
+	SamplingMS   int64     `json:"sampling_ms"`
+	PromptTokens int       `json:"prompt_tokens"`
+	EvalTokens   int       `json:"eval_tokens"`
+	Cached       bool      `json:"cached,omitempty"`
+}
+
+// feedEvent is one server-sent event.
+type feedEvent struct {
+	name string
+	data []byte
+}
+
+// activityFeed keeps recent requests and audit entries and passes new
+// ones to the connected dashboards. A nil activityFeed records nothing.
+type activityFeed struct {
+	mu       sync.Mutex
+	requests []json.RawMessage
+	audits   []json.RawMessage
+	subs     map[chan feedEvent]struct{}
+	closed   bool
+}
+
+func newActivityFeed() *activityFeed {
+	return &activityFeed{subs: make(map[chan feedEvent]struct{})}
+}
+
+func (f *activityFeed) request(e requestEvent) {
+	if f == nil {
+		return
+	}
+	f.publish("request", e, &f.requests, feedRequestHistory)
+}
+
+func (f *activityFeed) audit(e *auditEntry) {
+	if f == nil {
+		return
+	}
+	f.publish("audit", e, &f.audits, feedAuditHistory)
+}
+
+func (f *activityFeed) publish(name string, v any, history *[]json.RawMessage, limit int) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	*history = append(*history, data)
+	if len(*history) > limit {
+		*history = (*history)[len(*history)-limit:]
+	}
+	for ch := range f.subs {
+		// A dashboard that cannot keep up misses events rather than
+		// holding up requests.
+		select {
+		case ch <- feedEvent{name, data}:
+		default:
+		}
+	}
+}
+
+// subscribe returns a channel of new events and the history up to now.
+// The channel is closed by unsubscribe or close.
+func (f *activityFeed) subscribe() (ch chan feedEvent, requests, audits []json.RawMessage) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ch = make(chan feedEvent, 64)
+	if f.closed {
+		close(ch)
+	} else {
+		f.subs[ch] = struct{}{}
+	}
+	return ch, append([]json.RawMessage{}, f.requests...), append([]json.RawMessage{}, f.audits...)
+}
+
+func (f *activityFeed) unsubscribe(ch chan feedEvent) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.subs[ch]; ok {
+		delete(f.subs, ch)
+		close(ch)
+	}
+}
+
+// close ends every event stream, so that the admin server can shut down
+// without waiting for dashboards to disconnect.
+func (f *activityFeed) close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	for ch := range f.subs {
+		delete(f.subs, ch)
+		close(ch)
+	}
+}
+
+// dashboardStatus is the periodic "status" event.
+type dashboardStatus struct {
+	Sessions []sessionInfo `json:"sessions"`
+	Queued   int64         `json:"queued"`
+	InFlight int64         `json:"in_flight"`
+}
+
+// dashboardSnapshot is the "snapshot" event that starts every stream.
+type dashboardSnapshot struct {
+	Version   string            `json:"version"`
+	Auditing  bool              `json:"auditing"`
+	AuditText bool              `json:"audit_text"`
+	Requests  []json.RawMessage `json:"requests"`
+	Audits    []json.RawMessage `json:"audits"`
+	dashboardStatus
+}
+
+// dashboardEvents streams the dashboard's data as server-sent events: a
+// snapshot, then request and audit events as they happen and a status
+// event every few seconds.
+func dashboardEvents(feed *activityFeed, holder *sessionHolder, stats *metrics, audit *auditLog) http.HandlerFunc {
+	status := func() dashboardStatus {
+		return dashboardStatus{Sessions: holder.sessionInfos(), Queued: stats.queued.Load(), InFlight: stats.inFlight.Load()}
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+		ch, requests, audits := feed.subscribe()
+		defer feed.unsubscribe(ch)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		send := func(name string, v any) {
+			data, ok := v.([]byte)
+			if !ok {
+				data, _ = json.Marshal(v)
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, data)
+			flusher.Flush()
+		}
+		send("snapshot", dashboardSnapshot{
+			Version:         version,
+			Auditing:        audit != nil,
+			AuditText:       audit != nil && audit.text,
+			Requests:        requests,
+			Audits:          audits,
+			dashboardStatus: status(),
+		})
+
+		ticker := time.NewTicker(dashboardStatusInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case e, ok := <-ch:
+				if !ok {
+					return
+				}
+				send(e.name, e.data)
+			case <-ticker.C:
+				send("status", status())
+			}
+		}
+	}
+}
+
+// dashboardAssets serves the embedded page under /dashboard/. The files
+// hold no data, so they are served without authentication; the page asks
+// for an admin key and sends it with its API calls.
+func dashboardAssets() http.Handler {
+	return http.FileServerFS(dashboardFiles)
+}
+
+// playgroundChat serves the dashboard's chat playground by passing the
+// request on to the Ollama API's /api/chat handler. It must sit behind
+// clientAuth with the admin keys: the admin key is the client, and its
+// requests are limited in a playground scope of their own.
+func playgroundChat(ollama http.Handler, logger *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c := clientFromContext(r.Context())
+		if c == nil {
+			writeError(w, logger, http.StatusUnauthorized, "the playground needs an admin key")
+			return
+		}
+		pc := *c
+		pc.playground = true
+		r2 := r.Clone(withClient(r.Context(), &pc))
+		r2.URL.Path = "/api/chat"
+		r2.URL.RawPath = ""
+		r2.RequestURI = "/api/chat"
+		ollama.ServeHTTP(w, r2)
+	}
+}
@@ -0,0 +1,331 @@
+// Dashboard for the samplellama admin API. Data arrives as server-sent
+// events from /dashboard/events. The stream is read with fetch rather than
+// EventSource, which cannot send the Authorization header.
+"use strict";
+
+const $ = (id) => document.getElementById(id);
+const WINDOW_MS = 15 * 60 * 1000;
+const MAX_ROWS = 100;
+
+let key = sessionStorage.getItem("samplellama-admin-key") || "";
+let requests = [];
+let chat = [];
+
+function el(tag, props, ...children) {
+  const e = document.createElement(tag);
+  Object.assign(e, props || {});
+  for (const c of children) {
+    e.append(c instanceof Node ? c : document.createTextNode(c == null ? "" : String(c)));
+  }
+  return e;
+}
+
+function authHeaders(extra) {
+  return Object.assign({ Authorization: "Bearer " + key }, extra || {});
+}
+
+function showLogin(message) {
+  $("dashboard").hidden = true;
+  $("login").hidden = false;
+  $("login-error").textContent = message || "";
+}
+
+$("login").addEventListener("submit", (ev) => {
+  ev.preventDefault();
+  key = $("key").value;
+  sessionStorage.setItem("samplellama-admin-key", key);
+  connect();
+});
+
+// connect reads the event stream, reconnecting after a delay when it ends.
+async function connect() {
+  if (!key) {
+    showLogin();
+    return;
+  }
+  let resp;
+  try {
+    resp = await fetch("events", { headers: authHeaders() });
+  } catch (err) {
+    setConnected(false);
+    setTimeout(connect, 3000);
+    return;
+  }
+  if (resp.status === 401) {
+    sessionStorage.removeItem("samplellama-admin-key");
+    key = "";
+    showLogin("The key was not accepted.");
+    return;
+  }
+  if (!resp.ok) {
+    setConnected(false);
+    setTimeout(connect, 3000);
+    return;
+  }
+  $("login").hidden = true;
+  $("dashboard").hidden = false;
+  setConnected(true);
+
+  const reader = resp.body.pipeThrough(new TextDecoderStream()).getReader();
+  let buffer = "";
+  try {
+    for (;;) {
+      const { value, done } = await reader.read();
+      if (done) break;
+      buffer += value;
+      let end;
+      while ((end = buffer.indexOf("\n\n")) >= 0) {
+        dispatch(buffer.slice(0, end));
+        buffer = buffer.slice(end + 2);
+      }
+    }
+  } catch (err) {
+    // The connection dropped; reconnect below.
+  }
+  setConnected(false);
+  setTimeout(connect, 3000);
+}
+
+function setConnected(on) {
+  const badge = $("connection");
+  badge.textContent = on ? "live" : "disconnected";
+  badge.className = "badge " + (on ? "on" : "off");
+}
+
+function dispatch(block) {
+  let name = "message";
+  let data = "";
+  for (const line of block.split("\n")) {
+    if (line.startsWith("event: ")) name = line.slice(7);
+    else if (line.startsWith("data: ")) data += line.slice(6);
+  }
+  const msg = JSON.parse(data);
+  switch (name) {
+    case "snapshot":
+      $("version").textContent = msg.version;
+      requests = msg.requests || [];
+      $("activity").replaceChildren();
+      requests.forEach(addActivity);
+      $("audit-off").hidden = msg.auditing;
+      $("audits").replaceChildren();
+      (msg.audits || []).forEach(addAudit);
+      renderStatus(msg);
+      renderCharts();
+      break;
+    case "status":
+      renderStatus(msg);
+      renderCharts();
+      break;
+    case "request":
+      requests.push(msg);
+      if (requests.length > 500) requests.shift();
+      addActivity(msg);
+      renderCharts();
+      break;
+    case "audit":
+      addAudit(msg);
+      break;
+  }
+}
+
+function time(t) {
+  return new Date(t).toLocaleTimeString();
+}
+
+function renderStatus(s) {
+  const sessions = s.sessions || [];
+  $("tile-sessions").textContent = sessions.length;
+  $("tile-inflight").textContent = s.in_flight;
+  $("tile-queued").textContent = s.queued;
+  $("sessions").replaceChildren(...sessions.map((x) => {
+    const host = x.client ? x.client.name + " " + (x.client.version || "") : "unknown";
+    const state = x.draining ? "draining" : x.pinned ? "pinned" : "active";
+    return el("tr", null,
+      el("td", { title: x.id }, x.id.slice(0, 12)),
+      el("td", null, host),
+      el("td", null, x.mcp_identity || ""),
+      el("td", null, time(x.connected_at)),
+      el("td", null, x.in_flight),
+      el("td", null, x.requests_served),
+      el("td", { className: "error", title: x.last_error || "" }, x.last_error ? (x.last_error_at ? time(x.last_error_at) + ": " : "") + x.last_error : ""),
+      el("td", null, state));
+  }));
+}
+
+function addActivity(r) {
+  const row = el("tr", null,
+    el("td", null, time(r.time)),
+    el("td", null, r.endpoint),
+    el("td", null, r.model),
+    el("td", null, r.client || ""),
+    el("td", { className: r.status >= 400 ? "error" : "" }, r.status),
+    el("td", null, r.stop_reason || ""),
+    el("td", null, r.cached ? "cached" : r.sampling_ms ? r.sampling_ms + " ms" : ""),
+    el("td", null, r.prompt_tokens || r.eval_tokens ? r.prompt_tokens + " / " + r.eval_tokens : ""));
+  const body = $("activity");
+  body.prepend(row);
+  while (body.children.length > MAX_ROWS) body.lastChild.remove();
+}
+
+function addAudit(a) {
+  const meta = [time(a.time), a.endpoint, a.model, a.client, a.model_used && "answered by " + a.model_used, a.latency_ms + " ms"]
+    .filter(Boolean).join(" · ");
+  const box = el("div", { className: "exchange" }, el("div", { className: "meta" }, meta));
+  if (a.prompt) {
+    box.append(el("pre", null, promptText(a.prompt)));
+  } else {
+    box.append(el("div", { className: "meta" }, "prompt sha256 " + a.prompt_sha256));
+  }
+  if (a.error) {
+    box.append(el("pre", { className: "error" }, a.error));
+  } else if (a.response) {
+    box.append(el("pre", null, "→ " + a.response));
+  }
+  const list = $("audits");
+  list.prepend(box);
+  while (list.children.length > 50) list.lastChild.remove();
+}
+
+function promptText(p) {
+  const parts = [];
+  if (p.systemPrompt) parts.push("[system] " + p.systemPrompt);
+  for (const m of p.messages || []) {
+    const content = Array.isArray(m.content) ? m.content : [m.content];
+    parts.push("[" + m.role + "] " + content.map((c) => (c && c.text) || "[" + (c && c.type) + "]").join(" "));
+  }
+  return parts.join("\n");
+}
+
+// Charts are drawn on canvases so that no chart library is needed.
+function setupCanvas(canvas) {
+  const ratio = window.devicePixelRatio || 1;
+  const w = canvas.clientWidth, h = canvas.clientHeight;
+  if (canvas.width !== w * ratio || canvas.height !== h * ratio) {
+    canvas.width = w * ratio;
+    canvas.height = h * ratio;
+  }
+  const ctx = canvas.getContext("2d");
+  ctx.setTransform(ratio, 0, 0, ratio, 0, 0);
+  ctx.clearRect(0, 0, w, h);
+  const style = getComputedStyle(document.documentElement);
+  const color = (name) => style.getPropertyValue(name).trim();
+  ctx.font = "11px system-ui, sans-serif";
+  ctx.fillStyle = color("--muted");
+  return { ctx, w, h, color };
+}
+
+function renderCharts() {
+  const now = Date.now();
+  const recent = requests.filter((r) => now - new Date(r.time) < WINDOW_MS);
+  const errors = recent.filter((r) => r.status >= 400).length;
+  $("tile-requests").textContent = recent.length;
+  $("tile-errors").textContent = recent.length ? Math.round(100 * errors / recent.length) + "%" : "0%";
+  drawLatency(recent.filter((r) => r.sampling_ms > 0));
+  drawErrorRate(recent, now);
+}
+
+function drawLatency(points) {
+  const { ctx, w, h, color } = setupCanvas($("latency"));
+  const pad = 30;
+  if (!points.length) {
+    ctx.fillText("No sampling requests in the last 15 minutes", pad, h / 2);
+    return;
+  }
+  const max = Math.max(...points.map((p) => p.sampling_ms)) * 1.1;
+  ctx.fillText((max / 1000).toFixed(1) + " s", 2, 12);
+  ctx.fillText("0", 2, h - 4);
+  ctx.strokeStyle = color("--accent");
+  ctx.lineWidth = 1.5;
+  ctx.beginPath();
+  points.forEach((p, i) => {
+    const x = pad + (w - pad - 8) * (points.length === 1 ? 0.5 : i / (points.length - 1));
+    const y = h - 8 - (h - 20) * p.sampling_ms / max;
+    if (i === 0) ctx.moveTo(x, y); else ctx.lineTo(x, y);
+  });
+  ctx.stroke();
+  points.forEach((p, i) => {
+    const x = pad + (w - pad - 8) * (points.length === 1 ? 0.5 : i / (points.length - 1));
+    const y = h - 8 - (h - 20) * p.sampling_ms / max;
+    ctx.fillStyle = p.status >= 400 ? color("--bad") : color("--accent");
+    ctx.fillRect(x - 2, y - 2, 4, 4);
+  });
+}
+
+function drawErrorRate(recent, now) {
+  const { ctx, w, h, color } = setupCanvas($("errors"));
+  const buckets = 15;
+  const total = new Array(buckets).fill(0);
+  const failed = new Array(buckets).fill(0);
+  for (const r of recent) {
+    const i = buckets - 1 - Math.floor((now - new Date(r.time)) / 60000);
+    if (i < 0 || i >= buckets) continue;
+    total[i]++;
+    if (r.status >= 400) failed[i]++;
+  }
+  const max = Math.max(1, ...total);
+  const pad = 30;
+  const bw = (w - pad - 8) / buckets;
+  ctx.fillText(String(max), 2, 12);
+  ctx.fillText("0", 2, h - 4);
+  ctx.fillText("-15 min", pad, h - 2);
+  ctx.fillText("now", w - 30, h - 2);
+  for (let i = 0; i < buckets; i++) {
+    const x = pad + i * bw + 2;
+    const ok = total[i] - failed[i];
+    const hOK = (h - 30) * ok / max;
+    const hBad = (h - 30) * failed[i] / max;
+    ctx.fillStyle = color("--accent");
+    ctx.fillRect(x, h - 14 - hOK, bw - 4, hOK);
+    ctx.fillStyle = color("--bad");
+    ctx.fillRect(x, h - 14 - hOK - hBad, bw - 4, hBad);
+  }
+}
+
+// The playground sends the conversation to /api/chat through the admin
+// listener, so that it needs no Ollama API key.
+$("chat").addEventListener("submit", async (ev) => {
+  ev.preventDefault();
+  const input = $("chat-input");
+  const text = input.value.trim();
+  if (!text) return;
+  chat.push({ role: "user", content: text });
+  input.value = "";
+  renderChat();
+  const button = ev.submitter || ev.target.querySelector("button[type=submit]");
+  button.disabled = true;
+  const messages = [];
+  const system = $("chat-system").value.trim();
+  if (system) messages.push({ role: "system", content: system });
+  try {
+    const resp = await fetch("api/chat", {
+      method: "POST",
+      headers: authHeaders({ "Content-Type": "application/json" }),
+      body: JSON.stringify({ model: $("chat-model").value || "default", messages: messages.concat(chat.filter((m) => m.role !== "error")), stream: false }),
+    });
+    const body = await resp.json();
+    if (!resp.ok) {
+      chat.push({ role: "error", content: body.error || resp.statusText });
+    } else {
+      chat.push(body.message);
+    }
+  } catch (err) {
+    chat.push({ role: "error", content: String(err) });
+  }
+  button.disabled = false;
+  renderChat();
+});
+
+$("chat-reset").addEventListener("click", () => {
+  chat = [];
+  renderChat();
+});
+
+function renderChat() {
+  const log = $("chat-log");
+  log.replaceChildren(...chat.map((m) => el("div", { className: "turn" + (m.role === "error" ? " error" : "") },
+    el("span", { className: "role" }, m.role), m.content)));
+  log.scrollTop = log.scrollHeight;
+}
+
+window.addEventListener("resize", renderCharts);
+connect();
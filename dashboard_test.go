@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// readEvent reads the next server-sent event.
+func readEvent(t *testing.T, r *bufio.Reader) (name string, data []byte) {
+	t.Helper()
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading events: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = []byte(strings.TrimPrefix(line, "data: "))
+		case line == "" && name != "":
+			return name, data
+		}
+	}
+}
+
+func TestDashboardEvents(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	h := newSessionHolder()
+	h.set(&mockSession{id: "s1", createMessageFunc: func(ctx context.Context, params *mcp.CreateMessageParams) (*mcp.CreateMessageResult, error) {
+		return &mcp.CreateMessageResult{StopReason: "endTurn", Content: &mcp.TextContent{Text: "pong"}}, nil
+	}})
+	b := testBridge(h, logger)
+	b.limits = newRateLimiter(limitConfig{Playground: limitSpec{RequestsPerMinute: 10}}, &budgetStore{usage: map[string]*budgetUsage{}}, logger)
+	feed := newActivityFeed()
+	stats := newMetrics(h, b.models, nil)
+	stats.feed = feed
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/chat", handleChat(b))
+	ollama := stats.instrument(mux)
+
+	// A request before the dashboard connects is part of the snapshot.
+	ollama.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/api/chat", strings.NewReader(`{"model":"llama3","messages":[{"role":"user","content":"ping"}],"stream":false}`)))
+
+	admin := http.NewServeMux()
+	admin.HandleFunc("GET /dashboard/events", dashboardEvents(feed, h, stats, nil))
+	admin.HandleFunc("POST /dashboard/api/chat", playgroundChat(ollama, logger))
+	keys, err := newAPIKeyStore([]apiKey{{Key: "admin-secret", Label: "ops"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(clientAuth(keys, false, logger, admin))
+	defer srv.Close()
+	post := func(key string) *http.Response {
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+"/dashboard/api/chat", strings.NewReader(`{"model":"llama3","messages":[{"role":"user","content":"ping"}],"stream":false}`))
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/dashboard/events", nil)
+	req.Header.Set("Authorization", "Bearer admin-secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	events := bufio.NewReader(resp.Body)
+	name, data := readEvent(t, events)
+	var snap struct {
+		Auditing bool           `json:"auditing"`
+		Requests []requestEvent `json:"requests"`
+		Sessions []sessionInfo  `json:"sessions"`
+	}
+	if err := json.Unmarshal(data, &snap); err != nil || name != "snapshot" {
+		t.Fatalf("first event %s %s: %v", name, data, err)
+	}
+	if snap.Auditing || len(snap.Requests) != 1 || snap.Requests[0].StopReason != "endTurn" || len(snap.Sessions) != 1 {
+		t.Errorf("unexpected snapshot %s", data)
+	}
+
+	// The playground needs an admin key.
+	if resp := post(""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("playground without a key: got %d, want 401", resp.StatusCode)
+	}
+
+	// The playground goes through the Ollama handler and shows up live.
+	chat := post("admin-secret")
+	var reply ChatResponse
+	json.NewDecoder(chat.Body).Decode(&reply)
+	chat.Body.Close()
+	if reply.Message.Content != "pong" {
+		t.Errorf("playground reply %+v", reply)
+	}
+	name, data = readEvent(t, events)
+	var ev requestEvent
+	json.Unmarshal(data, &ev)
+	if name != "request" || ev.Endpoint != "/api/chat" || ev.Model != "llama3" || ev.Status != http.StatusOK {
+		t.Errorf("got %s %s, want the playground request", name, data)
+	}
+	// It is charged to the admin key's playground scope.
+	if st := b.limits.state(); len(st.Scopes) != 1 || st.Scopes[0].Scope != "playground:"+clientID("key:admin-secret") || st.Scopes[0].Label != "ops" || *st.Scopes[0].RequestsRemaining != 9 {
+		t.Errorf("unexpected limits %+v", st.Scopes)
+	}
+
+	// Closing the feed ends the stream.
+	feed.close()
+	done := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, events)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("the event stream did not end when the feed closed")
+	}
+}
+
+func TestDashboardAssets(t *testing.T) {
+	w := httptest.NewRecorder()
+	dashboardAssets().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/dashboard/", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `<script src="app.js">`) {
+		t.Errorf("got %d: %.200s", w.Code, w.Body)
+	}
+	// Everything the page needs is embedded.
+	fs.WalkDir(dashboardFiles, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, _ := fs.ReadFile(dashboardFiles, path)
+		if strings.Contains(string(data), "https://") || strings.Contains(string(data), "http://") {
+			t.Errorf("%s refers to an external URL", path)
+		}
+		return nil
+	})
+}
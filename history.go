@@ -0,0 +1,562 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A history segment is closed once it reaches historySegmentBytes or has
+// been open for historySegmentAge. Retention removes whole segments.
+const (
+	historySegmentBytes = 16 << 20
+	historySegmentAge   = 24 * time.Hour
+)
+
+// historyEntry is one chat or generate transaction as the client saw it:
+// the Ollama request and the complete response, or the error returned.
+type historyEntry struct {
+	ID               uint64            `json:"id"`
+	Time             time.Time         `json:"time"`
+	Endpoint         string            `json:"endpoint"`
+	Client           string            `json:"client,omitempty"`
+	Model            string            `json:"model"`
+	SessionID        string            `json:"session_id,omitempty"`
+	MCPIdentity      string            `json:"mcp_identity,omitempty"`
+	LatencyMS        int64             `json:"latency_ms"`
+	ChatRequest      *ChatRequest      `json:"chat_request,omitempty"`
+	ChatResponse     *ChatResponse     `json:"chat_response,omitempty"`
+	GenerateRequest  *GenerateRequest  `json:"generate_request,omitempty"`
+	GenerateResponse *GenerateResponse `json:"generate_response,omitempty"`
+	Error            string            `json:"error,omitempty"`
+}
+
+// matches reports whether any text of the entry contains text, which must
+// be lower case.
+func (e *historyEntry) matches(text string) bool {
+	fields := []string{e.Error}
+	if e.ChatRequest != nil {
+		for _, m := range e.ChatRequest.Messages {
+			fields = append(fields, m.Content)
+		}
+	}
+	if e.ChatResponse != nil {
+		fields = append(fields, e.ChatResponse.Message.Content)
+	}
+	if e.GenerateRequest != nil {
+		fields = append(fields, e.GenerateRequest.System, e.GenerateRequest.Prompt, e.GenerateRequest.Suffix)
+	}
+	if e.GenerateResponse != nil {
+		fields = append(fields, e.GenerateResponse.Response)
+	}
+	for _, f := range fields {
+		if strings.Contains(strings.ToLower(f), text) {
+			return true
+		}
+	}
+	return false
+}
+
+// historySegment is one JSONL file of the store.
+type historySegment struct {
+	path    string
+	size    int64
+	created time.Time
+	last    time.Time // time of the newest entry
+}
+
+// historyRef is the index entry of a stored transaction: what searches
+// filter on, and where to read the rest.
+type historyRef struct {
+	id       uint64
+	time     time.Time
+	endpoint string
+	model    string
+	client   string
+	seg      *historySegment
+	offset   int64
+	length   int
+}
+
+// historyStore persists transactions to append-only JSONL segments in a
+// directory. The index is kept in memory and rebuilt from the segments
+// when the store is opened. Segments are removed once their newest entry
+// is older than maxAge, or oldest first while the store is larger than
+// maxBytes; zero disables either limit. A nil historyStore records
+// nothing.
+type historyStore struct {
+	mu       sync.Mutex
+	dir      string
+	maxAge   time.Duration
+	maxBytes int64
+	segments []*historySegment // oldest first; new entries go to the last
+	index    []historyRef      // ordered by ID
+	file     *os.File          // the last segment, once opened for appending
+	nextID   uint64
+	logger   *slog.Logger
+	now      func() time.Time
+}
+
+// openHistory opens the store in dir, creating it if needed.
+func openHistory(dir string, maxAge time.Duration, maxBytes int64, logger *slog.Logger) (*historyStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("creating history directory: %w", err)
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "history-*.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	slices.Sort(paths)
+	h := &historyStore{dir: dir, maxAge: maxAge, maxBytes: maxBytes, nextID: 1, logger: logger, now: time.Now}
+	for i, path := range paths {
+		if err := h.loadSegment(path, i == len(paths)-1); err != nil {
+			return nil, err
+		}
+	}
+	h.pruneLocked(h.now())
+	return h, nil
+}
+
+// loadSegment indexes the entries of a segment. A partial line at the end
+// of the last segment, left by a crash, is cut off so that appends start
+// on a new line.
+func (h *historyStore) loadSegment(path string, last bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("reading history: %w", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("reading history: %w", err)
+	}
+	seg := &historySegment{path: path, created: info.ModTime()}
+	r := bufio.NewReader(f)
+	var offset int64
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 && line[len(line)-1] == '\n' {
+			var e historyEntry
+			if json.Unmarshal(line, &e) == nil {
+				if seg.last.IsZero() {
+					seg.created = e.Time
+				}
+				seg.last = e.Time
+				h.index = append(h.index, historyRef{
+					id:       e.ID,
+					time:     e.Time,
+					endpoint: e.Endpoint,
+					model:    e.Model,
+					client:   e.Client,
+					seg:      seg,
+					offset:   offset,
+					length:   len(line),
+				})
+				h.nextID = max(h.nextID, e.ID+1)
+			} else {
+				h.logger.Warn("Skipping unreadable history entry", "file", path, "offset", offset)
+			}
+			offset += int64(len(line))
+		}
+		if err == io.EOF {
+			if len(line) > 0 && last {
+				h.logger.Warn("Truncating partial history entry", "file", path, "offset", offset)
+				if err := os.Truncate(path, offset); err != nil {
+					return fmt.Errorf("repairing history: %w", err)
+				}
+			}
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("reading history: %w", err)
+		}
+	}
+	seg.size = offset
+	h.segments = append(h.segments, seg)
+	return nil
+}
+
+func (h *historyStore) close() error {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.file == nil {
+		return nil
+	}
+	err := h.file.Close()
+	h.file = nil
+	return err
+}
+
+// openSegmentLocked prepares the last segment for appending, starting a
+// new one when it is full or old.
+func (h *historyStore) openSegmentLocked(now time.Time, size int) error {
+	if n := len(h.segments); n > 0 {
+		seg := h.segments[n-1]
+		if seg.size+int64(size) <= historySegmentBytes && now.Sub(seg.created) < historySegmentAge {
+			if h.file != nil {
+				return nil
+			}
+			f, err := os.OpenFile(seg.path, os.O_WRONLY|os.O_APPEND, 0)
+			if err != nil {
+				return err
+			}
+			h.file = f
+			return nil
+		}
+	}
+	if h.file != nil {
+		h.file.Close()
+		h.file = nil
+	}
+	path := filepath.Join(h.dir, fmt.Sprintf("history-%012d.jsonl", h.nextID))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	h.file = f
+	h.segments = append(h.segments, &historySegment{path: path, created: now})
+	return nil
+}
+
+// write assigns e an ID and appends it to the store.
+func (h *historyStore) write(e *historyEntry) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	e.ID = h.nextID
+	line, err := json.Marshal(e)
+	if err != nil {
+		h.logger.Error("Failed to encode history entry", "error", err)
+		return
+	}
+	line = append(line, '\n')
+	now := h.now()
+	if err := h.openSegmentLocked(now, len(line)); err != nil {
+		h.logger.Error("Failed to open history segment", "error", err)
+		return
+	}
+	seg := h.segments[len(h.segments)-1]
+	n, err := h.file.Write(line)
+	if err != nil {
+		// A partial line would corrupt the entries after it, so start a
+		// new segment next time.
+		h.logger.Error("Failed to write history", "error", err)
+		seg.size += int64(n)
+		seg.created = time.Time{}
+		return
+	}
+	h.nextID++
+	h.index = append(h.index, historyRef{
+		id:       e.ID,
+		time:     e.Time,
+		endpoint: e.Endpoint,
+		model:    e.Model,
+		client:   e.Client,
+		seg:      seg,
+		offset:   seg.size,
+		length:   n,
+	})
+	seg.size += int64(n)
+	seg.last = e.Time
+	h.pruneLocked(now)
+}
+
+// pruneLocked applies the retention limits. The segment being written is
+// never removed.
+func (h *historyStore) pruneLocked(now time.Time) {
+	var total int64
+	for _, seg := range h.segments {
+		total += seg.size
+	}
+	for len(h.segments) > 1 {
+		seg := h.segments[0]
+		if !(h.maxAge > 0 && now.Sub(seg.last) > h.maxAge || h.maxBytes > 0 && total > h.maxBytes) {
+			break
+		}
+		if err := os.Remove(seg.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			h.logger.Error("Failed to remove history segment", "file", seg.path, "error", err)
+			return
+		}
+		total -= seg.size
+		h.segments = h.segments[1:]
+		i := 0
+		for i < len(h.index) && h.index[i].seg == seg {
+			i++
+		}
+		h.index = h.index[i:]
+	}
+}
+
+// historyQuery selects stored transactions. Zero fields do not filter.
+type historyQuery struct {
+	Since, Until time.Time
+	Endpoint     string
+	Model        string
+	Client       string
+	Text         string // case-insensitive substring of prompts, responses and errors
+	Before       uint64 // only entries with smaller IDs, for paging
+	Limit        int
+}
+
+// parseHistoryQuery reads a query from URL parameters. Times are RFC 3339
+// or durations before now, such as 24h.
+func parseHistoryQuery(r *http.Request, now time.Time) (historyQuery, error) {
+	v := r.URL.Query()
+	q := historyQuery{
+		Endpoint: v.Get("endpoint"),
+		Model:    v.Get("model"),
+		Client:   v.Get("client"),
+		Text:     strings.ToLower(v.Get("q")),
+	}
+	var err error
+	parseTime := func(name string) time.Time {
+		s := v.Get(name)
+		if s == "" || err != nil {
+			return time.Time{}
+		}
+		if d, perr := time.ParseDuration(s); perr == nil {
+			return now.Add(-d)
+		}
+		t, perr := time.Parse(time.RFC3339, s)
+		if perr != nil {
+			err = fmt.Errorf("invalid %s: %q is neither an RFC 3339 time nor a duration", name, s)
+		}
+		return t
+	}
+	q.Since, q.Until = parseTime("since"), parseTime("until")
+	if err != nil {
+		return q, err
+	}
+	if s := v.Get("before"); s != "" {
+		if q.Before, err = strconv.ParseUint(s, 10, 64); err != nil {
+			return q, fmt.Errorf("invalid before: %q", s)
+		}
+	}
+	if s := v.Get("limit"); s != "" {
+		if q.Limit, err = strconv.Atoi(s); err != nil || q.Limit < 0 {
+			return q, fmt.Errorf("invalid limit: %q", s)
+		}
+	}
+	return q, nil
+}
+
+func (q *historyQuery) selects(ref *historyRef) bool {
+	return (q.Since.IsZero() || !ref.time.Before(q.Since)) &&
+		(q.Until.IsZero() || ref.time.Before(q.Until)) &&
+		(q.Before == 0 || ref.id < q.Before) &&
+		(q.Endpoint == "" || ref.endpoint == q.Endpoint) &&
+		(q.Model == "" || ref.model == q.Model) &&
+		(q.Client == "" || ref.client == q.Client)
+}
+
+// search calls fn with the entries matching q, newest first unless
+// oldestFirst, until fn returns false or q.Limit entries were found.
+func (h *historyStore) search(q historyQuery, oldestFirst bool, fn func(*historyEntry) bool) error {
+	h.mu.Lock()
+	refs := h.index
+	h.mu.Unlock()
+
+	files := make(map[*historySegment]*os.File)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	found := 0
+	for i := range refs {
+		ref := &refs[len(refs)-1-i]
+		if oldestFirst {
+			ref = &refs[i]
+		}
+		if !q.selects(ref) {
+			continue
+		}
+		f := files[ref.seg]
+		if f == nil {
+			var err error
+			if f, err = os.Open(ref.seg.path); err != nil {
+				if errors.Is(err, os.ErrNotExist) {
+					continue // removed by retention meanwhile
+				}
+				return err
+			}
+			files[ref.seg] = f
+		}
+		buf := make([]byte, ref.length)
+		if _, err := f.ReadAt(buf, ref.offset); err != nil {
+			return err
+		}
+		var e historyEntry
+		if err := json.Unmarshal(buf, &e); err != nil {
+			return fmt.Errorf("history entry %d: %w", ref.id, err)
+		}
+		if q.Text != "" && !e.matches(q.Text) {
+			continue
+		}
+		found++
+		if !fn(&e) || q.Limit > 0 && found >= q.Limit {
+			return nil
+		}
+	}
+	return nil
+}
+
+// get returns the entry with the given ID.
+func (h *historyStore) get(id uint64) (*historyEntry, error) {
+	var entry *historyEntry
+	err := h.search(historyQuery{Before: id + 1, Limit: 1}, false, func(e *historyEntry) bool {
+		if e.ID == id {
+			entry = e
+		}
+		return false
+	})
+	return entry, err
+}
+
+// historyRecord is a transaction being recorded.
+type historyRecord struct {
+	h     *historyStore
+	entry historyEntry
+	start time.Time
+}
+
+// start begins the record of a chat or generate transaction.
+func (h *historyStore) start(r *http.Request, endpoint, model, sessionID, identity string) *historyRecord {
+	if h == nil {
+		return nil
+	}
+	if model == "" {
+		model = "default"
+	}
+	return &historyRecord{h: h, start: h.now(), entry: historyEntry{
+		Endpoint:    endpoint,
+		Client:      clientLabel(r.Context()),
+		Model:       model,
+		SessionID:   sessionID,
+		MCPIdentity: identity,
+	}}
+}
+
+func (rec *historyRecord) finish(err error) {
+	e := &rec.entry
+	e.Time = rec.start.UTC()
+	e.LatencyMS = rec.h.now().Sub(rec.start).Milliseconds()
+	if err != nil {
+		e.Error = err.Error()
+	}
+	rec.h.write(e)
+}
+
+// chat records a chat transaction; resp is nil when it failed.
+func (rec *historyRecord) chat(req *ChatRequest, resp *ChatResponse, err error) {
+	if rec == nil {
+		return
+	}
+	rec.entry.ChatRequest, rec.entry.ChatResponse = req, resp
+	rec.finish(err)
+}
+
+// generate records a generate transaction; resp is nil when it failed.
+func (rec *historyRecord) generate(req *GenerateRequest, resp *GenerateResponse, err error) {
+	if rec == nil {
+		return
+	}
+	rec.entry.GenerateRequest, rec.entry.GenerateResponse = req, resp
+	rec.finish(err)
+}
+
+// historySearch serves GET /admin/history: matching entries, newest
+// first, 50 by default and at most 1000. When more may follow, next_before
+// is the value of before for the next page.
+func historySearch(h *historyStore, logger *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q, err := parseHistoryQuery(r, time.Now())
+		if err != nil {
+			writeError(w, logger, http.StatusBadRequest, err.Error())
+			return
+		}
+		if q.Limit == 0 {
+			q.Limit = 50
+		}
+		q.Limit = min(q.Limit, 1000)
+		entries := []*historyEntry{}
+		err = h.search(q, false, func(e *historyEntry) bool {
+			entries = append(entries, e)
+			return true
+		})
+		if err != nil {
+			writeError(w, logger, http.StatusInternalServerError, err.Error())
+			return
+		}
+		resp := struct {
+			Entries    []*historyEntry `json:"entries"`
+			NextBefore uint64          `json:"next_before,omitempty"`
+		}{Entries: entries}
+		if len(entries) == q.Limit {
+			resp.NextBefore = entries[len(entries)-1].ID
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(resp)
+	}
+}
+
+// historyGet serves GET /admin/history/{id}.
+func historyGet(h *historyStore, logger *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+		if err != nil {
+			writeError(w, logger, http.StatusNotFound, "history entry not found")
+			return
+		}
+		e, err := h.get(id)
+		if err != nil {
+			writeError(w, logger, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if e == nil {
+			writeError(w, logger, http.StatusNotFound, "history entry not found")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(e)
+	}
+}
+
+// historyExport serves GET /admin/history/export: the matching entries,
+// oldest first, as JSONL. There is no limit unless one is given.
+func historyExport(h *historyStore, logger *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q, err := parseHistoryQuery(r, time.Now())
+		if err != nil {
+			writeError(w, logger, http.StatusBadRequest, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", `attachment; filename="history.jsonl"`)
+		enc := json.NewEncoder(w)
+		err = h.search(q, true, func(e *historyEntry) bool {
+			return enc.Encode(e) == nil
+		})
+		if err != nil {
+			// The status has been sent; end the stream short.
+			logger.Error("History export failed", "error", err)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+func historyChat(model, client, prompt, answer string) *historyEntry {
+	return &historyEntry{
+		Endpoint:     "/api/chat",
+		Model:        model,
+		Client:       client,
+		ChatRequest:  &ChatRequest{Model: model, Messages: []OllamaMessage{{Role: "user", Content: prompt}}},
+		ChatResponse: &ChatResponse{Model: model, Message: OllamaMessage{Role: "assistant", Content: answer}, Done: true},
+	}
+}
+
+func searchIDs(t *testing.T, h *historyStore, q historyQuery) []uint64 {
+	t.Helper()
+	var ids []uint64
+	if err := h.search(q, false, func(e *historyEntry) bool {
+		ids = append(ids, e.ID)
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return ids
+}
+
+func TestHistoryStore(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	dir := t.TempDir()
+	start := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	h, err := openHistory(dir, 0, 0, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, e := range []*historyEntry{
+		historyChat("llama3", "ci", "What is Go?", "A programming language."),
+		historyChat("mistral", "ci", "Name a gopher", "Gordon"),
+		historyChat("llama3", "alice", "Write a haiku", "Autumn moonlight"),
+		{Endpoint: "/api/generate", Model: "llama3", Client: "alice", GenerateRequest: &GenerateRequest{Model: "llama3", Prompt: "func main"}, Error: "sampling failed: host went away"},
+	} {
+		e.Time = start.Add(time.Duration(i) * time.Hour)
+		h.write(e)
+	}
+
+	for _, tc := range []struct {
+		name string
+		q    historyQuery
+		want []uint64
+	}{
+		{"all", historyQuery{}, []uint64{4, 3, 2, 1}},
+		{"model", historyQuery{Model: "llama3"}, []uint64{4, 3, 1}},
+		{"client", historyQuery{Client: "ci"}, []uint64{2, 1}},
+		{"endpoint", historyQuery{Endpoint: "/api/generate"}, []uint64{4}},
+		{"prompt text", historyQuery{Text: "gopher"}, []uint64{2}},
+		{"response text", historyQuery{Text: "moonlight"}, []uint64{3}},
+		{"error text", historyQuery{Text: "went away"}, []uint64{4}},
+		{"time", historyQuery{Since: start.Add(time.Hour), Until: start.Add(3 * time.Hour)}, []uint64{3, 2}},
+		{"page", historyQuery{Before: 3, Limit: 1}, []uint64{2}},
+	} {
+		if got := searchIDs(t, h, tc.q); !slices.Equal(got, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+	h.close()
+
+	// Simulate a crash in the middle of a write.
+	paths, _ := filepath.Glob(filepath.Join(dir, "history-*.jsonl"))
+	if len(paths) != 1 {
+		t.Fatalf("segments: %v", paths)
+	}
+	f, err := os.OpenFile(paths[0], os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"id":5,"time":`)
+	f.Close()
+
+	h, err = openHistory(dir, 0, 0, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.close()
+	e := historyChat("llama3", "ci", "again", "ok")
+	e.Time = start.Add(5 * time.Hour)
+	h.write(e)
+	if got := searchIDs(t, h, historyQuery{}); !slices.Equal(got, []uint64{5, 4, 3, 2, 1}) {
+		t.Errorf("after reopening: got %v", got)
+	}
+	if e, err := h.get(2); err != nil || e == nil || e.ChatResponse.Message.Content != "Gordon" {
+		t.Errorf("get(2) = %+v, %v", e, err)
+	}
+}
+
+func TestHistoryRetention(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	dir := t.TempDir()
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	h, err := openHistory(dir, 72*time.Hour, 0, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.close()
+	h.now = func() time.Time { return now }
+	// A write a day later starts a new segment.
+	for range 4 {
+		e := historyChat("llama3", "ci", "hello", "hi")
+		e.Time = now
+		h.write(e)
+		now = now.Add(25 * time.Hour)
+	}
+	if got := searchIDs(t, h, historyQuery{}); !slices.Equal(got, []uint64{4, 3, 2}) {
+		t.Errorf("after age limit: got %v", got)
+	}
+	if paths, _ := filepath.Glob(filepath.Join(dir, "history-*.jsonl")); len(paths) != 3 {
+		t.Errorf("segments: %v", paths)
+	}
+
+	h.maxBytes = 1
+	e := historyChat("llama3", "ci", "hello", "hi")
+	e.Time = now
+	h.write(e)
+	if got := searchIDs(t, h, historyQuery{}); !slices.Equal(got, []uint64{5}) {
+		t.Errorf("after size limit: got %v", got)
+	}
+}
+
+func TestHistoryAPI(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	h := newSessionHolder()
+	h.set(&mockSession{id: "s1", createMessageFunc: func(ctx context.Context, params *mcp.CreateMessageParams) (*mcp.CreateMessageResult, error) {
+		return &mcp.CreateMessageResult{Model: "host-model", StopReason: "endTurn", Content: &mcp.TextContent{Text: "echo: " + extractTextContent(params.Messages[0].Content)}}, nil
+	}})
+	b := testBridge(h, logger)
+	history, err := openHistory(t.TempDir(), 0, 0, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer history.close()
+	b.history = history
+
+	for _, body := range []string{
+		`{"model":"llama3","messages":[{"role":"user","content":"first"}]}`,
+		`{"model":"llama3","messages":[{"role":"user","content":"second"}],"stream":false}`,
+	} {
+		w := httptest.NewRecorder()
+		handleChat(b).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/chat", strings.NewReader(body)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("chat: got %d: %s", w.Code, w.Body)
+		}
+	}
+	w := httptest.NewRecorder()
+	handleGenerate(b).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/generate", strings.NewReader(`{"model":"llama3","prompt":"third","stream":false}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("generate: got %d: %s", w.Code, w.Body)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/history", historySearch(history, logger))
+	mux.HandleFunc("GET /admin/history/export", historyExport(history, logger))
+	mux.HandleFunc("GET /admin/history/{id}", historyGet(history, logger))
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	w = get("/admin/history?endpoint=/api/chat&limit=1")
+	var page struct {
+		Entries    []historyEntry `json:"entries"`
+		NextBefore uint64         `json:"next_before"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Entries) != 1 || page.NextBefore != 2 {
+		t.Fatalf("page: %s", w.Body)
+	}
+	e := page.Entries[0]
+	if e.ChatRequest == nil || e.ChatRequest.Messages[0].Content != "second" || e.ChatResponse == nil || e.ChatResponse.Message.Content != "echo: second" {
+		t.Errorf("entry: %s", w.Body)
+	}
+
+	w = get("/admin/history?q=ECHO:+FIRST")
+	if !strings.Contains(w.Body.String(), `"id": 1,`) || strings.Contains(w.Body.String(), `"id": 2,`) {
+		t.Errorf("text search: %s", w.Body)
+	}
+
+	w = get("/admin/history/3")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"response": "echo: third"`) {
+		t.Errorf("get: got %d: %s", w.Code, w.Body)
+	}
+	if w := get("/admin/history/9"); w.Code != http.StatusNotFound {
+		t.Errorf("get unknown: got %d", w.Code)
+	}
+	if w := get("/admin/history?since=yesterday"); w.Code != http.StatusBadRequest {
+		t.Errorf("bad since: got %d", w.Code)
+	}
+
+	w = get("/admin/history/export?since=1h")
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if w.Header().Get("Content-Type") != "application/x-ndjson" || len(lines) != 3 || !strings.HasPrefix(lines[0], `{"id":1,`) {
+		t.Errorf("export: %s", w.Body)
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// defaultHookTimeout applies to hooks that do not set a timeout.
+const defaultHookTimeout = 10 * time.Second
+
+// maxHookResponse bounds what is read from a hook.
+const maxHookResponse = 16 << 20
+
+// hookConfig is one hook of the -hooks file: either a local Command, run
+// with the request on stdin, or a webhook URL the request is POSTed to.
+type hookConfig struct {
+	Name     string            `json:"name"`
+	Command  []string          `json:"command,omitempty"`
+	URL      string            `json:"url,omitempty"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	Timeout  string            `json:"timeout,omitempty"`
+	FailOpen bool              `json:"fail_open,omitempty"`
+}
+
+// hooksConfig is the -hooks file. Hooks of each stage run in order.
+type hooksConfig struct {
+	PreSample  []hookConfig `json:"pre_sample"`
+	PostSample []hookConfig `json:"post_sample"`
+}
+
+// hookRequest is the JSON a hook receives. Pre-sample hooks get the
+// translated CreateMessage parameters, post-sample hooks also the result.
+type hookRequest struct {
+	Stage     string                   `json:"stage"`
+	Endpoint  string                   `json:"endpoint"`
+	Model     string                   `json:"model"`
+	Client    string                   `json:"client,omitempty"`
+	SessionID string                   `json:"session_id"`
+	Summary   bool                     `json:"summary,omitempty"` // summarizes a chat history that does not fit
+	Params    *mcp.CreateMessageParams `json:"params"`
+	Result    *mcp.CreateMessageResult `json:"result,omitempty"`
+}
+
+// hookResponse is what a hook answers. An empty response or action
+// allows the request unchanged. "modify" replaces the parameters (pre) or
+// the result (post), and "reject" fails the request with Message.
+type hookResponse struct {
+	Action  string                   `json:"action"`
+	Message string                   `json:"message,omitempty"`
+	Params  *mcp.CreateMessageParams `json:"params,omitempty"`
+	Result  *mcp.CreateMessageResult `json:"result,omitempty"`
+}
+
+// hookRejection is returned when a hook rejects a request.
+type hookRejection struct {
+	hook    string
+	message string
+}
+
+func (e *hookRejection) Error() string {
+	return fmt.Sprintf("rejected by policy hook %s: %s", e.hook, e.message)
+}
+
+type hook struct {
+	hookConfig
+	timeout time.Duration
+}
+
+// hooks runs the configured policy hooks around sampling. A nil hooks
+// runs nothing.
+type hooks struct {
+	pre    []*hook
+	post   []*hook
+	client *http.Client
+	logger *slog.Logger
+}
+
+func loadHooks(path string, logger *slog.Logger) (*hooks, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading hooks: %w", err)
+	}
+	var cfg hooksConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parsing hooks %s: %w", path, err)
+	}
+	return newHooks(cfg, logger)
+}
+
+func newHooks(cfg hooksConfig, logger *slog.Logger) (*hooks, error) {
+	h := &hooks{client: &http.Client{}, logger: logger}
+	for _, stage := range []struct {
+		configs []hookConfig
+		hooks   *[]*hook
+	}{{cfg.PreSample, &h.pre}, {cfg.PostSample, &h.post}} {
+		for _, c := range stage.configs {
+			if c.Name == "" {
+				return nil, errors.New("hook without a name")
+			}
+			if (len(c.Command) == 0) == (c.URL == "") {
+				return nil, fmt.Errorf("hook %s: exactly one of command and url is required", c.Name)
+			}
+			hk := &hook{hookConfig: c, timeout: defaultHookTimeout}
+			if c.Timeout != "" {
+				d, err := time.ParseDuration(c.Timeout)
+				if err != nil || d <= 0 {
+					return nil, fmt.Errorf("hook %s: invalid timeout %q", c.Name, c.Timeout)
+				}
+				hk.timeout = d
+			}
+			*stage.hooks = append(*stage.hooks, hk)
+		}
+	}
+	return h, nil
+}
+
+// preSample runs the pre-sample hooks on req.Params, which they may
+// modify in place. It returns a *hookRejection if a hook rejected the
+// request, or another error if a fail-closed hook failed.
+func (h *hooks) preSample(ctx context.Context, req *hookRequest) error {
+	if h == nil {
+		return nil
+	}
+	req.Stage = "pre_sample"
+	for _, hk := range h.pre {
+		resp, err := h.run(ctx, hk, req)
+		if err != nil {
+			return err
+		}
+		if resp.Action == "modify" {
+			*req.Params = *resp.Params
+		}
+	}
+	return nil
+}
+
+// postSample runs the post-sample hooks on req.Result, which they may
+// modify in place.
+func (h *hooks) postSample(ctx context.Context, req *hookRequest) error {
+	if h == nil {
+		return nil
+	}
+	req.Stage = "post_sample"
+	for _, hk := range h.post {
+		resp, err := h.run(ctx, hk, req)
+		if err != nil {
+			return err
+		}
+		if resp.Action == "modify" {
+			*req.Result = *resp.Result
+		}
+	}
+	return nil
+}
+
+// run calls one hook and validates its answer. A failing fail-open hook
+// is logged and counts as allowing the request.
+func (h *hooks) run(ctx context.Context, hk *hook, req *hookRequest) (*hookResponse, error) {
+	start := time.Now()
+	resp, err := h.call(ctx, hk, req)
+	if err == nil {
+		switch resp.Action {
+		case "", "allow":
+			resp.Action = "allow"
+		case "reject":
+			h.logger.Info("Policy hook rejected request", "hook", hk.Name, "stage", req.Stage, "message", resp.Message)
+			return nil, &hookRejection{hook: hk.Name, message: resp.Message}
+		case "modify":
+			if req.Stage == "pre_sample" && resp.Params == nil {
+				err = errors.New("modify without params")
+			} else if req.Stage == "post_sample" && resp.Result == nil {
+				err = errors.New("modify without result")
+			}
+		default:
+			err = fmt.Errorf("unknown action %q", resp.Action)
+		}
+	}
+	if err != nil {
+		h.logger.Warn("Policy hook failed", "hook", hk.Name, "stage", req.Stage, "fail_open", hk.FailOpen, "error", err)
+		if hk.FailOpen {
+			return &hookResponse{Action: "allow"}, nil
+		}
+		return nil, fmt.Errorf("policy hook %s failed: %w", hk.Name, err)
+	}
+	h.logger.Debug("Policy hook", "hook", hk.Name, "stage", req.Stage, "action", resp.Action, "duration", time.Since(start))
+	return resp, nil
+}
+
+func (h *hooks) call(ctx context.Context, hk *hook, req *hookRequest) (*hookResponse, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, hk.timeout)
+	defer cancel()
+	var out []byte
+	if hk.URL != "" {
+		out, err = h.webhook(ctx, hk, body)
+	} else {
+		out, err = execHook(ctx, hk, body)
+	}
+	if err != nil {
+		return nil, err
+	}
+	resp := &hookResponse{}
+	if len(bytes.TrimSpace(out)) == 0 {
+		return resp, nil
+	}
+	if err := json.Unmarshal(out, resp); err != nil {
+		return nil, fmt.Errorf("invalid response: %w", err)
+	}
+	return resp, nil
+}
+
+func (h *hooks) webhook(ctx context.Context, hk *hook, body []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hk.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range hk.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	out, err := io.ReadAll(io.LimitReader(resp.Body, maxHookResponse))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("webhook returned %s: %s", resp.Status, truncate(strings.TrimSpace(string(out)), 200))
+	}
+	return out, nil
+}
+
+func execHook(ctx context.Context, hk *hook, body []byte) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, hk.Command[0], hk.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(body)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	// Do not wait for children that keep the output pipes open.
+	cmd.WaitDelay = time.Second
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%w: %s", err, truncate(msg, 200))
+		}
+		return nil, err
+	}
+	if stdout.Len() > maxHookResponse {
+		return nil, errors.New("response too large")
+	}
+	return stdout.Bytes(), nil
+}
+
+// writeHookError answers a request stopped by a hook: 403 with the hook's
+// message for a rejection, 502 for a failed fail-closed hook.
+func writeHookError(w http.ResponseWriter, logger *slog.Logger, err error) {
+	var rejection *hookRejection
+	if errors.As(err, &rejection) {
+		err = rejection
+	}
+	writeError(w, logger, hookErrorStatus(err), err.Error())
+}
+
+// hookErrorStatus is the status writeHookError answers err with.
+func hookErrorStatus(err error) int {
+	var rejection *hookRejection
+	if errors.As(err, &rejection) {
+		return http.StatusForbidden
+	}
+	return http.StatusBadGateway
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+func hookParams(text string) *mcp.CreateMessageParams {
+	return &mcp.CreateMessageParams{MaxTokens: 100, Messages: []*mcp.SamplingMessage{{Role: "user", Content: &mcp.TextContent{Text: text}}}}
+}
+
+func TestWebhookHooks(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer policy" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var req hookRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Stage != "pre_sample" || req.Endpoint != "/api/chat" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		text := extractTextContent(req.Params.Messages[0].Content)
+		switch {
+		case strings.Contains(text, "weapons"):
+			json.NewEncoder(w).Encode(hookResponse{Action: "reject", Message: "topic not allowed"})
+		case strings.Contains(text, "rewrite"):
+			req.Params.SystemPrompt = "Be brief."
+			json.NewEncoder(w).Encode(hookResponse{Action: "modify", Params: req.Params})
+		}
+	}))
+	defer srv.Close()
+	h, err := newHooks(hooksConfig{PreSample: []hookConfig{{Name: "topics", URL: srv.URL, Headers: map[string]string{"Authorization": "Bearer policy"}}}}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	params := hookParams("hello")
+	if err := h.preSample(context.Background(), &hookRequest{Endpoint: "/api/chat", Params: params}); err != nil || params.SystemPrompt != "" {
+		t.Errorf("allow: err %v, params %+v", err, params)
+	}
+	params = hookParams("please rewrite")
+	if err := h.preSample(context.Background(), &hookRequest{Endpoint: "/api/chat", Params: params}); err != nil || params.SystemPrompt != "Be brief." || params.MaxTokens != 100 {
+		t.Errorf("modify: err %v, params %+v", err, params)
+	}
+	err = h.preSample(context.Background(), &hookRequest{Endpoint: "/api/chat", Params: hookParams("weapons")})
+	var rejection *hookRejection
+	if !errors.As(err, &rejection) || rejection.message != "topic not allowed" {
+		t.Errorf("reject: got %v", err)
+	}
+}
+
+func TestHookFailureModes(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	for _, failOpen := range []bool{true, false} {
+		h, err := newHooks(hooksConfig{PreSample: []hookConfig{{Name: "slow", URL: srv.URL, Timeout: "50ms", FailOpen: failOpen}}}, logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now()
+		err = h.preSample(context.Background(), &hookRequest{Params: hookParams("hi")})
+		if time.Since(start) > 5*time.Second {
+			t.Error("the timeout was not applied")
+		}
+		if failOpen && err != nil {
+			t.Errorf("fail-open hook: unexpected error %v", err)
+		}
+		var rejection *hookRejection
+		if !failOpen && (err == nil || errors.As(err, &rejection)) {
+			t.Errorf("fail-closed hook: got %v, want a failure", err)
+		}
+	}
+
+	for _, cfg := range []hookConfig{
+		{Name: "both", Command: []string{"true"}, URL: "http://localhost"},
+		{Name: "neither"},
+		{Name: "timeout", URL: "http://localhost", Timeout: "soon"},
+	} {
+		if _, err := newHooks(hooksConfig{PostSample: []hookConfig{cfg}}, logger); err == nil {
+			t.Errorf("hook %s: expected a config error", cfg.Name)
+		}
+	}
+}
+
+func TestCommandHookDisclaimer(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	// The stub checks it was given the result and replaces it with a
+	// disclaimed version.
+	script := filepath.Join(t.TempDir(), "disclaimer.sh")
+	writeFile(t, script, []byte(`#!/bin/sh
+grep -q '"stage":"post_sample"' || exit 1
+echo '{"action":"modify","result":{"role":"assistant","model":"m","content":{"type":"text","text":"The answer is 42. (AI generated)"}}}'
+`))
+	if err := os.Chmod(script, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	h, err := newHooks(hooksConfig{PostSample: []hookConfig{{Name: "disclaimer", Command: []string{script}}}}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newSessionHolder()
+	s.set(&mockSession{id: "s1", createMessageFunc: func(ctx context.Context, params *mcp.CreateMessageParams) (*mcp.CreateMessageResult, error) {
+		return &mcp.CreateMessageResult{Content: &mcp.TextContent{Text: "The answer is 42."}}, nil
+	}})
+	b := testBridge(s, logger)
+	b.hooks = h
+	w := httptest.NewRecorder()
+	handleGenerate(b)(w, httptest.NewRequest(http.MethodPost, "/api/generate", strings.NewReader(`{"model":"llama3","prompt":"question","stream":false}`)))
+	var resp GenerateResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Response != "The answer is 42. (AI generated)" {
+		t.Errorf("response = %q", resp.Response)
+	}
+
+	// A failing fail-closed command stops the request with 502.
+	b.hooks, _ = newHooks(hooksConfig{PostSample: []hookConfig{{Name: "broken", Command: []string{"false"}}}}, logger)
+	w = httptest.NewRecorder()
+	handleGenerate(b)(w, httptest.NewRequest(http.MethodPost, "/api/generate", strings.NewReader(`{"model":"llama3","prompt":"question","stream":false}`)))
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("broken hook: got %d, want 502", w.Code)
+	}
+}
+
+func TestHandleChatHookRejection(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"action":"reject","message":"no"}`)
+	}))
+	defer srv.Close()
+	s := newSessionHolder()
+	called := false
+	s.set(&mockSession{id: "s1", createMessageFunc: func(ctx context.Context, params *mcp.CreateMessageParams) (*mcp.CreateMessageResult, error) {
+		called = true
+		return &mcp.CreateMessageResult{}, nil
+	}})
+	b := testBridge(s, logger)
+	b.hooks, _ = newHooks(hooksConfig{PreSample: []hookConfig{{Name: "policy", URL: srv.URL}}}, logger)
+	w := httptest.NewRecorder()
+	handleChat(b)(w, httptest.NewRequest(http.MethodPost, "/api/chat", strings.NewReader(`{"model":"llama3","messages":[{"role":"user","content":"hi"}]}`)))
+	if w.Code != http.StatusForbidden || called {
+		t.Errorf("got %d, sampled %v; want 403 without sampling", w.Code, called)
+	}
+	if !strings.Contains(w.Body.String(), "rejected by policy hook policy: no") {
+		t.Errorf("unexpected body %s", w.Body)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var b64 = base64.RawURLEncoding
+
+// signJWT returns a compact JWS over claims, signed with key.
+func signJWT(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]any) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := b64.EncodeToString(header) + "." + b64.EncodeToString(payload)
+	var sig []byte
+	var err error
+	switch k := key.(type) {
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(k, []byte(signed))
+	case *ecdsa.PrivateKey:
+		digest := sha256.Sum256([]byte(signed))
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	default:
+		digest := sha256.Sum256([]byte(signed))
+		sig, err = key.Sign(rand.Reader, digest[:], crypto.SHA256)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return signed + "." + b64.EncodeToString(sig)
+}
+
+type testJWKS struct {
+	rsa *rsa.PrivateKey
+	ec  *ecdsa.PrivateKey
+	ed  ed25519.PrivateKey
+}
+
+// writeTestJWKS generates one key of each supported type and writes their
+// public halves to a JWKS file.
+func writeTestJWKS(t *testing.T) (*testJWKS, string) {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := map[string]any{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa", "alg": "RS256", "n": b64.EncodeToString(rsaKey.N.Bytes()), "e": b64.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64.EncodeToString(ecKey.X.FillBytes(make([]byte, 32))), "y": b64.EncodeToString(ecKey.Y.FillBytes(make([]byte, 32)))},
+		{"kty": "OKP", "kid": "ed", "crv": "Ed25519", "x": b64.EncodeToString(edKey.Public().(ed25519.PublicKey))},
+		{"kty": "RSA", "use": "enc", "n": "ignored", "e": "AQAB"},
+	}}
+	data, _ := json.Marshal(doc)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return &testJWKS{rsa: rsaKey, ec: ecKey, ed: edKey}, path
+}
+
+func TestJWTVerifier(t *testing.T) {
+	keys, path := writeTestJWKS(t)
+	v, err := loadJWKS(path, "https://issuer.example", "https://mcp.example/mcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1_700_000_000, 0)
+	v.now = func() time.Time { return now }
+
+	valid := func() map[string]any {
+		return map[string]any{
+			"iss":   "https://issuer.example",
+			"sub":   "host-1",
+			"aud":   []string{"other", "https://mcp.example/mcp"},
+			"exp":   now.Add(time.Hour).Unix(),
+			"scope": "mcp:sample mcp:read",
+		}
+	}
+	with := func(k string, val any) map[string]any {
+		c := valid()
+		if val == nil {
+			delete(c, k)
+		} else {
+			c[k] = val
+		}
+		return c
+	}
+
+	for _, tt := range []struct {
+		alg, kid string
+		key      crypto.Signer
+	}{
+		{"RS256", "rsa", keys.rsa},
+		{"ES256", "ec", keys.ec},
+		{"EdDSA", "ed", keys.ed},
+		{"EdDSA", "", keys.ed},
+	} {
+		claims, err := v.verify(signJWT(t, tt.alg, tt.kid, tt.key, valid()))
+		if err != nil {
+			t.Errorf("%s/%q: %v", tt.alg, tt.kid, err)
+			continue
+		}
+		if claims.Subject != "host-1" || strings.Join(claims.scopes(), ",") != "mcp:sample,mcp:read" {
+			t.Errorf("%s: unexpected claims %+v", tt.alg, claims)
+		}
+	}
+
+	rejected := map[string]string{
+		"expired":      signJWT(t, "RS256", "rsa", keys.rsa, with("exp", now.Add(-time.Hour).Unix())),
+		"no expiry":    signJWT(t, "RS256", "rsa", keys.rsa, with("exp", nil)),
+		"not before":   signJWT(t, "RS256", "rsa", keys.rsa, with("nbf", now.Add(time.Hour).Unix())),
+		"issuer":       signJWT(t, "RS256", "rsa", keys.rsa, with("iss", "https://evil.example")),
+		"audience":     signJWT(t, "RS256", "rsa", keys.rsa, with("aud", "https://other.example")),
+		"wrong kid":    signJWT(t, "RS256", "ec", keys.rsa, valid()),
+		"alg mismatch": signJWT(t, "ES256", "rsa", keys.ec, valid()),
+		"malformed":    "not-a-jwt",
+	}
+	// An unsigned token must never verify.
+	header := b64.EncodeToString([]byte(`{"alg":"none"}`))
+	payload, _ := json.Marshal(valid())
+	rejected["alg none"] = header + "." + b64.EncodeToString(payload) + "."
+	// Nor may the claims be altered after signing.
+	parts := strings.Split(signJWT(t, "EdDSA", "ed", keys.ed, valid()), ".")
+	payload, _ = json.Marshal(with("sub", "admin"))
+	rejected["tampered"] = parts[0] + "." + b64.EncodeToString(payload) + "." + parts[2]
+
+	for name, token := range rejected {
+		if _, err := v.verify(token); err == nil {
+			t.Errorf("%s: expected token to be rejected", name)
+		}
+	}
+}
+
+func TestLoadJWKSErrors(t *testing.T) {
+	dir := t.TempDir()
+	for name, data := range map[string]string{
+		"empty.json":   `{"keys": []}`,
+		"invalid.json": `{"keys": [{"kty": "EC", "crv": "P-256", "x": "AQ", "y": "AQ"}]}`,
+		"unknown.json": `{"keys": [{"kty": "oct", "k": "c2VjcmV0"}]}`,
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadJWKS(path, "", "https://mcp.example/mcp"); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	// Without an audience, tokens issued for other resources would pass.
+	path := filepath.Join(dir, "jwks.json")
+	if err := os.WriteFile(path, []byte(`{"keys": [{"kty": "OKP", "crv": "Ed25519", "x": "11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"}]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadJWKS(path, "https://issuer.example", ""); err == nil {
+		t.Error("expected an error without an audience")
+	}
+}
@@ -0,0 +1,539 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// limitSpec sets the limits of one scope. Zero disables a limit.
+type limitSpec struct {
+	RequestsPerMinute int   `json:"requests_per_minute,omitempty"`
+	TokensPerMinute   int   `json:"tokens_per_minute,omitempty"`
+	DailyTokens       int64 `json:"daily_tokens,omitempty"`
+	MonthlyTokens     int64 `json:"monthly_tokens,omitempty"`
+}
+
+func (s limitSpec) empty() bool {
+	return s == limitSpec{}
+}
+
+// override returns s with the limits o sets replacing its own.
+func (s limitSpec) override(o limitSpec) limitSpec {
+	if o.RequestsPerMinute > 0 {
+		s.RequestsPerMinute = o.RequestsPerMinute
+	}
+	if o.TokensPerMinute > 0 {
+		s.TokensPerMinute = o.TokensPerMinute
+	}
+	if o.DailyTokens > 0 {
+		s.DailyTokens = o.DailyTokens
+	}
+	if o.MonthlyTokens > 0 {
+		s.MonthlyTokens = o.MonthlyTokens
+	}
+	return s
+}
+
+// limitConfig is the -limits file. Key applies to every API key, with
+// any limits the key's entry sets taking precedence, IP to every client address, and Model
+// to every model unless Models names it. Playground applies to each admin
+// key's dashboard playground requests, in place of Key.
+type limitConfig struct {
+	Key        limitSpec            `json:"key"`
+	IP         limitSpec            `json:"ip"`
+	Model      limitSpec            `json:"model"`
+	Models     map[string]limitSpec `json:"models,omitempty"`
+	Playground limitSpec            `json:"playground"`
+}
+
+func loadLimitConfig(path string) (limitConfig, error) {
+	var cfg limitConfig
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, fmt.Errorf("reading limits: %w", err)
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("parsing limits %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// maxQuotas bounds the per-scope state. Beyond it, scopes whose buckets
+// have refilled completely are dropped, and if that is not enough, the
+// least recently used ones, which start afresh when they return.
+const maxQuotas = 10000
+
+// budgetSaveInterval is how often changed token budgets are written to
+// the -budget-store file.
+const budgetSaveInterval = 10 * time.Second
+
+// quota is the live state of one scope, such as "key:ci" or "ip:10.0.0.7".
+type quota struct {
+	scope string
+	// label names the client of key and playground scopes, whose scope
+	// names hold only the key's ID.
+	label    string
+	spec     limitSpec
+	requests *tokenBucket
+	tokens   *tokenBucket
+	used     time.Time
+}
+
+// rateLimiter enforces request and token rates and token budgets on the
+// sampling endpoints, per API key, client IP and model. A nil rateLimiter
+// admits everything.
+type rateLimiter struct {
+	mu      sync.Mutex
+	saveMu  sync.Mutex // serializes writing the budget store
+	config  limitConfig
+	quotas  map[string]*quota
+	budgets *budgetStore
+	logger  *slog.Logger
+	now     func() time.Time
+}
+
+func newRateLimiter(cfg limitConfig, budgets *budgetStore, logger *slog.Logger) *rateLimiter {
+	return &rateLimiter{
+		config:  cfg,
+		quotas:  make(map[string]*quota),
+		budgets: budgets,
+		logger:  logger,
+		now:     time.Now,
+	}
+}
+
+// errRateLimited is audited for requests admit refused. The response and
+// the server log name the limit.
+var errRateLimited = errors.New("rate limit or token budget exceeded")
+
+// admission is an admitted request. Its token usage must be reported with
+// done once the response is known.
+type admission struct {
+	l        *rateLimiter
+	quotas   []*quota
+	estimate int
+}
+
+// clientIP returns the address part of the request's remote address, or
+// "" for Unix socket clients.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return ""
+	}
+	return host
+}
+
+// scopes returns the scopes a request is subject to, with their limits.
+// Clients are scoped by their key's ID rather than their label, which
+// several keys may share.
+func (l *rateLimiter) scopes(r *http.Request, model string) map[string]limitSpec {
+	scopes := make(map[string]limitSpec)
+	if c := clientFromContext(r.Context()); c != nil && c.playground {
+		scopes["playground:"+c.id] = l.config.Playground
+	} else if c != nil {
+		spec := l.config.Key
+		if c.limits != nil {
+			spec = spec.override(*c.limits)
+		}
+		scopes["key:"+c.id] = spec
+	}
+	if ip := clientIP(r); ip != "" {
+		scopes["ip:"+ip] = l.config.IP
+	}
+	spec, ok := l.config.Models[model]
+	if !ok {
+		spec = l.config.Model
+	}
+	scopes["model:"+model] = spec
+	return scopes
+}
+
+// isClientScope reports whether scope belongs to an API key.
+func isClientScope(scope string) bool {
+	return strings.HasPrefix(scope, "key:") || strings.HasPrefix(scope, "playground:")
+}
+
+func (l *rateLimiter) quotaLocked(scope string, spec limitSpec, now time.Time) *quota {
+	q := l.quotas[scope]
+	if q != nil && q.spec == spec {
+		q.used = now
+		return q
+	}
+	if q == nil && len(l.quotas) >= maxQuotas {
+		l.pruneLocked(now)
+	}
+	q = &quota{scope: scope, spec: spec, used: now}
+	if spec.RequestsPerMinute > 0 {
+		q.requests = newTokenBucket(float64(spec.RequestsPerMinute))
+	}
+	if spec.TokensPerMinute > 0 {
+		q.tokens = newTokenBucket(float64(spec.TokensPerMinute))
+	}
+	l.quotas[scope] = q
+	return q
+}
+
+// pruneLocked drops scopes that are back at full capacity, since they
+// carry no state worth keeping. If more than a tenth of maxQuotas are
+// still busy, as when many clients arrive at once, the least recently
+// used are dropped until that much room is free.
+func (l *rateLimiter) pruneLocked(now time.Time) {
+	for scope, q := range l.quotas {
+		if (q.requests == nil || q.requests.remaining(now) >= q.requests.limit()) &&
+			(q.tokens == nil || q.tokens.remaining(now) >= q.tokens.limit()) {
+			delete(l.quotas, scope)
+		}
+	}
+	if excess := len(l.quotas) - maxQuotas*9/10; excess > 0 {
+		lru := slices.SortedFunc(maps.Values(l.quotas), func(a, b *quota) int { return a.used.Compare(b.used) })
+		for _, q := range lru[:excess] {
+			delete(l.quotas, q.scope)
+		}
+	}
+}
+
+// admit checks every scope of the request against its limits. If all
+// admit the request, it takes one request and the estimated prompt tokens
+// from each, sets the remaining-quota headers and returns the admission.
+// Otherwise it writes a 429 response with Retry-After and returns nil.
+func (l *rateLimiter) admit(w http.ResponseWriter, r *http.Request, model string, estimate int) *admission {
+	if l == nil {
+		return &admission{}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+
+	a := &admission{l: l, estimate: estimate}
+	label := clientLabel(r.Context())
+	var wait time.Duration
+	var reason string
+	for scope, spec := range l.scopes(r, model) {
+		if spec.empty() {
+			continue
+		}
+		q := l.quotaLocked(scope, spec, now)
+		name := scope
+		if isClientScope(scope) {
+			q.label = label
+			name = fmt.Sprintf("%s (%s)", scope, label)
+		}
+		a.quotas = append(a.quotas, q)
+		if q.requests != nil {
+			if d := q.requests.wait(1, now); d > wait {
+				wait, reason = d, fmt.Sprintf("request rate limit exceeded for %s", name)
+			}
+		}
+		if q.tokens != nil {
+			if d := q.tokens.wait(float64(estimate), now); d > wait {
+				wait, reason = d, fmt.Sprintf("token rate limit exceeded for %s", name)
+			}
+		}
+		if d, what := l.budgets.exhausted(scope, spec, now); d > wait {
+			wait, reason = d, fmt.Sprintf("%s token budget exhausted for %s", what, name)
+		}
+	}
+	if wait > 0 {
+		l.logger.Warn("Rate limited", "reason", reason, "retry_after", wait)
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		writeError(w, l.logger, http.StatusTooManyRequests, reason)
+		return nil
+	}
+	for _, q := range a.quotas {
+		if q.requests != nil {
+			q.requests.take(1, now)
+		}
+		if q.tokens != nil {
+			q.tokens.charge(float64(estimate), now)
+		}
+	}
+	l.setHeadersLocked(w.Header(), a.quotas, now)
+	return a
+}
+
+// setHeadersLocked reports the tightest remaining quota across scopes.
+func (l *rateLimiter) setHeadersLocked(h http.Header, quotas []*quota, now time.Time) {
+	type bound struct {
+		limit, remaining int64
+		set              bool
+	}
+	var requests, tokens, daily, monthly bound
+	tighten := func(b *bound, limit, remaining int64) {
+		if !b.set || remaining < b.remaining {
+			*b = bound{limit: limit, remaining: max(0, remaining), set: true}
+		}
+	}
+	for _, q := range quotas {
+		if q.requests != nil {
+			tighten(&requests, int64(q.requests.limit()), int64(q.requests.remaining(now)))
+		}
+		if q.tokens != nil {
+			tighten(&tokens, int64(q.tokens.limit()), int64(q.tokens.remaining(now)))
+		}
+		day, month := l.budgets.used(q.scope, now)
+		if q.spec.DailyTokens > 0 {
+			tighten(&daily, q.spec.DailyTokens, q.spec.DailyTokens-day)
+		}
+		if q.spec.MonthlyTokens > 0 {
+			tighten(&monthly, q.spec.MonthlyTokens, q.spec.MonthlyTokens-month)
+		}
+	}
+	for _, hdr := range []struct {
+		name string
+		b    bound
+	}{
+		{"Requests", requests},
+		{"Tokens", tokens},
+		{"Tokens-Day", daily},
+		{"Tokens-Month", monthly},
+	} {
+		if hdr.b.set {
+			h.Set("X-RateLimit-Limit-"+hdr.name, strconv.FormatInt(hdr.b.limit, 10))
+			h.Set("X-RateLimit-Remaining-"+hdr.name, strconv.FormatInt(hdr.b.remaining, 10))
+		}
+	}
+}
+
+// done records the tokens a request actually used. The prompt estimate
+// was charged on admission, so only the difference is charged now. The
+// budget store is written later by saveBudgets.
+func (a *admission) done(promptTokens, evalTokens int) {
+	if a == nil || a.l == nil {
+		return
+	}
+	l := a.l
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	total := promptTokens + evalTokens
+	for _, q := range a.quotas {
+		if q.tokens != nil {
+			q.tokens.charge(float64(total-a.estimate), now)
+		}
+		if q.spec.DailyTokens > 0 || q.spec.MonthlyTokens > 0 {
+			l.budgets.add(q.scope, int64(total), now)
+		}
+	}
+}
+
+// saveBudgets writes the budget store if it changed. Only the snapshot is
+// taken under the lock, so admissions never wait for the disk.
+func (l *rateLimiter) saveBudgets() {
+	if l == nil {
+		return
+	}
+	l.saveMu.Lock()
+	defer l.saveMu.Unlock()
+	l.mu.Lock()
+	data, err := l.budgets.snapshot(l.now())
+	l.mu.Unlock()
+	if err == nil && data != nil {
+		err = l.budgets.write(data)
+	}
+	if err != nil {
+		l.mu.Lock()
+		l.budgets.dirty = true
+		l.mu.Unlock()
+		l.logger.Error("Failed to save token budgets", "error", err)
+	}
+}
+
+// saveBudgetsEvery calls saveBudgets every interval until ctx is done.
+// main saves once more after the API has shut down.
+func (l *rateLimiter) saveBudgetsEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			l.saveBudgets()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// scopeState is the live state of one scope, as reported by the admin API.
+type scopeState struct {
+	Scope             string    `json:"scope"`
+	Label             string    `json:"label,omitempty"`
+	Limits            limitSpec `json:"limits"`
+	RequestsRemaining *int      `json:"requests_remaining,omitempty"`
+	TokensRemaining   *int      `json:"tokens_remaining,omitempty"`
+	DayTokens         int64     `json:"day_tokens"`
+	MonthTokens       int64     `json:"month_tokens"`
+}
+
+// limiterState is the limiter's configuration and the scopes it tracks.
+type limiterState struct {
+	Config limitConfig  `json:"config"`
+	Scopes []scopeState `json:"scopes"`
+}
+
+// state returns a snapshot of the limiter ordered by scope. Scopes pruned
+// after going idle are not included.
+func (l *rateLimiter) state() limiterState {
+	if l == nil {
+		return limiterState{Scopes: []scopeState{}}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	st := limiterState{Config: l.config, Scopes: []scopeState{}}
+	for _, scope := range slices.Sorted(maps.Keys(l.quotas)) {
+		q := l.quotas[scope]
+		ss := scopeState{Scope: scope, Label: q.label, Limits: q.spec}
+		if q.requests != nil {
+			n := q.requests.remaining(now)
+			ss.RequestsRemaining = &n
+		}
+		if q.tokens != nil {
+			n := q.tokens.remaining(now)
+			ss.TokensRemaining = &n
+		}
+		ss.DayTokens, ss.MonthTokens = l.budgets.used(scope, now)
+		st.Scopes = append(st.Scopes, ss)
+	}
+	return st
+}
+
+// budgetUsage is the token usage of one scope in the current day and
+// month (UTC).
+type budgetUsage struct {
+	Day         string `json:"day"`
+	DayTokens   int64  `json:"day_tokens"`
+	Month       string `json:"month"`
+	MonthTokens int64  `json:"month_tokens"`
+}
+
+// budgetStore tracks daily and monthly token usage per scope, persisted
+// to a JSON file so that budgets survive restarts. Without a path, usage
+// is kept in memory only. Callers serialize access, apart from write.
+type budgetStore struct {
+	path  string
+	usage map[string]*budgetUsage
+	dirty bool
+}
+
+func loadBudgetStore(path string) (*budgetStore, error) {
+	s := &budgetStore{path: path, usage: make(map[string]*budgetUsage)}
+	if path == "" {
+		return s, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading budget store: %w", err)
+	}
+	if err := json.Unmarshal(data, &s.usage); err != nil {
+		return nil, fmt.Errorf("parsing budget store %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// current returns the scope's usage, reset if the day or month rolled over.
+func (s *budgetStore) current(scope string, now time.Time) *budgetUsage {
+	now = now.UTC()
+	day, month := now.Format(time.DateOnly), now.Format("2006-01")
+	u := s.usage[scope]
+	if u == nil {
+		u = &budgetUsage{}
+		s.usage[scope] = u
+	}
+	if u.Day != day {
+		u.Day, u.DayTokens = day, 0
+	}
+	if u.Month != month {
+		u.Month, u.MonthTokens = month, 0
+	}
+	return u
+}
+
+func (s *budgetStore) used(scope string, now time.Time) (day, month int64) {
+	if s.usage[scope] == nil {
+		return 0, 0
+	}
+	u := s.current(scope, now)
+	return u.DayTokens, u.MonthTokens
+}
+
+func (s *budgetStore) add(scope string, tokens int64, now time.Time) {
+	u := s.current(scope, now)
+	u.DayTokens += tokens
+	u.MonthTokens += tokens
+	s.dirty = true
+}
+
+// exhausted reports whether a budget of spec is used up and, if so, how
+// long until it resets and which budget it is.
+func (s *budgetStore) exhausted(scope string, spec limitSpec, now time.Time) (time.Duration, string) {
+	day, month := s.used(scope, now)
+	utc := now.UTC()
+	if spec.MonthlyTokens > 0 && month >= spec.MonthlyTokens {
+		next := time.Date(utc.Year(), utc.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		return next.Sub(utc), "monthly"
+	}
+	if spec.DailyTokens > 0 && day >= spec.DailyTokens {
+		next := time.Date(utc.Year(), utc.Month(), utc.Day()+1, 0, 0, 0, 0, time.UTC)
+		return next.Sub(utc), "daily"
+	}
+	return 0, ""
+}
+
+// snapshot encodes the usage if it changed, for write, and marks it
+// clean. Scopes without usage this month are dropped first. It returns nil
+// without a path or changes.
+func (s *budgetStore) snapshot(now time.Time) ([]byte, error) {
+	if s.path == "" || !s.dirty {
+		return nil, nil
+	}
+	month := now.UTC().Format("2006-01")
+	for scope, u := range s.usage {
+		if u.Month != month {
+			delete(s.usage, scope)
+		}
+	}
+	data, err := json.MarshalIndent(s.usage, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	s.dirty = false
+	return append(data, '\n'), nil
+}
+
+// write replaces the store file with data atomically.
+func (s *budgetStore) write(data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".budgets-*.json")
+	if err != nil {
+		return fmt.Errorf("writing budget store: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing budget store: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("writing budget store: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("writing budget store: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func limitRequest(client *clientIdentity, ip string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/api/chat", nil)
+	r.RemoteAddr = ip + ":5555"
+	if client != nil {
+		r = r.WithContext(withClient(r.Context(), client))
+	}
+	return r
+}
+
+func TestRateLimiterRequests(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	budgets, _ := loadBudgetStore("")
+	l := newRateLimiter(limitConfig{
+		Key:    limitSpec{RequestsPerMinute: 2},
+		Models: map[string]limitSpec{"big": {RequestsPerMinute: 1}},
+	}, budgets, logger)
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	l.now = func() time.Time { return now }
+	ci := &clientIdentity{Label: "ci", id: "ci-id"}
+
+	for i := range 2 {
+		w := httptest.NewRecorder()
+		if l.admit(w, limitRequest(ci, "10.0.0.1"), "llama3", 10) == nil {
+			t.Fatalf("request %d: unexpectedly limited", i)
+		}
+		if got := w.Header().Get("X-RateLimit-Remaining-Requests"); got != []string{"1", "0"}[i] {
+			t.Errorf("request %d: remaining = %q", i, got)
+		}
+	}
+	w := httptest.NewRecorder()
+	if l.admit(w, limitRequest(ci, "10.0.0.1"), "llama3", 10) != nil {
+		t.Fatal("expected the third request to be limited")
+	}
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "30" {
+		t.Errorf("got %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	var body map[string]string
+	json.NewDecoder(w.Body).Decode(&body)
+	if !strings.Contains(body["error"], "key:ci-id (ci)") {
+		t.Errorf("unexpected error body %v", body)
+	}
+
+	// Other keys are unaffected, even under the same label, but a model
+	// limit applies to everyone.
+	other := &clientIdentity{Label: "ci", id: "other-id"}
+	if l.admit(httptest.NewRecorder(), limitRequest(other, "10.0.0.2"), "big", 10) == nil {
+		t.Error("expected another key to be admitted")
+	}
+	if l.admit(httptest.NewRecorder(), limitRequest(nil, "10.0.0.3"), "big", 10) != nil {
+		t.Error("expected the per-model limit to apply across clients")
+	}
+}
+
+func TestKeyLimitsOverride(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	l := newRateLimiter(limitConfig{Key: limitSpec{RequestsPerMinute: 5, DailyTokens: 1000}}, &budgetStore{}, logger)
+	l.now = func() time.Time { return time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC) }
+	slow := &clientIdentity{Label: "slow", id: "slow-id", limits: &limitSpec{RequestsPerMinute: 1}}
+
+	// The key's request rate replaces the default, and the defaults it
+	// does not set still apply.
+	if l.admit(httptest.NewRecorder(), limitRequest(slow, "10.0.0.1"), "llama3", 1) == nil {
+		t.Fatal("expected the first request to be admitted")
+	}
+	if l.admit(httptest.NewRecorder(), limitRequest(slow, "10.0.0.1"), "llama3", 1) != nil {
+		t.Error("expected the key's own request rate to apply")
+	}
+	if got := l.quotas["key:slow-id"].spec; got != (limitSpec{RequestsPerMinute: 1, DailyTokens: 1000}) {
+		t.Errorf("key limits = %+v, want the default budget kept", got)
+	}
+}
+
+func TestRateLimiterTokens(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	budgets, _ := loadBudgetStore("")
+	l := newRateLimiter(limitConfig{IP: limitSpec{TokensPerMinute: 600}}, budgets, logger)
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	l.now = func() time.Time { return now }
+
+	a := l.admit(httptest.NewRecorder(), limitRequest(nil, "10.0.0.1"), "llama3", 100)
+	if a == nil {
+		t.Fatal("expected admission")
+	}
+	a.done(100, 500)
+	w := httptest.NewRecorder()
+	if l.admit(w, limitRequest(nil, "10.0.0.1"), "llama3", 100) != nil {
+		t.Fatal("expected the token rate to be exhausted")
+	}
+	if w.Header().Get("Retry-After") != "10" {
+		t.Errorf("Retry-After = %q, want 10", w.Header().Get("Retry-After"))
+	}
+	if l.admit(httptest.NewRecorder(), limitRequest(nil, "10.0.0.2"), "llama3", 100) == nil {
+		t.Error("expected another client IP to be admitted")
+	}
+	now = now.Add(10 * time.Second)
+	if l.admit(httptest.NewRecorder(), limitRequest(nil, "10.0.0.1"), "llama3", 100) == nil {
+		t.Error("expected admission after the bucket refilled")
+	}
+}
+
+func TestQuotaEviction(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	l := newRateLimiter(limitConfig{IP: limitSpec{RequestsPerMinute: 1}}, &budgetStore{}, logger)
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	l.now = func() time.Time { return now }
+
+	// Every client keeps its bucket busy, so none can be pruned as idle.
+	for i := range maxQuotas + 100 {
+		now = now.Add(time.Microsecond)
+		l.admit(httptest.NewRecorder(), limitRequest(nil, fmt.Sprintf("10.%d.%d.%d", i>>16, i>>8&0xff, i&0xff)), "llama3", 1)
+		if i == maxQuotas/2 {
+			// The first client returns, and so is not the least recent.
+			l.admit(httptest.NewRecorder(), limitRequest(nil, "10.0.0.0"), "llama3", 1)
+		}
+	}
+	if n := len(l.quotas); n > maxQuotas {
+		t.Errorf("%d quotas kept, want at most %d", n, maxQuotas)
+	}
+	if l.quotas["ip:10.0.0.0"] == nil || l.quotas["ip:10.0.0.1"] != nil {
+		t.Error("expected the least recently used scopes to be evicted")
+	}
+}
+
+func TestTokenBudgets(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	path := filepath.Join(t.TempDir(), "budgets.json")
+	budgets, err := loadBudgetStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := limitConfig{Key: limitSpec{DailyTokens: 1000, MonthlyTokens: 1500}}
+	l := newRateLimiter(cfg, budgets, logger)
+	now := time.Date(2026, 3, 30, 18, 0, 0, 0, time.UTC)
+	l.now = func() time.Time { return now }
+	ci := &clientIdentity{Label: "ci", id: "ci-id"}
+	// A key's own limits take precedence over the defaults.
+	capped := &clientIdentity{Label: "capped", id: "capped-id", limits: &limitSpec{DailyTokens: 10}}
+
+	w := httptest.NewRecorder()
+	a := l.admit(w, limitRequest(ci, "10.0.0.1"), "llama3", 100)
+	if w.Header().Get("X-RateLimit-Remaining-Tokens-Day") != "1000" || w.Header().Get("X-RateLimit-Limit-Tokens-Month") != "1500" {
+		t.Errorf("unexpected budget headers: %v", w.Header())
+	}
+	a.done(400, 700)
+
+	w = httptest.NewRecorder()
+	if l.admit(w, limitRequest(ci, "10.0.0.1"), "llama3", 100) != nil {
+		t.Fatal("expected the daily budget to be exhausted")
+	}
+	if w.Header().Get("Retry-After") != "21600" {
+		t.Errorf("Retry-After = %q, want 6h until midnight UTC", w.Header().Get("Retry-After"))
+	}
+	l.admit(httptest.NewRecorder(), limitRequest(capped, "10.0.0.1"), "llama3", 1).done(5, 5)
+	if l.admit(httptest.NewRecorder(), limitRequest(capped, "10.0.0.1"), "llama3", 1) != nil {
+		t.Error("expected the key's own budget to apply")
+	}
+
+	// Requests do not write the store; saveBudgets does, as main does
+	// periodically and at shutdown.
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("budget store written by a request: %v", err)
+	}
+	l.saveBudgets()
+
+	// Usage survives a restart.
+	reloaded, err := loadBudgetStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if day, month := reloaded.used("key:ci-id", now); day != 1100 || month != 1100 {
+		t.Errorf("reloaded usage = %d/%d, want 1100/1100", day, month)
+	}
+	l = newRateLimiter(cfg, reloaded, logger)
+	l.now = func() time.Time { return now }
+	if l.admit(httptest.NewRecorder(), limitRequest(ci, "10.0.0.1"), "llama3", 100) != nil {
+		t.Fatal("expected the persisted budget to still be exhausted")
+	}
+
+	// The next day resets the daily budget, but not the monthly one.
+	now = now.Add(7 * time.Hour)
+	l.now = func() time.Time { return now }
+	a = l.admit(httptest.NewRecorder(), limitRequest(ci, "10.0.0.1"), "llama3", 100)
+	if a == nil {
+		t.Fatal("expected a new day to reset the daily budget")
+	}
+	a.done(100, 400)
+	w = httptest.NewRecorder()
+	if l.admit(w, limitRequest(ci, "10.0.0.1"), "llama3", 100) != nil {
+		t.Fatal("expected the monthly budget to be exhausted")
+	}
+	if !strings.Contains(w.Body.String(), "monthly") {
+		t.Errorf("unexpected error body %s", w.Body)
+	}
+	now = time.Date(2026, 4, 1, 8, 0, 0, 0, time.UTC)
+	if a := l.admit(httptest.NewRecorder(), limitRequest(ci, "10.0.0.1"), "llama3", 100); a == nil {
+		t.Error("expected a new month to reset the monthly budget")
+	}
+}
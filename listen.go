@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// unixPrefix marks a listen address as a Unix domain socket path.
+const unixPrefix = "unix:"
+
+// defaultSocketMode is the permission of Unix sockets created for the
+// listeners: read/write for the owner and group.
+const defaultSocketMode = 0660
+
+// ollamaHostAddr interprets an OLLAMA_HOST value the way Ollama does. The
+// scheme, if any, only picks the default port (80 for http://, 443 for
+// https://, 11434 otherwise), and a path is ignored. A bare host listens on
+// the default port, and an invalid port falls back to 127.0.0.1:11434.
+func ollamaHostAddr(s string) string {
+	s = strings.Trim(strings.TrimSpace(s), "\"'")
+	defaultPort := "11434"
+	scheme, hostport, ok := strings.Cut(s, "://")
+	switch {
+	case !ok:
+		hostport = s
+	case scheme == "http":
+		defaultPort = "80"
+	case scheme == "https":
+		defaultPort = "443"
+	}
+	hostport, _, _ = strings.Cut(hostport, "/")
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host, port = "127.0.0.1", defaultPort
+		if ip := net.ParseIP(strings.Trim(hostport, "[]")); ip != nil {
+			host = ip.String()
+		} else if hostport != "" {
+			host = hostport
+		}
+	}
+	if n, err := strconv.ParseInt(port, 10, 32); err != nil || n < 0 || n > 65535 {
+		return "127.0.0.1:11434"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// listenAddress picks the address of a listener. An explicit address wins,
+// then an explicitly set port, then the environment value (OLLAMA_HOST for
+// the Ollama API), and finally the default port on all interfaces.
+func listenAddress(addr string, port int, portSet bool, env string) string {
+	switch {
+	case addr != "":
+		return addr
+	case portSet:
+		return fmt.Sprintf(":%d", port)
+	case env != "":
+		return ollamaHostAddr(env)
+	default:
+		return fmt.Sprintf(":%d", port)
+	}
+}
+
+// listen opens a listener for addr, which is either a TCP host:port (IPv6
+// hosts in brackets) or "unix:" followed by a socket path. A stale socket
+// left by a previous run is replaced, and the new socket gets mode.
+func listen(addr string, mode fs.FileMode) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, unixPrefix)
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	if path == "" {
+		return nil, errors.New("empty Unix socket path")
+	}
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode().Type() != fs.ModeSocket {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		// Only remove the socket if nothing is accepting on it.
+		if c, err := net.Dial("unix", path); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("%s is in use by another process", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("setting socket permissions: %w", err)
+	}
+	return ln, nil
+}
+
+// parseSocketMode parses an octal permission such as "0660".
+func parseSocketMode(s string) (fs.FileMode, error) {
+	n, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || n > 0o777 {
+		return 0, fmt.Errorf("invalid socket mode %q", s)
+	}
+	return fs.FileMode(n), nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOllamaHostAddr(t *testing.T) {
+	tests := map[string]string{
+		"":                         "127.0.0.1:11434",
+		"1.2.3.4":                  "1.2.3.4:11434",
+		":1234":                    ":1234",
+		"1.2.3.4:1234":             "1.2.3.4:1234",
+		"0.0.0.0":                  "0.0.0.0:11434",
+		"[::]":                     "[::]:11434",
+		"[::]:1234":                "[::]:1234",
+		"::1":                      "[::1]:11434",
+		"example.com":              "example.com:11434",
+		"example.com:1234":         "example.com:1234",
+		"http://1.2.3.4":           "1.2.3.4:80",
+		"https://1.2.3.4":          "1.2.3.4:443",
+		"http://1.2.3.4:4321/path": "1.2.3.4:4321",
+		"  \"0.0.0.0:9000\" ":      "0.0.0.0:9000",
+		"1.2.3.4:99999":            "127.0.0.1:11434",
+	}
+	for in, want := range tests {
+		if got := ollamaHostAddr(in); got != want {
+			t.Errorf("ollamaHostAddr(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestListenAddress(t *testing.T) {
+	tests := []struct {
+		addr    string
+		port    int
+		portSet bool
+		env     string
+		want    string
+	}{
+		{"", 11434, false, "", ":11434"},
+		{"", 11434, false, "0.0.0.0", "0.0.0.0:11434"},
+		{"", 9000, true, "0.0.0.0", ":9000"},
+		{"unix:/tmp/s.sock", 9000, true, "0.0.0.0", "unix:/tmp/s.sock"},
+	}
+	for _, tt := range tests {
+		if got := listenAddress(tt.addr, tt.port, tt.portSet, tt.env); got != tt.want {
+			t.Errorf("listenAddress(%q, %d, %v, %q) = %q, want %q", tt.addr, tt.port, tt.portSet, tt.env, got, tt.want)
+		}
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ollama.sock")
+	ln, err := listen("unix:"+path, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("socket mode = %v, want 0600", fi.Mode().Perm())
+	}
+
+	srv := &http.Server{Handler: http.HandlerFunc(handleHealth)}
+	go srv.Serve(ln)
+	client := &http.Client{Transport: &http.Transport{
+		Dial: func(string, string) (net.Conn, error) { return net.Dial("unix", path) },
+	}}
+	resp, err := client.Get("http://ollama/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected 200 over the socket, got %d", resp.StatusCode)
+	}
+
+	if _, err := listen("unix:"+path, 0600); err == nil {
+		t.Error("expected an error for a socket in use")
+	}
+	srv.Close()
+
+	// A stale socket file left behind by a crash is replaced.
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	ln, err = listen("unix:"+path, 0660)
+	if err != nil {
+		t.Fatalf("expected stale socket to be replaced: %v", err)
+	}
+	ln.Close()
+
+	file := filepath.Join(t.TempDir(), "regular")
+	if err := os.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listen("unix:"+file, 0600); err == nil {
+		t.Error("expected an error for a path that is not a socket")
+	}
+}
+
+func TestParseSocketMode(t *testing.T) {
+	if m, err := parseSocketMode("0660"); err != nil || m != 0660 {
+		t.Errorf("parseSocketMode(0660) = %v, %v", m, err)
+	}
+	for _, s := range []string{"", "rw", "0999", "7777"} {
+		if _, err := parseSocketMode(s); err == nil {
+			t.Errorf("parseSocketMode(%q): expected an error", s)
+		}
+	}
+}
@@ -3,12 +3,16 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log/slog"
+	"maps"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"slices"
 	"strings"
 	"sync"
 	"syscall"
@@ -28,14 +32,31 @@ type SamplingSession interface {
 // sessionHolder provides thread-safe access to MCP client sessions.
 // In stdio mode there is one session; in HTTP mode there may be multiple.
 type sessionHolder struct {
-	mu       sync.RWMutex
-	sessions map[string]SamplingSession
-	latest   SamplingSession
+	mu         sync.RWMutex
+	sessions   map[string]SamplingSession
+	identities map[string]string // session ID -> authenticated MCP identity
+	stats      map[string]*sessionStats
+	latest     SamplingSession
+	pinned     string // session ID preferred over latest, set by the admin API
+	stdio      string // ID of the stdio session, whose end stops the process
+}
+
+// sessionStats is what the admin API reports about a session.
+type sessionStats struct {
+	connectedAt time.Time
+	inFlight    int
+	served      int64
+	lastError   string
+	lastErrorAt time.Time
+	// draining sessions get no new requests and are closed once idle.
+	draining bool
 }
 
 func newSessionHolder() *sessionHolder {
 	return &sessionHolder{
-		sessions: make(map[string]SamplingSession),
+		sessions:   make(map[string]SamplingSession),
+		identities: make(map[string]string),
+		stats:      make(map[string]*sessionStats),
 	}
 }
 
@@ -43,13 +64,44 @@ func (h *sessionHolder) set(session SamplingSession) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 	h.sessions[session.ID()] = session
+	if h.stats[session.ID()] == nil {
+		h.stats[session.ID()] = &sessionStats{connectedAt: time.Now()}
+	}
 	h.latest = session
 }
 
+// setStdio adds the stdio session. samplellama exits when it ends, so the
+// admin API may not close it.
+func (h *sessionHolder) setStdio(session SamplingSession) {
+	h.set(session)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.stdio = session.ID()
+}
+
+// setIdentity records the identity the MCP host authenticated as.
+func (h *sessionHolder) setIdentity(sessionID, identity string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.identities[sessionID] = identity
+}
+
+// identity returns the authenticated identity of a session, or "".
+func (h *sessionHolder) identity(sessionID string) string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.identities[sessionID]
+}
+
 func (h *sessionHolder) remove(sessionID string) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 	delete(h.sessions, sessionID)
+	delete(h.identities, sessionID)
+	delete(h.stats, sessionID)
+	if h.pinned == sessionID {
+		h.pinned = ""
+	}
 	if h.latest != nil && h.latest.ID() == sessionID {
 		h.latest = nil
 		for _, s := range h.sessions {
@@ -59,21 +111,273 @@ func (h *sessionHolder) remove(sessionID string) {
 	}
 }
 
+// count returns the number of connected sessions.
+func (h *sessionHolder) count() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.sessions)
+}
+
+// list returns the connected sessions ordered by ID.
+func (h *sessionHolder) list() []SamplingSession {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	sessions := slices.Collect(maps.Values(h.sessions))
+	slices.SortFunc(sessions, func(a, b SamplingSession) int { return strings.Compare(a.ID(), b.ID()) })
+	return sessions
+}
+
 func (h *sessionHolder) get() SamplingSession {
+	return h.getFor("")
+}
+
+// getFor returns the session that serves a client bound to identity: the
+// pinned session, else the latest, else any other, skipping sessions of
+// other identities and draining sessions. An empty identity matches every
+// session.
+func (h *sessionHolder) getFor(identity string) SamplingSession {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
-	return h.latest
+	usable := func(s SamplingSession) bool {
+		if s == nil {
+			return false
+		}
+		if st := h.stats[s.ID()]; st != nil && st.draining {
+			return false
+		}
+		return identity == "" || h.identities[s.ID()] == identity
+	}
+	if s := h.sessions[h.pinned]; usable(s) {
+		return s
+	}
+	if usable(h.latest) {
+		return h.latest
+	}
+	for _, s := range h.sessions {
+		if usable(s) {
+			return s
+		}
+	}
+	return nil
+}
+
+// createMessage sends a sampling request to session, counting it in the
+// session's stats and recording it in the request's capture, if any. A
+// draining session is closed when its last request completes.
+func (h *sessionHolder) createMessage(ctx context.Context, session SamplingSession, params *mcp.CreateMessageParams) (*mcp.CreateMessageResult, error) {
+	h.mu.Lock()
+	st := h.stats[session.ID()]
+	if st == nil {
+		st = &sessionStats{connectedAt: time.Now()}
+	}
+	st.inFlight++
+	h.mu.Unlock()
+
+	result, err := session.CreateMessage(ctx, params)
+	capturing(ctx).sample(params, result, err)
+
+	h.mu.Lock()
+	st.inFlight--
+	st.served++
+	if err != nil {
+		st.lastError, st.lastErrorAt = err.Error(), time.Now()
+	}
+	idle := st.draining && st.inFlight == 0
+	h.mu.Unlock()
+	if idle {
+		closeSession(session)
+	}
+	return result, err
+}
+
+var (
+	errSessionNotFound = errors.New("session not found")
+	errStdioSession    = errors.New("the stdio session cannot be closed: samplellama exits when it ends")
+)
+
+// drain stops routing requests to a session and closes it once its
+// in-flight requests complete.
+func (h *sessionHolder) drain(sessionID string) error {
+	h.mu.Lock()
+	s, st := h.sessions[sessionID], h.stats[sessionID]
+	if s == nil || st == nil {
+		h.mu.Unlock()
+		return errSessionNotFound
+	}
+	if sessionID == h.stdio {
+		h.mu.Unlock()
+		return errStdioSession
+	}
+	st.draining = true
+	idle := st.inFlight == 0
+	h.mu.Unlock()
+	if idle {
+		closeSession(s)
+	}
+	return nil
+}
+
+// kick closes a session immediately, failing its in-flight requests.
+func (h *sessionHolder) kick(sessionID string) error {
+	h.mu.RLock()
+	s, stdio := h.sessions[sessionID], h.stdio
+	h.mu.RUnlock()
+	if s == nil {
+		return errSessionNotFound
+	}
+	if sessionID == stdio {
+		return errStdioSession
+	}
+	closeSession(s)
+	return nil
+}
+
+// pin makes a session the default for clients it may serve. An empty ID
+// removes the pin.
+func (h *sessionHolder) pin(sessionID string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if sessionID != "" && h.sessions[sessionID] == nil {
+		return errSessionNotFound
+	}
+	h.pinned = sessionID
+	return nil
+}
+
+// closeSession ends an MCP session. The session's Wait then returns and
+// its usual cleanup removes it from the holder.
+func closeSession(s SamplingSession) {
+	if c, ok := s.(interface{ Close() error }); ok {
+		c.Close()
+	}
+}
+
+// bridge holds the dependencies shared by the Ollama sampling handlers.
+type bridge struct {
+	holder           *sessionHolder
+	models           *modelRegistry
+	defaultMaxTokens int
+	contextLength    int
+	truncation       string
+	conversations    *conversationStore
+	limits           *rateLimiter
+	audit            *auditLog
+	redact           *redactor
+	hooks            *hooks
+	cache            *responseCache
+	history          *historyStore
+	tracer           *tracer
+	logger           *slog.Logger
+}
+
+// session returns the MCP session serving the request's client. Clients
+// bound to an MCP identity are only routed to sessions of that identity.
+func (b *bridge) session(ctx context.Context) SamplingSession {
+	var identity string
+	if c := clientFromContext(ctx); c != nil {
+		identity = c.MCPIdentity
+	}
+	return b.holder.getFor(identity)
+}
+
+// sessionClientInfo returns the MCP host's implementation details, if the
+// session exposes its initialize parameters.
+func sessionClientInfo(s SamplingSession) *mcp.Implementation {
+	if p := sessionInitializeParams(s); p != nil {
+		return p.ClientInfo
+	}
+	return nil
+}
+
+func sessionInitializeParams(s SamplingSession) *mcp.InitializeParams {
+	ip, ok := s.(interface{ InitializeParams() *mcp.InitializeParams })
+	if !ok {
+		return nil
+	}
+	return ip.InitializeParams()
+}
+
+// sessionCapabilities derives the Ollama model capabilities from the MCP
+// host's standard sampling capability. Models support completion unless
+// the host's initialize parameters show it cannot sample. Ollama's tools,
+// vision and thinking are never reported: MCP has no standard way to
+// advertise them, and requests do not forward tools or images.
+func sessionCapabilities(s SamplingSession) []string {
+	if s != nil {
+		if p := sessionInitializeParams(s); p != nil && (p.Capabilities == nil || p.Capabilities.Sampling == nil) {
+			return []string{}
+		}
+	}
+	return []string{"completion"}
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(runReplay(os.Args[2:], os.Stdout, os.Stderr))
+	}
 	port := flag.Int("port", 11434, "Ollama HTTP listen port")
+	listenAddr := flag.String("listen", "", "Ollama HTTP listen address: host:port or unix:/path (default: $OLLAMA_HOST, else :port)")
 	models := flag.String("models", "default", "Comma-separated model names to advertise")
+	modelConfig := flag.String("model-config", "", "JSON file defining base models and their settings")
+	modelStore := flag.String("model-store", "", "JSON file for persisting models created via /api/copy")
 	defaultMaxTokens := flag.Int("default-max-tokens", 4096, "Default max tokens for sampling")
+	contextLength := flag.Int("context-length", 131072, "Default context length of models")
+	truncation := flag.String("truncation", truncateOldest, "How to fit chat histories longer than the context length: oldest, middle, summarize or reject")
+	contextTTL := flag.Duration("generate-context-ttl", 30*time.Minute, "How long /api/generate context values stay valid")
+	contextMaxEntries := flag.Int("generate-context-max-entries", 1000, "Maximum number of stored /api/generate contexts")
+	contextMaxBytes := flag.Int("generate-context-max-bytes", 256*1024, "Maximum text size kept per /api/generate context")
+	limitsFile := flag.String("limits", "", "JSON file of request and token limits per API key, client IP and model")
+	budgetStore := flag.String("budget-store", "", "JSON file for persisting daily and monthly token usage")
+	tokenizerName := flag.String("tokenizer", "bpe", "How to count tokens: bpe or heuristic (four bytes per token)")
+	tokenizerVocab := flag.String("tokenizer-vocab", "", "tiktoken vocabulary file for the bpe tokenizer, such as cl100k_base.tiktoken (default: embedded)")
+	auditPath := flag.String("audit-log", "", "JSONL file recording every chat and generate request")
+	auditMaxBytes := flag.Int64("audit-log-max-bytes", 100<<20, "Rotate the audit log before it grows beyond this size (0: no limit)")
+	auditMaxAge := flag.Duration("audit-log-max-age", 24*time.Hour, "Rotate the audit log after this long (0: no limit)")
+	auditText := flag.Bool("audit-log-text", false, "Include full prompts and responses in the audit log")
+	redactFile := flag.String("redact", "", "JSON file of redaction detectors and rules applied to prompts")
+	hooksFile := flag.String("hooks", "", "JSON file of pre- and post-sample policy hooks")
+	cacheBackend := flag.String("cache", "", "Response cache for deterministic requests: memory or disk (default: off)")
+	cacheDir := flag.String("cache-dir", "", "Directory of the disk response cache")
+	cacheTTL := flag.Duration("cache-ttl", 24*time.Hour, "How long cached responses stay valid (0: no limit)")
+	cacheMaxEntries := flag.Int("cache-max-entries", 10000, "Maximum number of cached responses (0: no limit)")
+	cacheMaxBytes := flag.Int64("cache-max-bytes", 100<<20, "Maximum total size of cached responses (0: no limit)")
+	traceEndpoint := flag.String("trace-otlp-endpoint", "", "OTLP/HTTP traces URL to export spans to (default: $OTEL_EXPORTER_OTLP_TRACES_ENDPOINT)")
+	historyDir := flag.String("history-dir", "", "Directory storing chat and generate transactions for /admin/history")
+	historyMaxAge := flag.Duration("history-max-age", 30*24*time.Hour, "Remove history older than this (0: no limit)")
+	historyMaxBytes := flag.Int64("history-max-bytes", 1<<30, "Remove the oldest history beyond this total size (0: no limit)")
+	captureFile := flag.String("capture", "", "Append chat and generate requests with their sampling calls and responses to this JSONL file")
+	traceFile := flag.String("trace-file", "", "Append spans as OTLP JSON lines to this file")
+	metricsListen := flag.String("metrics-listen", "", "Serve /metrics on this address instead of the Ollama API: host:port or unix:/path")
+	adminListen := flag.String("admin-listen", "", "Serve the admin API on this address: host:port or unix:/path")
+	adminKeysFile := flag.String("admin-keys", "", "JSON file of API keys accepted by the admin API (required with -admin-listen)")
+	pullCreates := flag.Bool("pull-creates-models", false, "Create unknown models pulled via /api/pull as hint-only aliases")
+	apiKeysFile := flag.String("api-keys", "", "JSON file of API keys required as bearer tokens on the Ollama API")
+	origins := flag.String("origins", "", "Comma-separated browser origins allowed in addition to $OLLAMA_ORIGINS and local pages")
+	allowedHosts := flag.String("allowed-hosts", "", "Comma-separated extra Host names accepted on a loopback listener; * disables the check")
+	publicHealth := flag.Bool("public-health", true, "Serve the health check at / without an API key")
+	var ollamaTLS, mcpTLS tlsFiles
+	flag.StringVar(&ollamaTLS.Cert, "tls-cert", "", "TLS certificate file for the Ollama API")
+	flag.StringVar(&ollamaTLS.Key, "tls-key", "", "TLS key file for the Ollama API")
+	flag.StringVar(&ollamaTLS.ClientCA, "tls-client-ca", "", "CA bundle for verifying Ollama API client certificates")
 	mcpTransport := flag.String("mcp-transport", "stdio", "MCP transport: stdio or http")
 	mcpPort := flag.Int("mcp-port", 8081, "Port for MCP Streamable HTTP transport")
+	mcpListenAddr := flag.String("mcp-listen", "", "MCP Streamable HTTP listen address: host:port or unix:/path (default: :mcp-port)")
+	socketModeFlag := flag.String("socket-mode", "0660", "Permissions of Unix sockets created by -listen and -mcp-listen")
+	flag.StringVar(&mcpTLS.Cert, "mcp-tls-cert", "", "TLS certificate file for the MCP HTTP transport")
+	flag.StringVar(&mcpTLS.Key, "mcp-tls-key", "", "TLS key file for the MCP HTTP transport")
+	flag.StringVar(&mcpTLS.ClientCA, "mcp-tls-client-ca", "", "CA bundle for verifying MCP client certificates")
+	mcpAPIKeysFile := flag.String("mcp-api-keys", "", "JSON file of bearer tokens accepted from MCP hosts")
+	mcpJWKS := flag.String("mcp-jwks", "", "JWKS file for validating OAuth access tokens from MCP hosts")
+	mcpJWTIssuer := flag.String("mcp-jwt-issuer", "", "Required issuer of MCP access tokens")
+	mcpJWTAudience := flag.String("mcp-jwt-audience", "", "Required audience of MCP access tokens (default: -mcp-resource)")
+	mcpResource := flag.String("mcp-resource", "", "Canonical URL of the MCP endpoint, advertised as an OAuth protected resource")
+	mcpAuthServers := flag.String("mcp-authorization-servers", "", "Comma-separated OAuth authorization servers advertised for the MCP endpoint")
+	readyOnSession := flag.Bool("notify-ready-on-session", false, "Report readiness to systemd only once the first MCP session is attached")
 	logFile := flag.String("log-file", "", "Log to file instead of stderr")
 	verbose := flag.Bool("verbose", false, "Enable verbose request logging")
 	flag.Parse()
+	setFlags := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { setFlags[f.Name] = true })
 
 	logOutput := os.Stderr
 	if *logFile != "" {
@@ -91,50 +395,322 @@ func main() {
 	}
 	logger := slog.New(slog.NewTextHandler(logOutput, &slog.HandlerOptions{Level: logLevel}))
 
+	socketMode, err := parseSocketMode(*socketModeFlag)
+	if err != nil {
+		logger.Error("Invalid -socket-mode", "error", err)
+		os.Exit(1)
+	}
+
 	holder := newSessionHolder()
 
+	// systemd readiness: READY=1 is sent once the listeners are up, or with
+	// -notify-ready-on-session once the first MCP session attaches.
+	notifier := newSDNotifier()
+	var readyOnce sync.Once
+	ready := func() {
+		readyOnce.Do(func() {
+			if err := notifier.notify("READY=1\n" + sessionStatus(holder.count())); err != nil {
+				logger.Warn("systemd notification failed", "error", err)
+			}
+		})
+	}
+	sessionsChanged := func() {
+		notifier.notify(sessionStatus(holder.count()))
+		if *readyOnSession {
+			ready()
+		}
+	}
+
+	// stats is set up with the bridge below; sessions cannot connect before
+	// the transports start.
+	var stats *metrics
 	mcpServer := mcp.NewServer(&mcp.Implementation{
 		Name:    "samplellama",
 		Version: version,
 	}, &mcp.ServerOptions{
 		Logger: logger,
 		InitializedHandler: func(ctx context.Context, req *mcp.InitializedRequest) {
+			identity := holder.identity(req.Session.ID())
 			holder.set(req.Session)
-			logger.Info("MCP session initialized", "session_id", req.Session.ID())
+			sessionsChanged()
+			stats.sessionConnected()
+			logger.Info("MCP session initialized", "session_id", req.Session.ID(), "mcp_identity", identity)
 			go func() {
 				req.Session.Wait()
 				holder.remove(req.Session.ID())
-				logger.Info("MCP session closed", "session_id", req.Session.ID())
+				sessionsChanged()
+				stats.sessionDisconnected()
+				logger.Info("MCP session closed", "session_id", req.Session.ID(), "mcp_identity", identity)
 			}()
 		},
 	})
 
-	modelList := parseModels(*models)
+	mcpServer.AddReceivingMiddleware(recordMCPIdentity(holder))
+
+	baseModels := modelsFromNames(parseModels(*models))
+	if *modelConfig != "" {
+		configured, err := loadModelConfig(*modelConfig)
+		if err != nil {
+			logger.Error("Failed to load model config", "error", err)
+			os.Exit(1)
+		}
+		baseModels = append(baseModels, configured...)
+	}
+	registry, err := newModelRegistry(baseModels, *modelStore)
+	if err != nil {
+		logger.Error("Failed to load model store", "error", err)
+		os.Exit(1)
+	}
+	// The limiter also enforces the limits set on individual API keys,
+	// so it exists even without -limits.
+	var limitCfg limitConfig
+	if *limitsFile != "" {
+		limitCfg, err = loadLimitConfig(*limitsFile)
+		if err != nil {
+			logger.Error("Failed to load limits", "error", err)
+			os.Exit(1)
+		}
+	}
+	budgets, err := loadBudgetStore(*budgetStore)
+	if err != nil {
+		logger.Error("Failed to load budget store", "error", err)
+		os.Exit(1)
+	}
+	var audit *auditLog
+	if *auditPath != "" {
+		audit, err = newAuditLog(*auditPath, *auditMaxBytes, *auditMaxAge, *auditText, logger)
+		if err != nil {
+			logger.Error("Failed to open audit log", "error", err)
+			os.Exit(1)
+		}
+		defer audit.close()
+	}
+	var capture *captureLog
+	if *captureFile != "" {
+		capture, err = newCaptureLog(*captureFile, logger)
+		if err != nil {
+			logger.Error("Failed to open capture file", "error", err)
+			os.Exit(1)
+		}
+		defer capture.close()
+	}
+	var history *historyStore
+	if *historyDir != "" {
+		history, err = openHistory(*historyDir, *historyMaxAge, *historyMaxBytes, logger)
+		if err != nil {
+			logger.Error("Failed to open history", "error", err)
+			os.Exit(1)
+		}
+		defer history.close()
+	}
+	var redact *redactor
+	if *redactFile != "" {
+		redact, err = loadRedactor(*redactFile)
+		if err != nil {
+			logger.Error("Failed to load redaction config", "error", err)
+			os.Exit(1)
+		}
+	}
+	var policyHooks *hooks
+	if *hooksFile != "" {
+		policyHooks, err = loadHooks(*hooksFile, logger)
+		if err != nil {
+			logger.Error("Failed to load hooks", "error", err)
+			os.Exit(1)
+		}
+	}
+	switch *tokenizerName {
+	case "bpe":
+		if *tokenizerVocab != "" {
+			bpe, err := loadBPEFile(*tokenizerVocab)
+			if err != nil {
+				logger.Error("Failed to load tokenizer", "error", err)
+				os.Exit(1)
+			}
+			textTokens = bpe
+		}
+		// Parse the embedded vocabulary now rather than in the first
+		// request.
+		estimateTokens("")
+	case "heuristic":
+		textTokens = heuristicTokenizer{}
+	default:
+		logger.Error("Unknown tokenizer", "tokenizer", *tokenizerName)
+		os.Exit(1)
+	}
+	if !slices.Contains(truncationStrategies, *truncation) {
+		logger.Error("Unknown truncation strategy", "truncation", *truncation)
+		os.Exit(1)
+	}
+	var cache *responseCache
+	switch *cacheBackend {
+	case "":
+	case "memory":
+		cache = newMemoryCache(*cacheTTL, *cacheMaxEntries, *cacheMaxBytes, logger)
+	case "disk":
+		if *cacheDir == "" {
+			logger.Error("-cache disk requires -cache-dir")
+			os.Exit(1)
+		}
+		cache, err = newDiskCache(*cacheDir, *cacheTTL, *cacheMaxEntries, *cacheMaxBytes, logger)
+		if err != nil {
+			logger.Error("Failed to open response cache", "error", err)
+			os.Exit(1)
+		}
+	default:
+		logger.Error("Unknown response cache backend", "cache", *cacheBackend)
+		os.Exit(1)
+	}
+	var spans *tracer
+	if exporter := newTraceExporter(*traceEndpoint, *traceFile, os.Getenv); exporter != nil {
+		service := os.Getenv("OTEL_SERVICE_NAME")
+		if service == "" {
+			service = "samplellama"
+		}
+		spans = newTracer(service, exporter, logger)
+		defer spans.close()
+	}
+	b := &bridge{
+		holder:           holder,
+		models:           registry,
+		defaultMaxTokens: *defaultMaxTokens,
+		contextLength:    *contextLength,
+		truncation:       *truncation,
+		conversations:    newConversationStore(*contextTTL, *contextMaxEntries, *contextMaxBytes),
+		limits:           newRateLimiter(limitCfg, budgets, logger),
+		audit:            audit,
+		redact:           redact,
+		hooks:            policyHooks,
+		cache:            cache,
+		history:          history,
+		tracer:           spans,
+		logger:           logger,
+	}
+
+	stats = newMetrics(holder, registry, redact)
+	stats.cache = cache
+	stats.tracer = spans
+	// The feed behind the dashboard only runs with the admin API.
+	var feed *activityFeed
+	if *adminListen != "" {
+		feed = newActivityFeed()
+		stats.feed = feed
+		if audit != nil {
+			audit.feed = feed
+		}
+	}
 
 	// Set up Ollama HTTP server.
 	mux := http.NewServeMux()
 	mux.HandleFunc("GET /{$}", handleHealth)
 	mux.HandleFunc("HEAD /{$}", handleHealth)
 	mux.HandleFunc("GET /api/version", handleVersion)
-	mux.HandleFunc("GET /api/tags", handleTags(modelList))
-	mux.HandleFunc("POST /api/show", handleShow(modelList))
-	mux.HandleFunc("POST /api/pull", handlePull(modelList))
-	mux.HandleFunc("POST /api/chat", handleChat(holder, *defaultMaxTokens, logger))
-	mux.HandleFunc("POST /api/generate", handleGenerate(holder, *defaultMaxTokens, logger))
+	mux.HandleFunc("GET /api/tags", handleTags(registry))
+	mux.HandleFunc("POST /api/show", handleShow(b))
+	mux.HandleFunc("POST /api/pull", handlePull(registry, *pullCreates, logger))
+	mux.HandleFunc("POST /api/copy", handleCopy(registry, logger))
+	mux.HandleFunc("DELETE /api/delete", handleDelete(registry, logger))
+	mux.HandleFunc("POST /api/chat", handleChat(b))
+	mux.HandleFunc("POST /api/generate", handleGenerate(b))
+	if *metricsListen == "" {
+		mux.HandleFunc("GET /metrics", stats.handler())
+	}
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		logger.Warn("Unhandled request", "method", r.Method, "path", r.URL.Path)
 		http.NotFound(w, r)
 	})
 
-	logged := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		logger.Info("HTTP request", "method", r.Method, "path", r.URL.Path)
-		mux.ServeHTTP(w, r)
+	instrumented := capture.wrap(stats.instrument(mux))
+	var logged http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger.Info("HTTP request", "method", r.Method, "path", r.URL.Path, "client", clientLabel(r.Context()))
+		instrumented.ServeHTTP(w, r)
 	})
+	var keys *apiKeyStore
+	if *apiKeysFile != "" {
+		keys, err = loadAPIKeys(*apiKeysFile)
+		if err != nil {
+			logger.Error("Failed to load API keys", "error", err)
+			os.Exit(1)
+		}
+	}
+	if keys != nil || ollamaTLS.ClientCA != "" {
+		logged = clientAuth(keys, *publicHealth, logger, logged)
+	}
 
-	ollamaAddr := fmt.Sprintf(":%d", *port)
+	ollamaTLSConfig, err := newTLSConfig(ollamaTLS, logger)
+	if err != nil {
+		logger.Error("Invalid Ollama API TLS configuration", "error", err)
+		os.Exit(1)
+	}
+	activated, err := activatedListeners()
+	if err != nil {
+		logger.Error("Invalid systemd socket activation", "error", err)
+		os.Exit(1)
+	}
+	ollamaAddr := listenAddress(*listenAddr, *port, setFlags["port"], os.Getenv("OLLAMA_HOST"))
+	ollamaListener := pickActivated(activated, "ollama", 0)
+	if ollamaListener != nil {
+		ollamaAddr = ollamaListener.Addr().String()
+	} else if ollamaListener, err = listen(ollamaAddr, socketMode); err != nil {
+		logger.Error("Failed to listen for the Ollama API", "addr", ollamaAddr, "error", err)
+		os.Exit(1)
+	}
+	// Browser protection wraps everything else, so that preflight requests
+	// are answered before authentication.
+	hosts := parseModels(*allowedHosts)
+	logged = withCORS(newCORSPolicy(os.Getenv("OLLAMA_ORIGINS")+","+*origins), hosts, logger, logged)
+	logged = hostGuard(ollamaListener.Addr(), hosts, logger, logged)
+	logged = traceRequests(spans, logged)
 	ollamaServer := &http.Server{
-		Addr:    ollamaAddr,
-		Handler: logged,
+		Handler:   logged,
+		TLSConfig: ollamaTLSConfig,
+	}
+	var metricsServer *http.Server
+	var metricsListener net.Listener
+	if *metricsListen != "" {
+		if metricsListener, err = listen(*metricsListen, socketMode); err != nil {
+			logger.Error("Failed to listen for metrics", "addr", *metricsListen, "error", err)
+			os.Exit(1)
+		}
+		metricsMux := http.NewServeMux()
+		metricsMux.HandleFunc("GET /metrics", stats.handler())
+		metricsServer = &http.Server{Handler: metricsMux}
+	}
+
+	var adminServer *http.Server
+	var adminListener net.Listener
+	if *adminListen != "" {
+		if *adminKeysFile == "" {
+			logger.Error("-admin-listen requires -admin-keys")
+			os.Exit(1)
+		}
+		adminKeys, err := loadAPIKeys(*adminKeysFile)
+		if err != nil {
+			logger.Error("Failed to load admin keys", "error", err)
+			os.Exit(1)
+		}
+		if adminListener, err = listen(*adminListen, socketMode); err != nil {
+			logger.Error("Failed to listen for the admin API", "addr", *adminListen, "error", err)
+			os.Exit(1)
+		}
+		flagValues := make(map[string]string)
+		flag.VisitAll(func(f *flag.Flag) { flagValues[f.Name] = f.Value.String() })
+		adminAPI := newAdminHandler(holder, registry, b.limits, flagValues, logger)
+		adminAPI.HandleFunc("GET /dashboard/events", dashboardEvents(feed, holder, stats, audit))
+		adminAPI.HandleFunc("POST /dashboard/api/chat", playgroundChat(instrumented, logger))
+		if history != nil {
+			adminAPI.HandleFunc("GET /admin/history", historySearch(history, logger))
+			adminAPI.HandleFunc("GET /admin/history/export", historyExport(history, logger))
+			adminAPI.HandleFunc("GET /admin/history/{id}", historyGet(history, logger))
+		}
+		authenticated := clientAuth(adminKeys, false, logger, adminAPI)
+		adminMux := http.NewServeMux()
+		adminMux.Handle("GET /dashboard/", dashboardAssets())
+		adminMux.Handle("GET /{$}", http.RedirectHandler("/dashboard/", http.StatusFound))
+		adminMux.Handle("/", authenticated)
+		adminMux.Handle("GET /dashboard/events", authenticated)
+		adminMux.Handle("POST /dashboard/api/chat", authenticated)
+		adminServer = &http.Server{Handler: adminMux}
 	}
 
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
@@ -142,42 +718,113 @@ func main() {
 
 	// Start Ollama HTTP server in background.
 	go func() {
-		logger.Info("Ollama-compatible API listening", "addr", ollamaAddr)
-		if err := ollamaServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logger.Info("Ollama-compatible API listening", "addr", ollamaAddr, "tls", ollamaTLSConfig != nil)
+		if err := serve(ollamaServer, ollamaListener); err != nil && err != http.ErrServerClosed {
 			logger.Error("Ollama HTTP server error", "error", err)
 			os.Exit(1)
 		}
 	}()
+	if metricsServer != nil {
+		go func() {
+			logger.Info("Metrics listening", "addr", *metricsListen)
+			if err := metricsServer.Serve(metricsListener); err != nil && err != http.ErrServerClosed {
+				logger.Error("Metrics HTTP server error", "error", err)
+				os.Exit(1)
+			}
+		}()
+	}
+
+	if adminServer != nil {
+		go func() {
+			logger.Info("Admin API listening", "addr", *adminListen)
+			if err := adminServer.Serve(adminListener); err != nil && err != http.ErrServerClosed {
+				logger.Error("Admin HTTP server error", "error", err)
+				os.Exit(1)
+			}
+		}()
+	}
+
+	interval, err := watchdogInterval(os.Getpid(), os.Getenv)
+	if err != nil {
+		logger.Warn("systemd watchdog disabled", "error", err)
+	}
+	go notifier.watchdog(ctx, interval)
+	go b.limits.saveBudgetsEvery(ctx, budgetSaveInterval)
 
 	// Start MCP transport (blocks until context is cancelled or transport closes).
 	switch *mcpTransport {
 	case "stdio":
 		logger.Info("Starting MCP stdio transport")
+		if !*readyOnSession {
+			ready()
+		}
 		ss, err := mcpServer.Connect(ctx, &mcp.StdioTransport{}, nil)
 		if err != nil {
 			logger.Error("MCP stdio connect error", "error", err)
 			os.Exit(1)
 		}
-		holder.set(ss)
+		holder.setStdio(ss)
+		sessionsChanged()
+		stats.sessionConnected()
 		logger.Info("MCP stdio session", "session_id", ss.ID())
 		ss.Wait()
 	case "http":
-		mcpAddr := fmt.Sprintf(":%d", *mcpPort)
-		logger.Info("Starting MCP Streamable HTTP transport", "addr", mcpAddr)
-		httpHandler := mcp.NewStreamableHTTPHandler(func(r *http.Request) *mcp.Server {
-			return mcpServer
-		}, nil)
+		mcpTLSConfig, err := newTLSConfig(mcpTLS, logger)
+		if err != nil {
+			logger.Error("Invalid MCP TLS configuration", "error", err)
+			os.Exit(1)
+		}
+		mcpAddr := listenAddress(*mcpListenAddr, *mcpPort, true, "")
+		mcpListener := pickActivated(activated, "mcp", 1)
+		if mcpListener != nil {
+			mcpAddr = mcpListener.Addr().String()
+		} else if mcpListener, err = listen(mcpAddr, socketMode); err != nil {
+			logger.Error("Failed to listen for MCP", "addr", mcpAddr, "error", err)
+			os.Exit(1)
+		}
+		logger.Info("Starting MCP Streamable HTTP transport", "addr", mcpAddr, "tls", mcpTLSConfig != nil)
+		mcpAuth := mcpAuthConfig{
+			resource:             *mcpResource,
+			authorizationServers: parseModels(*mcpAuthServers),
+			clientCA:             mcpTLS.ClientCA != "",
+		}
+		if *mcpAPIKeysFile != "" {
+			mcpAuth.keys, err = loadAPIKeys(*mcpAPIKeysFile)
+			if err != nil {
+				logger.Error("Failed to load MCP API keys", "error", err)
+				os.Exit(1)
+			}
+		}
+		if *mcpJWKS != "" {
+			audience := *mcpJWTAudience
+			if audience == "" {
+				audience = *mcpResource
+			}
+			mcpAuth.jwks, err = loadJWKS(*mcpJWKS, *mcpJWTIssuer, audience)
+			if err != nil {
+				logger.Error("Failed to load MCP JWKS", "error", err)
+				os.Exit(1)
+			}
+		}
+		httpHandler, err := newMCPHTTPHandler(mcpServer, mcpAuth, logger)
+		if err != nil {
+			logger.Error("Invalid MCP authentication configuration", "error", err)
+			os.Exit(1)
+		}
 
 		mcpHTTPServer := &http.Server{
-			Addr:    mcpAddr,
-			Handler: httpHandler,
+			Handler:   httpHandler,
+			TLSConfig: mcpTLSConfig,
 		}
 		go func() {
-			if err := mcpHTTPServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			if err := serve(mcpHTTPServer, mcpListener); err != nil && err != http.ErrServerClosed {
 				logger.Error("MCP HTTP server error", "error", err)
 				os.Exit(1)
 			}
 		}()
+		if !*readyOnSession {
+			ready()
+		}
 		<-ctx.Done()
 		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer shutdownCancel()
@@ -189,12 +836,23 @@ func main() {
 		os.Exit(1)
 	}
 
+	notifier.notify("STOPPING=1")
+
 	// Graceful shutdown of Ollama server.
 	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer shutdownCancel()
 	if err := ollamaServer.Shutdown(shutdownCtx); err != nil {
 		logger.Error("Ollama HTTP shutdown error", "error", err)
 	}
+	// Requests have finished, so their usage can be saved for good.
+	b.limits.saveBudgets()
+	if metricsServer != nil {
+		metricsServer.Shutdown(shutdownCtx)
+	}
+	if adminServer != nil {
+		feed.close()
+		adminServer.Shutdown(shutdownCtx)
+	}
 	logger.Info("Shutdown complete")
 }
 
@@ -221,16 +879,20 @@ func handleVersion(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(VersionResponse{Version: version})
 }
 
-func handleTags(models []string) http.HandlerFunc {
+func handleTags(models *modelRegistry) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		client := clientFromContext(r.Context())
 		var infos []ModelInfo
-		for _, m := range models {
+		for _, m := range models.list() {
+			if client != nil && !client.allowsModel(m.Name) {
+				continue
+			}
 			infos = append(infos, ModelInfo{
-				Name:       m,
-				Model:      m,
-				ModifiedAt: time.Now(),
+				Name:       m.Name,
+				Model:      m.Name,
+				ModifiedAt: m.ModifiedAt,
 				Size:       0,
-				Digest:     "sha256:000000000000",
+				Digest:     m.digest(),
 				Details: ModelDetails{
 					Format: "mcp",
 					Family: "mcp",
@@ -242,11 +904,7 @@ func handleTags(models []string) http.HandlerFunc {
 	}
 }
 
-func handleShow(models []string) http.HandlerFunc {
-	known := make(map[string]bool, len(models))
-	for _, m := range models {
-		known[m] = true
-	}
+func handleShow(b *bridge) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var req ShowRequest
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -259,31 +917,54 @@ func handleShow(models []string) http.HandlerFunc {
 		if name == "" {
 			name = req.Name
 		}
-		if !known[name] {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusNotFound)
-			json.NewEncoder(w).Encode(ErrorResponse{Error: fmt.Sprintf("model %q not found", name)})
+		if !authorizeModel(w, r, b.logger, name) {
 			return
 		}
+		entry, ok := b.models.lookup(name)
+		if !ok {
+			writeModelNotFound(w, name)
+			return
+		}
+		contextLength := entry.ContextLength
+		if contextLength == 0 {
+			contextLength = b.contextLength
+		}
+		template := entry.Template
+		if template == "" {
+			template = "{{ .Prompt }}"
+		}
+		session := b.session(r.Context())
+		modelInfo := map[string]any{
+			"general.architecture": "mcp",
+			"general.basename":     entry.Base,
+			"mcp.context_length":   contextLength,
+		}
+		if req.Verbose && session != nil {
+			modelInfo["samplellama.session_id"] = session.ID()
+			if info := sessionClientInfo(session); info != nil {
+				modelInfo["samplellama.host.name"] = info.Name
+				modelInfo["samplellama.host.version"] = info.Version
+			}
+		}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(ShowResponse{
-			Modelfile:  fmt.Sprintf("# Modelfile generated by samplellama\nFROM %s\n", name),
-			Parameters: "",
-			Template:   "{{ .Prompt }}",
+			Modelfile:  entry.modelfile(),
+			Parameters: formatParameters(entry.Parameters),
+			Template:   template,
+			System:     entry.System,
 			Details: ModelDetails{
-				Format: "mcp",
-				Family: "mcp",
+				ParentModel: entry.From,
+				Format:      "mcp",
+				Family:      "mcp",
 			},
-			ModifiedAt: time.Now(),
+			ModelInfo:    modelInfo,
+			Capabilities: sessionCapabilities(session),
+			ModifiedAt:   entry.ModifiedAt,
 		})
 	}
 }
 
-func handlePull(models []string) http.HandlerFunc {
-	known := make(map[string]bool, len(models))
-	for _, m := range models {
-		known[m] = true
-	}
+func handlePull(models *modelRegistry, createMissing bool, logger *slog.Logger) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var req PullRequest
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -296,41 +977,183 @@ func handlePull(models []string) http.HandlerFunc {
 		if name == "" {
 			name = req.Name
 		}
-		if !known[name] {
+		if !authorizeModel(w, r, logger, name) {
+			return
+		}
+		entry, ok := models.lookup(name)
+		if !ok && createMissing && name != "" {
+			// Create the model as an alias that forwards its own name as
+			// the model hint.
+			if err := models.add(modelEntry{Name: name}); err != nil {
+				writeError(w, logger, http.StatusInternalServerError, err.Error())
+				return
+			}
+			logger.Info("Model created by pull", "model", name)
+			entry, ok = models.lookup(name)
+		}
+		if !ok {
+			writeModelNotFound(w, name)
+			return
+		}
+
+		streaming := req.Stream == nil || *req.Stream
+		if !streaming {
+			// Model is "already available" — just report success.
 			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusNotFound)
-			json.NewEncoder(w).Encode(ErrorResponse{Error: fmt.Sprintf("model %q not found", name)})
+			json.NewEncoder(w).Encode(ProgressResponse{Status: "success"})
 			return
 		}
-		// Model is "already available" — just report success.
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(ProgressResponse{Status: "success"})
+
+		// Emulate the progress sequence of a real pull so that clients
+		// rendering progress bars see the stages they expect.
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		writeNDJSON(w, ProgressResponse{Status: "pulling manifest"})
+		for _, l := range entry.layers() {
+			status := "pulling " + strings.TrimPrefix(l.Digest, "sha256:")[:12]
+			writeNDJSON(w, ProgressResponse{Status: status, Digest: l.Digest, Total: l.Size})
+			writeNDJSON(w, ProgressResponse{Status: status, Digest: l.Digest, Total: l.Size, Completed: l.Size})
+		}
+		writeNDJSON(w, ProgressResponse{Status: "verifying sha256 digest"})
+		writeNDJSON(w, ProgressResponse{Status: "writing manifest"})
+		writeNDJSON(w, ProgressResponse{Status: "success"})
 	}
 }
 
-func handleChat(holder *sessionHolder, defaultMaxTokens int, logger *slog.Logger) http.HandlerFunc {
+func handleCopy(models *modelRegistry, logger *slog.Logger) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		var req ChatRequest
+		var req CopyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, logger, http.StatusBadRequest, fmt.Sprintf("invalid JSON: %v", err))
+			return
+		}
+		if req.Source == "" || req.Destination == "" {
+			writeError(w, logger, http.StatusBadRequest, "source and destination are required")
+			return
+		}
+		if !authorizeModel(w, r, logger, req.Source) || !authorizeModel(w, r, logger, req.Destination) {
+			return
+		}
+		switch err := models.copy(req.Source, req.Destination); {
+		case errors.Is(err, errModelNotFound):
+			writeModelNotFound(w, req.Source)
+		case errors.Is(err, errBaseModel):
+			writeError(w, logger, http.StatusForbidden, fmt.Sprintf("model %q is defined in the configuration and cannot be overwritten", req.Destination))
+		case err != nil:
+			writeError(w, logger, http.StatusInternalServerError, err.Error())
+		default:
+			logger.Info("Model copied", "source", req.Source, "destination", req.Destination)
+			w.WriteHeader(http.StatusOK)
+		}
+	}
+}
+
+func handleDelete(models *modelRegistry, logger *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req DeleteRequest
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			writeError(w, logger, http.StatusBadRequest, fmt.Sprintf("invalid JSON: %v", err))
 			return
 		}
+		name := req.Model
+		if name == "" {
+			name = req.Name
+		}
+		if name == "" {
+			writeError(w, logger, http.StatusBadRequest, "model is required")
+			return
+		}
+		if !authorizeModel(w, r, logger, name) {
+			return
+		}
+		switch err := models.delete(name); {
+		case errors.Is(err, errModelNotFound):
+			writeModelNotFound(w, name)
+		case errors.Is(err, errBaseModel):
+			writeError(w, logger, http.StatusForbidden, fmt.Sprintf("model %q is defined in the configuration and cannot be deleted", name))
+		case err != nil:
+			writeError(w, logger, http.StatusInternalServerError, err.Error())
+		default:
+			logger.Info("Model deleted", "model", name)
+			w.WriteHeader(http.StatusOK)
+		}
+	}
+}
+
+func handleChat(b *bridge) http.HandlerFunc {
+	logger := b.logger
+	return func(w http.ResponseWriter, r *http.Request) {
+		timing := startTiming()
+		var req ChatRequest
+		decodeErr := json.NewDecoder(r.Body).Decode(&req)
+		audited := b.audit.start(r, "/api/chat", req.Model)
+		// refuse answers and audits a request refused before sampling.
+		refuse := func(status int, err error) {
+			audited.finish(status, nil, "", err)
+			writeError(w, logger, status, err.Error())
+		}
+		if decodeErr != nil {
+			refuse(http.StatusBadRequest, fmt.Errorf("invalid JSON: %v", decodeErr))
+			return
+		}
+		if !authorizeModel(w, r, logger, req.Model) {
+			audited.finish(http.StatusForbidden, nil, "", errModelNotAllowed)
+			return
+		}
+		obs := observe(r.Context())
+		obs.setModel(req.Model)
+		obs.enqueue()
 
-		session := holder.get()
+		_, selectSpan := b.tracer.start(r.Context(), "select session", spanKindInternal)
+		session := timing.selectSession(func() SamplingSession { return b.session(r.Context()) })
+		if session != nil {
+			selectSpan.setAttr("mcp.session.id", session.ID())
+		}
+		selectSpan.finish(nil)
 		if session == nil {
-			writeError(w, logger, http.StatusServiceUnavailable, "MCP host not connected")
+			refuse(http.StatusServiceUnavailable, errors.New("MCP host not connected"))
 			return
 		}
+		audited.setSession(session, b.holder.identity(session.ID()))
 
 		logger.Info("Ollama chat request",
+			"client", clientLabel(r.Context()),
+			"session_id", session.ID(),
+			"mcp_identity", b.holder.identity(session.ID()),
 			"model", req.Model,
 			"num_messages", len(req.Messages),
 		)
 		for i, msg := range req.Messages {
-			logger.Info("  message", "index", i, "role", msg.Role, "content_len", len(msg.Content), "content_preview", truncate(msg.Content, 100))
+			preview := truncate(msg.Content, 100)
+			if b.redact != nil {
+				// The preview could contain the secrets being redacted.
+				preview = ""
+			}
+			logger.Info("  message", "index", i, "role", msg.Role, "content_len", len(msg.Content), "content_preview", preview)
 		}
 
-		params := chatToCreateMessage(req, defaultMaxTokens)
+		_, translateSpan := b.tracer.start(r.Context(), "translate request", spanKindInternal)
+		entry := b.models.resolve(req.Model)
+		req.Options = withDefaults(req.Options, entry.Parameters)
+		window := b.contextWindow(entry, req.Options, b.summarizer(w, r, req.Model, entry.Base, session))
+		params, err := chatToCreateMessage(req, b.defaultMaxTokens, window)
+		translateSpan.finish(err)
+		switch {
+		case errors.Is(err, errContextLength):
+			refuse(http.StatusBadRequest, err)
+			return
+		case errors.Is(err, errRateLimited):
+			// admit has answered the summary request with 429.
+			audited.finish(http.StatusTooManyRequests, nil, "", err)
+			return
+		case err != nil:
+			logger.Error("Summarizing chat history failed", "error", err)
+			audited.finish(hookErrorStatus(err), nil, "", err)
+			writeHookError(w, logger, err)
+			return
+		}
+		applyModelEntry(params, entry)
+		redacted := b.redact.redactParams(params)
+		audited.setPrompt(params)
 
 		paramsJSON, _ := json.Marshal(params)
 		logger.Info("CreateMessage request", "params", string(paramsJSON))
@@ -338,6 +1161,7 @@ func handleChat(holder *sessionHolder, defaultMaxTokens int, logger *slog.Logger
 		if len(params.Messages) == 0 {
 			// Ollama sends an empty request to preload the model; respond with an empty done message.
 			logger.Info("Empty message list, returning preload response")
+			audited.finish(http.StatusOK, nil, "", nil)
 			w.Header().Set("Content-Type", "application/json")
 			json.NewEncoder(w).Encode(ChatResponse{
 				Model:     req.Model,
@@ -348,14 +1172,70 @@ func handleChat(holder *sessionHolder, defaultMaxTokens int, logger *slog.Logger
 			return
 		}
 
-		result, err := session.CreateMessage(r.Context(), params)
+		hookReq := &hookRequest{Endpoint: "/api/chat", Model: req.Model, Client: clientLabel(r.Context()), SessionID: session.ID(), Params: params}
+		if err := b.hooks.preSample(r.Context(), hookReq); err != nil {
+			audited.finish(hookErrorStatus(err), nil, "", err)
+			writeHookError(w, logger, err)
+			return
+		}
+		admitted := b.limits.admit(w, r, req.Model, estimatePromptTokens(params))
+		if admitted == nil {
+			audited.finish(http.StatusTooManyRequests, nil, "", errRateLimited)
+			return
+		}
+		recorded := b.history.start(r, "/api/chat", req.Model, session.ID(), b.holder.identity(session.ID()))
+		cached := b.cache.lookup(w, r, req.Options, params, entry.Base, b.holder.identity(session.ID()))
+		result := cached.hit()
+		if result != nil {
+			// Cached answers cost the host nothing, so they are not
+			// charged to token budgets.
+			admitted.done(0, 0)
+			admitted = &admission{}
+			capturing(r.Context()).sample(params, result, nil)
+			obs.cacheHit()
+			timing.startSampling()
+			timing.endSampling()
+		} else {
+			sampleCtx, sampleSpan := b.tracer.startSampling(r.Context(), session, req.Model, params)
+			obs.startSampling()
+			timing.startSampling()
+			result, err = b.holder.createMessage(sampleCtx, session, params)
+			timing.endSampling()
+			obs.endSampling()
+			sampleSpan.finishSampling(result, err)
+			if err == nil {
+				cached.save(result)
+			}
+		}
+		timing.setHeader(w)
 		if err != nil {
+			admitted.done(0, 0)
+			audited.finish(http.StatusBadGateway, nil, "", err)
+			recorded.chat(&req, nil, err)
 			logger.Error("CreateMessage failed", "error", err)
 			writeError(w, logger, http.StatusBadGateway, fmt.Sprintf("sampling failed: %v", err))
 			return
 		}
+		hookReq.Result = result
+		if err := b.hooks.postSample(r.Context(), hookReq); err != nil {
+			admitted.done(tokenUsage(params, result, extractTextContent(result.Content)))
+			audited.finish(hookErrorStatus(err), nil, "", err)
+			recorded.chat(&req, nil, err)
+			writeHookError(w, logger, err)
+			return
+		}
 
-		text := extractTextContent(result.Content)
+		// The audit log gets the text as the host saw it, so that
+		// restored secrets do not reach it.
+		hostText := redacted.redactResponse(extractTextContent(result.Content))
+		text := redacted.restore(hostText)
+		redacted.log(logger)
+		promptTokens, evalTokens := tokenUsage(params, result, text)
+		admitted.done(promptTokens, evalTokens)
+		audited.finish(http.StatusOK, result, hostText, nil)
+		obs.finish(result.StopReason, promptTokens, evalTokens)
+		_, writeSpan := b.tracer.start(r.Context(), "write response", spanKindInternal)
+		defer writeSpan.finish(nil)
 		now := time.Now()
 		stopReason := mcpStopReason(result.StopReason)
 
@@ -364,7 +1244,20 @@ func handleChat(holder *sessionHolder, defaultMaxTokens int, logger *slog.Logger
 			model = "default"
 		}
 
+		resp := ChatResponse{
+			Model:           model,
+			CreatedAt:       now,
+			Message:         OllamaMessage{Role: "assistant", Content: text},
+			Done:            true,
+			DoneReason:      stopReason,
+			PromptEvalCount: promptTokens,
+			EvalCount:       evalTokens,
+		}
+		resp.TotalDuration, resp.LoadDuration, resp.PromptEvalDuration, resp.EvalDuration = timing.ollamaDurations(promptTokens, evalTokens)
+		recorded.chat(&req, &resp, nil)
+
 		streaming := req.Stream == nil || *req.Stream // default true
+		timing.startWrite(w)
 		if streaming {
 			w.Header().Set("Content-Type", "application/x-ndjson")
 			writeNDJSON(w, ChatResponse{
@@ -373,49 +1266,102 @@ func handleChat(holder *sessionHolder, defaultMaxTokens int, logger *slog.Logger
 				Message:   OllamaMessage{Role: "assistant", Content: text},
 				Done:      false,
 			})
-			writeNDJSON(w, ChatResponse{
-				Model:      model,
-				CreatedAt:  now,
-				Message:    OllamaMessage{Role: "assistant", Content: ""},
-				Done:       true,
-				DoneReason: stopReason,
-				EvalCount:  len(text),
-			})
+			// The final chunk carries the statistics without the text,
+			// and its total includes writing the text.
+			done := resp
+			done.Message.Content = ""
+			done.TotalDuration = int64(timing.total())
+			writeNDJSON(w, done)
 		} else {
 			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(ChatResponse{
-				Model:      model,
-				CreatedAt:  now,
-				Message:    OllamaMessage{Role: "assistant", Content: text},
-				Done:       true,
-				DoneReason: stopReason,
-				EvalCount:  len(text),
-			})
+			json.NewEncoder(w).Encode(resp)
 		}
+		timing.endWrite(w)
 	}
 }
 
-func handleGenerate(holder *sessionHolder, defaultMaxTokens int, logger *slog.Logger) http.HandlerFunc {
+func handleGenerate(b *bridge) http.HandlerFunc {
+	logger := b.logger
 	return func(w http.ResponseWriter, r *http.Request) {
+		timing := startTiming()
 		var req GenerateRequest
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			writeError(w, logger, http.StatusBadRequest, fmt.Sprintf("invalid JSON: %v", err))
+		decodeErr := json.NewDecoder(r.Body).Decode(&req)
+		audited := b.audit.start(r, "/api/generate", req.Model)
+		// refuse answers and audits a request refused before sampling.
+		refuse := func(status int, err error) {
+			audited.finish(status, nil, "", err)
+			writeError(w, logger, status, err.Error())
+		}
+		if decodeErr != nil {
+			refuse(http.StatusBadRequest, fmt.Errorf("invalid JSON: %v", decodeErr))
 			return
 		}
+		if !authorizeModel(w, r, logger, req.Model) {
+			audited.finish(http.StatusForbidden, nil, "", errModelNotAllowed)
+			return
+		}
+		obs := observe(r.Context())
+		obs.setModel(req.Model)
+		obs.enqueue()
 
-		session := holder.get()
+		_, selectSpan := b.tracer.start(r.Context(), "select session", spanKindInternal)
+		session := timing.selectSession(func() SamplingSession { return b.session(r.Context()) })
+		if session != nil {
+			selectSpan.setAttr("mcp.session.id", session.ID())
+		}
+		selectSpan.finish(nil)
 		if session == nil {
-			writeError(w, logger, http.StatusServiceUnavailable, "MCP host not connected")
+			refuse(http.StatusServiceUnavailable, errors.New("MCP host not connected"))
+			return
+		}
+		audited.setSession(session, b.holder.identity(session.ID()))
+
+		if req.Raw && (req.Template != "" || req.System != "" || len(req.Context) > 0) {
+			refuse(http.StatusBadRequest, errors.New("raw mode does not support template, system, or context"))
 			return
 		}
 
-		params := generateToCreateMessage(req, defaultMaxTokens)
+		_, translateSpan := b.tracer.start(r.Context(), "translate request", spanKindInternal)
+		entry := b.models.resolve(req.Model)
+		if req.Raw {
+			entry.System = ""
+			entry.Template = ""
+		}
+		req.Options = withDefaults(req.Options, entry.Parameters)
+		params := generateToCreateMessage(req, b.defaultMaxTokens)
+		applyModelEntry(params, entry)
+		if len(req.Context) > 0 {
+			history, ok := b.conversations.load(req.Context)
+			if !ok {
+				logger.Warn("Unknown or expired generate context, continuing without history")
+			}
+			params.Messages = append(history, params.Messages...)
+		}
+		// The conversation is stored untemplated so that a template sees
+		// plain turns in .Messages on the next request.
+		turns := params.Messages
+		tmpl := req.Template
+		if tmpl == "" {
+			tmpl = entry.Template
+		}
+		if tmpl != "" {
+			if err := applyPromptTemplate(params, tmpl, req); err != nil {
+				translateSpan.finish(err)
+				refuse(http.StatusBadRequest, err)
+				return
+			}
+		}
+
+		redacted := b.redact.redactParams(params)
+		audited.setPrompt(params)
+		translateSpan.finish(nil)
 
 		paramsJSON, _ := json.Marshal(params)
-		logger.Info("Generate CreateMessage request", "prompt_len", len(req.Prompt), "params", string(paramsJSON))
+		logger.Info("Generate CreateMessage request", "client", clientLabel(r.Context()), "session_id", session.ID(), "mcp_identity", b.holder.identity(session.ID()), "prompt_len", len(req.Prompt), "params", string(paramsJSON))
 
 		if len(params.Messages) == 0 || req.Prompt == "" {
 			logger.Info("Empty prompt, returning preload response")
+			audited.finish(http.StatusOK, nil, "", nil)
 			w.Header().Set("Content-Type", "application/json")
 			json.NewEncoder(w).Encode(GenerateResponse{
 				Model:     req.Model,
@@ -426,13 +1372,75 @@ func handleGenerate(holder *sessionHolder, defaultMaxTokens int, logger *slog.Lo
 			return
 		}
 
-		result, err := session.CreateMessage(r.Context(), params)
+		hookReq := &hookRequest{Endpoint: "/api/generate", Model: req.Model, Client: clientLabel(r.Context()), SessionID: session.ID(), Params: params}
+		if err := b.hooks.preSample(r.Context(), hookReq); err != nil {
+			audited.finish(hookErrorStatus(err), nil, "", err)
+			writeHookError(w, logger, err)
+			return
+		}
+		admitted := b.limits.admit(w, r, req.Model, estimatePromptTokens(params))
+		if admitted == nil {
+			audited.finish(http.StatusTooManyRequests, nil, "", errRateLimited)
+			return
+		}
+		recorded := b.history.start(r, "/api/generate", req.Model, session.ID(), b.holder.identity(session.ID()))
+		cached := b.cache.lookup(w, r, req.Options, params, entry.Base, b.holder.identity(session.ID()))
+		var err error
+		result := cached.hit()
+		if result != nil {
+			// Cached answers cost the host nothing, so they are not
+			// charged to token budgets.
+			admitted.done(0, 0)
+			admitted = &admission{}
+			capturing(r.Context()).sample(params, result, nil)
+			obs.cacheHit()
+			timing.startSampling()
+			timing.endSampling()
+		} else {
+			sampleCtx, sampleSpan := b.tracer.startSampling(r.Context(), session, req.Model, params)
+			obs.startSampling()
+			timing.startSampling()
+			result, err = b.holder.createMessage(sampleCtx, session, params)
+			timing.endSampling()
+			obs.endSampling()
+			sampleSpan.finishSampling(result, err)
+			if err == nil {
+				cached.save(result)
+			}
+		}
+		timing.setHeader(w)
 		if err != nil {
+			admitted.done(0, 0)
+			audited.finish(http.StatusBadGateway, nil, "", err)
+			recorded.generate(&req, nil, err)
 			writeError(w, logger, http.StatusBadGateway, fmt.Sprintf("sampling failed: %v", err))
 			return
 		}
+		hookReq.Result = result
+		if err := b.hooks.postSample(r.Context(), hookReq); err != nil {
+			admitted.done(tokenUsage(params, result, extractTextContent(result.Content)))
+			audited.finish(hookErrorStatus(err), nil, "", err)
+			recorded.generate(&req, nil, err)
+			writeHookError(w, logger, err)
+			return
+		}
 
-		text := extractTextContent(result.Content)
+		// The audit log gets the text as the host saw it, so that
+		// restored secrets do not reach it.
+		hostText := redacted.redactResponse(extractTextContent(result.Content))
+		text := redacted.restore(hostText)
+		redacted.log(logger)
+		// The host generated any echo of the prompt too, so it counts.
+		promptTokens, evalTokens := tokenUsage(params, result, text)
+		admitted.done(promptTokens, evalTokens)
+		if req.Suffix != "" && !req.Raw {
+			text = stripInfillEcho(text, req.Prompt, req.Suffix)
+			hostText = stripInfillEcho(hostText, req.Prompt, req.Suffix)
+		}
+		audited.finish(http.StatusOK, result, hostText, nil)
+		obs.finish(result.StopReason, promptTokens, evalTokens)
+		_, writeSpan := b.tracer.start(r.Context(), "write response", spanKindInternal)
+		defer writeSpan.finish(nil)
 		now := time.Now()
 		stopReason := mcpStopReason(result.StopReason)
 
@@ -441,7 +1449,30 @@ func handleGenerate(holder *sessionHolder, defaultMaxTokens int, logger *slog.Lo
 			model = "default"
 		}
 
+		// Like Ollama, raw requests do not return a context.
+		var conversationContext []int
+		if !req.Raw {
+			conversationContext = b.conversations.save(append(turns[:len(turns):len(turns)], &mcp.SamplingMessage{
+				Role:    mcp.Role("assistant"),
+				Content: &mcp.TextContent{Text: text},
+			}))
+		}
+
+		resp := GenerateResponse{
+			Model:           model,
+			CreatedAt:       now,
+			Response:        text,
+			Done:            true,
+			DoneReason:      stopReason,
+			Context:         conversationContext,
+			PromptEvalCount: promptTokens,
+			EvalCount:       evalTokens,
+		}
+		resp.TotalDuration, resp.LoadDuration, resp.PromptEvalDuration, resp.EvalDuration = timing.ollamaDurations(promptTokens, evalTokens)
+		recorded.generate(&req, &resp, nil)
+
 		streaming := req.Stream == nil || *req.Stream
+		timing.startWrite(w)
 		if streaming {
 			w.Header().Set("Content-Type", "application/x-ndjson")
 			writeNDJSON(w, GenerateResponse{
@@ -450,28 +1481,26 @@ func handleGenerate(holder *sessionHolder, defaultMaxTokens int, logger *slog.Lo
 				Response:  text,
 				Done:      false,
 			})
-			writeNDJSON(w, GenerateResponse{
-				Model:      model,
-				CreatedAt:  now,
-				Response:   "",
-				Done:       true,
-				DoneReason: stopReason,
-				EvalCount:  len(text),
-			})
+			// The final chunk carries the statistics without the text,
+			// and its total includes writing the text.
+			done := resp
+			done.Response = ""
+			done.TotalDuration = int64(timing.total())
+			writeNDJSON(w, done)
 		} else {
 			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(GenerateResponse{
-				Model:      model,
-				CreatedAt:  now,
-				Response:   text,
-				Done:       true,
-				DoneReason: stopReason,
-				EvalCount:  len(text),
-			})
+			json.NewEncoder(w).Encode(resp)
 		}
+		timing.endWrite(w)
 	}
 }
 
+func writeModelNotFound(w http.ResponseWriter, name string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusNotFound)
+	json.NewEncoder(w).Encode(ErrorResponse{Error: fmt.Sprintf("model %q not found", name)})
+}
+
 func writeError(w http.ResponseWriter, logger *slog.Logger, status int, msg string) {
 	logger.Error("HTTP error", "status", status, "message", msg)
 	w.Header().Set("Content-Type", "application/json")
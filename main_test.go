@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
@@ -11,6 +12,7 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/modelcontextprotocol/go-sdk/mcp"
 )
@@ -49,6 +51,17 @@ func (m *mockSession) CreateMessage(ctx context.Context, params *mcp.CreateMessa
 	return &mcp.CreateMessageResult{}, nil
 }
 
+func testBridge(h *sessionHolder, logger *slog.Logger) *bridge {
+	models, _ := newModelRegistry(modelsFromNames([]string{"llama3"}), "")
+	return &bridge{
+		holder:           h,
+		models:           models,
+		defaultMaxTokens: 4096,
+		conversations:    newConversationStore(time.Hour, 100, 0),
+		logger:           logger,
+	}
+}
+
 func TestSessionHolder(t *testing.T) {
 	h := newSessionHolder()
 
@@ -80,6 +93,40 @@ func TestSessionHolder(t *testing.T) {
 	}
 }
 
+func TestSessionHolderIdentity(t *testing.T) {
+	h := newSessionHolder()
+	a := &mockSession{id: "a"}
+	b := &mockSession{id: "b"}
+	h.setIdentity("a", "key:alice")
+	h.set(a)
+	h.setIdentity("b", "jwt:https://issuer.example/bob")
+	h.set(b)
+
+	if h.getFor("") != b {
+		t.Error("expected unrestricted clients to get the latest session")
+	}
+	if h.getFor("key:alice") != a || h.getFor("jwt:https://issuer.example/bob") != b {
+		t.Error("expected clients to be routed to their identity's session")
+	}
+	if h.getFor("carol") != nil || h.getFor("cert:alice") != nil {
+		t.Error("expected no session for an unknown identity")
+	}
+	h.remove("a")
+	if h.getFor("key:alice") != nil || h.identity("a") != "" {
+		t.Error("expected identity to be forgotten with its session")
+	}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	handler := handleChat(testBridge(h, logger))
+	req := httptest.NewRequest(http.MethodPost, "/api/chat", strings.NewReader(`{"model":"llama3","messages":[{"role":"user","content":"hi"}]}`))
+	req = req.WithContext(withClient(req.Context(), &clientIdentity{Label: "ci", MCPIdentity: "key:alice"}))
+	w := httptest.NewRecorder()
+	handler(w, req)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 without a session for the client's identity, got %d", w.Code)
+	}
+}
+
 func TestHandleHealth(t *testing.T) {
 	req := httptest.NewRequest("GET", "/", nil)
 	rr := httptest.NewRecorder()
@@ -115,7 +162,10 @@ func TestHandleVersion(t *testing.T) {
 }
 
 func TestHandleTags(t *testing.T) {
-	models := []string{"llama3", "codellama"}
+	models, err := newModelRegistry(modelsFromNames([]string{"llama3", "codellama"}), "")
+	if err != nil {
+		t.Fatal(err)
+	}
 	handler := handleTags(models)
 
 	req := httptest.NewRequest("GET", "/api/tags", nil)
@@ -160,7 +210,7 @@ func TestHandleChat(t *testing.T) {
 		req := httptest.NewRequest("POST", "/api/chat", strings.NewReader(reqBody))
 		rr := httptest.NewRecorder()
 
-		handler := handleChat(h, 4096, logger)
+		handler := handleChat(testBridge(h, logger))
 		handler.ServeHTTP(rr, req)
 
 		if rr.Code != http.StatusOK {
@@ -186,7 +236,7 @@ func TestHandleChat(t *testing.T) {
 		req := httptest.NewRequest("POST", "/api/chat", strings.NewReader(reqBody))
 		rr := httptest.NewRecorder()
 
-		handler := handleChat(h, 4096, logger)
+		handler := handleChat(testBridge(h, logger))
 		handler.ServeHTTP(rr, req)
 
 		if rr.Code != http.StatusServiceUnavailable {
@@ -208,7 +258,7 @@ func TestHandleChat(t *testing.T) {
 		req := httptest.NewRequest("POST", "/api/chat", strings.NewReader(reqBody))
 		rr := httptest.NewRecorder()
 
-		handler := handleChat(h, 4096, logger)
+		handler := handleChat(testBridge(h, logger))
 		handler.ServeHTTP(rr, req)
 
 		if rr.Code != http.StatusBadGateway {
@@ -235,7 +285,7 @@ func TestHandleChatStreaming(t *testing.T) {
 	req := httptest.NewRequest("POST", "/api/chat", strings.NewReader(reqBody))
 	rr := httptest.NewRecorder()
 
-	handler := handleChat(h, 4096, logger)
+	handler := handleChat(testBridge(h, logger))
 	handler.ServeHTTP(rr, req)
 
 	if rr.Code != http.StatusOK {
@@ -285,7 +335,7 @@ func TestHandleGenerate(t *testing.T) {
 	req := httptest.NewRequest("POST", "/api/generate", strings.NewReader(reqBody))
 	rr := httptest.NewRecorder()
 
-	handler := handleGenerate(h, 4096, logger)
+	handler := handleGenerate(testBridge(h, logger))
 	handler.ServeHTTP(rr, req)
 
 	if rr.Code != http.StatusOK {
@@ -309,10 +359,344 @@ func TestHandleChatMalformedJSON(t *testing.T) {
 	req := httptest.NewRequest("POST", "/api/chat", strings.NewReader(reqBody))
 	rr := httptest.NewRecorder()
 
-	handler := handleChat(h, 4096, logger)
+	handler := handleChat(testBridge(h, logger))
 	handler.ServeHTTP(rr, req)
 
 	if rr.Code != http.StatusBadRequest {
 		t.Errorf("expected 400, got %d", rr.Code)
 	}
 }
+
+func TestHandleCopyDelete(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	models, err := newModelRegistry(modelsFromNames([]string{"llama3"}), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	copyHandler := handleCopy(models, logger)
+	deleteHandler := handleDelete(models, logger)
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		body    string
+		status  int
+	}{
+		{"copy", copyHandler, `{"source": "llama3", "destination": "alias"}`, http.StatusOK},
+		{"copy missing source", copyHandler, `{"source": "nope", "destination": "x"}`, http.StatusNotFound},
+		{"copy onto base", copyHandler, `{"source": "alias", "destination": "llama3"}`, http.StatusForbidden},
+		{"copy without destination", copyHandler, `{"source": "llama3"}`, http.StatusBadRequest},
+		{"delete base", deleteHandler, `{"model": "llama3"}`, http.StatusForbidden},
+		{"delete alias", deleteHandler, `{"model": "alias"}`, http.StatusOK},
+		{"delete again", deleteHandler, `{"model": "alias"}`, http.StatusNotFound},
+		{"delete without model", deleteHandler, `{}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", "/", strings.NewReader(tt.body))
+		rr := httptest.NewRecorder()
+		tt.handler.ServeHTTP(rr, req)
+		if rr.Code != tt.status {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.status, rr.Code)
+		}
+	}
+
+	// Pull reports unknown models the same way.
+	req := httptest.NewRequest("POST", "/api/pull", strings.NewReader(`{"model": "alias"}`))
+	rr := httptest.NewRecorder()
+	handlePull(models, false, logger).ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected pull of deleted model to return 404, got %d", rr.Code)
+	}
+	var resp ErrorResponse
+	json.NewDecoder(rr.Body).Decode(&resp)
+	if resp.Error != `model "alias" not found` {
+		t.Errorf("unexpected error message %q", resp.Error)
+	}
+}
+
+func TestHandleChatAliasHint(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	h := newSessionHolder()
+	var hint string
+	h.set(&mockSession{
+		id: "s1",
+		createMessageFunc: func(ctx context.Context, params *mcp.CreateMessageParams) (*mcp.CreateMessageResult, error) {
+			hint = params.ModelPreferences.Hints[0].Name
+			return &mcp.CreateMessageResult{Content: &mcp.TextContent{Text: "ok"}}, nil
+		},
+	})
+	b := testBridge(h, logger)
+	if err := b.models.copy("llama3", "my-llama"); err != nil {
+		t.Fatal(err)
+	}
+
+	reqBody := `{"model": "my-llama", "messages": [{"role": "user", "content": "hi"}], "stream": false}`
+	req := httptest.NewRequest("POST", "/api/chat", strings.NewReader(reqBody))
+	rr := httptest.NewRecorder()
+	handleChat(b).ServeHTTP(rr, req)
+
+	if hint != "llama3" {
+		t.Errorf("expected alias to resolve to hint 'llama3', got %q", hint)
+	}
+	var resp ChatResponse
+	json.NewDecoder(rr.Body).Decode(&resp)
+	if resp.Model != "my-llama" {
+		t.Errorf("expected response model 'my-llama', got %q", resp.Model)
+	}
+}
+
+// initSession is a mock session that reports initialize parameters, as
+// *mcp.ServerSession does.
+type initSession struct {
+	mockSession
+	params *mcp.InitializeParams
+}
+
+func (s *initSession) InitializeParams() *mcp.InitializeParams { return s.params }
+
+func TestHandleShow(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	temp := 0.2
+	h := newSessionHolder()
+	models, err := newModelRegistry([]modelEntry{{
+		Name:          "coder",
+		Base:          "claude",
+		ContextLength: 8192,
+		System:        "You write code.",
+		Parameters:    &Options{Temperature: &temp},
+	}}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := testBridge(h, logger)
+	b.models = models
+
+	show := func(body string) (int, ShowResponse) {
+		req := httptest.NewRequest("POST", "/api/show", strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		handleShow(b).ServeHTTP(rr, req)
+		var resp ShowResponse
+		json.NewDecoder(rr.Body).Decode(&resp)
+		return rr.Code, resp
+	}
+
+	if code, _ := show(`{"model": "missing"}`); code != http.StatusNotFound {
+		t.Errorf("expected 404 for unknown model, got %d", code)
+	}
+
+	code, resp := show(`{"model": "coder"}`)
+	if code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if resp.System != "You write code." {
+		t.Errorf("unexpected system %q", resp.System)
+	}
+	if resp.Parameters != "temperature                    0.2" {
+		t.Errorf("unexpected parameters %q", resp.Parameters)
+	}
+	if !strings.Contains(resp.Modelfile, "FROM claude\n") || !strings.Contains(resp.Modelfile, "PARAMETER temperature 0.2\n") {
+		t.Errorf("unexpected modelfile %q", resp.Modelfile)
+	}
+	if got := resp.ModelInfo["mcp.context_length"]; got != float64(8192) {
+		t.Errorf("expected context length 8192, got %v", got)
+	}
+	if !reflect.DeepEqual(resp.Capabilities, []string{"completion"}) {
+		t.Errorf("expected only completion without a session, got %v", resp.Capabilities)
+	}
+
+	h.set(&initSession{
+		mockSession: mockSession{id: "s1"},
+		params: &mcp.InitializeParams{
+			ClientInfo: &mcp.Implementation{Name: "host", Version: "1.0"},
+			Capabilities: &mcp.ClientCapabilities{
+				Sampling: &mcp.SamplingCapabilities{},
+				// Non-standard capabilities are ignored.
+				Experimental: map[string]any{
+					"sampling": map[string]any{"tools": map[string]any{}, "vision": map[string]any{}},
+				},
+			},
+		},
+	})
+	_, resp = show(`{"model": "coder", "verbose": true}`)
+	if !reflect.DeepEqual(resp.Capabilities, []string{"completion"}) {
+		t.Errorf("unexpected capabilities %v", resp.Capabilities)
+	}
+	if resp.ModelInfo["samplellama.host.name"] != "host" {
+		t.Errorf("expected verbose model_info to include host name, got %v", resp.ModelInfo)
+	}
+
+	// A host without the sampling capability cannot complete.
+	h.set(&initSession{
+		mockSession: mockSession{id: "s1"},
+		params:      &mcp.InitializeParams{Capabilities: &mcp.ClientCapabilities{}},
+	})
+	if _, resp = show(`{"model": "coder"}`); len(resp.Capabilities) != 0 {
+		t.Errorf("expected no capabilities without sampling, got %v", resp.Capabilities)
+	}
+}
+
+func TestHandlePullStreaming(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	models, err := newModelRegistry(modelsFromNames([]string{"llama3"}), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("POST", "/api/pull", strings.NewReader(`{"model": "llama3"}`))
+	rr := httptest.NewRecorder()
+	handlePull(models, false, logger).ServeHTTP(rr, req)
+
+	if ct := rr.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("expected NDJSON content type, got %q", ct)
+	}
+	var statuses []string
+	var layer ProgressResponse
+	dec := json.NewDecoder(rr.Body)
+	for dec.More() {
+		var p ProgressResponse
+		if err := dec.Decode(&p); err != nil {
+			t.Fatal(err)
+		}
+		statuses = append(statuses, p.Status)
+		if p.Digest != "" {
+			layer = p
+		}
+	}
+	want := []string{"pulling manifest", "pulling", "pulling", "verifying sha256 digest", "writing manifest", "success"}
+	if len(statuses) != len(want) {
+		t.Fatalf("expected %d progress lines, got %v", len(want), statuses)
+	}
+	for i, w := range want {
+		if !strings.HasPrefix(statuses[i], w) {
+			t.Errorf("line %d: expected status %q, got %q", i, w, statuses[i])
+		}
+	}
+	if layer.Total == 0 || layer.Completed != layer.Total {
+		t.Errorf("expected completed layer progress, got %+v", layer)
+	}
+
+	// Unknown models are created when allowed.
+	req = httptest.NewRequest("POST", "/api/pull", strings.NewReader(`{"model": "gpt-5", "stream": false}`))
+	rr = httptest.NewRecorder()
+	handlePull(models, true, logger).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	if e, ok := models.lookup("gpt-5"); !ok || e.Base != "gpt-5" {
+		t.Errorf("expected gpt-5 to be created as a hint-only alias, got %+v", e)
+	}
+	if err := models.delete("gpt-5"); err != nil {
+		t.Errorf("expected pulled model to be deletable: %v", err)
+	}
+}
+
+func TestHandleGenerateContext(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	h := newSessionHolder()
+	var seen []*mcp.SamplingMessage
+	h.set(&mockSession{
+		id: "s1",
+		createMessageFunc: func(ctx context.Context, params *mcp.CreateMessageParams) (*mcp.CreateMessageResult, error) {
+			seen = params.Messages
+			return &mcp.CreateMessageResult{Content: &mcp.TextContent{Text: fmt.Sprintf("reply %d", len(params.Messages))}}, nil
+		},
+	})
+	handler := handleGenerate(testBridge(h, logger))
+
+	generate := func(body string) GenerateResponse {
+		req := httptest.NewRequest("POST", "/api/generate", strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		var resp GenerateResponse
+		if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	first := generate(`{"model": "llama3", "prompt": "My name is Ann.", "stream": false}`)
+	if len(first.Context) == 0 {
+		t.Fatal("expected a context in the response")
+	}
+	ctxJSON, _ := json.Marshal(first.Context)
+
+	generate(fmt.Sprintf(`{"model": "llama3", "prompt": "What is my name?", "context": %s, "stream": false}`, ctxJSON))
+	if len(seen) != 3 {
+		t.Fatalf("expected history plus prompt (3 messages), got %d", len(seen))
+	}
+	texts := []string{"My name is Ann.", "reply 1", "What is my name?"}
+	for i, want := range texts {
+		if got := extractTextContent(seen[i].Content); got != want {
+			t.Errorf("message %d: expected %q, got %q", i, want, got)
+		}
+	}
+	if seen[1].Role != mcp.Role("assistant") {
+		t.Errorf("expected prior response as assistant turn, got %q", seen[1].Role)
+	}
+
+	generate(`{"model": "llama3", "prompt": "Hi", "context": [1, 2, 3], "stream": false}`)
+	if len(seen) != 1 {
+		t.Errorf("expected foreign context to be ignored, got %d messages", len(seen))
+	}
+}
+
+func TestHandleGenerateTemplateAndRaw(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	h := newSessionHolder()
+	var seen *mcp.CreateMessageParams
+	h.set(&mockSession{
+		id: "s1",
+		createMessageFunc: func(ctx context.Context, params *mcp.CreateMessageParams) (*mcp.CreateMessageResult, error) {
+			seen = params
+			return &mcp.CreateMessageResult{Content: &mcp.TextContent{Text: "ok"}}, nil
+		},
+	})
+	b := testBridge(h, logger)
+	models, err := newModelRegistry([]modelEntry{{
+		Name:     "llama3",
+		System:   "Model system.",
+		Template: "<s>{{ .System }}</s>{{ .Prompt }}",
+	}}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.models = models
+	handler := handleGenerate(b)
+
+	generate := func(body string) (int, GenerateResponse) {
+		req := httptest.NewRequest("POST", "/api/generate", strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		var resp GenerateResponse
+		json.NewDecoder(rr.Body).Decode(&resp)
+		return rr.Code, resp
+	}
+
+	generate(`{"model": "llama3", "prompt": "Hi", "stream": false}`)
+	if got := extractTextContent(seen.Messages[0].Content); got != "<s>Model system.</s>Hi" {
+		t.Errorf("expected model template to be applied, got %q", got)
+	}
+	if seen.SystemPrompt != "" {
+		t.Errorf("expected system prompt to be rendered into the template, got %q", seen.SystemPrompt)
+	}
+
+	generate(`{"model": "llama3", "prompt": "Hi", "template": "Q: {{ .Prompt }}", "stream": false}`)
+	if got := extractTextContent(seen.Messages[0].Content); got != "Q: Hi" {
+		t.Errorf("expected request template to win, got %q", got)
+	}
+
+	_, resp := generate(`{"model": "llama3", "prompt": "[INST]Hi[/INST]", "raw": true, "stream": false}`)
+	if got := extractTextContent(seen.Messages[0].Content); got != "[INST]Hi[/INST]" || seen.SystemPrompt != "" {
+		t.Errorf("expected verbatim raw prompt without system, got %q / %q", got, seen.SystemPrompt)
+	}
+	if len(resp.Context) != 0 {
+		t.Error("expected no context for raw requests")
+	}
+
+	if code, _ := generate(`{"model": "llama3", "prompt": "Hi", "raw": true, "system": "x"}`); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for raw with system, got %d", code)
+	}
+	if code, _ := generate(`{"model": "llama3", "prompt": "Hi", "template": "{{ .Nope }}"}`); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a broken template, got %d", code)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/modelcontextprotocol/go-sdk/auth"
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+	"github.com/modelcontextprotocol/go-sdk/oauthex"
+)
+
+// staticTokenLifetime is the expiry reported for static MCP tokens. They
+// do not expire, but the SDK requires every token to carry an expiry.
+const staticTokenLifetime = time.Hour
+
+// mcpSubjectHeader carries the verified client certificate subject of an
+// MCP HTTP request to the session handlers, which only see request headers.
+// It is always overwritten, so clients cannot supply it themselves.
+const mcpSubjectHeader = "Samplellama-Client-Subject"
+
+// MCP identities are qualified by how the host authenticated, so that a
+// JWT subject or certificate name equal to a static key's label does not
+// pass for that key: "key:<label>", "jwt:<iss>/<sub>" or "cert:<subject>".
+// The mcp_identity of -api-keys entries uses the same form.
+const (
+	identityKeyPrefix  = "key:"
+	identityJWTPrefix  = "jwt:"
+	identityCertPrefix = "cert:"
+)
+
+// validMCPIdentity reports whether identity is in the qualified form.
+func validMCPIdentity(identity string) bool {
+	for _, prefix := range []string{identityKeyPrefix, identityJWTPrefix, identityCertPrefix} {
+		if rest, ok := strings.CutPrefix(identity, prefix); ok && rest != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// newMCPTokenVerifier accepts bearer tokens from the static key store or,
+// failing that, JWTs signed by the configured JWKS. Either may be nil.
+func newMCPTokenVerifier(keys *apiKeyStore, jwks *jwtVerifier, logger *slog.Logger) auth.TokenVerifier {
+	return func(ctx context.Context, token string, r *http.Request) (*auth.TokenInfo, error) {
+		if keys != nil {
+			if c := keys.authenticate(token); c != nil {
+				return &auth.TokenInfo{
+					UserID:     identityKeyPrefix + c.Label,
+					Expiration: time.Now().Add(staticTokenLifetime),
+				}, nil
+			}
+		}
+		if jwks != nil {
+			claims, err := jwks.verify(token)
+			if err != nil {
+				logger.Warn("Rejected MCP access token", "remote", r.RemoteAddr, "error", err)
+				return nil, fmt.Errorf("%w: %v", auth.ErrInvalidToken, err)
+			}
+			user := claims.Subject
+			if user == "" {
+				user = claims.ClientID
+			}
+			return &auth.TokenInfo{
+				UserID:     identityJWTPrefix + claims.Issuer + "/" + user,
+				Scopes:     claims.scopes(),
+				Expiration: time.Unix(*claims.ExpiresAt, 0),
+				Extra:      map[string]any{"iss": claims.Issuer, "client_id": claims.ClientID},
+			}, nil
+		}
+		logger.Warn("Unknown MCP bearer token", "remote", r.RemoteAddr)
+		return nil, auth.ErrInvalidToken
+	}
+}
+
+// withCertSubject records the verified client certificate subject of each
+// request in mcpSubjectHeader, discarding any value sent by the client.
+func withCertSubject(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del(mcpSubjectHeader)
+		if subject := certSubject(r); subject != "" {
+			r.Header.Set(mcpSubjectHeader, subject)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// mcpIdentity returns the authenticated identity of an MCP request: the
+// bearer token's user, else the client certificate subject, else "".
+// Both are qualified by their mechanism.
+func mcpIdentity(extra *mcp.RequestExtra) string {
+	if extra == nil {
+		return ""
+	}
+	if extra.TokenInfo != nil && extra.TokenInfo.UserID != "" {
+		return extra.TokenInfo.UserID
+	}
+	if extra.Header != nil {
+		if subject := extra.Header.Get(mcpSubjectHeader); subject != "" {
+			return identityCertPrefix + subject
+		}
+	}
+	return ""
+}
+
+// recordMCPIdentity stores the authenticated identity of each session in
+// holder when the session is initialized. It runs as receiving middleware
+// because the SDK does not pass transport details to InitializedHandler.
+func recordMCPIdentity(holder *sessionHolder) mcp.Middleware {
+	return func(next mcp.MethodHandler) mcp.MethodHandler {
+		return func(ctx context.Context, method string, req mcp.Request) (mcp.Result, error) {
+			if method == "notifications/initialized" {
+				holder.setIdentity(req.GetSession().ID(), mcpIdentity(req.GetExtra()))
+			}
+			return next(ctx, method, req)
+		}
+	}
+}
+
+// mcpAuthConfig configures authentication of the MCP Streamable HTTP
+// endpoint.
+type mcpAuthConfig struct {
+	// keys holds static bearer tokens for MCP hosts.
+	keys *apiKeyStore
+	// jwks verifies OAuth access tokens issued as JWTs.
+	jwks *jwtVerifier
+	// resource is the canonical URL of the MCP endpoint. When set, its
+	// protected resource metadata (RFC 9728) is served and advertised in
+	// 401 responses.
+	resource string
+	// authorizationServers are advertised in the resource metadata.
+	authorizationServers []string
+	// clientCA is set when the listener verifies client certificates.
+	clientCA bool
+}
+
+func (c mcpAuthConfig) requiresToken() bool {
+	return c.keys != nil || c.jwks != nil
+}
+
+// resourceMetadataPath returns the well-known path of the protected
+// resource metadata for resource, and its full URL.
+func resourceMetadataPath(resource string) (path, metadataURL string, err error) {
+	u, err := url.Parse(resource)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return "", "", fmt.Errorf("invalid resource URL %q", resource)
+	}
+	path = "/.well-known/oauth-protected-resource" + strings.TrimSuffix(u.Path, "/")
+	return path, u.Scheme + "://" + u.Host + path, nil
+}
+
+// newMCPHTTPHandler serves the MCP Streamable HTTP transport, requiring a
+// valid bearer token when tokens are configured and recording the client
+// certificate subject when client certificates are verified.
+func newMCPHTTPHandler(server *mcp.Server, cfg mcpAuthConfig, logger *slog.Logger) (http.Handler, error) {
+	streamable := mcp.NewStreamableHTTPHandler(func(r *http.Request) *mcp.Server {
+		return server
+	}, nil)
+	var h http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var user string
+		if info := auth.TokenInfoFromContext(r.Context()); info != nil {
+			user = info.UserID
+		}
+		logger.Info("MCP HTTP request", "method", r.Method, "client", clientLabel(r.Context()), "mcp_identity", user)
+		streamable.ServeHTTP(w, r)
+	})
+
+	mux := http.NewServeMux()
+	var opts auth.RequireBearerTokenOptions
+	if cfg.resource != "" {
+		path, metadataURL, err := resourceMetadataPath(cfg.resource)
+		if err != nil {
+			return nil, err
+		}
+		mux.Handle(path, auth.ProtectedResourceMetadataHandler(&oauthex.ProtectedResourceMetadata{
+			Resource:               cfg.resource,
+			AuthorizationServers:   cfg.authorizationServers,
+			BearerMethodsSupported: []string{"header"},
+		}))
+		opts.ResourceMetadataURL = metadataURL
+	}
+	if cfg.requiresToken() {
+		h = auth.RequireBearerToken(newMCPTokenVerifier(cfg.keys, cfg.jwks, logger), &opts)(h)
+	}
+	mux.Handle("/", h)
+
+	handler := withCertSubject(mux)
+	if cfg.clientCA {
+		handler = clientAuth(nil, false, logger, handler)
+	}
+	return handler, nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// bearerTransport adds a bearer token to every request.
+type bearerTransport struct {
+	token string
+}
+
+func (t bearerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.Header.Set("Authorization", "Bearer "+t.token)
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestMCPHTTPAuth(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	keys, err := newAPIKeyStore([]apiKey{{Key: "host-secret", Label: "desktop"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwtKeys, path := writeTestJWKS(t)
+	jwks, err := loadJWKS(path, "", "https://mcp.example/mcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	holder := newSessionHolder()
+	identities := make(chan string, 1)
+	server := mcp.NewServer(&mcp.Implementation{Name: "test"}, &mcp.ServerOptions{
+		InitializedHandler: func(ctx context.Context, req *mcp.InitializedRequest) {
+			identities <- holder.identity(req.Session.ID())
+		},
+	})
+	server.AddReceivingMiddleware(recordMCPIdentity(holder))
+	handler, err := newMCPHTTPHandler(server, mcpAuthConfig{
+		keys:                 keys,
+		jwks:                 jwks,
+		resource:             "https://mcp.example/mcp",
+		authorizationServers: []string{"https://issuer.example"},
+	}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	// Unauthenticated requests are rejected and pointed at the metadata.
+	resp, err := http.Post(srv.URL, "application/json", strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", resp.StatusCode)
+	}
+	want := "Bearer resource_metadata=https://mcp.example/.well-known/oauth-protected-resource/mcp"
+	if got := resp.Header.Get("WWW-Authenticate"); got != want {
+		t.Errorf("WWW-Authenticate = %q, want %q", got, want)
+	}
+
+	resp, err = http.Get(srv.URL + "/.well-known/oauth-protected-resource/mcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var meta struct {
+		Resource             string   `json:"resource"`
+		AuthorizationServers []string `json:"authorization_servers"`
+	}
+	json.NewDecoder(resp.Body).Decode(&meta)
+	resp.Body.Close()
+	if meta.Resource != "https://mcp.example/mcp" || len(meta.AuthorizationServers) != 1 {
+		t.Errorf("unexpected metadata: %+v", meta)
+	}
+
+	token := signJWT(t, "RS256", "rsa", jwtKeys.rsa, map[string]any{
+		"sub": "oauth-host",
+		"iss": "https://issuer.example",
+		"aud": "https://mcp.example/mcp",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	// A token whose subject is a static key's label does not get that
+	// key's identity.
+	impostor := signJWT(t, "RS256", "rsa", jwtKeys.rsa, map[string]any{
+		"sub": "desktop",
+		"aud": "https://mcp.example/mcp",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	for _, tt := range []struct {
+		token, identity string
+	}{
+		{"host-secret", "key:desktop"},
+		{token, "jwt:https://issuer.example/oauth-host"},
+		{impostor, "jwt:/desktop"},
+	} {
+		client := mcp.NewClient(&mcp.Implementation{Name: "host"}, nil)
+		cs, err := client.Connect(context.Background(), &mcp.StreamableClientTransport{
+			Endpoint:   srv.URL,
+			HTTPClient: &http.Client{Transport: bearerTransport{tt.token}},
+		}, nil)
+		if err != nil {
+			t.Fatalf("%s: connect: %v", tt.identity, err)
+		}
+		select {
+		case got := <-identities:
+			if got != tt.identity {
+				t.Errorf("session identity = %q, want %q", got, tt.identity)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("session was not initialized")
+		}
+		cs.Close()
+	}
+
+	client := mcp.NewClient(&mcp.Implementation{Name: "host"}, nil)
+	if _, err := client.Connect(context.Background(), &mcp.StreamableClientTransport{
+		Endpoint:   srv.URL,
+		HTTPClient: &http.Client{Transport: bearerTransport{"wrong"}},
+		MaxRetries: -1,
+	}, nil); err == nil {
+		t.Error("expected connection with an unknown token to fail")
+	}
+}
+
+func TestMCPIdentityHeaderNotTrusted(t *testing.T) {
+	var got string
+	h := withCertSubject(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = mcpIdentity(&mcp.RequestExtra{Header: r.Header})
+	}))
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	req.Header.Set(mcpSubjectHeader, "admin")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if got != "" {
+		t.Errorf("client-supplied subject header was trusted: %q", got)
+	}
+	if got := mcpIdentity(&mcp.RequestExtra{Header: http.Header{"Samplellama-Client-Subject": {"desktop"}}}); got != "cert:desktop" {
+		t.Errorf("certificate identity = %q, want cert:desktop", got)
+	}
+}
+
+func TestMCPIdentityRouting(t *testing.T) {
+	for _, identity := range []string{"key:desktop", "jwt:https://issuer.example/host", "cert:host.example"} {
+		if _, err := newAPIKeyStore([]apiKey{{Key: "k", MCPIdentity: identity}}); err != nil {
+			t.Errorf("mcp_identity %q: %v", identity, err)
+		}
+	}
+	for _, identity := range []string{"desktop", "key:", "user:desktop"} {
+		if _, err := newAPIKeyStore([]apiKey{{Key: "k", MCPIdentity: identity}}); err == nil {
+			t.Errorf("accepted unqualified mcp_identity %q", identity)
+		}
+	}
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// samplingBuckets are the upper bounds, in seconds, of the sampling latency
+// histogram. Sampling takes seconds to minutes, so the buckets are wider
+// than Prometheus' defaults.
+var samplingBuckets = []float64{0.25, 0.5, 1, 2.5, 5, 10, 20, 30, 60, 120, 300}
+
+// requestKey labels samplellama_requests_total.
+type requestKey struct {
+	endpoint, model, status, stopReason string
+}
+
+// modelKey labels the per-endpoint and per-model series.
+type modelKey struct {
+	endpoint, model string
+}
+
+// summaryKey labels samplellama_summaries_total.
+type summaryKey struct {
+	model, result string
+}
+
+type histogram struct {
+	counts []int64 // per bucket, not cumulative; the last is +Inf
+	sum    float64
+	count  int64
+}
+
+func (h *histogram) observe(v float64) {
+	i, _ := slices.BinarySearch(samplingBuckets, v)
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+// metrics collects the counters exposed at /metrics in the Prometheus text
+// format. It is written by hand to avoid a dependency on the client
+// library. Session gauges and redaction counts are read at scrape time.
+type metrics struct {
+	mu           sync.Mutex
+	requests     map[requestKey]int64
+	latency      map[modelKey]*histogram
+	promptTokens map[modelKey]int64
+	evalTokens   map[modelKey]int64
+	summaries    map[summaryKey]int64
+
+	queued      atomic.Int64
+	inFlight    atomic.Int64
+	connects    atomic.Int64
+	disconnects atomic.Int64
+
+	holder *sessionHolder
+	models *modelRegistry
+	redact *redactor
+	cache  *responseCache
+	tracer *tracer
+	// feed receives completed sampling requests for the dashboard.
+	feed *activityFeed
+}
+
+func newMetrics(holder *sessionHolder, models *modelRegistry, redact *redactor) *metrics {
+	return &metrics{
+		requests:     make(map[requestKey]int64),
+		latency:      make(map[modelKey]*histogram),
+		promptTokens: make(map[modelKey]int64),
+		evalTokens:   make(map[modelKey]int64),
+		summaries:    make(map[summaryKey]int64),
+		holder:       holder,
+		models:       models,
+		redact:       redact,
+	}
+}
+
+func (m *metrics) sessionConnected() {
+	if m != nil {
+		m.connects.Add(1)
+	}
+}
+
+func (m *metrics) sessionDisconnected() {
+	if m != nil {
+		m.disconnects.Add(1)
+	}
+}
+
+type observationKey struct{}
+
+// observation collects what a handler learns about a request, such as the
+// model and stop reason, for the counters recorded when it completes.
+type observation struct {
+	m              *metrics
+	model          string
+	stopReason     string
+	queued         bool
+	samplingStart  time.Time
+	sampling       bool
+	promptTokens   int
+	evalTokens     int
+	samplingLength time.Duration
+	cached         bool
+	// summarized is the outcome of summarizing the chat history, "ok"
+	// or "error", or "" if there was none, with the tokens it took.
+	summarized          string
+	summaryPromptTokens int
+	summaryEvalTokens   int
+}
+
+// observe returns the request's observation, or nil if metrics are off.
+// All observation methods accept a nil receiver.
+func observe(ctx context.Context) *observation {
+	o, _ := ctx.Value(observationKey{}).(*observation)
+	return o
+}
+
+// setModel records the requested model. Names that are not registered
+// are reported as "other", so that clients cannot create series at will.
+func (o *observation) setModel(name string) {
+	if o == nil {
+		return
+	}
+	if name == "" {
+		name = "default"
+	}
+	if _, ok := o.m.models.lookup(name); !ok {
+		name = "other"
+	}
+	o.model = name
+}
+
+// enqueue marks the request as waiting to be sent to the MCP host.
+func (o *observation) enqueue() {
+	if o == nil || o.queued {
+		return
+	}
+	o.queued = true
+	o.m.queued.Add(1)
+}
+
+func (o *observation) dequeue() {
+	if o.queued {
+		o.queued = false
+		o.m.queued.Add(-1)
+	}
+}
+
+// startSampling marks the start of the CreateMessage call.
+func (o *observation) startSampling() {
+	if o == nil {
+		return
+	}
+	o.dequeue()
+	o.sampling = true
+	o.samplingStart = time.Now()
+	o.m.inFlight.Add(1)
+}
+
+// cacheHit marks the request as answered from the response cache.
+func (o *observation) cacheHit() {
+	if o == nil {
+		return
+	}
+	o.dequeue()
+	o.cached = true
+}
+
+// endSampling marks the end of the CreateMessage call.
+func (o *observation) endSampling() {
+	if o == nil || !o.sampling {
+		return
+	}
+	o.sampling = false
+	o.samplingLength = time.Since(o.samplingStart)
+	o.m.inFlight.Add(-1)
+}
+
+// startSummary marks the start of the CreateMessage call that summarizes
+// the chat history.
+func (o *observation) startSummary() {
+	if o != nil {
+		o.m.inFlight.Add(1)
+	}
+}
+
+func (o *observation) endSummary() {
+	if o != nil {
+		o.m.inFlight.Add(-1)
+	}
+}
+
+// summary records the outcome of summarizing the chat history and the
+// tokens it took.
+func (o *observation) summary(promptTokens, evalTokens int, err error) {
+	if o == nil {
+		return
+	}
+	o.summarized = "ok"
+	if err != nil {
+		o.summarized = "error"
+	}
+	o.summaryPromptTokens, o.summaryEvalTokens = promptTokens, evalTokens
+}
+
+// finish records the stop reason and token counts of a
+// completed sampling call.
+func (o *observation) finish(stopReason string, promptTokens, evalTokens int) {
+	if o == nil {
+		return
+	}
+	o.stopReason = stopReasonLabel(stopReason)
+	o.promptTokens = promptTokens
+	o.evalTokens = evalTokens
+}
+
+// stopReasonLabel maps the host's stop reason to one of the reasons the
+// MCP spec defines, or "other", so that a host cannot create unbounded
+// series.
+func stopReasonLabel(stopReason string) string {
+	switch stopReason {
+	case "endTurn", "maxTokens", "stopSequence":
+		return stopReason
+	default:
+		return "other"
+	}
+}
+
+// statusRecorder captures the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// instrument counts the requests served by mux. It must wrap the mux
+// directly: the mux records the matched pattern in the request it is
+// given, which names the endpoint.
+func (m *metrics) instrument(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		o := &observation{m: m}
+		rec := &statusRecorder{ResponseWriter: w}
+		r = r.WithContext(context.WithValue(r.Context(), observationKey{}, o))
+		mux.ServeHTTP(rec, r)
+
+		o.dequeue()
+		o.endSampling()
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		endpoint := "other"
+		if _, path, ok := strings.Cut(r.Pattern, " "); ok && path != "/" {
+			endpoint = strings.TrimSuffix(path, "{$}")
+		}
+		if endpoint == "/api/chat" || endpoint == "/api/generate" {
+			m.feed.request(requestEvent{
+				Time:         start.UTC(),
+				Endpoint:     endpoint,
+				Model:        o.model,
+				Client:       clientLabel(r.Context()),
+				Status:       rec.status,
+				StopReason:   o.stopReason,
+				DurationMS:   time.Since(start).Milliseconds(),
+				SamplingMS:   o.samplingLength.Milliseconds(),
+				PromptTokens: o.promptTokens,
+				EvalTokens:   o.evalTokens,
+				Cached:       o.cached,
+			})
+		}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.requests[requestKey{endpoint, o.model, strconv.Itoa(rec.status), o.stopReason}]++
+		if o.samplingLength > 0 {
+			k := modelKey{endpoint, o.model}
+			h := m.latency[k]
+			if h == nil {
+				h = &histogram{counts: make([]int64, len(samplingBuckets)+1)}
+				m.latency[k] = h
+			}
+			h.observe(o.samplingLength.Seconds())
+			m.promptTokens[k] += int64(o.promptTokens)
+			m.evalTokens[k] += int64(o.evalTokens)
+		}
+		if o.summarized != "" {
+			k := modelKey{endpoint, o.model}
+			m.summaries[summaryKey{o.model, o.summarized}]++
+			m.promptTokens[k] += int64(o.summaryPromptTokens)
+			m.evalTokens[k] += int64(o.summaryEvalTokens)
+		}
+	})
+}
+
+// handler serves the metrics in the Prometheus text exposition format.
+func (m *metrics) handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		bw := bufio.NewWriter(w)
+		m.write(bw)
+		bw.Flush()
+	}
+}
+
+func (m *metrics) write(w *bufio.Writer) {
+	m.mu.Lock()
+	requests := maps.Clone(m.requests)
+	latency := make(map[modelKey]histogram, len(m.latency))
+	for k, h := range m.latency {
+		latency[k] = histogram{counts: slices.Clone(h.counts), sum: h.sum, count: h.count}
+	}
+	promptTokens := maps.Clone(m.promptTokens)
+	evalTokens := maps.Clone(m.evalTokens)
+	summaries := maps.Clone(m.summaries)
+	m.mu.Unlock()
+
+	promHeader(w, "samplellama_requests_total", "counter", "Ollama API requests by endpoint, model, status and stop reason.")
+	for _, k := range slices.SortedFunc(maps.Keys(requests), compareRequestKeys) {
+		fmt.Fprintf(w, "samplellama_requests_total{endpoint=%s,model=%s,status=%s,stop_reason=%s} %d\n",
+			promLabel(k.endpoint), promLabel(k.model), promLabel(k.status), promLabel(k.stopReason), requests[k])
+	}
+
+	promHeader(w, "samplellama_sampling_duration_seconds", "histogram", "Duration of MCP CreateMessage calls.")
+	for _, k := range slices.SortedFunc(maps.Keys(latency), compareModelKeys) {
+		h := latency[k]
+		labels := fmt.Sprintf("endpoint=%s,model=%s", promLabel(k.endpoint), promLabel(k.model))
+		var cumulative int64
+		for i, le := range samplingBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "samplellama_sampling_duration_seconds_bucket{%s,le=\"%s\"} %d\n", labels, strconv.FormatFloat(le, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(w, "samplellama_sampling_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, h.count)
+		fmt.Fprintf(w, "samplellama_sampling_duration_seconds_sum{%s} %s\n", labels, strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(w, "samplellama_sampling_duration_seconds_count{%s} %d\n", labels, h.count)
+	}
+
+	for _, c := range []struct {
+		name, help string
+		values     map[modelKey]int64
+	}{
+		{"samplellama_prompt_tokens_total", "Prompt tokens sent to the MCP host.", promptTokens},
+		{"samplellama_eval_tokens_total", "Response tokens received from the MCP host.", evalTokens},
+	} {
+		promHeader(w, c.name, "counter", c.help)
+		for _, k := range slices.SortedFunc(maps.Keys(c.values), compareModelKeys) {
+			fmt.Fprintf(w, "%s{endpoint=%s,model=%s} %d\n", c.name, promLabel(k.endpoint), promLabel(k.model), c.values[k])
+		}
+	}
+
+	promHeader(w, "samplellama_summaries_total", "counter", "Chat history summaries sampled to fit the context length, by model and result.")
+	for _, k := range slices.SortedFunc(maps.Keys(summaries), compareSummaryKeys) {
+		fmt.Fprintf(w, "samplellama_summaries_total{model=%s,result=%s} %d\n", promLabel(k.model), promLabel(k.result), summaries[k])
+	}
+
+	promHeader(w, "samplellama_requests_queued", "gauge", "Sampling requests received but not yet sent to the MCP host.")
+	fmt.Fprintf(w, "samplellama_requests_queued %d\n", m.queued.Load())
+	promHeader(w, "samplellama_requests_in_flight", "gauge", "MCP CreateMessage calls in progress.")
+	fmt.Fprintf(w, "samplellama_requests_in_flight %d\n", m.inFlight.Load())
+
+	promHeader(w, "samplellama_sessions", "gauge", "Connected MCP sessions by host implementation.")
+	hosts := make(map[string]int)
+	for _, s := range m.holder.list() {
+		name := "unknown"
+		if info := sessionClientInfo(s); info != nil && info.Name != "" {
+			name = info.Name
+		}
+		hosts[name]++
+	}
+	for _, name := range slices.Sorted(maps.Keys(hosts)) {
+		fmt.Fprintf(w, "samplellama_sessions{host=%s} %d\n", promLabel(name), hosts[name])
+	}
+	promHeader(w, "samplellama_session_connects_total", "counter", "MCP sessions initialized.")
+	fmt.Fprintf(w, "samplellama_session_connects_total %d\n", m.connects.Load())
+	promHeader(w, "samplellama_session_disconnects_total", "counter", "MCP sessions closed.")
+	fmt.Fprintf(w, "samplellama_session_disconnects_total %d\n", m.disconnects.Load())
+
+	if m.cache != nil {
+		promHeader(w, "samplellama_cache_requests_total", "counter", "Sampling requests by response cache outcome: hit, miss or bypass.")
+		fmt.Fprintf(w, "samplellama_cache_requests_total{result=\"hit\"} %d\n", m.cache.hits.Load())
+		fmt.Fprintf(w, "samplellama_cache_requests_total{result=\"miss\"} %d\n", m.cache.misses.Load())
+		fmt.Fprintf(w, "samplellama_cache_requests_total{result=\"bypass\"} %d\n", m.cache.bypasses.Load())
+		entries, bytes := m.cache.size()
+		promHeader(w, "samplellama_cache_entries", "gauge", "Results held in the response cache.")
+		fmt.Fprintf(w, "samplellama_cache_entries %d\n", entries)
+		promHeader(w, "samplellama_cache_bytes", "gauge", "Size of the results held in the response cache.")
+		fmt.Fprintf(w, "samplellama_cache_bytes %d\n", bytes)
+	}
+
+	if m.tracer != nil {
+		promHeader(w, "samplellama_trace_spans_dropped_total", "counter", "Spans dropped because too many were waiting for export.")
+		fmt.Fprintf(w, "samplellama_trace_spans_dropped_total %d\n", m.tracer.dropped.Load())
+	}
+
+	if counts := m.redact.counts(); counts != nil {
+		promHeader(w, "samplellama_redactions_total", "counter", "Values redacted from prompts and responses by detector or rule.")
+		for _, name := range slices.Sorted(maps.Keys(counts)) {
+			fmt.Fprintf(w, "samplellama_redactions_total{name=%s} %d\n", promLabel(name), counts[name])
+		}
+	}
+}
+
+func promHeader(w *bufio.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// promLabel formats a label value, escaping as the exposition format requires.
+func promLabel(v string) string {
+	v = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+	return `"` + v + `"`
+}
+
+func compareRequestKeys(a, b requestKey) int {
+	return strings.Compare(a.endpoint+"\x00"+a.model+"\x00"+a.status+"\x00"+a.stopReason,
+		b.endpoint+"\x00"+b.model+"\x00"+b.status+"\x00"+b.stopReason)
+}
+
+func compareModelKeys(a, b modelKey) int {
+	return strings.Compare(a.endpoint+"\x00"+a.model, b.endpoint+"\x00"+b.model)
+}
+
+func compareSummaryKeys(a, b summaryKey) int {
+	return strings.Compare(a.model+"\x00"+a.result, b.model+"\x00"+b.result)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+func TestMetrics(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	h := newSessionHolder()
+	fail := false
+	var m *metrics
+	h.set(&mockSession{id: "s1", createMessageFunc: func(ctx context.Context, params *mcp.CreateMessageParams) (*mcp.CreateMessageResult, error) {
+		if got := m.inFlight.Load(); got != 1 {
+			t.Errorf("in-flight during sampling = %d, want 1", got)
+		}
+		if fail {
+			return nil, errors.New("boom")
+		}
+		return &mcp.CreateMessageResult{StopReason: "endTurn", Content: &mcp.TextContent{Text: "12345678"}}, nil
+	}})
+	b := testBridge(h, logger)
+	m = newMetrics(h, b.models, nil)
+	m.sessionConnected()
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/chat", handleChat(b))
+	mux.HandleFunc("GET /metrics", m.handler())
+	handler := m.instrument(mux)
+
+	chat := func(model string) {
+		req := httptest.NewRequest(http.MethodPost, "/api/chat", strings.NewReader(`{"model":"`+model+`","messages":[{"role":"user","content":"hi"}]}`))
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	chat("llama3")
+	chat("llama3")
+	chat("made-up")
+	fail = true
+	chat("llama3")
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/nowhere", nil))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := w.Body.String()
+	for _, want := range []string{
+		`samplellama_requests_total{endpoint="/api/chat",model="llama3",status="200",stop_reason="endTurn"} 2`,
+		`samplellama_requests_total{endpoint="/api/chat",model="other",status="200",stop_reason="endTurn"} 1`,
+		`samplellama_requests_total{endpoint="/api/chat",model="llama3",status="502",stop_reason=""} 1`,
+		`samplellama_requests_total{endpoint="other",model="",status="404",stop_reason=""} 1`,
+		`samplellama_sampling_duration_seconds_bucket{endpoint="/api/chat",model="llama3",le="+Inf"} 3`,
+		`samplellama_sampling_duration_seconds_count{endpoint="/api/chat",model="llama3"} 3`,
+		`samplellama_eval_tokens_total{endpoint="/api/chat",model="llama3"} 6`,
+		`samplellama_prompt_tokens_total{endpoint="/api/chat",model="llama3"} 10`,
+		"samplellama_requests_queued 0",
+		"samplellama_requests_in_flight 0",
+		`samplellama_sessions{host="unknown"} 1`,
+		"samplellama_session_connects_total 1",
+		"# TYPE samplellama_sampling_duration_seconds histogram",
+	} {
+		if !strings.Contains(body, want+"\n") {
+			t.Errorf("metrics lack %q", want)
+		}
+	}
+	if t.Failed() {
+		t.Log(body)
+	}
+}
+
+func TestPromLabel(t *testing.T) {
+	if got := promLabel("a\"b\\c\nd"); got != `"a\"b\\c\nd"` {
+		t.Errorf("promLabel = %s", got)
+	}
+}
+
+func TestStopReasonLabel(t *testing.T) {
+	for _, tt := range []struct{ in, want string }{
+		{"endTurn", "endTurn"},
+		{"maxTokens", "maxTokens"},
+		{"stopSequence", "stopSequence"},
+		{"toolUse", "other"},
+		{"", "other"},
+		{"host-chosen-\x00-reason", "other"},
+	} {
+		if got := stopReasonLabel(tt.in); got != tt.want {
+			t.Errorf("stopReasonLabel(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errModelNotFound = errors.New("model not found")
+	errBaseModel     = errors.New("model is defined in the configuration")
+)
+
+// modelEntry describes a model advertised on the Ollama API.
+type modelEntry struct {
+	Name string `json:"name"`
+	// Base is the model name forwarded to the MCP host as a model hint.
+	// It defaults to Name.
+	Base string `json:"base,omitempty"`
+	// From is the model a derived model was copied from.
+	From string `json:"from,omitempty"`
+	// ContextLength overrides the -context-length default.
+	ContextLength int `json:"context_length,omitempty"`
+	// Truncation overrides the -truncation default.
+	Truncation string `json:"truncation,omitempty"`
+	// System is used when a request carries no system prompt.
+	System string `json:"system,omitempty"`
+	// Template is the Ollama prompt template applied to /api/generate.
+	Template string `json:"template,omitempty"`
+	// Parameters provide defaults for request options.
+	Parameters *Options  `json:"parameters,omitempty"`
+	ModifiedAt time.Time `json:"modified_at"`
+}
+
+// modelsFromNames returns base model entries for plain model names.
+func modelsFromNames(names []string) []modelEntry {
+	var entries []modelEntry
+	for _, name := range names {
+		entries = append(entries, modelEntry{Name: name})
+	}
+	return entries
+}
+
+// loadModelConfig reads base model definitions from a JSON file holding an
+// array of model entries.
+func loadModelConfig(path string) ([]modelEntry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading model config: %w", err)
+	}
+	var entries []modelEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("parsing model config %s: %w", path, err)
+	}
+	for i, e := range entries {
+		if e.Name == "" {
+			return nil, fmt.Errorf("model config %s: entry %d has no name", path, i)
+		}
+		if e.Truncation != "" && !slices.Contains(truncationStrategies, e.Truncation) {
+			return nil, fmt.Errorf("model config %s: model %s has unknown truncation %q", path, e.Name, e.Truncation)
+		}
+	}
+	return entries, nil
+}
+
+// modelRegistry tracks the models advertised on the Ollama API.
+// Base models come from -models and -model-config and cannot be removed.
+// Derived models (copies and aliases) are created through /api/copy and,
+// when a store path is configured, persisted across restarts.
+type modelRegistry struct {
+	mu      sync.RWMutex
+	base    []modelEntry
+	derived map[string]modelEntry
+	path    string
+}
+
+// newModelRegistry creates a registry with the given base models and loads
+// derived models from path, if set and present. A later base entry with
+// the same name as an earlier one replaces it.
+func newModelRegistry(base []modelEntry, path string) (*modelRegistry, error) {
+	r := &modelRegistry{
+		derived: make(map[string]modelEntry),
+		path:    path,
+	}
+	now := time.Now()
+	for _, e := range base {
+		if e.Base == "" {
+			e.Base = e.Name
+		}
+		if e.ModifiedAt.IsZero() {
+			e.ModifiedAt = now
+		}
+		if i := r.baseIndex(e.Name); i >= 0 {
+			r.base[i] = e
+			continue
+		}
+		r.base = append(r.base, e)
+	}
+	if path == "" {
+		return r, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading model store: %w", err)
+	}
+	var entries []modelEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("parsing model store %s: %w", path, err)
+	}
+	for _, e := range entries {
+		if r.isBase(e.Name) {
+			continue
+		}
+		r.derived[e.Name] = e
+	}
+	return r, nil
+}
+
+func (r *modelRegistry) baseIndex(name string) int {
+	for i, e := range r.base {
+		if e.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// isBase reports whether name is a configured base model.
+func (r *modelRegistry) isBase(name string) bool {
+	return r.baseIndex(name) >= 0
+}
+
+// list returns all models: base models in configuration order followed by
+// derived models sorted by name.
+func (r *modelRegistry) list() []modelEntry {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	entries := append([]modelEntry(nil), r.base...)
+	var derived []modelEntry
+	for _, e := range r.derived {
+		derived = append(derived, e)
+	}
+	sort.Slice(derived, func(i, j int) bool { return derived[i].Name < derived[j].Name })
+	return append(entries, derived...)
+}
+
+// lookup returns the entry for name.
+func (r *modelRegistry) lookup(name string) (modelEntry, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.lookupLocked(name)
+}
+
+func (r *modelRegistry) lookupLocked(name string) (modelEntry, bool) {
+	for _, e := range r.base {
+		if e.Name == name {
+			return e, true
+		}
+	}
+	e, ok := r.derived[name]
+	return e, ok
+}
+
+// resolve returns the entry for a requested model. Unknown names resolve to
+// a bare entry that forwards the name unchanged.
+func (r *modelRegistry) resolve(name string) modelEntry {
+	if e, ok := r.lookup(name); ok {
+		return e
+	}
+	return modelEntry{Name: name, Base: name}
+}
+
+// hint returns the model name to forward to the MCP host for a requested
+// model. Unknown names are passed through unchanged.
+func (r *modelRegistry) hint(name string) string {
+	if e, ok := r.lookup(name); ok {
+		return e.Base
+	}
+	return name
+}
+
+// add registers a new derived model. It is a no-op if the model exists.
+func (r *modelRegistry) add(e modelEntry) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.lookupLocked(e.Name); ok {
+		return nil
+	}
+	if e.Base == "" {
+		e.Base = e.Name
+	}
+	if e.ModifiedAt.IsZero() {
+		e.ModifiedAt = time.Now()
+	}
+	r.derived[e.Name] = e
+	if err := r.saveLocked(); err != nil {
+		delete(r.derived, e.Name)
+		return err
+	}
+	return nil
+}
+
+// copy creates destination as a copy of source, including its settings,
+// replacing any existing derived model of that name.
+func (r *modelRegistry) copy(source, destination string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	src, ok := r.lookupLocked(source)
+	if !ok {
+		return errModelNotFound
+	}
+	if r.isBase(destination) {
+		return errBaseModel
+	}
+	prev, existed := r.derived[destination]
+	dst := src
+	dst.Name = destination
+	dst.From = source
+	dst.ModifiedAt = time.Now()
+	r.derived[destination] = dst
+	if err := r.saveLocked(); err != nil {
+		if existed {
+			r.derived[destination] = prev
+		} else {
+			delete(r.derived, destination)
+		}
+		return err
+	}
+	return nil
+}
+
+// delete removes a derived model. Base models cannot be deleted.
+func (r *modelRegistry) delete(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.isBase(name) {
+		return errBaseModel
+	}
+	prev, ok := r.derived[name]
+	if !ok {
+		return errModelNotFound
+	}
+	delete(r.derived, name)
+	if err := r.saveLocked(); err != nil {
+		r.derived[name] = prev
+		return err
+	}
+	return nil
+}
+
+// saveLocked writes the derived models to the store file atomically.
+func (r *modelRegistry) saveLocked() error {
+	if r.path == "" {
+		return nil
+	}
+	entries := make([]modelEntry, 0, len(r.derived))
+	for _, e := range r.derived {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(r.path), ".models-*.json")
+	if err != nil {
+		return fmt.Errorf("writing model store: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing model store: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("writing model store: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), r.path); err != nil {
+		return fmt.Errorf("writing model store: %w", err)
+	}
+	return nil
+}
+
+// modelfile renders the entry as an Ollama Modelfile.
+func (e modelEntry) modelfile() string {
+	var sb strings.Builder
+	sb.WriteString("# Modelfile generated by samplellama\n")
+	fmt.Fprintf(&sb, "FROM %s\n", e.Base)
+	if e.Template != "" {
+		fmt.Fprintf(&sb, "TEMPLATE \"\"\"%s\"\"\"\n", e.Template)
+	}
+	if e.System != "" {
+		fmt.Fprintf(&sb, "SYSTEM \"\"\"%s\"\"\"\n", e.System)
+	}
+	for _, kv := range parameterList(e.Parameters) {
+		fmt.Fprintf(&sb, "PARAMETER %s %s\n", kv[0], kv[1])
+	}
+	return sb.String()
+}
+
+// modelLayer is a synthetic Ollama image layer describing part of a model.
+type modelLayer struct {
+	MediaType string
+	Digest    string
+	Size      int64
+}
+
+// layers returns the synthetic layers of the entry, one per setting, in
+// the order Ollama lists them in a manifest.
+func (e modelEntry) layers() []modelLayer {
+	parts := []struct{ mediaType, content string }{
+		{"application/vnd.ollama.image.model", e.Base},
+		{"application/vnd.ollama.image.template", e.Template},
+		{"application/vnd.ollama.image.system", e.System},
+		{"application/vnd.ollama.image.params", formatParameters(e.Parameters)},
+	}
+	var layers []modelLayer
+	for _, p := range parts {
+		if p.content == "" {
+			continue
+		}
+		layers = append(layers, modelLayer{
+			MediaType: p.mediaType,
+			Digest:    sha256Digest(p.content),
+			Size:      int64(len(p.content)),
+		})
+	}
+	return layers
+}
+
+// digest returns the manifest digest of the entry.
+func (e modelEntry) digest() string {
+	var sb strings.Builder
+	for _, l := range e.layers() {
+		sb.WriteString(l.Digest)
+	}
+	return sha256Digest(sb.String())
+}
+
+func sha256Digest(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// formatParameters renders options in the column layout Ollama uses for
+// the "parameters" field of /api/show.
+func formatParameters(o *Options) string {
+	var lines []string
+	for _, kv := range parameterList(o) {
+		lines = append(lines, fmt.Sprintf("%-30s %s", kv[0], kv[1]))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// parameterList returns the set options as sorted name/value pairs.
+func parameterList(o *Options) [][2]string {
+	if o == nil {
+		return nil
+	}
+	data, err := json.Marshal(o)
+	if err != nil {
+		return nil
+	}
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var out [][2]string
+	for _, k := range keys {
+		out = append(out, [2]string{k, string(m[k])})
+	}
+	return out
+}
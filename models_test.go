@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestModelRegistryCopyDelete(t *testing.T) {
+	r, err := newModelRegistry(modelsFromNames([]string{"llama3", "codellama"}), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.copy("llama3", "my-llama"); err != nil {
+		t.Fatalf("copy failed: %v", err)
+	}
+	if err := r.copy("my-llama", "my-llama-2"); err != nil {
+		t.Fatalf("copy of derived model failed: %v", err)
+	}
+	if got := r.hint("my-llama-2"); got != "llama3" {
+		t.Errorf("expected hint 'llama3', got %q", got)
+	}
+	if got := r.hint("unknown"); got != "unknown" {
+		t.Errorf("expected unknown names to pass through, got %q", got)
+	}
+
+	var names []string
+	for _, e := range r.list() {
+		names = append(names, e.Name)
+	}
+	want := []string{"llama3", "codellama", "my-llama", "my-llama-2"}
+	if len(names) != len(want) {
+		t.Fatalf("expected %v, got %v", want, names)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Fatalf("expected %v, got %v", want, names)
+		}
+	}
+
+	if err := r.copy("missing", "x"); !errors.Is(err, errModelNotFound) {
+		t.Errorf("expected errModelNotFound, got %v", err)
+	}
+	if err := r.copy("my-llama", "codellama"); !errors.Is(err, errBaseModel) {
+		t.Errorf("expected errBaseModel when overwriting a base model, got %v", err)
+	}
+	if err := r.delete("llama3"); !errors.Is(err, errBaseModel) {
+		t.Errorf("expected errBaseModel when deleting a base model, got %v", err)
+	}
+	if err := r.delete("missing"); !errors.Is(err, errModelNotFound) {
+		t.Errorf("expected errModelNotFound, got %v", err)
+	}
+	if err := r.delete("my-llama"); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	if _, ok := r.lookup("my-llama"); ok {
+		t.Error("expected my-llama to be deleted")
+	}
+	if _, ok := r.lookup("my-llama-2"); !ok {
+		t.Error("expected my-llama-2 to survive deletion of its source")
+	}
+}
+
+func TestModelRegistryPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "models.json")
+
+	r, err := newModelRegistry(modelsFromNames([]string{"llama3"}), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.copy("llama3", "alias"); err != nil {
+		t.Fatal(err)
+	}
+
+	r2, err := newModelRegistry(modelsFromNames([]string{"llama3"}), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, ok := r2.lookup("alias")
+	if !ok {
+		t.Fatal("expected alias to be loaded from the store")
+	}
+	if e.Base != "llama3" {
+		t.Errorf("expected base 'llama3', got %q", e.Base)
+	}
+
+	if err := r2.delete("alias"); err != nil {
+		t.Fatal(err)
+	}
+	r3, err := newModelRegistry(modelsFromNames([]string{"llama3"}), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r3.lookup("alias"); ok {
+		t.Error("expected alias deletion to be persisted")
+	}
+}
@@ -17,46 +17,57 @@ type OllamaMessage struct {
 }
 
 type ChatResponse struct {
-	Model           string        `json:"model"`
-	CreatedAt       time.Time     `json:"created_at"`
-	Message         OllamaMessage `json:"message"`
-	Done            bool          `json:"done"`
-	DoneReason      string        `json:"done_reason,omitempty"`
-	TotalDuration   int64         `json:"total_duration,omitempty"`
-	LoadDuration    int64         `json:"load_duration,omitempty"`
-	PromptEvalCount int           `json:"prompt_eval_count,omitempty"`
-	EvalCount       int           `json:"eval_count,omitempty"`
-	EvalDuration    int64         `json:"eval_duration,omitempty"`
+	Model              string        `json:"model"`
+	CreatedAt          time.Time     `json:"created_at"`
+	Message            OllamaMessage `json:"message"`
+	Done               bool          `json:"done"`
+	DoneReason         string        `json:"done_reason,omitempty"`
+	TotalDuration      int64         `json:"total_duration,omitempty"`
+	LoadDuration       int64         `json:"load_duration,omitempty"`
+	PromptEvalCount    int           `json:"prompt_eval_count,omitempty"`
+	PromptEvalDuration int64         `json:"prompt_eval_duration,omitempty"`
+	EvalCount          int           `json:"eval_count,omitempty"`
+	EvalDuration       int64         `json:"eval_duration,omitempty"`
 }
 
 // Generate endpoint types
 
 type GenerateRequest struct {
-	Model   string   `json:"model"`
-	Prompt  string   `json:"prompt"`
-	System  string   `json:"system,omitempty"`
-	Stream  *bool    `json:"stream,omitempty"`
-	Options *Options `json:"options,omitempty"`
+	Model    string   `json:"model"`
+	Prompt   string   `json:"prompt"`
+	Suffix   string   `json:"suffix,omitempty"`
+	System   string   `json:"system,omitempty"`
+	Template string   `json:"template,omitempty"`
+	Context  []int    `json:"context,omitempty"`
+	Raw      bool     `json:"raw,omitempty"`
+	Stream   *bool    `json:"stream,omitempty"`
+	Options  *Options `json:"options,omitempty"`
 }
 
 type GenerateResponse struct {
-	Model           string    `json:"model"`
-	CreatedAt       time.Time `json:"created_at"`
-	Response        string    `json:"response"`
-	Done            bool      `json:"done"`
-	DoneReason      string    `json:"done_reason,omitempty"`
-	TotalDuration   int64     `json:"total_duration,omitempty"`
-	LoadDuration    int64     `json:"load_duration,omitempty"`
-	PromptEvalCount int       `json:"prompt_eval_count,omitempty"`
-	EvalCount       int       `json:"eval_count,omitempty"`
-	EvalDuration    int64     `json:"eval_duration,omitempty"`
+	Model              string    `json:"model"`
+	CreatedAt          time.Time `json:"created_at"`
+	Response           string    `json:"response"`
+	Done               bool      `json:"done"`
+	DoneReason         string    `json:"done_reason,omitempty"`
+	Context            []int     `json:"context,omitempty"`
+	TotalDuration      int64     `json:"total_duration,omitempty"`
+	LoadDuration       int64     `json:"load_duration,omitempty"`
+	PromptEvalCount    int       `json:"prompt_eval_count,omitempty"`
+	PromptEvalDuration int64     `json:"prompt_eval_duration,omitempty"`
+	EvalCount          int       `json:"eval_count,omitempty"`
+	EvalDuration       int64     `json:"eval_duration,omitempty"`
 }
 
 // Options shared by chat and generate requests.
 
 type Options struct {
 	NumPredict  int      `json:"num_predict,omitempty"`
+	NumCtx      int      `json:"num_ctx,omitempty"`
 	Temperature *float64 `json:"temperature,omitempty"`
+	Seed        *int     `json:"seed,omitempty"`
+	// Cache overrides whether the response cache is used for the request.
+	Cache *bool `json:"cache,omitempty"`
 }
 
 // Tags endpoint types
@@ -75,6 +86,7 @@ type ModelInfo struct {
 }
 
 type ModelDetails struct {
+	ParentModel       string `json:"parent_model"`
 	Format            string `json:"format"`
 	Family            string `json:"family"`
 	ParameterSize     string `json:"parameter_size"`
@@ -84,18 +96,21 @@ type ModelDetails struct {
 // Show endpoint types
 
 type ShowRequest struct {
-	Model string `json:"model"`
-	Name  string `json:"name"` // deprecated alias
+	Model   string `json:"model"`
+	Name    string `json:"name"` // deprecated alias
+	Verbose bool   `json:"verbose,omitempty"`
 }
 
 type ShowResponse struct {
-	License    string       `json:"license"`
-	Modelfile  string       `json:"modelfile"`
-	Parameters string       `json:"parameters"`
-	Template   string       `json:"template"`
-	System     string       `json:"system"`
-	Details    ModelDetails `json:"details"`
-	ModifiedAt time.Time    `json:"modified_at"`
+	License      string         `json:"license"`
+	Modelfile    string         `json:"modelfile"`
+	Parameters   string         `json:"parameters"`
+	Template     string         `json:"template"`
+	System       string         `json:"system"`
+	Details      ModelDetails   `json:"details"`
+	ModelInfo    map[string]any `json:"model_info,omitempty"`
+	Capabilities []string       `json:"capabilities,omitempty"`
+	ModifiedAt   time.Time      `json:"modified_at"`
 }
 
 // Pull endpoint types
@@ -107,7 +122,24 @@ type PullRequest struct {
 }
 
 type ProgressResponse struct {
-	Status string `json:"status"`
+	Status    string `json:"status"`
+	Digest    string `json:"digest,omitempty"`
+	Total     int64  `json:"total,omitempty"`
+	Completed int64  `json:"completed,omitempty"`
+}
+
+// Copy endpoint types
+
+type CopyRequest struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+}
+
+// Delete endpoint types
+
+type DeleteRequest struct {
+	Model string `json:"model"`
+	Name  string `json:"name"` // deprecated alias
 }
 
 // Version endpoint
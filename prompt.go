@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// templateMessage is a conversation turn as seen by Ollama templates.
+type templateMessage struct {
+	Role    string
+	Content string
+}
+
+// templateData holds the variables available to Ollama prompt templates.
+type templateData struct {
+	System   string
+	Prompt   string
+	Suffix   string
+	Response string
+	Messages []templateMessage
+}
+
+// responseMarker stands in for .Response while rendering. As in Ollama,
+// everything from the response onwards is cut from the rendered prompt.
+const responseMarker = "\x00samplellama-response\x00"
+
+// renderPromptTemplate executes an Ollama-style Go template.
+func renderPromptTemplate(tmpl string, data templateData) (string, error) {
+	t, err := template.New("prompt").Parse(tmpl)
+	if err != nil {
+		return "", fmt.Errorf("invalid template: %w", err)
+	}
+	data.Response = responseMarker
+	var sb strings.Builder
+	if err := t.Execute(&sb, data); err != nil {
+		return "", fmt.Errorf("rendering template: %w", err)
+	}
+	out, _, _ := strings.Cut(sb.String(), responseMarker)
+	return out, nil
+}
+
+// applyPromptTemplate renders the generate request through tmpl and
+// replaces the sampling messages with the result. The system prompt and
+// any prior turns are made available to the template rather than sent
+// separately.
+func applyPromptTemplate(params *mcp.CreateMessageParams, tmpl string, req GenerateRequest) error {
+	data := templateData{
+		System: params.SystemPrompt,
+		Prompt: req.Prompt,
+		Suffix: req.Suffix,
+	}
+	history := params.Messages[:len(params.Messages)-1]
+	for _, m := range history {
+		data.Messages = append(data.Messages, templateMessage{Role: string(m.Role), Content: extractTextContent(m.Content)})
+	}
+	data.Messages = append(data.Messages, templateMessage{Role: "user", Content: req.Prompt})
+
+	rendered, err := renderPromptTemplate(tmpl, data)
+	if err != nil {
+		return err
+	}
+	params.SystemPrompt = ""
+	params.Messages = []*mcp.SamplingMessage{{
+		Role:    mcp.Role("user"),
+		Content: &mcp.TextContent{Text: rendered},
+	}}
+	return nil
+}
+
+// infillPrompt turns a fill-in-the-middle request into an instruction the
+// host's model can follow without native FIM support.
+func infillPrompt(prefix, suffix string) string {
+	var sb strings.Builder
+	sb.WriteString("Fill in the missing text between <prefix> and <suffix>. ")
+	sb.WriteString("Reply with only the missing text. Do not repeat the prefix or the suffix, ")
+	sb.WriteString("and do not add explanations or code fences.\n\n")
+	sb.WriteString("<prefix>\n")
+	sb.WriteString(prefix)
+	sb.WriteString("\n</prefix>\n<suffix>\n")
+	sb.WriteString(suffix)
+	sb.WriteString("\n</suffix>")
+	return sb.String()
+}
+
+// minEchoOverlap is the shortest partial overlap with the prefix or suffix
+// that stripInfillEcho treats as an echo rather than a coincidence.
+const minEchoOverlap = 8
+
+// stripInfillEcho removes code fences and any echoed prefix or suffix from
+// an infill response.
+func stripInfillEcho(text, prefix, suffix string) string {
+	text = stripCodeFence(text)
+	if n := overlap(prefix, text); n > 0 {
+		text = text[n:]
+	}
+	if n := overlap(text, suffix); n > 0 {
+		text = text[:len(text)-n]
+	}
+	return text
+}
+
+// overlap returns the length of the longest suffix of a that is also a
+// prefix of b, if it is all of a, all of b or at least minEchoOverlap bytes.
+func overlap(a, b string) int {
+	for n := min(len(a), len(b)); n > 0; n-- {
+		if a[len(a)-n:] != b[:n] {
+			continue
+		}
+		if n == len(a) || n == len(b) || n >= minEchoOverlap {
+			return n
+		}
+		return 0
+	}
+	return 0
+}
+
+// stripCodeFence unwraps a response that consists of a single fenced code
+// block.
+func stripCodeFence(text string) string {
+	trimmed := strings.TrimSpace(text)
+	if !strings.HasPrefix(trimmed, "```") || !strings.HasSuffix(trimmed, "```") || len(trimmed) < 6 {
+		return text
+	}
+	body := strings.TrimSuffix(trimmed[3:], "```")
+	// Drop the info string (e.g. the language) on the opening line.
+	_, body, ok := strings.Cut(body, "\n")
+	if !ok {
+		return text
+	}
+	return strings.TrimSuffix(body, "\n")
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+func TestRenderPromptTemplate(t *testing.T) {
+	tmpl := "{{ if .System }}<sys>{{ .System }}</sys>{{ end }}" +
+		"{{ range .Messages }}<{{ .Role }}>{{ .Content }}{{ end }}" +
+		"<assistant>{{ .Response }}<end>"
+	got, err := renderPromptTemplate(tmpl, templateData{
+		System:   "Be brief.",
+		Messages: []templateMessage{{Role: "user", Content: "Hi"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "<sys>Be brief.</sys><user>Hi<assistant>"
+	if got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+
+	if _, err := renderPromptTemplate("{{ .Prompt", templateData{}); err == nil {
+		t.Error("expected a parse error")
+	}
+	if _, err := renderPromptTemplate("{{ .Missing }}", templateData{}); err == nil {
+		t.Error("expected an execution error")
+	}
+}
+
+func TestApplyPromptTemplate(t *testing.T) {
+	params := &mcp.CreateMessageParams{
+		SystemPrompt: "Be brief.",
+		Messages:     textMessages("Hi", "Hello", "Bye"),
+	}
+	req := GenerateRequest{Prompt: "Bye"}
+	tmpl := "[{{ .System }}]{{ range .Messages }}{{ .Role }}:{{ .Content }};{{ end }}"
+	if err := applyPromptTemplate(params, tmpl, req); err != nil {
+		t.Fatal(err)
+	}
+	if params.SystemPrompt != "" {
+		t.Errorf("expected system prompt to move into the template, got %q", params.SystemPrompt)
+	}
+	if len(params.Messages) != 1 {
+		t.Fatalf("expected a single rendered message, got %d", len(params.Messages))
+	}
+	want := "[Be brief.]user:Hi;assistant:Hello;user:Bye;"
+	if got := extractTextContent(params.Messages[0].Content); got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
+
+func TestStripInfillEcho(t *testing.T) {
+	tests := []struct {
+		name, text, prefix, suffix, want string
+	}{
+		{"clean", "x + y", "return ", "\n}", "x + y"},
+		{"echoed prefix", "func add(x, y int) int {\n\treturn x + y", "func add(x, y int) int {\n\treturn ", "\n}", "x + y"},
+		{"echoed prefix tail", "\treturn x + y", "package main\n\nfunc add(x, y int) int {\n\treturn ", "\n}", "x + y"},
+		{"echoed suffix", "x + y\n}", "return ", "\n}", "x + y"},
+		{"short coincidence kept", "s := 1", "x := ", "", "s := 1"},
+		{"code fence", "```go\nx + y\n```", "return ", "\n}", "x + y"},
+	}
+	for _, tt := range tests {
+		if got := stripInfillEcho(tt.text, tt.prefix, tt.suffix); got != tt.want {
+			t.Errorf("%s: expected %q, got %q", tt.name, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// tokenBucket is a token-bucket rate limiter refilled continuously at a
+// fixed per-minute rate. Its capacity equals one minute's worth of tokens.
+type tokenBucket struct {
+	mu       sync.Mutex
+	capacity float64
+	tokens   float64
+	rate     float64 // tokens per second
+	last     time.Time
+}
+
+func newTokenBucket(perMinute float64) *tokenBucket {
+	return &tokenBucket{
+		capacity: perMinute,
+		tokens:   perMinute,
+		rate:     perMinute / 60,
+	}
+}
+
+// take removes n tokens if available. Otherwise it leaves the bucket
+// unchanged and reports how long until n tokens will be available.
+func (b *tokenBucket) take(n float64, now time.Time) (ok bool, retryAfter time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if d := b.waitLocked(n, now); d > 0 {
+		return false, d
+	}
+	b.tokens -= n
+	return true, 0
+}
+
+// wait reports how long until n tokens will be available, without taking
+// them. Requests larger than the capacity wait for a full bucket.
+func (b *tokenBucket) wait(n float64, now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.waitLocked(math.Min(n, b.capacity), now)
+}
+
+func (b *tokenBucket) waitLocked(n float64, now time.Time) time.Duration {
+	b.refillLocked(now)
+	if n <= b.tokens {
+		return 0
+	}
+	need := math.Min(n, b.capacity) - b.tokens
+	return time.Duration(need / b.rate * float64(time.Second))
+}
+
+// charge removes n tokens unconditionally. The bucket may go into debt,
+// which later refills repay before new tokens become available.
+func (b *tokenBucket) charge(n float64, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refillLocked(now)
+	b.tokens -= n
+}
+
+// remaining returns the number of whole tokens currently available.
+func (b *tokenBucket) remaining(now time.Time) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refillLocked(now)
+	return max(0, int(b.tokens))
+}
+
+// limit returns the bucket's capacity.
+func (b *tokenBucket) limit() int {
+	return int(b.capacity)
+}
+
+func (b *tokenBucket) refillLocked(now time.Time) {
+	if !b.last.IsZero() {
+		b.tokens = math.Min(b.capacity, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	b.last = now
+}
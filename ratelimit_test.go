@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(60)
+
+	if ok, _ := b.take(60, now); !ok {
+		t.Fatal("expected a full bucket")
+	}
+	ok, retry := b.take(1, now)
+	if ok {
+		t.Fatal("expected an empty bucket")
+	}
+	if retry != time.Second {
+		t.Errorf("expected retry after 1s, got %v", retry)
+	}
+
+	now = now.Add(10 * time.Second)
+	if got := b.remaining(now); got != 10 {
+		t.Errorf("expected 10 tokens after 10s, got %d", got)
+	}
+	if ok, _ := b.take(5, now); !ok {
+		t.Error("expected refilled tokens to be available")
+	}
+
+	now = now.Add(time.Hour)
+	if got := b.remaining(now); got != 60 {
+		t.Errorf("expected refill to stop at capacity, got %d", got)
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// redactRule is a user-defined redaction. If Pattern has capture groups,
+// only the first group is redacted, so that a rule can match a secret by
+// its context, as in `password=(\S+)`. Replacement, if set, is the literal
+// text that replaces the value when placeholders are not reversible.
+type redactRule struct {
+	Name        string `json:"name"`
+	Pattern     string `json:"pattern"`
+	Replacement string `json:"replacement,omitempty"`
+}
+
+// redactConfig is the -redact file.
+type redactConfig struct {
+	Detectors  []string     `json:"detectors"`
+	Rules      []redactRule `json:"rules"`
+	Reversible bool         `json:"reversible"`
+	Responses  bool         `json:"responses"`
+}
+
+// redactPattern is a compiled detector or rule. valid, if set, rejects
+// matches that only look like a secret, such as digit runs that fail the
+// Luhn check.
+type redactPattern struct {
+	name        string
+	re          *regexp.Regexp
+	replacement string
+	valid       func(string) bool
+}
+
+// builtinDetectors are the detectors that may be named in the detectors
+// list of the -redact file.
+var builtinDetectors = map[string][]redactPattern{
+	"api_key": {
+		{re: regexp.MustCompile(`\b(?:sk-(?:proj-|ant-)?[A-Za-z0-9_-]{20,}|gh[pousr]_[A-Za-z0-9]{36,}|github_pat_[A-Za-z0-9_]{22,}|glpat-[A-Za-z0-9_-]{20,}|xox[abprs]-[A-Za-z0-9-]{10,}|AIza[0-9A-Za-z_-]{35})`)},
+		{re: regexp.MustCompile(`(?i)\b(?:api[_-]?key|secret|access[_-]?token|auth[_-]?token|password)\b["']?\s*[:=]\s*["']?([^\s"',;]{8,})`)},
+	},
+	"aws_key": {
+		{re: regexp.MustCompile(`\b(?:AKIA|ASIA|ABIA|ACCA)[0-9A-Z]{16}\b`)},
+		{re: regexp.MustCompile(`(?i)aws_?secret_?access_?key["']?\s*[:=]\s*["']?([A-Za-z0-9/+=]{40})`)},
+	},
+	"email": {
+		{re: regexp.MustCompile(`\b[A-Za-z0-9._%+-]+@[A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,}\b`)},
+	},
+	"credit_card": {
+		{re: regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`), valid: luhnValid},
+	},
+}
+
+// luhnValid reports whether the digits in s pass the Luhn checksum used by
+// payment card numbers.
+func luhnValid(s string) bool {
+	sum, double := 0, false
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+// redactor removes secrets from sampling requests before they are sent to
+// the MCP host. With reversible placeholders, each distinct value becomes
+// a numbered placeholder such as [REDACTED_EMAIL_1], and the values are put
+// back into the response. A nil redactor redacts nothing.
+type redactor struct {
+	patterns   []redactPattern
+	reversible bool
+	responses  bool
+
+	mu     sync.Mutex
+	totals map[string]int64
+}
+
+func loadRedactor(path string) (*redactor, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading redaction config: %w", err)
+	}
+	var cfg redactConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parsing redaction config %s: %w", path, err)
+	}
+	return newRedactor(cfg)
+}
+
+func newRedactor(cfg redactConfig) (*redactor, error) {
+	r := &redactor{reversible: cfg.Reversible, responses: cfg.Responses, totals: make(map[string]int64)}
+	for _, name := range cfg.Detectors {
+		patterns, ok := builtinDetectors[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown redaction detector %q (known: %s)", name, strings.Join(slices.Sorted(maps.Keys(builtinDetectors)), ", "))
+		}
+		for _, p := range patterns {
+			p.name = name
+			r.patterns = append(r.patterns, p)
+		}
+	}
+	for _, rule := range cfg.Rules {
+		if rule.Name == "" {
+			return nil, fmt.Errorf("redaction rule %q has no name", rule.Pattern)
+		}
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("redaction rule %s: %w", rule.Name, err)
+		}
+		r.patterns = append(r.patterns, redactPattern{name: rule.Name, re: re, replacement: rule.Replacement})
+	}
+	return r, nil
+}
+
+// counts returns the number of values redacted so far, by detector or
+// rule name.
+func (r *redactor) counts() map[string]int64 {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return maps.Clone(r.totals)
+}
+
+// redaction is the state of one request: its placeholders and the number
+// of values redacted from the prompt and the response by each detector or
+// rule.
+type redaction struct {
+	r            *redactor
+	values       map[string]string // placeholder -> original value
+	placeholders map[string]string // original value -> placeholder
+	next         map[string]int
+	prompt       map[string]int
+	response     map[string]int
+}
+
+// redactParams redacts the system prompt and text messages of params. The
+// messages are replaced rather than modified, so callers holding the
+// original messages keep the unredacted text.
+func (r *redactor) redactParams(params *mcp.CreateMessageParams) *redaction {
+	if r == nil {
+		return nil
+	}
+	x := &redaction{
+		r:            r,
+		values:       make(map[string]string),
+		placeholders: make(map[string]string),
+		next:         make(map[string]int),
+		prompt:       make(map[string]int),
+		response:     make(map[string]int),
+	}
+	params.SystemPrompt = x.redact(params.SystemPrompt, r.reversible, x.prompt)
+	messages := make([]*mcp.SamplingMessage, len(params.Messages))
+	for i, m := range params.Messages {
+		messages[i] = m
+		if c, ok := m.Content.(*mcp.TextContent); ok {
+			if text := x.redact(c.Text, r.reversible, x.prompt); text != c.Text {
+				content := *c
+				content.Text = text
+				messages[i] = &mcp.SamplingMessage{Role: m.Role, Content: &content}
+			}
+		}
+	}
+	params.Messages = messages
+	r.add(x.prompt)
+	return x
+}
+
+func (r *redactor) add(counts map[string]int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for name, n := range counts {
+		r.totals[name] += int64(n)
+	}
+}
+
+// log reports how many values were redacted, by name. The values
+// themselves are never logged.
+func (x *redaction) log(logger *slog.Logger) {
+	if x == nil || len(x.prompt) == 0 && len(x.response) == 0 {
+		return
+	}
+	logger.Info("Redacted sampling request", "prompt", x.prompt, "response", x.response)
+}
+
+func (x *redaction) redact(s string, reversible bool, counts map[string]int) string {
+	for _, p := range x.r.patterns {
+		s = p.re.ReplaceAllStringFunc(s, func(match string) string {
+			value := match
+			var prefix, suffix string
+			if p.re.NumSubexp() > 0 {
+				// Redact only the first group, keeping its context.
+				sub := p.re.FindStringSubmatchIndex(match)
+				if sub == nil || sub[2] < 0 {
+					return match
+				}
+				prefix, value, suffix = match[:sub[2]], match[sub[2]:sub[3]], match[sub[3]:]
+			}
+			if strings.HasPrefix(value, redactedPrefix) || p.valid != nil && !p.valid(value) {
+				return match
+			}
+			counts[p.name]++
+			return prefix + x.placeholder(p, value, reversible) + suffix
+		})
+	}
+	return s
+}
+
+// redactedPrefix starts every generated placeholder. Values starting with
+// it were already redacted by an earlier pattern.
+const redactedPrefix = "[REDACTED_"
+
+func (x *redaction) placeholder(p redactPattern, value string, reversible bool) string {
+	label := strings.ToUpper(p.name)
+	if !reversible {
+		if p.replacement != "" {
+			return p.replacement
+		}
+		return redactedPrefix + label + "]"
+	}
+	if ph, ok := x.placeholders[value]; ok {
+		return ph
+	}
+	x.next[label]++
+	ph := fmt.Sprintf("%s%s_%d]", redactedPrefix, label, x.next[label])
+	x.placeholders[value] = ph
+	x.values[ph] = value
+	return ph
+}
+
+// redactResponse replaces secrets the host produced, without placeholders
+// to restore, when responses are redacted. The result is the host-side
+// text, which is what the audit log records.
+func (x *redaction) redactResponse(text string) string {
+	if x == nil || !x.r.responses {
+		return text
+	}
+	text = x.redact(text, false, x.response)
+	x.r.add(x.response)
+	return text
+}
+
+// restore prepares host-side response text for the client by replacing
+// reversible placeholders from the request with their original values.
+func (x *redaction) restore(text string) string {
+	if x == nil || len(x.values) == 0 {
+		return text
+	}
+	pairs := make([]string, 0, 2*len(x.values))
+	for ph, value := range x.values {
+		pairs = append(pairs, ph, value)
+	}
+	return strings.NewReplacer(pairs...).Replace(text)
+}
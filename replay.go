@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// volatileResponseFields differ on every run and are not compared.
+// Generate contexts are random IDs; replay maps captured to new ones.
+var volatileResponseFields = []string{"created_at", "total_duration", "load_duration", "prompt_eval_duration", "eval_duration", "context"}
+
+// replayOutcome is what replaying one captured request produced.
+type replayOutcome struct {
+	status   int
+	response string
+	// samples are the CreateMessage calls made, when replaying offline.
+	samples []captureSample
+}
+
+// replayer sends a captured request with the given body.
+type replayer interface {
+	replay(e *captureEntry, body []byte) (*replayOutcome, error)
+}
+
+// runReplay implements "samplellama replay": it re-sends the requests of a
+// capture file and reports where the results differ from the capture.
+// It returns the process exit status.
+func runReplay(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	target := fs.String("target", "", "Base URL of a running samplellama to send requests to (default: replay offline against a mock MCP session)")
+	apiKey := fs.String("api-key", "", "Bearer token sent with requests to -target")
+	models := fs.String("models", "default", "Comma-separated model names, as given to the captured instance (offline)")
+	modelConfig := fs.String("model-config", "", "Model config file, as given to the captured instance (offline)")
+	defaultMaxTokens := fs.Int("default-max-tokens", 4096, "Default max tokens, as given to the captured instance (offline)")
+	verbose := fs.Bool("v", false, "Also list requests that match")
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: samplellama replay [flags] capture.jsonl")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	entries, err := readCapture(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(stderr, "samplellama replay: %v\n", err)
+		return 2
+	}
+
+	var r replayer
+	if *target != "" {
+		r = &targetReplayer{base: strings.TrimSuffix(*target, "/"), apiKey: *apiKey, client: &http.Client{Timeout: 10 * time.Minute}}
+	} else {
+		base := modelsFromNames(parseModels(*models))
+		if *modelConfig != "" {
+			configured, err := loadModelConfig(*modelConfig)
+			if err != nil {
+				fmt.Fprintf(stderr, "samplellama replay: %v\n", err)
+				return 2
+			}
+			base = append(base, configured...)
+		}
+		r, err = newOfflineReplayer(base, *defaultMaxTokens)
+		if err != nil {
+			fmt.Fprintf(stderr, "samplellama replay: %v\n", err)
+			return 2
+		}
+	}
+
+	contexts := make(map[string][]int)
+	var failed int
+	for i, e := range entries {
+		label := fmt.Sprintf("#%d %s %s", i+1, e.Method, e.Path)
+		out, err := r.replay(e, replayBody(e, contexts))
+		if err != nil {
+			fmt.Fprintf(stdout, "FAIL %s: %v\n", label, err)
+			failed++
+			continue
+		}
+		if captured, replayed := responseContext(e.Response), responseContext(out.response); captured != nil && replayed != nil {
+			contexts[fmt.Sprint(captured)] = replayed
+		}
+		diffs := compareReplay(e, out)
+		if len(diffs) == 0 {
+			if *verbose {
+				fmt.Fprintf(stdout, "ok   %s\n", label)
+			}
+			continue
+		}
+		failed++
+		fmt.Fprintf(stdout, "FAIL %s\n", label)
+		for _, d := range diffs {
+			fmt.Fprintf(stdout, "  %s\n", strings.ReplaceAll(d, "\n", "\n  "))
+		}
+	}
+	fmt.Fprintf(stdout, "%d requests replayed, %d matched, %d differed\n", len(entries), len(entries)-failed, failed)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+func readCapture(path string) ([]*captureEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading capture: %w", err)
+	}
+	defer f.Close()
+	var entries []*captureEntry
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 64<<20)
+	for line := 1; sc.Scan(); line++ {
+		if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+			continue
+		}
+		e := &captureEntry{}
+		if err := json.Unmarshal(sc.Bytes(), e); err != nil {
+			return nil, fmt.Errorf("parsing capture %s line %d: %w", path, line, err)
+		}
+		entries = append(entries, e)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("reading capture: %w", err)
+	}
+	return entries, nil
+}
+
+// replayBody returns the captured request body, with a generate context
+// from the capture replaced by the context the replay returned for it.
+func replayBody(e *captureEntry, contexts map[string][]int) []byte {
+	if e.Body == nil {
+		return []byte(e.BodyText)
+	}
+	var body map[string]any
+	if json.Unmarshal(e.Body, &body) != nil {
+		return e.Body
+	}
+	var captured []int
+	if raw, ok := body["context"]; ok {
+		data, _ := json.Marshal(raw)
+		json.Unmarshal(data, &captured)
+	}
+	replayed, ok := contexts[fmt.Sprint(captured)]
+	if captured == nil || !ok {
+		return e.Body
+	}
+	body["context"] = replayed
+	data, _ := json.Marshal(body)
+	return data
+}
+
+// responseContext returns the generate context in a response, if any.
+func responseContext(response string) []int {
+	var ctx []int
+	for _, line := range strings.Split(response, "\n") {
+		var r struct {
+			Context []int `json:"context"`
+		}
+		if json.Unmarshal([]byte(line), &r) == nil && r.Context != nil {
+			ctx = r.Context
+		}
+	}
+	return ctx
+}
+
+// compareReplay lists the differences between a capture and its replay.
+func compareReplay(e *captureEntry, out *replayOutcome) []string {
+	var diffs []string
+	if out.status != e.Status {
+		diffs = append(diffs, fmt.Sprintf("status: captured %d, replayed %d", e.Status, out.status))
+	}
+	if out.samples != nil {
+		if len(out.samples) != len(e.Samples) {
+			diffs = append(diffs, fmt.Sprintf("sampling calls: captured %d, replayed %d", len(e.Samples), len(out.samples)))
+		}
+		for i := range min(len(out.samples), len(e.Samples)) {
+			if d := diffJSON(e.Samples[i].Params, out.samples[i].Params, nil); d != "" {
+				diffs = append(diffs, fmt.Sprintf("sampling call %d params:\n%s", i+1, d))
+			}
+		}
+	}
+	if d := diffResponses(e.Response, out.response); d != "" {
+		diffs = append(diffs, "response:\n"+d)
+	}
+	return diffs
+}
+
+// diffResponses compares response bodies line by line, as JSON where
+// possible, ignoring volatile fields.
+func diffResponses(captured, replayed string) string {
+	a := strings.Split(strings.TrimSpace(captured), "\n")
+	b := strings.Split(strings.TrimSpace(replayed), "\n")
+	var out []string
+	for i := range max(len(a), len(b)) {
+		var x, y string
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		if json.Valid([]byte(x)) && json.Valid([]byte(y)) {
+			if d := diffJSON([]byte(x), []byte(y), volatileResponseFields); d != "" {
+				out = append(out, d)
+			}
+		} else if x != y {
+			out = append(out, "- "+x+"\n+ "+y)
+		}
+	}
+	return strings.Join(out, "\n")
+}
+
+// diffJSON compares two JSON documents, ignoring the named top-level
+// fields and trace context in _meta, and returns a line diff of their
+// indented forms, or "" if they are equal.
+func diffJSON(a, b []byte, ignore []string) string {
+	x, y := canonicalJSON(a, ignore), canonicalJSON(b, ignore)
+	if x == y {
+		return ""
+	}
+	return diffLines(strings.Split(x, "\n"), strings.Split(y, "\n"))
+}
+
+func canonicalJSON(data []byte, ignore []string) string {
+	var v any
+	if json.Unmarshal(data, &v) != nil {
+		return string(data)
+	}
+	if m, ok := v.(map[string]any); ok {
+		for _, k := range ignore {
+			delete(m, k)
+		}
+		if meta, ok := m["_meta"].(map[string]any); ok {
+			delete(meta, "traceparent")
+			if len(meta) == 0 {
+				delete(m, "_meta")
+			}
+		}
+	}
+	out, _ := json.MarshalIndent(v, "", "  ")
+	return string(out)
+}
+
+// diffLines returns a minimal line diff of a and b, with "- " and "+ "
+// marking removed and added lines and two lines of context around each
+// change.
+func diffLines(a, b []string) string {
+	// lcs[i][j] is the length of the longest common subsequence of a[i:]
+	// and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	type line struct {
+		op   byte
+		text string
+	}
+	var lines []line
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			lines = append(lines, line{' ', a[i]})
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			lines = append(lines, line{'-', a[i]})
+			i++
+		default:
+			lines = append(lines, line{'+', b[j]})
+			j++
+		}
+	}
+	const context = 2
+	show := make([]bool, len(lines))
+	for k, l := range lines {
+		if l.op != ' ' {
+			for c := max(0, k-context); c <= min(len(lines)-1, k+context); c++ {
+				show[c] = true
+			}
+		}
+	}
+	var out []string
+	for k, l := range lines {
+		if !show[k] {
+			continue
+		}
+		if k > 0 && !show[k-1] && len(out) > 0 {
+			out = append(out, "  ...")
+		}
+		out = append(out, string(l.op)+" "+l.text)
+	}
+	return strings.Join(out, "\n")
+}
+
+// targetReplayer sends requests to a running samplellama.
+type targetReplayer struct {
+	base   string
+	apiKey string
+	client *http.Client
+}
+
+func (t *targetReplayer) replay(e *captureEntry, body []byte) (*replayOutcome, error) {
+	req, err := http.NewRequest(e.Method, t.base+e.Path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range e.Header {
+		req.Header[k] = v
+	}
+	if t.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+t.apiKey)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return &replayOutcome{status: resp.StatusCode, response: string(data)}, nil
+}
+
+// offlineReplayer runs requests through the sampling handlers in process,
+// against a session that answers with the captured results.
+type offlineReplayer struct {
+	handler http.Handler
+	session *replaySession
+}
+
+func newOfflineReplayer(models []modelEntry, defaultMaxTokens int) (*offlineReplayer, error) {
+	registry, err := newModelRegistry(models, "")
+	if err != nil {
+		return nil, err
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	holder := newSessionHolder()
+	session := &replaySession{}
+	holder.set(session)
+	b := &bridge{
+		holder:           holder,
+		models:           registry,
+		defaultMaxTokens: defaultMaxTokens,
+		conversations:    newConversationStore(30*time.Minute, 1000, 256*1024),
+		logger:           logger,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/chat", handleChat(b))
+	mux.HandleFunc("POST /api/generate", handleGenerate(b))
+	return &offlineReplayer{handler: mux, session: session}, nil
+}
+
+func (o *offlineReplayer) replay(e *captureEntry, body []byte) (*replayOutcome, error) {
+	o.session.reset(e.Samples)
+	req := httptest.NewRequest(e.Method, e.Path, bytes.NewReader(body))
+	for k, v := range e.Header {
+		req.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	o.handler.ServeHTTP(w, req)
+	return &replayOutcome{status: w.Code, response: w.Body.String(), samples: o.session.sent()}, nil
+}
+
+// replaySession answers sampling calls with captured results, in order,
+// and records the parameters it was sent.
+type replaySession struct {
+	mu      sync.Mutex
+	pending []captureSample
+	calls   []captureSample
+}
+
+func (s *replaySession) reset(samples []captureSample) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = samples
+	s.calls = []captureSample{}
+}
+
+func (s *replaySession) sent() []captureSample {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls
+}
+
+func (s *replaySession) ID() string { return "replay" }
+
+func (s *replaySession) CreateMessage(ctx context.Context, params *mcp.CreateMessageParams) (*mcp.CreateMessageResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, _ := json.Marshal(params)
+	s.calls = append(s.calls, captureSample{Params: data})
+	if len(s.pending) == 0 {
+		return nil, errors.New("no captured sampling call left to replay")
+	}
+	next := s.pending[0]
+	s.pending = s.pending[1:]
+	if next.Error != "" {
+		return nil, errors.New(next.Error)
+	}
+	result := &mcp.CreateMessageResult{}
+	if err := json.Unmarshal(next.Result, result); err != nil {
+		return nil, fmt.Errorf("captured result: %w", err)
+	}
+	return result, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestReplayOffline(t *testing.T) {
+	path := captureTraffic(t,
+		`/api/chat {"model":"llama3","messages":[{"role":"user","content":"hi"}]}`,
+		`/api/generate {"model":"llama3","prompt":"one","stream":false}`,
+		`/api/generate {"model":"llama3","prompt":"two","stream":false,"context":$CONTEXT}`,
+	)
+	var stdout, stderr bytes.Buffer
+	if code := runReplay([]string{"-models", "llama3", "-v", path}, &stdout, &stderr); code != 0 {
+		t.Fatalf("exit %d\n%s%s", code, stdout.String(), stderr.String())
+	}
+	if !strings.Contains(stdout.String(), "3 requests replayed, 3 matched, 0 differed") {
+		t.Errorf("unexpected output:\n%s", stdout.String())
+	}
+
+	// A translation change shows up as a difference in the parameters.
+	data, _ := os.ReadFile(path)
+	os.WriteFile(path, bytes.Replace(data, []byte(`"maxTokens":4096`), []byte(`"maxTokens":1024`), 1), 0o600)
+	stdout.Reset()
+	if code := runReplay([]string{"-models", "llama3", path}, &stdout, &stderr); code != 1 {
+		t.Fatalf("exit %d, want 1\n%s", code, stdout.String())
+	}
+	for _, want := range []string{"FAIL #1 POST /api/chat", "sampling call 1 params:", `-   "maxTokens": 1024`, `+   "maxTokens": 4096`, "1 differed"} {
+		if !strings.Contains(stdout.String(), want) {
+			t.Errorf("output lacks %q:\n%s", want, stdout.String())
+		}
+	}
+}
+
+func TestReplayTarget(t *testing.T) {
+	path := captureTraffic(t, `/api/chat {"model":"llama3","messages":[{"role":"user","content":"hi"}],"stream":false}`)
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ChatResponse{Model: "llama3", Message: OllamaMessage{Role: "assistant", Content: "something else"}, Done: true, DoneReason: "stop", EvalCount: 8})
+	}))
+	defer srv.Close()
+
+	var stdout, stderr bytes.Buffer
+	code := runReplay([]string{"-target", srv.URL, "-api-key", "k", path}, &stdout, &stderr)
+	if code != 1 || auth != "Bearer k" {
+		t.Fatalf("exit %d, auth %q\n%s%s", code, auth, stdout.String(), stderr.String())
+	}
+	if !strings.Contains(stdout.String(), `-     "content": "echo: hi"`) || !strings.Contains(stdout.String(), `+     "content": "something else"`) {
+		t.Errorf("unexpected diff:\n%s", stdout.String())
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	a := strings.Split("a b c d e f g h i j", " ")
+	b := strings.Split("a X c d e f g h i Y", " ")
+	want := "  a\n- b\n+ X\n  c\n  d\n  ...\n  h\n  i\n- j\n+ Y"
+	if got := diffLines(a, b); got != want {
+		t.Errorf("diffLines =\n%s\nwant\n%s", got, want)
+	}
+}
@@ -49,28 +49,30 @@ CGO_ENABLED=0 go build \
 %install
 install -D -m 0755 samplellama %{buildroot}%{_bindir}/samplellama
 install -D -m 0644 samplellama.service %{buildroot}%{_unitdir}/%{name}.service
+install -D -m 0644 samplellama.socket %{buildroot}%{_unitdir}/%{name}.socket
 install -D -m 0644 samplellama.1 %{buildroot}%{_mandir}/man1/samplellama.1
 
 %check
 go test ./...
 
 %pre
-%service_add_pre %{name}.service
+%service_add_pre %{name}.service %{name}.socket
 
 %post
-%service_add_post %{name}.service
+%service_add_post %{name}.service %{name}.socket
 
 %preun
-%service_del_preun %{name}.service
+%service_del_preun %{name}.service %{name}.socket
 
 %postun
-%service_del_postun %{name}.service
+%service_del_postun %{name}.service %{name}.socket
 
 %files
 %license LICENSE
 %doc README.md DESIGN.md
 %{_bindir}/samplellama
 %{_unitdir}/%{name}.service
+%{_unitdir}/%{name}.socket
 %{_mandir}/man1/samplellama.1*
 
 %changelog
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd socket
+// activation (SD_LISTEN_FDS_START).
+const listenFDsStart = 3
+
+// activatedSocket is a listening socket inherited from systemd.
+type activatedSocket struct {
+	name string // FileDescriptorName= of the socket unit
+	ln   net.Listener
+}
+
+// parseListenFDs reads the socket activation variables. It returns the
+// number of passed descriptors and their names, or 0 if the variables are
+// absent or meant for another process.
+func parseListenFDs(pid int, getenv func(string) string) (int, []string, error) {
+	if getenv("LISTEN_PID") == "" {
+		return 0, nil, nil
+	}
+	listenPID, err := strconv.Atoi(getenv("LISTEN_PID"))
+	if err != nil {
+		return 0, nil, fmt.Errorf("invalid LISTEN_PID: %w", err)
+	}
+	if listenPID != pid {
+		return 0, nil, nil
+	}
+	n, err := strconv.Atoi(getenv("LISTEN_FDS"))
+	if err != nil || n < 0 {
+		return 0, nil, fmt.Errorf("invalid LISTEN_FDS %q", getenv("LISTEN_FDS"))
+	}
+	names := make([]string, n)
+	if s := getenv("LISTEN_FDNAMES"); s != "" {
+		copy(names, strings.Split(s, ":"))
+	}
+	return n, names, nil
+}
+
+// activatedListeners returns the listening sockets passed by systemd, if
+// any. The activation variables are cleared so that child processes do not
+// pick them up.
+func activatedListeners() ([]activatedSocket, error) {
+	n, names, err := parseListenFDs(os.Getpid(), os.Getenv)
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if err != nil || n == 0 {
+		return nil, err
+	}
+	socks := make([]activatedSocket, 0, n)
+	for i := range n {
+		// FileListener duplicates the descriptor with close-on-exec set, so
+		// the inherited one can be closed right away.
+		f := os.NewFile(uintptr(listenFDsStart+i), names[i])
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("socket %d (%s): %w", i, names[i], err)
+		}
+		socks = append(socks, activatedSocket{name: names[i], ln: ln})
+	}
+	return socks, nil
+}
+
+// pickActivated returns the activated socket for a listener. If any socket
+// is named "ollama" or "mcp", sockets are matched by name; otherwise the
+// socket at position index is used, in the order of the ListenStream=
+// lines. It returns nil if there is no such socket.
+func pickActivated(socks []activatedSocket, name string, index int) net.Listener {
+	named := false
+	for _, s := range socks {
+		if s.name == "ollama" || s.name == "mcp" {
+			named = true
+		}
+		if s.name == name {
+			return s.ln
+		}
+	}
+	if named || index >= len(socks) {
+		return nil
+	}
+	return socks[index].ln
+}
+
+// sdNotifier sends service state notifications to systemd. A nil notifier,
+// used when not running under systemd, does nothing.
+type sdNotifier struct {
+	addr *net.UnixAddr
+}
+
+// newSDNotifier returns a notifier for NOTIFY_SOCKET, or nil if it is
+// unset.
+func newSDNotifier() *sdNotifier {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+	if strings.HasPrefix(path, "@") {
+		// Abstract namespace socket.
+		path = "\x00" + path[1:]
+	}
+	return &sdNotifier{addr: &net.UnixAddr{Name: path, Net: "unixgram"}}
+}
+
+// notify sends newline-separated assignments such as "READY=1".
+func (n *sdNotifier) notify(state string) error {
+	if n == nil {
+		return nil
+	}
+	conn, err := net.DialUnix("unixgram", nil, n.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval returns how often systemd expects a watchdog ping, or 0
+// if the watchdog is disabled or meant for another process.
+func watchdogInterval(pid int, getenv func(string) string) (time.Duration, error) {
+	s := getenv("WATCHDOG_USEC")
+	if s == "" {
+		return 0, nil
+	}
+	if p := getenv("WATCHDOG_PID"); p != "" && p != strconv.Itoa(pid) {
+		return 0, nil
+	}
+	usec, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || usec <= 0 {
+		return 0, errors.New("invalid WATCHDOG_USEC " + strconv.Quote(s))
+	}
+	return time.Duration(usec) * time.Microsecond, nil
+}
+
+// watchdog pings systemd at half the watchdog interval until ctx is done.
+func (n *sdNotifier) watchdog(ctx context.Context, interval time.Duration) {
+	if n == nil || interval <= 0 {
+		return
+	}
+	t := time.NewTicker(interval / 2)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			n.notify("WATCHDOG=1")
+		}
+	}
+}
+
+// sessionStatus is the STATUS= text reported to systemd.
+func sessionStatus(n int) string {
+	if n == 1 {
+		return "STATUS=1 MCP session connected"
+	}
+	return fmt.Sprintf("STATUS=%d MCP sessions connected", n)
+}
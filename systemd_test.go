@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func envMap(m map[string]string) func(string) string {
+	return func(k string) string { return m[k] }
+}
+
+func TestParseListenFDs(t *testing.T) {
+	n, names, err := parseListenFDs(42, envMap(map[string]string{
+		"LISTEN_PID":     "42",
+		"LISTEN_FDS":     "2",
+		"LISTEN_FDNAMES": "ollama:mcp",
+	}))
+	if err != nil || n != 2 || strings.Join(names, ",") != "ollama,mcp" {
+		t.Errorf("got %d %v %v", n, names, err)
+	}
+
+	n, names, err = parseListenFDs(42, envMap(map[string]string{"LISTEN_PID": "42", "LISTEN_FDS": "1"}))
+	if err != nil || n != 1 || len(names) != 1 || names[0] != "" {
+		t.Errorf("unnamed: got %d %q %v", n, names, err)
+	}
+
+	if n, _, _ := parseListenFDs(42, envMap(map[string]string{"LISTEN_PID": "7", "LISTEN_FDS": "1"})); n != 0 {
+		t.Error("expected sockets for another process to be ignored")
+	}
+	if n, _, _ := parseListenFDs(42, envMap(nil)); n != 0 {
+		t.Error("expected no sockets without LISTEN_PID")
+	}
+	if _, _, err := parseListenFDs(42, envMap(map[string]string{"LISTEN_PID": "42", "LISTEN_FDS": "x"})); err == nil {
+		t.Error("expected an error for invalid LISTEN_FDS")
+	}
+}
+
+func TestPickActivated(t *testing.T) {
+	a, b := &net.TCPListener{}, &net.TCPListener{}
+	positional := []activatedSocket{{name: "samplellama.socket", ln: a}, {name: "samplellama.socket", ln: b}}
+	if pickActivated(positional, "ollama", 0) != a || pickActivated(positional, "mcp", 1) != b {
+		t.Error("expected unnamed sockets to be assigned in order")
+	}
+	if pickActivated(positional[:1], "mcp", 1) != nil {
+		t.Error("expected no MCP socket when only one is passed")
+	}
+
+	named := []activatedSocket{{name: "mcp", ln: b}}
+	if pickActivated(named, "mcp", 1) != b {
+		t.Error("expected the socket named mcp")
+	}
+	if pickActivated(named, "ollama", 0) != nil {
+		t.Error("expected named sockets not to be assigned by position")
+	}
+}
+
+func TestSDNotifier(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	t.Setenv("NOTIFY_SOCKET", path)
+
+	n := newSDNotifier()
+	if err := n.notify("READY=1\n" + sessionStatus(1)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 256)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	m, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:m]); got != "READY=1\nSTATUS=1 MCP session connected" {
+		t.Errorf("unexpected notification %q", got)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go n.watchdog(ctx, 20*time.Millisecond)
+	m, err = conn.Read(buf)
+	cancel()
+	if err != nil || string(buf[:m]) != "WATCHDOG=1" {
+		t.Errorf("expected a watchdog ping, got %q, %v", buf[:m], err)
+	}
+
+	var none *sdNotifier
+	if err := none.notify("READY=1"); err != nil {
+		t.Errorf("nil notifier: %v", err)
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	d, err := watchdogInterval(42, envMap(map[string]string{"WATCHDOG_USEC": "30000000", "WATCHDOG_PID": "42"}))
+	if err != nil || d != 30*time.Second {
+		t.Errorf("got %v, %v", d, err)
+	}
+	if d, _ := watchdogInterval(42, envMap(map[string]string{"WATCHDOG_USEC": "30000000", "WATCHDOG_PID": "7"})); d != 0 {
+		t.Error("expected a watchdog for another process to be ignored")
+	}
+	if d, _ := watchdogInterval(42, envMap(nil)); d != 0 {
+		t.Error("expected no watchdog without WATCHDOG_USEC")
+	}
+	if _, err := watchdogInterval(42, envMap(map[string]string{"WATCHDOG_USEC": "-1"})); err == nil {
+		t.Error("expected an error for an invalid interval")
+	}
+}
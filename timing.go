@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// promptEvalWeight is the time a prompt token takes relative to a
+// response token. MCP reports only the wall time of CreateMessage, so the
+// durations are apportioned by token counts, with prompt tokens weighted
+// down because models process the prompt in parallel but generate the
+// response one token at a time.
+const promptEvalWeight = 0.1
+
+// requestTiming measures the phases of a sampling request:
+//
+//   - queue: from receiving the request to calling CreateMessage, apart
+//     from selecting a session: decoding, translation, hooks, limits and
+//     the cache lookup
+//   - session: selecting an MCP session
+//   - sample: the CreateMessage call
+//   - write: writing the response
+type requestTiming struct {
+	now         func() time.Time
+	start       time.Time
+	sampleStart time.Time
+	writeStart  time.Time
+
+	queue, session, sample, write time.Duration
+}
+
+func startTiming() *requestTiming {
+	now := time.Now
+	return &requestTiming{now: now, start: now()}
+}
+
+// selectSession times choosing a session.
+func (t *requestTiming) selectSession(selectSession func() SamplingSession) SamplingSession {
+	start := t.now()
+	s := selectSession()
+	t.session = t.now().Sub(start)
+	return s
+}
+
+// startSampling ends the queue phase. Cache hits call it too, with
+// endSampling right after, so that their sample phase is nearly zero.
+func (t *requestTiming) startSampling() {
+	t.sampleStart = t.now()
+	t.queue = t.sampleStart.Sub(t.start) - t.session
+}
+
+func (t *requestTiming) endSampling() {
+	if t.sampleStart.IsZero() {
+		return
+	}
+	t.sample = t.now().Sub(t.sampleStart)
+}
+
+// startWrite starts the write phase. It declares Server-Timing as a
+// trailer, to be sent by endWrite.
+func (t *requestTiming) startWrite(w http.ResponseWriter) {
+	t.writeStart = t.now()
+	w.Header().Set("Trailer", "Server-Timing")
+}
+
+// endWrite ends the write phase and sends it with the total as the
+// Server-Timing trailer. The header of the same name was sent with the
+// response, so replacing its value only affects the trailer.
+func (t *requestTiming) endWrite(w http.ResponseWriter) {
+	t.write = t.now().Sub(t.writeStart)
+	w.Header().Set("Server-Timing", serverTiming(timingPhase{"write", t.write}, timingPhase{"total", t.total()}))
+}
+
+// total is the time since the request was received.
+func (t *requestTiming) total() time.Duration {
+	return t.now().Sub(t.start)
+}
+
+// ollamaDurations returns the Ollama duration fields in nanoseconds.
+// load_duration is the time before CreateMessage: the queue and session
+// phases. prompt_eval_duration and eval_duration split the sample phase
+// between the prompt and response tokens, weighting prompt tokens by
+// promptEvalWeight. Each is at least 1ns when its count is nonzero, so
+// that clients computing tokens per second never divide by zero.
+func (t *requestTiming) ollamaDurations(promptTokens, evalTokens int) (total, load, promptEval, eval int64) {
+	total = int64(t.total())
+	load = int64(t.queue + t.session)
+	prompt := float64(promptTokens) * promptEvalWeight
+	if weight := prompt + float64(evalTokens); weight > 0 {
+		promptEval = int64(float64(t.sample) * prompt / weight)
+		eval = int64(t.sample) - promptEval
+	}
+	if promptTokens > 0 {
+		promptEval = max(promptEval, 1)
+	}
+	if evalTokens > 0 {
+		eval = max(eval, 1)
+	}
+	return total, load, promptEval, eval
+}
+
+// timingPhase is one metric of a Server-Timing header.
+type timingPhase struct {
+	name string
+	d    time.Duration
+}
+
+// serverTiming formats phases as a Server-Timing value, in milliseconds.
+func serverTiming(phases ...timingPhase) string {
+	parts := make([]string, len(phases))
+	for i, p := range phases {
+		parts[i] = fmt.Sprintf("%s;dur=%.3f", p.name, float64(p.d)/float64(time.Millisecond))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// setHeader sets Server-Timing to the phases known before the response is
+// written.
+func (t *requestTiming) setHeader(w http.ResponseWriter) {
+	w.Header().Set("Server-Timing", serverTiming(timingPhase{"queue", t.queue}, timingPhase{"session", t.session}, timingPhase{"sample", t.sample}))
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+func TestOllamaDurations(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	timing := &requestTiming{now: func() time.Time { return now }, start: now}
+	advance := func(d time.Duration) { now = now.Add(d) }
+
+	advance(2 * time.Millisecond)
+	timing.selectSession(func() SamplingSession {
+		advance(time.Millisecond)
+		return nil
+	})
+	advance(7 * time.Millisecond)
+	timing.startSampling()
+	advance(1100 * time.Millisecond)
+	timing.endSampling()
+	advance(5 * time.Millisecond)
+
+	if timing.queue != 9*time.Millisecond || timing.session != time.Millisecond || timing.sample != 1100*time.Millisecond {
+		t.Errorf("phases: queue %v, session %v, sample %v", timing.queue, timing.session, timing.sample)
+	}
+	// 1000 prompt tokens weigh as much as 100 response tokens.
+	total, load, promptEval, eval := timing.ollamaDurations(1000, 10)
+	if total != int64(1115*time.Millisecond) || load != int64(10*time.Millisecond) || promptEval != int64(1000*time.Millisecond) || eval != int64(100*time.Millisecond) {
+		t.Errorf("got total %d, load %d, prompt eval %d, eval %d", total, load, promptEval, eval)
+	}
+
+	// A cache hit takes no time to sample, yet the durations stay nonzero.
+	hit := &requestTiming{now: func() time.Time { return now }, start: now}
+	hit.startSampling()
+	hit.endSampling()
+	if _, _, promptEval, eval := hit.ollamaDurations(12, 3); promptEval != 1 || eval != 1 {
+		t.Errorf("cache hit: prompt eval %d, eval %d", promptEval, eval)
+	}
+	if _, _, promptEval, eval := hit.ollamaDurations(0, 0); promptEval != 0 || eval != 0 {
+		t.Errorf("no tokens: prompt eval %d, eval %d", promptEval, eval)
+	}
+
+	got := serverTiming(timingPhase{"queue", 9 * time.Millisecond}, timingPhase{"sample", 1500 * time.Microsecond})
+	if want := "queue;dur=9.000, sample;dur=1.500"; got != want {
+		t.Errorf("serverTiming = %q, want %q", got, want)
+	}
+}
+
+func TestTimingResponse(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	h := newSessionHolder()
+	h.set(&mockSession{id: "s1", createMessageFunc: func(ctx context.Context, params *mcp.CreateMessageParams) (*mcp.CreateMessageResult, error) {
+		time.Sleep(10 * time.Millisecond)
+		return &mcp.CreateMessageResult{Model: "host-model", StopReason: "endTurn", Content: &mcp.TextContent{Text: "Four."}}, nil
+	}})
+	b := testBridge(h, logger)
+
+	for _, tc := range []struct {
+		path, body string
+	}{
+		{"/api/chat", `{"model":"llama3","messages":[{"role":"user","content":"What is 2+2?"}],"stream":false}`},
+		{"/api/chat", `{"model":"llama3","messages":[{"role":"user","content":"What is 2+2?"}]}`},
+		{"/api/generate", `{"model":"llama3","prompt":"What is 2+2?","stream":false}`},
+		{"/api/generate", `{"model":"llama3","prompt":"What is 2+2?"}`},
+	} {
+		handler := handleChat(b)
+		if tc.path == "/api/generate" {
+			handler = handleGenerate(b)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, tc.path, strings.NewReader(tc.body)))
+		res := w.Result()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("%s: got %d: %s", tc.path, res.StatusCode, w.Body)
+		}
+		lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+		var resp struct {
+			TotalDuration      int64 `json:"total_duration"`
+			LoadDuration       int64 `json:"load_duration"`
+			PromptEvalDuration int64 `json:"prompt_eval_duration"`
+			EvalDuration       int64 `json:"eval_duration"`
+		}
+		if err := json.Unmarshal([]byte(lines[len(lines)-1]), &resp); err != nil {
+			t.Fatal(err)
+		}
+		sampled := resp.PromptEvalDuration + resp.EvalDuration
+		if resp.PromptEvalDuration <= 0 || resp.EvalDuration <= 0 || sampled < int64(10*time.Millisecond) || resp.TotalDuration < resp.LoadDuration+sampled {
+			t.Errorf("%s %s: durations %+v", tc.path, tc.body, resp)
+		}
+		header := res.Header.Get("Server-Timing")
+		for _, phase := range []string{"queue;dur=", "session;dur=", "sample;dur="} {
+			if !strings.Contains(header, phase) {
+				t.Errorf("%s: Server-Timing %q lacks %s", tc.path, header, phase)
+			}
+		}
+		if trailer := res.Trailer.Get("Server-Timing"); !strings.HasPrefix(trailer, "write;dur=") || !strings.Contains(trailer, ", total;dur=") {
+			t.Errorf("%s: Server-Timing trailer %q", tc.path, trailer)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// tlsReloadInterval limits how often the certificate files are checked for
+// changes.
+const tlsReloadInterval = 5 * time.Second
+
+// tlsFiles names the PEM files configuring TLS for one listener.
+type tlsFiles struct {
+	Cert     string
+	Key      string
+	ClientCA string // optional; enables client certificate verification
+}
+
+func (f tlsFiles) enabled() bool {
+	return f.Cert != "" || f.Key != ""
+}
+
+// certReloader serves the certificate, key and client CA bundle of a
+// listener, reloading them when the files change on disk.
+type certReloader struct {
+	files  tlsFiles
+	logger *slog.Logger
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTimes  [3]time.Time
+	lastCheck time.Time
+	now       func() time.Time
+}
+
+// newTLSConfig returns a TLS configuration for files, or nil when TLS is
+// not configured. The files are loaded once up front so that startup
+// fails on bad input.
+func newTLSConfig(files tlsFiles, logger *slog.Logger) (*tls.Config, error) {
+	if !files.enabled() {
+		if files.ClientCA != "" {
+			return nil, errors.New("client CA requires a certificate and key")
+		}
+		return nil, nil
+	}
+	if files.Cert == "" || files.Key == "" {
+		return nil, errors.New("both a certificate and a key are required")
+	}
+	r := &certReloader{files: files, logger: logger, now: time.Now}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		GetCertificate:     r.getCertificate,
+		GetConfigForClient: r.getConfigForClient,
+	}, nil
+}
+
+func (r *certReloader) load() error {
+	mods, err := r.stat()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.files.Cert, r.files.Key)
+	if err != nil {
+		return fmt.Errorf("loading TLS certificate: %w", err)
+	}
+	var pool *x509.CertPool
+	if r.files.ClientCA != "" {
+		pem, err := os.ReadFile(r.files.ClientCA)
+		if err != nil {
+			return fmt.Errorf("reading client CA: %w", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in client CA %s", r.files.ClientCA)
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = &cert
+	r.clientCAs = pool
+	r.modTimes = mods
+	return nil
+}
+
+func (r *certReloader) stat() ([3]time.Time, error) {
+	var mods [3]time.Time
+	for i, path := range []string{r.files.Cert, r.files.Key, r.files.ClientCA} {
+		if path == "" {
+			continue
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			return mods, err
+		}
+		mods[i] = fi.ModTime()
+	}
+	return mods, nil
+}
+
+// maybeReload reloads the files if they changed since the last load. A
+// failed reload keeps the previous certificate in service.
+func (r *certReloader) maybeReload() {
+	r.mu.Lock()
+	now := r.now()
+	if now.Sub(r.lastCheck) < tlsReloadInterval {
+		r.mu.Unlock()
+		return
+	}
+	r.lastCheck = now
+	current := r.modTimes
+	r.mu.Unlock()
+
+	mods, err := r.stat()
+	if err != nil || mods == current {
+		return
+	}
+	if err := r.load(); err != nil {
+		r.logger.Error("TLS reload failed, keeping previous certificate", "cert", r.files.Cert, "error", err)
+		return
+	}
+	r.logger.Info("TLS certificate reloaded", "cert", r.files.Cert)
+}
+
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.maybeReload()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cert, nil
+}
+
+func (r *certReloader) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	r.maybeReload()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cfg := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{*r.cert},
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+	if r.clientCAs != nil {
+		cfg.ClientCAs = r.clientCAs
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// serve serves srv on ln, over TLS if srv has a TLS configuration.
+func serve(srv *http.Server, ln net.Listener) error {
+	if srv.TLSConfig != nil {
+		return srv.ServeTLS(ln, "", "")
+	}
+	return srv.Serve(ln)
+}
+
+// certSubject returns the name identifying the verified client certificate
+// of a request: its common name, else its first DNS name, else the full
+// subject. It returns "" if the client presented no verified certificate.
+func certSubject(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	default:
+		return cert.Subject.String()
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate generated in-process for TLS tests.
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+func newTestCert(t *testing.T, cn string, parent *testCert, isCA bool) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	if isCA {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	}
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func (c *testCert) tlsCertificate(t *testing.T) tls.Certificate {
+	t.Helper()
+	cert, err := tls.X509KeyPair(c.certPEM, c.keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func writeFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewTLSConfigValidation(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	if cfg, err := newTLSConfig(tlsFiles{}, logger); cfg != nil || err != nil {
+		t.Errorf("expected no TLS without files, got %v, %v", cfg, err)
+	}
+	if _, err := newTLSConfig(tlsFiles{Cert: "cert.pem"}, logger); err == nil {
+		t.Error("expected an error for a certificate without key")
+	}
+	if _, err := newTLSConfig(tlsFiles{ClientCA: "ca.pem"}, logger); err == nil {
+		t.Error("expected an error for a client CA without certificate")
+	}
+	if _, err := newTLSConfig(tlsFiles{Cert: "missing.pem", Key: "missing.pem"}, logger); err == nil {
+		t.Error("expected an error for missing files")
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	dir := t.TempDir()
+	ca := newTestCert(t, "test CA", nil, true)
+	server := newTestCert(t, "localhost", ca, false)
+	client := newTestCert(t, "alice", ca, false)
+
+	files := tlsFiles{
+		Cert:     filepath.Join(dir, "server.pem"),
+		Key:      filepath.Join(dir, "server-key.pem"),
+		ClientCA: filepath.Join(dir, "ca.pem"),
+	}
+	writeFile(t, files.Cert, server.certPEM)
+	writeFile(t, files.Key, server.keyPEM)
+	writeFile(t, files.ClientCA, ca.certPEM)
+
+	cfg, err := newTLSConfig(files, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{
+		Handler: clientAuth(nil, false, logger, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, clientLabel(r.Context()))
+		})),
+		TLSConfig: cfg,
+	}
+	go srv.ServeTLS(ln, "", "")
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	get := func(certs []tls.Certificate) (string, error) {
+		c := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:      roots,
+			Certificates: certs,
+		}}}
+		resp, err := c.Get("https://" + ln.Addr().String() + "/")
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body), nil
+	}
+
+	got, err := get([]tls.Certificate{client.tlsCertificate(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "alice" {
+		t.Errorf("expected client identity 'alice', got %q", got)
+	}
+
+	if _, err := get(nil); err == nil {
+		t.Error("expected a request without client certificate to fail")
+	}
+
+	stranger := newTestCert(t, "mallory", nil, true)
+	if _, err := get([]tls.Certificate{stranger.tlsCertificate(t)}); err == nil {
+		t.Error("expected a certificate from another CA to be rejected")
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	dir := t.TempDir()
+	ca := newTestCert(t, "test CA", nil, true)
+	first := newTestCert(t, "first", ca, false)
+	second := newTestCert(t, "second", ca, false)
+
+	files := tlsFiles{Cert: filepath.Join(dir, "cert.pem"), Key: filepath.Join(dir, "key.pem")}
+	writeFile(t, files.Cert, first.certPEM)
+	writeFile(t, files.Key, first.keyPEM)
+
+	now := time.Now()
+	r := &certReloader{files: files, logger: logger, now: func() time.Time { return now }}
+	if err := r.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	leafCN := func() string {
+		cert, _ := r.getCertificate(nil)
+		leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+		return leaf.Subject.CommonName
+	}
+	if got := leafCN(); got != "first" {
+		t.Fatalf("expected 'first', got %q", got)
+	}
+
+	writeFile(t, files.Cert, second.certPEM)
+	writeFile(t, files.Key, second.keyPEM)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(files.Cert, later, later)
+	os.Chtimes(files.Key, later, later)
+
+	now = now.Add(tlsReloadInterval + time.Second)
+	if got := leafCN(); got != "second" {
+		t.Errorf("expected reloaded certificate 'second', got %q", got)
+	}
+
+	// A broken file keeps the previous certificate in service.
+	writeFile(t, files.Cert, []byte("garbage"))
+	later = later.Add(time.Minute)
+	os.Chtimes(files.Cert, later, later)
+	now = now.Add(tlsReloadInterval + time.Second)
+	if got := leafCN(); got != "second" {
+		t.Errorf("expected previous certificate after failed reload, got %q", got)
+	}
+}
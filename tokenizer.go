@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bufio"
+	_ "embed"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"iter"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// tokenizer counts the tokens of text. Counts feed prompt_eval_count and
+// eval_count, rate limits, budgets, metrics and the audit log.
+type tokenizer interface {
+	count(text string) int
+}
+
+// textTokens is the tokenizer in use. main replaces it according to
+// -tokenizer before serving; it is not changed afterwards.
+var textTokens tokenizer = embeddedTokenizer{}
+
+// heuristicTokenizer assumes four bytes per token, which is about right
+// for English prose and code in the tokenizers of current models.
+type heuristicTokenizer struct{}
+
+func (heuristicTokenizer) count(text string) int {
+	return (len(text) + 3) / 4
+}
+
+// embeddedVocab is a vocabulary of 32768 tokens that TestTrainVocab learned
+// from the Go source tree. It is not OpenAI's cl100k_base, which
+// -tokenizer-vocab can load, but is built the same way, and approximates
+// cl100k counts for code and common English; rare words and non-Latin
+// scripts take more tokens. TestEmbeddedVocabApproximatesCL100K checks a
+// few published cl100k counts.
+//
+//go:embed tokenizer/vocab.tiktoken
+var embeddedVocab string
+
+// embeddedBPE parses the embedded vocabulary the first time it is needed,
+// which takes a few milliseconds.
+var embeddedBPE = sync.OnceValue(func() *bpeTokenizer {
+	t, err := loadBPE(strings.NewReader(embeddedVocab))
+	if err != nil {
+		panic("embedded tokenizer vocabulary: " + err.Error())
+	}
+	return t
+})
+
+// embeddedTokenizer is the BPE tokenizer of the embedded vocabulary.
+type embeddedTokenizer struct{}
+
+func (embeddedTokenizer) count(text string) int {
+	return embeddedBPE().count(text)
+}
+
+// bpeTokenizer is a byte-level BPE tokenizer in the style of OpenAI's
+// cl100k_base: text is split with cl100k's pre-tokenization rules and each
+// piece is merged pairwise, lowest rank first, until no pair of adjacent
+// parts is in the vocabulary.
+type bpeTokenizer struct {
+	ranks map[string]int
+}
+
+// bpeMaxPiece bounds the work for one piece; merging is quadratic in its
+// length. Longer pieces, such as long runs of symbols, are counted in
+// chunks of this size, which may split a token at a chunk boundary.
+const bpeMaxPiece = 256
+
+// loadBPE reads a vocabulary in the tiktoken format: one token per line,
+// base64-encoded, followed by a space and its rank. Every single byte
+// must be a token, so that any text can be encoded.
+func loadBPE(r io.Reader) (*bpeTokenizer, error) {
+	t := &bpeTokenizer{ranks: make(map[string]int)}
+	sc := bufio.NewScanner(r)
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimSpace(sc.Text())
+		if text == "" {
+			continue
+		}
+		token, rank, ok := strings.Cut(text, " ")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected a token and a rank", line)
+		}
+		b, err := base64.StdEncoding.DecodeString(token)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		n, err := strconv.Atoi(rank)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid rank %q", line, rank)
+		}
+		t.ranks[string(b)] = n
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	for c := range 256 {
+		if _, ok := t.ranks[string([]byte{byte(c)})]; !ok {
+			return nil, fmt.Errorf("byte %#02x is not a token", c)
+		}
+	}
+	return t, nil
+}
+
+// loadBPEFile reads a tiktoken vocabulary file, such as cl100k_base.tiktoken.
+func loadBPEFile(path string) (*bpeTokenizer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading tokenizer vocabulary: %w", err)
+	}
+	defer f.Close()
+	t, err := loadBPE(f)
+	if err != nil {
+		return nil, fmt.Errorf("parsing tokenizer vocabulary %s: %w", path, err)
+	}
+	return t, nil
+}
+
+func (t *bpeTokenizer) count(text string) int {
+	n := 0
+	for piece := range pretokenize(text) {
+		for len(piece) > bpeMaxPiece {
+			n += t.pieceTokens(piece[:bpeMaxPiece])
+			piece = piece[bpeMaxPiece:]
+		}
+		n += t.pieceTokens(piece)
+	}
+	return n
+}
+
+// pieceTokens returns the number of tokens piece merges into.
+func (t *bpeTokenizer) pieceTokens(piece string) int {
+	if _, ok := t.ranks[piece]; ok {
+		return 1
+	}
+	// bounds[i] is where part i starts; ranks[i] is the rank of parts i
+	// and i+1 merged, or -1 if that is not a token.
+	bounds := make([]int, len(piece)+1)
+	for i := range bounds {
+		bounds[i] = i
+	}
+	rank := func(i int) int {
+		if i+2 >= len(bounds) {
+			return -1
+		}
+		if r, ok := t.ranks[piece[bounds[i]:bounds[i+2]]]; ok {
+			return r
+		}
+		return -1
+	}
+	ranks := make([]int, len(bounds)-2)
+	for i := range ranks {
+		ranks[i] = rank(i)
+	}
+	for {
+		best := -1
+		for i, r := range ranks {
+			if r >= 0 && (best < 0 || r < ranks[best]) {
+				best = i
+			}
+		}
+		if best < 0 {
+			return len(bounds) - 1
+		}
+		bounds = append(bounds[:best+1], bounds[best+2:]...)
+		ranks = append(ranks[:best], ranks[best+1:]...)
+		if best < len(ranks) {
+			ranks[best] = rank(best)
+		}
+		if best > 0 {
+			ranks[best-1] = rank(best - 1)
+		}
+	}
+}
+
+// pretokenize splits text as cl100k_base's pattern does:
+//
+//	(?i:'s|'t|'re|'ve|'m|'ll|'d)|[^\r\n\p{L}\p{N}]?\p{L}+|\p{N}{1,3}| ?[^\s\p{L}\p{N}]+[\r\n]*|\s*[\r\n]+|\s+(?!\S)|\s+
+//
+// Go's regexp has no lookahead, so the alternatives are matched by hand.
+func pretokenize(text string) iter.Seq[string] {
+	return func(yield func(string) bool) {
+		for len(text) > 0 {
+			n := pieceLen(text)
+			if !yield(text[:n]) {
+				return
+			}
+			text = text[n:]
+		}
+	}
+}
+
+var contractions = []string{"'s", "'t", "'re", "'ve", "'m", "'ll", "'d"}
+
+func isNewline(r rune) bool { return r == '\r' || r == '\n' }
+
+func isSymbol(r rune) bool {
+	return !unicode.IsSpace(r) && !unicode.IsLetter(r) && !unicode.IsNumber(r)
+}
+
+// spanFunc returns the length of the prefix of s whose runes satisfy f.
+func spanFunc(s string, f func(rune) bool) int {
+	i := strings.IndexFunc(s, func(r rune) bool { return !f(r) })
+	if i < 0 {
+		return len(s)
+	}
+	return i
+}
+
+// pieceLen returns the length of the piece at the start of s.
+func pieceLen(s string) int {
+	r, size := utf8.DecodeRuneInString(s)
+	if r == '\'' {
+		for _, c := range contractions {
+			if len(s) >= len(c) && strings.EqualFold(s[:len(c)], c) {
+				return len(c)
+			}
+		}
+	}
+	// [^\r\n\p{L}\p{N}]?\p{L}+
+	start := 0
+	if !unicode.IsLetter(r) && !unicode.IsNumber(r) && !isNewline(r) {
+		start = size
+	}
+	if n := spanFunc(s[start:], unicode.IsLetter); n > 0 {
+		return start + n
+	}
+	// \p{N}{1,3}
+	if unicode.IsNumber(r) {
+		n := 0
+		for i, d := range s {
+			if i >= 3*utf8.UTFMax || !unicode.IsNumber(d) || n == 3 {
+				return i
+			}
+			n++
+		}
+		return len(s)
+	}
+	// ?[^\s\p{L}\p{N}]+[\r\n]*
+	start = 0
+	if r == ' ' {
+		start = 1
+	}
+	if n := spanFunc(s[start:], isSymbol); n > 0 {
+		end := start + n
+		return end + spanFunc(s[end:], isNewline)
+	}
+	// \s*[\r\n]+
+	ws := spanFunc(s, unicode.IsSpace)
+	if i := strings.LastIndexAny(s[:ws], "\r\n"); i >= 0 {
+		return i + 1
+	}
+	// \s+(?!\S)|\s+
+	if ws > 0 {
+		if ws == len(s) {
+			return ws
+		}
+		_, last := utf8.DecodeLastRuneInString(s[:ws])
+		if ws > last {
+			return ws - last
+		}
+		return ws
+	}
+	return size
+}
+
+// estimateTokens counts the tokens of text.
+func estimateTokens(text string) int {
+	return textTokens.count(text)
+}
+
+// messageOverhead is the number of tokens a chat message costs beyond its
+// text, for the role and delimiters, as in OpenAI's accounting for
+// cl100k models.
+const messageOverhead = 4
+
+// estimatePromptTokens counts the prompt tokens of a sampling request.
+func estimatePromptTokens(params *mcp.CreateMessageParams) int {
+	n := 0
+	if params.SystemPrompt != "" {
+		n += estimateTokens(params.SystemPrompt) + messageOverhead
+	}
+	for _, m := range params.Messages {
+		n += estimateTokens(extractTextContent(m.Content)) + messageOverhead
+	}
+	return n
+}
+
+// hostUsage returns the token counts a host reported in the _meta of a
+// sampling result, under "usage" with Anthropic's input_tokens and
+// output_tokens or OpenAI's prompt_tokens and completion_tokens.
+func hostUsage(result *mcp.CreateMessageResult) (promptTokens, evalTokens int, ok bool) {
+	if result == nil {
+		return 0, 0, false
+	}
+	usage, _ := result.Meta["usage"].(map[string]any)
+	number := func(keys ...string) (int, bool) {
+		for _, k := range keys {
+			if v, ok := usage[k].(float64); ok && v >= 0 {
+				return int(v), true
+			}
+		}
+		return 0, false
+	}
+	promptTokens, okPrompt := number("input_tokens", "prompt_tokens")
+	evalTokens, okEval := number("output_tokens", "completion_tokens")
+	return promptTokens, evalTokens, okPrompt && okEval
+}
+
+// tokenUsage returns the prompt and response tokens of a sampling call:
+// as reported by the host if it did, or else counted from the request
+// and text, the response returned to the client.
+func tokenUsage(params *mcp.CreateMessageParams, result *mcp.CreateMessageResult, text string) (promptTokens, evalTokens int) {
+	if p, e, ok := hostUsage(result); ok {
+		return p, e
+	}
+	return estimatePromptTokens(params), estimateTokens(text)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+func TestPretokenize(t *testing.T) {
+	for _, tc := range []struct {
+		text string
+		want []string
+	}{
+		{"Hello, world!", []string{"Hello", ",", " world", "!"}},
+		{"I'LL see what's 12345 about", []string{"I", "'LL", " see", " what", "'s", " ", "123", "45", " about"}},
+		{"func main() {\n\treturn\n}\n", []string{"func", " main", "()", " {\n", "\treturn", "\n", "}\n"}},
+		{"a  b\n\n  c   ", []string{"a", " ", " b", "\n\n", " ", " c", "   "}},
+		{"naïve café ½", []string{"naïve", " café", " ", "½"}},
+		{"x := -y", []string{"x", " :=", " -", "y"}},
+	} {
+		if got := slices.Collect(pretokenize(tc.text)); !slices.Equal(got, tc.want) {
+			t.Errorf("pretokenize(%q) = %q, want %q", tc.text, got, tc.want)
+		}
+	}
+}
+
+// testVocab builds a vocabulary of the single bytes followed by tokens.
+func testVocab(tokens ...string) string {
+	var b strings.Builder
+	for c := range 256 {
+		fmt.Fprintf(&b, "%s %d\n", base64.StdEncoding.EncodeToString([]byte{byte(c)}), c)
+	}
+	for i, tok := range tokens {
+		fmt.Fprintf(&b, "%s %d\n", base64.StdEncoding.EncodeToString([]byte(tok)), 256+i)
+	}
+	return b.String()
+}
+
+func TestBPETokenizer(t *testing.T) {
+	bpe, err := loadBPE(strings.NewReader(testVocab("lo", "low", " l", " low", "er", "es", "est")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		text string
+		want int
+	}{
+		{"", 0},
+		{"low", 1},
+		{"lower", 2},   // low er
+		{" lowest", 2}, // " low" est
+		{"slow", 2},    // s low
+		{"lol", 2},     // lo l
+		{"low low", 2},
+		{strings.Repeat("-", 1000), 1000},
+	} {
+		if got := bpe.count(tc.text); got != tc.want {
+			t.Errorf("count(%q) = %d, want %d", tc.text, got, tc.want)
+		}
+	}
+
+	if _, err := loadBPE(strings.NewReader("YQ== 0\n")); err == nil {
+		t.Error("loaded a vocabulary without every byte")
+	}
+	if _, err := loadBPE(strings.NewReader("not base64! 0\n")); err == nil {
+		t.Error("loaded an invalid vocabulary")
+	}
+
+	// The embedded vocabulary encodes common words whole and stays
+	// well below the heuristic's count on prose.
+	embedded := embeddedBPE()
+	if n := embedded.count(" the"); n != 1 {
+		t.Errorf("embedded count(%q) = %d", " the", n)
+	}
+	prose := "The quick brown fox jumps over the lazy dog, and then returns to the forest where it lives."
+	if n, h := embedded.count(prose), (heuristicTokenizer{}).count(prose); n < 15 || n > h {
+		t.Errorf("embedded counted %d tokens in %q, heuristic %d", n, prose, h)
+	}
+}
+
+// TestEmbeddedVocabApproximatesCL100K holds the embedded vocabulary to
+// within a margin of cl100k_base counts published in OpenAI's tiktoken
+// cookbook. The sample is small, so this shows an approximation, not a
+// match: rare words and non-Latin scripts, which the Go source tree has
+// little of, are split further.
+func TestEmbeddedVocabApproximatesCL100K(t *testing.T) {
+	for _, tc := range []struct {
+		text   string
+		cl100k int
+		extra  int // tokens the embedded vocabulary may add
+	}{
+		{"hello world", 2, 0},
+		{"Hello, world!", 4, 0},
+		{"tiktoken is great!", 6, 0},
+		{"2 + 2 = 4", 7, 0},
+		{"The quick brown fox jumps over the lazy dog.", 10, 2},
+		{"antidisestablishmentarianism", 6, 3},
+		{"お誕生日おめでとう", 9, 11},
+	} {
+		if n := embeddedBPE().count(tc.text); n < tc.cl100k || n > tc.cl100k+tc.extra {
+			t.Errorf("embedded count(%q) = %d, cl100k_base counts %d", tc.text, n, tc.cl100k)
+		}
+	}
+}
+
+func TestTokenCounts(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	var meta mcp.Meta
+	h := newSessionHolder()
+	h.set(&mockSession{id: "s1", createMessageFunc: func(ctx context.Context, params *mcp.CreateMessageParams) (*mcp.CreateMessageResult, error) {
+		return &mcp.CreateMessageResult{Meta: meta, Model: "host-model", StopReason: "endTurn", Content: &mcp.TextContent{Text: "Four, of course."}}, nil
+	}})
+	b := testBridge(h, logger)
+	prompt := &mcp.CreateMessageParams{Messages: []*mcp.SamplingMessage{{Role: "user", Content: &mcp.TextContent{Text: "What is 2+2?"}}}}
+	wantPrompt, wantEval := estimatePromptTokens(prompt), estimateTokens("Four, of course.")
+
+	for _, tc := range []struct {
+		path, body string
+		meta       mcp.Meta
+		prompt     int
+		eval       int
+	}{
+		{"/api/chat", `{"model":"llama3","messages":[{"role":"user","content":"What is 2+2?"}],"stream":false}`, nil, wantPrompt, wantEval},
+		{"/api/generate", `{"model":"llama3","prompt":"What is 2+2?","stream":false}`, nil, wantPrompt, wantEval},
+		{"/api/chat", `{"model":"llama3","messages":[{"role":"user","content":"What is 2+2?"}]}`, nil, wantPrompt, wantEval},
+		{"/api/chat", `{"model":"llama3","messages":[{"role":"user","content":"What is 2+2?"}],"stream":false}`,
+			mcp.Meta{"usage": map[string]any{"input_tokens": 17.0, "output_tokens": 5.0}}, 17, 5},
+		{"/api/generate", `{"model":"llama3","prompt":"What is 2+2?","stream":false}`,
+			mcp.Meta{"usage": map[string]any{"prompt_tokens": 21.0, "completion_tokens": 6.0}}, 21, 6},
+	} {
+		meta = tc.meta
+		handler := handleChat(b)
+		if tc.path == "/api/generate" {
+			handler = handleGenerate(b)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, tc.path, strings.NewReader(tc.body)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: got %d: %s", tc.path, w.Code, w.Body)
+		}
+		lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+		var resp struct {
+			PromptEvalCount int `json:"prompt_eval_count"`
+			EvalCount       int `json:"eval_count"`
+		}
+		if err := json.Unmarshal([]byte(lines[len(lines)-1]), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.PromptEvalCount != tc.prompt || resp.EvalCount != tc.eval {
+			t.Errorf("%s %s: got prompt_eval_count %d, eval_count %d, want %d and %d", tc.path, tc.body, resp.PromptEvalCount, resp.EvalCount, tc.prompt, tc.eval)
+		}
+	}
+}
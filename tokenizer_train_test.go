@@ -0,0 +1,217 @@
+//go:build vocab
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"unicode/utf8"
+)
+
+var trainVocab = flag.String("train-vocab", "", "train tokenizer/vocab.tiktoken on the text files under this directory")
+
+// The embedded vocabulary was trained on the source tree of vocabGoVersion,
+// whose training files hash to vocabCorpusSHA256. make vocab runs that
+// toolchain, so the same corpus gives the same file. Retraining on another
+// corpus on purpose means updating both.
+const (
+	vocabGoVersion    = "go1.27.1"
+	vocabCorpusSHA256 = "7f0c4261327ef0a29eaed048694ab1b1e0525f754f825aa3e4437759e88f6f81"
+)
+
+// TestTrainVocab regenerates the embedded vocabulary with -train-vocab, as
+// make vocab does from the Go source tree. It only builds with the vocab
+// tag, so go test ./... leaves it out. It learns byte-level BPE merges
+// over the pieces pretokenize splits the corpus into, the way cl100k_base
+// was built, until the vocabulary has vocabSize tokens. It refuses any
+// corpus other than the pinned one.
+func TestTrainVocab(t *testing.T) {
+	if *trainVocab == "" {
+		t.Skip("-train-vocab not set")
+	}
+	const vocabSize = 32768
+	pieces := make(map[string]int)
+	corpus := sha256.New()
+	err := filepath.WalkDir(*trainVocab, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if d.Name() == "testdata" || d.Name() == "vendor" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		switch filepath.Ext(path) {
+		case ".go", ".md", ".txt", ".html":
+		default:
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil || !utf8.Valid(data) || bytes.Contains(data, []byte(" DO NOT EDIT.")) {
+			return err
+		}
+		rel, err := filepath.Rel(*trainVocab, path)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(corpus, "%s\x00%d\x00", filepath.ToSlash(rel), len(data))
+		corpus.Write(data)
+		for piece := range pretokenize(string(data)) {
+			if len(piece) <= bpeMaxPiece {
+				pieces[piece]++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum := hex.EncodeToString(corpus.Sum(nil)); sum != vocabCorpusSHA256 {
+		t.Fatalf("corpus hash %s, want %s: train on the %s source tree, as make vocab does", sum, vocabCorpusSHA256, vocabGoVersion)
+	}
+
+	// Each word is a distinct piece seen more than once, as a sequence of
+	// token ids.
+	type word struct {
+		syms []int
+		n    int
+	}
+	var words []*word
+	for piece, n := range pieces {
+		if n < 2 {
+			continue
+		}
+		w := &word{n: n}
+		for i := range len(piece) {
+			w.syms = append(w.syms, int(piece[i]))
+		}
+		words = append(words, w)
+	}
+	tokens := make([]string, 256)
+	for c := range tokens {
+		tokens[c] = string([]byte{byte(c)})
+	}
+	counts := make(map[[2]int]int)
+	where := make(map[[2]int]map[int]bool)
+	q := &pairQueue{}
+	addPairs := func(i, sign int) {
+		w := words[i]
+		for j := 0; j+1 < len(w.syms); j++ {
+			p := [2]int{w.syms[j], w.syms[j+1]}
+			counts[p] += sign * w.n
+			if sign > 0 {
+				if where[p] == nil {
+					where[p] = make(map[int]bool)
+				}
+				where[p][i] = true
+			}
+		}
+	}
+	for i := range words {
+		addPairs(i, 1)
+	}
+	for p, n := range counts {
+		heap.Push(q, pairCount{p, n})
+	}
+
+	for len(tokens) < vocabSize && q.Len() > 0 {
+		top := heap.Pop(q).(pairCount)
+		if n := counts[top.pair]; n != top.n {
+			if n > 0 {
+				heap.Push(q, pairCount{top.pair, n})
+			}
+			continue
+		}
+		id := len(tokens)
+		tokens = append(tokens, tokens[top.pair[0]]+tokens[top.pair[1]])
+		touched := make(map[[2]int]bool)
+		for i := range where[top.pair] {
+			w := words[i]
+			var merged []int
+			for j := 0; j < len(w.syms); j++ {
+				if j+1 < len(w.syms) && w.syms[j] == top.pair[0] && w.syms[j+1] == top.pair[1] {
+					merged = append(merged, id)
+					j++
+				} else {
+					merged = append(merged, w.syms[j])
+				}
+			}
+			if len(merged) == len(w.syms) {
+				continue
+			}
+			for j := 0; j+1 < len(w.syms); j++ {
+				touched[[2]int{w.syms[j], w.syms[j+1]}] = true
+			}
+			addPairs(i, -1)
+			w.syms = merged
+			addPairs(i, 1)
+			for j := 0; j+1 < len(w.syms); j++ {
+				touched[[2]int{w.syms[j], w.syms[j+1]}] = true
+			}
+		}
+		delete(where, top.pair)
+		delete(counts, top.pair)
+		for p := range touched {
+			if n := counts[p]; n > 0 {
+				heap.Push(q, pairCount{p, n})
+			} else {
+				delete(counts, p)
+			}
+		}
+	}
+
+	f, err := os.Create(filepath.Join("tokenizer", "vocab.tiktoken"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bw := bufio.NewWriter(f)
+	for rank, tok := range tokens {
+		fmt.Fprintf(bw, "%s %d\n", base64.StdEncoding.EncodeToString([]byte(tok)), rank)
+	}
+	if err := bw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("wrote %d tokens learned from %d distinct pieces", len(tokens), len(words))
+}
+
+type pairCount struct {
+	pair [2]int
+	n    int
+}
+
+// pairQueue orders pairs by count, most frequent first, and then by id so
+// that training is deterministic.
+type pairQueue []pairCount
+
+func (q pairQueue) Len() int { return len(q) }
+func (q pairQueue) Less(i, j int) bool {
+	if q[i].n != q[j].n {
+		return q[i].n > q[j].n
+	}
+	if q[i].pair[0] != q[j].pair[0] {
+		return q[i].pair[0] < q[j].pair[0]
+	}
+	return q[i].pair[1] < q[j].pair[1]
+}
+func (q pairQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q *pairQueue) Push(x any)   { *q = append(*q, x.(pairCount)) }
+func (q *pairQueue) Pop() any {
+	old := *q
+	x := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return x
+}
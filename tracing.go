@@ -0,0 +1,536 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// OTLP span kinds.
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+// traceBatchSize and traceFlushInterval bound how long finished spans wait
+// before they are exported. traceMaxPending bounds how many may wait while
+// an export is slow or failing; beyond it, the oldest are dropped.
+const (
+	traceBatchSize     = 256
+	traceFlushInterval = 5 * time.Second
+	traceMaxPending    = 16 * traceBatchSize
+)
+
+// traceExporter sends a batch of spans, encoded as an OTLP/JSON
+// ExportTraceServiceRequest.
+type traceExporter interface {
+	export(ctx context.Context, payload []byte) error
+}
+
+// otlpExporter posts spans to an OTLP/HTTP collector.
+type otlpExporter struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+func (e *otlpExporter) export(ctx context.Context, payload []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector returned %s: %s", resp.Status, truncate(strings.TrimSpace(string(body)), 200))
+	}
+	return nil
+}
+
+// fileExporter appends each batch as one JSON line, in the format of the
+// OpenTelemetry Collector's file exporter.
+type fileExporter struct {
+	path string
+}
+
+func (e *fileExporter) export(ctx context.Context, payload []byte) error {
+	f, err := os.OpenFile(e.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(payload, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// multiExporter sends each batch to several exporters.
+type multiExporter []traceExporter
+
+func (m multiExporter) export(ctx context.Context, payload []byte) error {
+	var errs []error
+	for _, e := range m {
+		errs = append(errs, e.export(ctx, payload))
+	}
+	return errors.Join(errs...)
+}
+
+// newTraceExporter returns the exporters configured by -trace-otlp-endpoint,
+// the OpenTelemetry environment variables and -trace-file, or nil if
+// tracing is off.
+func newTraceExporter(endpoint, file string, getenv func(string) string) traceExporter {
+	var m multiExporter
+	if u := otlpTracesURL(endpoint, getenv); u != "" {
+		m = append(m, &otlpExporter{url: u, headers: parseOTLPHeaders(getenv("OTEL_EXPORTER_OTLP_HEADERS")), client: &http.Client{}})
+	}
+	if file != "" {
+		m = append(m, &fileExporter{path: file})
+	}
+	switch len(m) {
+	case 0:
+		return nil
+	case 1:
+		return m[0]
+	}
+	return m
+}
+
+// otlpTracesURL returns the OTLP/HTTP traces URL configured by flag or by
+// the standard OpenTelemetry environment variables.
+func otlpTracesURL(flagValue string, getenv func(string) string) string {
+	if flagValue != "" {
+		return flagValue
+	}
+	if u := getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"); u != "" {
+		return u
+	}
+	if u := getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); u != "" {
+		return strings.TrimSuffix(u, "/") + "/v1/traces"
+	}
+	return ""
+}
+
+// parseOTLPHeaders parses OTEL_EXPORTER_OTLP_HEADERS: comma-separated,
+// URL-encoded key=value pairs.
+func parseOTLPHeaders(s string) map[string]string {
+	headers := make(map[string]string)
+	for _, pair := range parseModels(s) {
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok {
+			continue
+		}
+		if u, err := url.QueryUnescape(v); err == nil {
+			v = u
+		}
+		headers[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return headers
+}
+
+// spanAttr is one span attribute. Values are strings or integers.
+type spanAttr struct {
+	key   string
+	value any
+}
+
+// span is a unit of traced work. A nil span records nothing, so callers
+// need not check whether tracing is on.
+type span struct {
+	t          *tracer
+	traceID    [16]byte
+	spanID     [8]byte
+	parentID   [8]byte
+	sampled    bool
+	name       string
+	kind       int
+	start, end time.Time
+	mu         sync.Mutex
+	attrs      []spanAttr
+	err        string
+}
+
+// traceparent formats the W3C trace context header for s as the parent.
+func (s *span) traceparent() string {
+	flags := "00"
+	if s.sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(s.traceID[:]) + "-" + hex.EncodeToString(s.spanID[:]) + "-" + flags
+}
+
+func (s *span) setAttr(key string, value any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attrs = append(s.attrs, spanAttr{key, value})
+}
+
+// finish ends the span, marking it failed if err is not nil, and queues it
+// for export.
+func (s *span) finish(err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.end = time.Now()
+	if err != nil {
+		s.err = err.Error()
+	}
+	s.mu.Unlock()
+	if s.sampled {
+		s.t.queue(s)
+	}
+}
+
+// injectMeta passes the span's trace context to the MCP host in the
+// request's _meta, as the MCP specification suggests for W3C trace
+// context.
+func (s *span) injectMeta(params *mcp.CreateMessageParams) {
+	if s == nil {
+		return
+	}
+	if params.Meta == nil {
+		params.Meta = mcp.Meta{}
+	}
+	params.Meta["traceparent"] = s.traceparent()
+}
+
+type spanKey struct{}
+
+func spanFromContext(ctx context.Context) *span {
+	s, _ := ctx.Value(spanKey{}).(*span)
+	return s
+}
+
+// tracer records spans and exports them in batches in the background. A
+// nil tracer records nothing.
+type tracer struct {
+	service  string
+	exporter traceExporter
+	logger   *slog.Logger
+
+	mu      sync.Mutex
+	pending []*span
+	// dropped counts spans discarded because pending was full.
+	dropped atomic.Int64
+	// droppedLogged is the value of dropped last logged by flush.
+	droppedLogged int64
+	flushCh       chan struct{}
+	done          chan struct{}
+	stopped       chan struct{}
+}
+
+func newTracer(service string, exporter traceExporter, logger *slog.Logger) *tracer {
+	t := &tracer{
+		service:  service,
+		exporter: exporter,
+		logger:   logger,
+		flushCh:  make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go t.loop()
+	return t
+}
+
+// start begins a span as a child of the span in ctx, or as the root of a
+// new trace.
+func (t *tracer) start(ctx context.Context, name string, kind int) (context.Context, *span) {
+	if t == nil {
+		return ctx, nil
+	}
+	s := &span{t: t, name: name, kind: kind, start: time.Now(), sampled: true}
+	if parent := spanFromContext(ctx); parent != nil {
+		s.traceID, s.parentID, s.sampled = parent.traceID, parent.spanID, parent.sampled
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// startRemote begins a server span continuing the trace in traceparent,
+// or a new trace if the header is absent or invalid.
+func (t *tracer) startRemote(ctx context.Context, traceparent, name string) (context.Context, *span) {
+	if t == nil {
+		return ctx, nil
+	}
+	ctx, s := t.start(ctx, name, spanKindServer)
+	if traceID, parentID, sampled, ok := parseTraceparent(traceparent); ok {
+		s.traceID, s.parentID, s.sampled = traceID, parentID, sampled
+	}
+	return ctx, s
+}
+
+// startSampling begins the client span of a CreateMessage call and
+// passes its trace context to the MCP host.
+func (t *tracer) startSampling(ctx context.Context, session SamplingSession, model string, params *mcp.CreateMessageParams) (context.Context, *span) {
+	ctx, s := t.start(ctx, "CreateMessage", spanKindClient)
+	if s == nil {
+		return ctx, nil
+	}
+	s.setAttr("mcp.method.name", "sampling/createMessage")
+	s.setAttr("mcp.session.id", session.ID())
+	s.setAttr("gen_ai.request.model", model)
+	s.setAttr("gen_ai.request.max_tokens", int(params.MaxTokens))
+	s.injectMeta(params)
+	return ctx, s
+}
+
+// finishSampling ends a span begun by startSampling.
+func (s *span) finishSampling(result *mcp.CreateMessageResult, err error) {
+	if s == nil {
+		return
+	}
+	if result != nil {
+		s.setAttr("gen_ai.response.model", result.Model)
+		s.setAttr("gen_ai.response.finish_reasons", result.StopReason)
+	}
+	s.finish(err)
+}
+
+// parseTraceparent parses a W3C traceparent header of version 00, or a
+// later version by its first four fields as the specification requires.
+func parseTraceparent(h string) (traceID [16]byte, parentID [8]byte, sampled bool, ok bool) {
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || parts[0] == "00" && len(parts) != 4 {
+		return traceID, parentID, false, false
+	}
+	if _, err := hex.DecodeString(parts[0]); err != nil {
+		return traceID, parentID, false, false
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return traceID, parentID, false, false
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil || traceID == [16]byte{} {
+		return traceID, parentID, false, false
+	}
+	if _, err := hex.Decode(parentID[:], []byte(parts[2])); err != nil || parentID == [8]byte{} {
+		return traceID, parentID, false, false
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return traceID, parentID, false, false
+	}
+	return traceID, parentID, flags&1 == 1, true
+}
+
+// traceRequests wraps next in a server span per HTTP request, continuing
+// the caller's trace from a traceparent header.
+func traceRequests(t *tracer, next http.Handler) http.Handler {
+	if t == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, s := t.startRemote(r.Context(), r.Header.Get("traceparent"), r.Method+" "+r.URL.Path)
+		s.setAttr("http.request.method", r.Method)
+		s.setAttr("url.path", r.URL.Path)
+		s.setAttr("client.address", clientIP(r))
+		if ua := r.UserAgent(); ua != "" {
+			s.setAttr("user_agent.original", ua)
+		}
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		s.setAttr("http.response.status_code", rec.status)
+		var err error
+		if rec.status >= 500 {
+			err = fmt.Errorf("%d %s", rec.status, http.StatusText(rec.status))
+		}
+		s.finish(err)
+	})
+}
+
+// queue adds a finished span to the next batch. If traceMaxPending spans
+// are already waiting, the oldest is dropped to make room.
+func (t *tracer) queue(s *span) {
+	t.mu.Lock()
+	if len(t.pending) >= traceMaxPending {
+		t.pending = t.pending[1:]
+		t.dropped.Add(1)
+	}
+	t.pending = append(t.pending, s)
+	full := len(t.pending) >= traceBatchSize
+	t.mu.Unlock()
+	if full {
+		select {
+		case t.flushCh <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (t *tracer) loop() {
+	defer close(t.stopped)
+	ticker := time.NewTicker(traceFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-t.flushCh:
+		case <-t.done:
+			t.flush()
+			return
+		}
+		t.flush()
+	}
+}
+
+func (t *tracer) flush() {
+	t.mu.Lock()
+	batch := t.pending
+	t.pending = nil
+	t.mu.Unlock()
+	if dropped := t.dropped.Load(); dropped > t.droppedLogged {
+		t.logger.Warn("Dropped spans while exports were behind", "spans", dropped-t.droppedLogged)
+		t.droppedLogged = dropped
+	}
+	if len(batch) == 0 {
+		return
+	}
+	payload, err := json.Marshal(t.encode(batch))
+	if err != nil {
+		t.logger.Error("Failed to encode spans", "error", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := t.exporter.export(ctx, payload); err != nil {
+		t.logger.Warn("Failed to export spans", "spans", len(batch), "error", err)
+	}
+}
+
+// close exports the remaining spans and stops the background loop.
+func (t *tracer) close() {
+	if t == nil {
+		return
+	}
+	close(t.done)
+	<-t.stopped
+}
+
+// OTLP/JSON encoding of ExportTraceServiceRequest. IDs are hex strings
+// and 64-bit integers are decimal strings, as the OTLP JSON mapping
+// requires.
+type otlpAnyValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func otlpAttr(key string, value any) otlpKeyValue {
+	kv := otlpKeyValue{Key: key}
+	switch v := value.(type) {
+	case int:
+		s := strconv.Itoa(v)
+		kv.Value.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		kv.Value.IntValue = &s
+	default:
+		s := fmt.Sprint(v)
+		kv.Value.StringValue = &s
+	}
+	return kv
+}
+
+func (t *tracer) encode(batch []*span) otlpTraces {
+	scope := otlpScopeSpans{}
+	scope.Scope.Name = "samplellama"
+	scope.Scope.Version = version
+	for _, s := range batch {
+		s.mu.Lock()
+		out := otlpSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.spanID[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+		if s.parentID != [8]byte{} {
+			out.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		for _, a := range s.attrs {
+			out.Attributes = append(out.Attributes, otlpAttr(a.key, a.value))
+		}
+		if s.err != "" {
+			out.Status = otlpStatus{Code: 2, Message: s.err}
+		}
+		s.mu.Unlock()
+		scope.Spans = append(scope.Spans, out)
+	}
+	rs := otlpResourceSpans{ScopeSpans: []otlpScopeSpans{scope}}
+	rs.Resource.Attributes = []otlpKeyValue{otlpAttr("service.name", t.service), otlpAttr("service.version", version)}
+	return otlpTraces{ResourceSpans: []otlpResourceSpans{rs}}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	for _, tc := range []struct {
+		header  string
+		ok      bool
+		sampled bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true, false},
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false, false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01", false, false},
+		{"", false, false},
+	} {
+		_, _, sampled, ok := parseTraceparent(tc.header)
+		if ok != tc.ok || sampled != tc.sampled {
+			t.Errorf("parseTraceparent(%q) = sampled %v, ok %v", tc.header, sampled, ok)
+		}
+	}
+}
+
+func readSpans(t *testing.T, path string) []otlpSpan {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spans []otlpSpan
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var batch otlpTraces
+		if err := json.Unmarshal([]byte(line), &batch); err != nil {
+			t.Fatal(err)
+		}
+		for _, rs := range batch.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				spans = append(spans, ss.Spans...)
+			}
+		}
+	}
+	return spans
+}
+
+func TestTraceChat(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	path := filepath.Join(t.TempDir(), "spans.jsonl")
+	h := newSessionHolder()
+	var hostTraceparent string
+	h.set(&mockSession{id: "s1", createMessageFunc: func(ctx context.Context, params *mcp.CreateMessageParams) (*mcp.CreateMessageResult, error) {
+		hostTraceparent, _ = params.Meta["traceparent"].(string)
+		return &mcp.CreateMessageResult{Model: "host-model", StopReason: "endTurn", Content: &mcp.TextContent{Text: "hello"}}, nil
+	}})
+	b := testBridge(h, logger)
+	b.tracer = newTracer("samplellama", &fileExporter{path: path}, logger)
+	handler := traceRequests(b.tracer, handleChat(b))
+
+	req := httptest.NewRequest(http.MethodPost, "/api/chat", strings.NewReader(`{"model":"llama3","messages":[{"role":"user","content":"hi"}],"stream":false}`))
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body)
+	}
+	b.tracer.close()
+
+	spans := readSpans(t, path)
+	byName := make(map[string]otlpSpan)
+	for _, s := range spans {
+		if s.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Errorf("span %s has trace %s", s.Name, s.TraceID)
+		}
+		byName[s.Name] = s
+	}
+	server, ok := byName["POST /api/chat"]
+	if !ok || server.ParentSpanID != "00f067aa0ba902b7" || server.Kind != spanKindServer {
+		t.Fatalf("server span %+v; spans %+v", server, spans)
+	}
+	for _, name := range []string{"select session", "translate request", "CreateMessage", "write response"} {
+		if s, ok := byName[name]; !ok || s.ParentSpanID != server.SpanID {
+			t.Errorf("span %q missing or not a child of the server span: %+v", name, s)
+		}
+	}
+	sample := byName["CreateMessage"]
+	if want := "00-4bf92f3577b34da6a3ce929d0e0e4736-" + sample.SpanID + "-01"; hostTraceparent != want {
+		t.Errorf("_meta traceparent = %q, want %q", hostTraceparent, want)
+	}
+	if sample.Kind != spanKindClient {
+		t.Errorf("CreateMessage kind = %d", sample.Kind)
+	}
+	var finish string
+	for _, a := range sample.Attributes {
+		if a.Key == "gen_ai.response.finish_reasons" && a.Value.StringValue != nil {
+			finish = *a.Value.StringValue
+		}
+	}
+	if finish != "endTurn" {
+		t.Errorf("finish reason attribute = %q", finish)
+	}
+}
+
+func TestTraceUnsampled(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	var batches int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		batches++
+	}))
+	defer srv.Close()
+	tr := newTracer("samplellama", &otlpExporter{url: srv.URL, client: srv.Client()}, logger)
+	var forwarded string
+	handler := traceRequests(tr, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = spanFromContext(r.Context()).traceparent()
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/api/tags", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	tr.close()
+	if batches != 0 {
+		t.Errorf("exported %d batches of unsampled spans", batches)
+	}
+	if !strings.HasPrefix(forwarded, "00-4bf92f3577b34da6a3ce929d0e0e4736-") || !strings.HasSuffix(forwarded, "-00") {
+		t.Errorf("propagated traceparent %q", forwarded)
+	}
+}
+
+func TestOTLPExport(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	var got otlpTraces
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer srv.Close()
+	env := map[string]string{
+		"OTEL_EXPORTER_OTLP_ENDPOINT": srv.URL + "/",
+		"OTEL_EXPORTER_OTLP_HEADERS":  "Authorization=Bearer%20secret",
+	}
+	exporter := newTraceExporter("", "", func(k string) string { return env[k] })
+	if exporter == nil {
+		t.Fatal("no exporter configured")
+	}
+	tr := newTracer("bridge", exporter, logger)
+	_, s := tr.start(context.Background(), "work", spanKindInternal)
+	s.setAttr("count", 3)
+	s.finish(nil)
+	tr.close()
+
+	if auth != "Bearer secret" {
+		t.Errorf("Authorization = %q", auth)
+	}
+	if len(got.ResourceSpans) != 1 || len(got.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("unexpected export %+v", got)
+	}
+	rs := got.ResourceSpans[0]
+	if v := rs.Resource.Attributes[0].Value.StringValue; v == nil || *v != "bridge" {
+		t.Errorf("service.name = %v", v)
+	}
+	spans := rs.ScopeSpans[0].Spans
+	if len(spans) != 1 || spans[0].Name != "work" || len(spans[0].TraceID) != 32 || spans[0].ParentSpanID != "" {
+		t.Fatalf("unexpected spans %+v", spans)
+	}
+	if v := spans[0].Attributes[0].Value.IntValue; v == nil || *v != "3" {
+		t.Errorf("count attribute = %v", v)
+	}
+	if newTraceExporter("", "", func(string) string { return "" }) != nil {
+		t.Error("tracing enabled without configuration")
+	}
+}
+
+type failingExporter struct{ batches int }
+
+func (e *failingExporter) export(ctx context.Context, payload []byte) error {
+	e.batches++
+	return errors.New("connection refused")
+}
+
+func TestTraceBufferLimit(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	exporter := &failingExporter{}
+	// Without its loop, the tracer never exports, as if the endpoint
+	// were unreachable.
+	tr := &tracer{service: "bridge", exporter: exporter, logger: logger, flushCh: make(chan struct{}, 1)}
+	for i := range traceMaxPending + 10 {
+		_, s := tr.start(context.Background(), fmt.Sprintf("span %d", i), spanKindInternal)
+		s.finish(nil)
+	}
+	if len(tr.pending) != traceMaxPending || tr.dropped.Load() != 10 || tr.pending[0].name != "span 10" {
+		t.Fatalf("%d spans pending from %q, %d dropped", len(tr.pending), tr.pending[0].name, tr.dropped.Load())
+	}
+	tr.flush()
+	if len(tr.pending) != 0 || exporter.batches != 1 {
+		t.Errorf("after a failed export: %d spans pending, %d batches", len(tr.pending), exporter.batches)
+	}
+
+	m := newMetrics(newSessionHolder(), nil, nil)
+	m.tracer = tr
+	w := httptest.NewRecorder()
+	m.handler()(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !strings.Contains(w.Body.String(), "samplellama_trace_spans_dropped_total 10\n") {
+		t.Errorf("metrics lack the dropped spans:\n%s", w.Body)
+	}
+}
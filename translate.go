@@ -7,7 +7,8 @@ import (
 )
 
 // chatToCreateMessage translates an Ollama chat request into an MCP CreateMessageParams.
-func chatToCreateMessage(req ChatRequest, defaultMaxTokens int) *mcp.CreateMessageParams {
+// Messages are trimmed to fit window; errContextLength means they cannot be.
+func chatToCreateMessage(req ChatRequest, defaultMaxTokens int, window *contextWindow) (*mcp.CreateMessageParams, error) {
 	var messages []*mcp.SamplingMessage
 	var systemParts []string
 
@@ -53,15 +54,24 @@ func chatToCreateMessage(req ChatRequest, defaultMaxTokens int) *mcp.CreateMessa
 		params.Temperature = *req.Options.Temperature
 	}
 
-	return params
+	if err := window.fit(params); err != nil {
+		return nil, err
+	}
+	return params, nil
 }
 
 // generateToCreateMessage translates an Ollama generate request into an MCP CreateMessageParams.
+// In raw mode the prompt is sent verbatim without a system prompt. A suffix
+// turns the request into a fill-in-the-middle instruction.
 func generateToCreateMessage(req GenerateRequest, defaultMaxTokens int) *mcp.CreateMessageParams {
+	prompt := req.Prompt
+	if req.Suffix != "" && !req.Raw {
+		prompt = infillPrompt(req.Prompt, req.Suffix)
+	}
 	messages := []*mcp.SamplingMessage{
 		{
 			Role:    mcp.Role("user"),
-			Content: &mcp.TextContent{Text: req.Prompt},
+			Content: &mcp.TextContent{Text: prompt},
 		},
 	}
 
@@ -75,7 +85,7 @@ func generateToCreateMessage(req GenerateRequest, defaultMaxTokens int) *mcp.Cre
 		MaxTokens: maxTokens,
 	}
 
-	if req.System != "" {
+	if req.System != "" && !req.Raw {
 		params.SystemPrompt = req.System
 	}
 
@@ -92,6 +102,50 @@ func generateToCreateMessage(req GenerateRequest, defaultMaxTokens int) *mcp.Cre
 	return params
 }
 
+// withDefaults returns the request options with unset fields filled in from
+// the model's parameters.
+func withDefaults(opts, defaults *Options) *Options {
+	if defaults == nil {
+		return opts
+	}
+	if opts == nil {
+		merged := *defaults
+		return &merged
+	}
+	merged := *opts
+	if merged.NumPredict == 0 {
+		merged.NumPredict = defaults.NumPredict
+	}
+	if merged.NumCtx == 0 {
+		merged.NumCtx = defaults.NumCtx
+	}
+	if merged.Temperature == nil {
+		merged.Temperature = defaults.Temperature
+	}
+	if merged.Seed == nil {
+		merged.Seed = defaults.Seed
+	}
+	if merged.Cache == nil {
+		merged.Cache = defaults.Cache
+	}
+	return &merged
+}
+
+// applyModelEntry forwards the entry's base model as the model hint and
+// supplies its system prompt when the request did not set one.
+func applyModelEntry(params *mcp.CreateMessageParams, entry modelEntry) {
+	if params.ModelPreferences != nil {
+		for _, h := range params.ModelPreferences.Hints {
+			if h.Name == entry.Name {
+				h.Name = entry.Base
+			}
+		}
+	}
+	if params.SystemPrompt == "" {
+		params.SystemPrompt = entry.System
+	}
+}
+
 // mcpStopReason translates an MCP stop reason to an Ollama done_reason.
 func mcpStopReason(stopReason string) string {
 	switch stopReason {
@@ -17,7 +17,7 @@ func TestChatToCreateMessage(t *testing.T) {
 		},
 	}
 
-	result := chatToCreateMessage(req, 4096)
+	result, _ := chatToCreateMessage(req, 4096, nil)
 
 	if len(result.Messages) != 3 {
 		t.Fatalf("expected 3 messages, got %d", len(result.Messages))
@@ -59,7 +59,7 @@ func TestChatToCreateMessageWithOptions(t *testing.T) {
 		},
 	}
 
-	result := chatToCreateMessage(req, 4096)
+	result, _ := chatToCreateMessage(req, 4096, nil)
 
 	if result.MaxTokens != 2048 {
 		t.Errorf("expected max tokens 2048, got %d", result.MaxTokens)
@@ -78,7 +78,7 @@ func TestChatToCreateMessageMultipleSystemMessages(t *testing.T) {
 		},
 	}
 
-	result := chatToCreateMessage(req, 4096)
+	result, _ := chatToCreateMessage(req, 4096, nil)
 
 	if result.SystemPrompt != "First system.\nSecond system." {
 		t.Errorf("expected concatenated system prompt, got %q", result.SystemPrompt)
@@ -95,7 +95,7 @@ func TestChatToCreateMessageNoSystem(t *testing.T) {
 		},
 	}
 
-	result := chatToCreateMessage(req, 4096)
+	result, _ := chatToCreateMessage(req, 4096, nil)
 
 	if result.SystemPrompt != "" {
 		t.Errorf("expected empty system prompt, got %q", result.SystemPrompt)
@@ -204,7 +204,7 @@ func TestChatToCreateMessageUnknownRole(t *testing.T) {
 		},
 	}
 
-	result := chatToCreateMessage(req, 4096)
+	result, _ := chatToCreateMessage(req, 4096, nil)
 
 	if len(result.Messages) != 1 {
 		t.Fatalf("expected 1 message, got %d", len(result.Messages))
@@ -213,3 +213,82 @@ func TestChatToCreateMessageUnknownRole(t *testing.T) {
 		t.Errorf("expected unknown role to map to 'user', got %q", result.Messages[0].Role)
 	}
 }
+
+func TestWithDefaults(t *testing.T) {
+	modelTemp := 0.2
+	reqTemp := 0.9
+	defaults := &Options{NumPredict: 100, Temperature: &modelTemp}
+
+	got := withDefaults(nil, defaults)
+	if got.NumPredict != 100 || *got.Temperature != 0.2 {
+		t.Errorf("expected model defaults, got %+v", got)
+	}
+
+	got = withDefaults(&Options{Temperature: &reqTemp}, defaults)
+	if got.NumPredict != 100 || *got.Temperature != 0.9 {
+		t.Errorf("expected request temperature with default num_predict, got %+v", got)
+	}
+
+	if withDefaults(nil, nil) != nil {
+		t.Error("expected nil options without defaults")
+	}
+}
+
+func TestApplyModelEntry(t *testing.T) {
+	entry := modelEntry{Name: "coder", Base: "claude", System: "You write code."}
+
+	params, _ := chatToCreateMessage(ChatRequest{
+		Model:    "coder",
+		Messages: []OllamaMessage{{Role: "user", Content: "Hi"}},
+	}, 4096, nil)
+	applyModelEntry(params, entry)
+	if params.ModelPreferences.Hints[0].Name != "claude" {
+		t.Errorf("expected hint 'claude', got %q", params.ModelPreferences.Hints[0].Name)
+	}
+	if params.SystemPrompt != "You write code." {
+		t.Errorf("expected model system prompt, got %q", params.SystemPrompt)
+	}
+
+	params, _ = chatToCreateMessage(ChatRequest{
+		Model: "coder",
+		Messages: []OllamaMessage{
+			{Role: "system", Content: "Be brief."},
+			{Role: "user", Content: "Hi"},
+		},
+	}, 4096, nil)
+	applyModelEntry(params, entry)
+	if params.SystemPrompt != "Be brief." {
+		t.Errorf("expected request system prompt to win, got %q", params.SystemPrompt)
+	}
+}
+
+func TestGenerateToCreateMessageRaw(t *testing.T) {
+	req := GenerateRequest{
+		Prompt: "<|user|>Hi<|assistant|>",
+		Suffix: "ignored",
+		Raw:    true,
+	}
+
+	result := generateToCreateMessage(req, 4096)
+
+	if result.SystemPrompt != "" {
+		t.Errorf("expected no system prompt in raw mode, got %q", result.SystemPrompt)
+	}
+	if got := extractTextContent(result.Messages[0].Content); got != req.Prompt {
+		t.Errorf("expected verbatim prompt, got %q", got)
+	}
+}
+
+func TestGenerateToCreateMessageSuffix(t *testing.T) {
+	req := GenerateRequest{
+		Prompt: "def add(a, b):\n    return ",
+		Suffix: "\n\nprint(add(1, 2))",
+	}
+
+	result := generateToCreateMessage(req, 4096)
+
+	got := extractTextContent(result.Messages[0].Content)
+	if got != infillPrompt(req.Prompt, req.Suffix) {
+		t.Errorf("expected infill instruction, got %q", got)
+	}
+}
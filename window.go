@@ -0,0 +1,291 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// Truncation strategies for chat histories that exceed the context length.
+const (
+	truncateOldest    = "oldest"    // drop the oldest turns
+	truncateMiddle    = "middle"    // drop turns from the middle outwards
+	truncateSummarize = "summarize" // replace the oldest turns with a summary
+	truncateReject    = "reject"    // fail the request with 400
+)
+
+var truncationStrategies = []string{truncateOldest, truncateMiddle, truncateSummarize, truncateReject}
+
+// summaryMaxTokens caps the summary of dropped turns. It is also never
+// more than a quarter of the prompt budget.
+const summaryMaxTokens = 1024
+
+const summarizePrompt = "Summarize the conversation below in a few paragraphs for the assistant who will continue it. " +
+	"Keep names, facts, decisions, open questions and anything the user asked to remember. Reply with the summary only."
+
+// errContextLength reports a prompt that does not fit the context length,
+// either under the reject strategy or because even the latest message is
+// too long. Handlers answer it with 400.
+var errContextLength = errors.New("prompt exceeds the context length")
+
+// contextWindow is the context length a chat request is fitted into, and
+// how to get there. A nil window fits everything.
+type contextWindow struct {
+	length   int
+	strategy string
+	// system is the model's system prompt, which applyModelEntry adds
+	// after translation when the request has none.
+	system string
+	// summarize samples a summary for the summarize strategy.
+	summarize func(*mcp.CreateMessageParams) (string, error)
+	logger    *slog.Logger
+}
+
+// contextWindow returns the window for a chat request to a model. The
+// length is options.num_ctx if set, else the model's context_length, else
+// -context-length, and the strategy the model's truncation, else
+// -truncation.
+func (b *bridge) contextWindow(entry modelEntry, opts *Options, summarize func(*mcp.CreateMessageParams) (string, error)) *contextWindow {
+	w := &contextWindow{
+		length:    entry.ContextLength,
+		strategy:  entry.Truncation,
+		system:    entry.System,
+		summarize: summarize,
+		logger:    b.logger,
+	}
+	if opts != nil && opts.NumCtx > 0 {
+		w.length = opts.NumCtx
+	}
+	if w.length == 0 {
+		w.length = b.contextLength
+	}
+	if w.strategy == "" {
+		w.strategy = b.truncation
+	}
+	return w
+}
+
+// promptBudget is how many tokens the prompt may take. Room is left for
+// the response: MaxTokens, but at most half the context, since clients
+// often set a small num_ctx without lowering num_predict.
+func (w *contextWindow) promptBudget(params *mcp.CreateMessageParams) int {
+	return w.length - min(int(params.MaxTokens), w.length/2)
+}
+
+func messageTokens(m *mcp.SamplingMessage) int {
+	return estimateTokens(extractTextContent(m.Content)) + messageOverhead
+}
+
+// fit trims params.Messages until the prompt fits the window, according
+// to the strategy, and logs what it trimmed. System prompts and the latest
+// message are always kept.
+func (w *contextWindow) fit(params *mcp.CreateMessageParams) error {
+	if w == nil || w.length <= 0 {
+		return nil
+	}
+	budget := w.promptBudget(params)
+	system := params.SystemPrompt
+	if system == "" {
+		system = w.system
+	}
+	if system != "" {
+		budget -= estimateTokens(system) + messageOverhead
+	}
+	costs := make([]int, len(params.Messages))
+	total := 0
+	for i, m := range params.Messages {
+		costs[i] = messageTokens(m)
+		total += costs[i]
+	}
+	if total <= budget {
+		return nil
+	}
+	if w.strategy == truncateReject || len(costs) == 0 || costs[len(costs)-1] > budget {
+		return fmt.Errorf("%w: about %d tokens for the messages, %d available of %d", errContextLength, total, max(budget, 0), w.length)
+	}
+
+	before := len(params.Messages)
+	var summarized int
+	switch w.strategy {
+	case truncateMiddle:
+		params.Messages = dropMiddle(params.Messages, costs, budget)
+	case truncateSummarize:
+		n, err := w.summarizeOldest(params, costs, budget)
+		if err != nil {
+			return err
+		}
+		summarized = n
+	default:
+		params.Messages = keepLatest(params.Messages, costs, budget)
+	}
+	w.logger.Info("Truncated chat history to fit the context length",
+		"strategy", w.strategy,
+		"context_length", w.length,
+		"prompt_budget", budget,
+		"messages_before", before,
+		"messages_after", len(params.Messages),
+		"summarized", summarized,
+		"message_tokens_before", total,
+		"message_tokens_after", estimatePromptTokens(&mcp.CreateMessageParams{Messages: params.Messages}),
+	)
+	return nil
+}
+
+// keepLatest returns the longest suffix of messages that fits budget, not
+// starting with an assistant turn, since hosts expect a conversation to
+// open with the user.
+func keepLatest(messages []*mcp.SamplingMessage, costs []int, budget int) []*mcp.SamplingMessage {
+	start, used := len(messages), 0
+	for start > 0 && used+costs[start-1] <= budget {
+		start--
+		used += costs[start]
+	}
+	for start < len(messages)-1 && messages[start].Role == "assistant" {
+		start++
+	}
+	return messages[start:]
+}
+
+// dropMiddle removes messages from the middle outwards until the rest fits
+// budget, keeping the opening messages, which often set up the task, and
+// the latest ones.
+func dropMiddle(messages []*mcp.SamplingMessage, costs []int, budget int) []*mcp.SamplingMessage {
+	total := 0
+	for _, c := range costs {
+		total += c
+	}
+	// Drop the range [lo, hi), growing it around the middle, never
+	// touching the first or the last message.
+	mid := len(messages) / 2
+	lo, hi := mid, mid
+	for total > budget {
+		if hi < len(messages)-1 && (hi-mid <= mid-lo || lo <= 1) {
+			total -= costs[hi]
+			hi++
+		} else if lo > 1 {
+			lo--
+			total -= costs[lo]
+		} else {
+			// Only the first and the last message are left.
+			return messages[len(messages)-1:]
+		}
+	}
+	return append(messages[:lo:lo], messages[hi:]...)
+}
+
+const summaryPrefix = "Summary of the earlier conversation:\n"
+
+// summarizeOldest replaces the oldest messages with a summary of them,
+// keeping the latest messages that fit beside it. Messages too old to fit
+// in the summarizing request itself are dropped. It returns the number of
+// messages summarized.
+func (w *contextWindow) summarizeOldest(params *mcp.CreateMessageParams, costs []int, budget int) (int, error) {
+	summaryBudget := min(summaryMaxTokens, budget/4)
+	reserved := summaryBudget + estimateTokens(summaryPrefix) + messageOverhead
+	if summaryBudget < 1 || costs[len(costs)-1] > budget-reserved {
+		// No room for a summary beside the latest message.
+		params.Messages = keepLatest(params.Messages, costs, budget)
+		return 0, nil
+	}
+	kept := keepLatest(params.Messages, costs, budget-reserved)
+	dropped := params.Messages[:len(params.Messages)-len(kept)]
+	// The summarizing request must fit the context length too.
+	transcriptBudget := budget - summaryBudget - estimateTokens(summarizePrompt) - 2*messageOverhead
+	dropped = keepLatest(dropped, costs[:len(dropped)], transcriptBudget)
+	if len(dropped) == 0 {
+		params.Messages = kept
+		return 0, nil
+	}
+	summary, err := w.summarize(summaryParams(dropped, summaryBudget))
+	if err != nil {
+		return 0, fmt.Errorf("summarizing earlier messages: %w", err)
+	}
+	params.Messages = append([]*mcp.SamplingMessage{{
+		Role:    "user",
+		Content: &mcp.TextContent{Text: summaryPrefix + summary},
+	}}, kept...)
+	return len(dropped), nil
+}
+
+// summarizer returns the summarize function of a chat request's context
+// window. The summary is a sampling request of its own, made for the same
+// client: it passes the policy hooks and the rate limits, is charged to
+// the client's quotas, and is audited, traced and counted like the chat
+// request it serves. It is redacted too, but never cached. An error from
+// a hook or errRateLimited, for which admit has already answered w, fails
+// the chat request. model is the requested name, for quotas and the audit
+// log, and base the name hinted to the host, as applyModelEntry would.
+func (b *bridge) summarizer(w http.ResponseWriter, r *http.Request, model, base string, session SamplingSession) func(*mcp.CreateMessageParams) (string, error) {
+	return func(params *mcp.CreateMessageParams) (string, error) {
+		if base != "" {
+			// The hint is the summary's own, so hooks that rewrite it
+			// leave the chat request's alone.
+			params.ModelPreferences = &mcp.ModelPreferences{Hints: []*mcp.ModelHint{{Name: base}}}
+		}
+		ctx, span := b.tracer.start(r.Context(), "summarize history", spanKindInternal)
+		span.setAttr("mcp.session.id", session.ID())
+		obs := observe(r.Context())
+		audited := b.audit.start(r, "/api/chat", model)
+		audited.setSummary()
+		audited.setSession(session, b.holder.identity(session.ID()))
+		redacted := b.redact.redactParams(params)
+		audited.setPrompt(params)
+		fail := func(status int, err error) (string, error) {
+			obs.summary(0, 0, err)
+			audited.finish(status, nil, "", err)
+			span.finish(err)
+			return "", err
+		}
+
+		hookReq := &hookRequest{Endpoint: "/api/chat", Model: model, Client: clientLabel(r.Context()), SessionID: session.ID(), Summary: true, Params: params}
+		if err := b.hooks.preSample(ctx, hookReq); err != nil {
+			return fail(hookErrorStatus(err), err)
+		}
+		admitted := b.limits.admit(w, r, model, estimatePromptTokens(params))
+		if admitted == nil {
+			return fail(http.StatusTooManyRequests, errRateLimited)
+		}
+		sampleCtx, sampleSpan := b.tracer.startSampling(ctx, session, model, params)
+		obs.startSummary()
+		result, err := b.holder.createMessage(sampleCtx, session, params)
+		obs.endSummary()
+		sampleSpan.finishSampling(result, err)
+		if err != nil {
+			admitted.done(0, 0)
+			return fail(http.StatusBadGateway, err)
+		}
+		hookReq.Result = result
+		if err := b.hooks.postSample(ctx, hookReq); err != nil {
+			admitted.done(tokenUsage(params, result, extractTextContent(result.Content)))
+			return fail(hookErrorStatus(err), err)
+		}
+
+		hostText := redacted.redactResponse(extractTextContent(result.Content))
+		text := redacted.restore(hostText)
+		redacted.log(b.logger)
+		promptTokens, evalTokens := tokenUsage(params, result, text)
+		admitted.done(promptTokens, evalTokens)
+		obs.summary(promptTokens, evalTokens, nil)
+		audited.finish(http.StatusOK, result, hostText, nil)
+		span.finish(nil)
+		return text, nil
+	}
+}
+
+// summaryParams builds the sampling request that summarizes the dropped
+// messages. The summarizer adds the model hint.
+func summaryParams(dropped []*mcp.SamplingMessage, maxTokens int) *mcp.CreateMessageParams {
+	var b strings.Builder
+	for _, m := range dropped {
+		fmt.Fprintf(&b, "%s: %s\n\n", m.Role, extractTextContent(m.Content))
+	}
+	return &mcp.CreateMessageParams{
+		SystemPrompt: summarizePrompt,
+		Messages:     []*mcp.SamplingMessage{{Role: "user", Content: &mcp.TextContent{Text: b.String()}}},
+		MaxTokens:    int64(maxTokens),
+	}
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// windowTurns returns alternating user and assistant messages of equal
+// token counts, and that count.
+func windowTurns(t *testing.T, n int) ([]*mcp.SamplingMessage, int) {
+	t.Helper()
+	var messages []*mcp.SamplingMessage
+	for i := range n {
+		role := mcp.Role("user")
+		if i%2 == 1 {
+			role = "assistant"
+		}
+		text := fmt.Sprintf("turn %d: %s", i, strings.Repeat("lorem ipsum ", 20))
+		messages = append(messages, &mcp.SamplingMessage{Role: role, Content: &mcp.TextContent{Text: text}})
+	}
+	cost := messageTokens(messages[0])
+	for _, m := range messages {
+		if messageTokens(m) != cost {
+			t.Fatalf("turns differ in size: %d and %d tokens", cost, messageTokens(m))
+		}
+	}
+	return messages, cost
+}
+
+// turnNumbers lists which turns messages are.
+func turnNumbers(messages []*mcp.SamplingMessage) []int {
+	var turns []int
+	for _, m := range messages {
+		var n int
+		if _, err := fmt.Sscanf(extractTextContent(m.Content), "turn %d:", &n); err == nil {
+			turns = append(turns, n)
+		} else {
+			turns = append(turns, -1)
+		}
+	}
+	return turns
+}
+
+func TestContextWindowFit(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	const maxTokens = 10
+	_, cost := windowTurns(t, 1)
+	// window fits n turns.
+	window := func(strategy string, n int) *contextWindow {
+		return &contextWindow{length: maxTokens + n*cost, strategy: strategy, logger: logger}
+	}
+
+	for _, tc := range []struct {
+		name   string
+		window *contextWindow
+		want   []int
+	}{
+		{"fits", window(truncateReject, 7), []int{0, 1, 2, 3, 4, 5, 6}},
+		{"no window", nil, []int{0, 1, 2, 3, 4, 5, 6}},
+		{"oldest", window(truncateOldest, 3), []int{4, 5, 6}},
+		{"oldest starts with the user", window(truncateOldest, 4), []int{4, 5, 6}},
+		{"middle", window(truncateMiddle, 4), []int{0, 1, 5, 6}},
+		{"middle keeps the latest", window(truncateMiddle, 1), []int{6}},
+	} {
+		messages, _ := windowTurns(t, 7)
+		params := &mcp.CreateMessageParams{Messages: messages, MaxTokens: maxTokens}
+		if err := tc.window.fit(params); err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if got := turnNumbers(params.Messages); !slices.Equal(got, tc.want) {
+			t.Errorf("%s: kept turns %v, want %v", tc.name, got, tc.want)
+		}
+	}
+
+	// The system prompt, the model's if the request has none, counts
+	// against the window.
+	messages, _ := windowTurns(t, 7)
+	w := window(truncateOldest, 4)
+	w.system = strings.Repeat("Be brief. ", 30)
+	params := &mcp.CreateMessageParams{Messages: messages, MaxTokens: maxTokens}
+	if err := w.fit(params); err != nil || !slices.Equal(turnNumbers(params.Messages), []int{6}) {
+		t.Errorf("with a system prompt: kept %v, %v", turnNumbers(params.Messages), err)
+	}
+
+	for name, w := range map[string]*contextWindow{
+		"reject":             window(truncateReject, 6),
+		"latest is too long": {length: maxTokens + cost/2, strategy: truncateOldest, logger: logger},
+	} {
+		messages, _ := windowTurns(t, 7)
+		if err := w.fit(&mcp.CreateMessageParams{Messages: messages, MaxTokens: maxTokens}); !errors.Is(err, errContextLength) {
+			t.Errorf("%s: got %v", name, err)
+		}
+	}
+}
+
+func TestContextWindowSummarize(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	messages, cost := windowTurns(t, 7)
+	var request *mcp.CreateMessageParams
+	w := &contextWindow{length: 10 + 5*cost, strategy: truncateSummarize, logger: logger,
+		summarize: func(p *mcp.CreateMessageParams) (string, error) {
+			request = p
+			return "The user counted turns.", nil
+		}}
+	params := &mcp.CreateMessageParams{Messages: messages, MaxTokens: 10, ModelPreferences: &mcp.ModelPreferences{Hints: []*mcp.ModelHint{{Name: "llama3"}}}}
+	if err := w.fit(params); err != nil {
+		t.Fatal(err)
+	}
+	if got := turnNumbers(params.Messages); !slices.Equal(got, []int{-1, 4, 5, 6}) {
+		t.Fatalf("kept turns %v", got)
+	}
+	if got := extractTextContent(params.Messages[0].Content); got != summaryPrefix+"The user counted turns." {
+		t.Errorf("summary message %q", got)
+	}
+	transcript := extractTextContent(request.Messages[0].Content)
+	if request.SystemPrompt != summarizePrompt || request.ModelPreferences != nil || !strings.Contains(transcript, "user: turn 2:") || !strings.Contains(transcript, "assistant: turn 3:") || strings.Contains(transcript, "turn 4:") {
+		t.Errorf("summary request %+v: %s", request, transcript)
+	}
+	if estimatePromptTokens(params) > w.promptBudget(params) {
+		t.Errorf("summarized prompt of %d tokens exceeds the budget of %d", estimatePromptTokens(params), w.promptBudget(params))
+	}
+
+	messages, _ = windowTurns(t, 7)
+	w.summarize = func(*mcp.CreateMessageParams) (string, error) { return "", errors.New("host went away") }
+	if err := w.fit(&mcp.CreateMessageParams{Messages: messages, MaxTokens: 10}); err == nil || errors.Is(err, errContextLength) {
+		t.Errorf("failed summary: got %v", err)
+	}
+}
+
+func TestContextWindowSettings(t *testing.T) {
+	b := &bridge{contextLength: 131072, truncation: truncateOldest}
+	for _, tc := range []struct {
+		entry    modelEntry
+		opts     *Options
+		length   int
+		strategy string
+	}{
+		{modelEntry{Name: "llama3"}, nil, 131072, truncateOldest},
+		{modelEntry{Name: "small", ContextLength: 8192, Truncation: truncateReject}, nil, 8192, truncateReject},
+		{modelEntry{Name: "small", ContextLength: 8192}, &Options{NumCtx: 2048}, 2048, truncateOldest},
+	} {
+		w := b.contextWindow(tc.entry, tc.opts, nil)
+		if w.length != tc.length || w.strategy != tc.strategy {
+			t.Errorf("%s %+v: got length %d, strategy %s", tc.entry.Name, tc.opts, w.length, w.strategy)
+		}
+	}
+}
+
+func TestChatContextLength(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	h := newSessionHolder()
+	var calls []*mcp.CreateMessageParams
+	h.set(&mockSession{id: "s1", createMessageFunc: func(ctx context.Context, params *mcp.CreateMessageParams) (*mcp.CreateMessageResult, error) {
+		calls = append(calls, params)
+		return &mcp.CreateMessageResult{Model: "host-model", StopReason: "endTurn", Content: &mcp.TextContent{Text: "ok"}}, nil
+	}})
+	b := testBridge(h, logger)
+	b.truncation = truncateOldest
+	handler := handleChat(b)
+
+	history := `{"role":"system","content":"Be brief."}`
+	for i := range 40 {
+		role := "user"
+		if i%2 == 1 {
+			role = "assistant"
+		}
+		history += fmt.Sprintf(`,{"role":%q,"content":"turn %d: %s"}`, role, i, strings.Repeat("lorem ipsum ", 20))
+	}
+	history += `,{"role":"user","content":"turn 40: and now?"}`
+
+	for _, tc := range []struct {
+		options string
+		status  int
+		calls   int
+	}{
+		{`{}`, http.StatusOK, 1},
+		{`{"num_ctx":512}`, http.StatusOK, 1},
+		{`{"num_ctx":8}`, http.StatusBadRequest, 0},
+	} {
+		calls = nil
+		body := `{"model":"llama3","stream":false,"options":` + tc.options + `,"messages":[` + history + `]}`
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/chat", strings.NewReader(body)))
+		if w.Code != tc.status || len(calls) != tc.calls {
+			t.Fatalf("options %s: got %d with %d calls: %s", tc.options, w.Code, len(calls), w.Body)
+		}
+		if tc.calls == 0 {
+			continue
+		}
+		params := calls[0]
+		if params.SystemPrompt != "Be brief." || turnNumbers(params.Messages[len(params.Messages)-1:])[0] != 40 {
+			t.Errorf("options %s: system %q, messages %v", tc.options, params.SystemPrompt, turnNumbers(params.Messages))
+		}
+		if tc.options != `{}` && (len(params.Messages) == 41 || estimatePromptTokens(params) > 512-256) {
+			t.Errorf("options %s: %d messages of %d tokens sent", tc.options, len(params.Messages), estimatePromptTokens(params))
+		}
+	}
+
+	b.models, _ = newModelRegistry([]modelEntry{{Name: "llama3", Base: "host-model", ContextLength: 512, Truncation: truncateSummarize}}, "")
+	calls = nil
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/chat", strings.NewReader(`{"model":"llama3","stream":false,"messages":[`+history+`]}`)))
+	if w.Code != http.StatusOK || len(calls) != 2 || calls[0].SystemPrompt != summarizePrompt {
+		t.Fatalf("summarize: got %d with %d calls: %s", w.Code, len(calls), w.Body)
+	}
+	if got := extractTextContent(calls[1].Messages[0].Content); got != summaryPrefix+"ok" {
+		t.Errorf("summarize: first message %q", got)
+	}
+	// Both requests hint the base model, each with hints of its own.
+	summaryHint, chatHint := calls[0].ModelPreferences.Hints[0], calls[1].ModelPreferences.Hints[0]
+	if summaryHint.Name != "host-model" || chatHint.Name != "host-model" || summaryHint == chatHint {
+		t.Errorf("summarize: hints %q and %q, shared %v", summaryHint.Name, chatHint.Name, summaryHint == chatHint)
+	}
+}
+
+// TestSummaryRequest checks that the summary of a long chat history is a
+// sampling request of its own: hooked, limited, audited, traced and
+// counted.
+func TestSummaryRequest(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	auditPath := filepath.Join(t.TempDir(), "audit.jsonl")
+	audit, err := newAuditLog(auditPath, 0, 0, false, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer audit.close()
+	var rejectSummary bool
+	var hooked []bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req hookRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Stage == "pre_sample" {
+			hooked = append(hooked, req.Summary)
+		}
+		if req.Summary && rejectSummary {
+			json.NewEncoder(w).Encode(hookResponse{Action: "reject", Message: "no summaries"})
+		}
+	}))
+	defer srv.Close()
+
+	h := newSessionHolder()
+	calls := 0
+	h.set(&mockSession{id: "s1", createMessageFunc: func(ctx context.Context, params *mcp.CreateMessageParams) (*mcp.CreateMessageResult, error) {
+		calls++
+		return &mcp.CreateMessageResult{Model: "host-model", StopReason: "endTurn", Content: &mcp.TextContent{Text: "ok"}}, nil
+	}})
+	b := testBridge(h, logger)
+	b.models, _ = newModelRegistry([]modelEntry{{Name: "llama3", ContextLength: 512, Truncation: truncateSummarize}}, "")
+	b.audit = audit
+	b.hooks, _ = newHooks(hooksConfig{PreSample: []hookConfig{{Name: "policy", URL: srv.URL}}, PostSample: []hookConfig{{Name: "policy", URL: srv.URL}}}, logger)
+	b.limits = newRateLimiter(limitConfig{Key: limitSpec{RequestsPerMinute: 3}}, &budgetStore{usage: map[string]*budgetUsage{}}, logger)
+	tr := &tracer{service: "bridge", exporter: &failingExporter{}, logger: logger, flushCh: make(chan struct{}, 1)}
+	b.tracer = tr
+	stats := newMetrics(h, b.models, nil)
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/chat", handleChat(b))
+	handler := stats.instrument(mux)
+
+	history := ""
+	for i := range 40 {
+		role := "user"
+		if i%2 == 1 {
+			role = "assistant"
+		}
+		history += fmt.Sprintf(`{"role":%q,"content":"turn %d: %s"},`, role, i, strings.Repeat("lorem ipsum ", 20))
+	}
+	body := `{"model":"llama3","stream":false,"messages":[` + history + `{"role":"user","content":"and now?"}]}`
+	send := func() int {
+		req := httptest.NewRequest(http.MethodPost, "/api/chat", strings.NewReader(body))
+		req = req.WithContext(withClient(req.Context(), &clientIdentity{Label: "ci"}))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// The summary and the chat request each pass the hooks and take a
+	// request from the client's quota.
+	if code := send(); code != http.StatusOK || calls != 2 || !slices.Equal(hooked, []bool{true, false}) {
+		t.Fatalf("got %d with %d calls, hooks saw %v", code, calls, hooked)
+	}
+	var summarySpan *span
+	for _, s := range tr.pending {
+		if s.name == "summarize history" {
+			summarySpan = s
+		}
+	}
+	if summarySpan == nil {
+		t.Fatal("no summary span")
+	}
+	children := 0
+	for _, s := range tr.pending {
+		if s.name == "CreateMessage" && s.parentID == summarySpan.spanID {
+			children++
+		}
+	}
+	if children != 1 {
+		t.Errorf("summary span has %d CreateMessage children, want 1", children)
+	}
+
+	// A rejected summary fails the chat request before it is charged.
+	rejectSummary = true
+	if code := send(); code != http.StatusForbidden || calls != 2 {
+		t.Errorf("rejected summary: got %d with %d calls", code, calls)
+	}
+	rejectSummary = false
+	// The summary takes the last request of the quota, the chat request
+	// finds none, and the next summary is refused.
+	if code := send(); code != http.StatusTooManyRequests || calls != 3 {
+		t.Errorf("quota used by the summary: got %d with %d calls", code, calls)
+	}
+	if code := send(); code != http.StatusTooManyRequests || calls != 3 {
+		t.Errorf("no quota left: got %d with %d calls", code, calls)
+	}
+
+	want := []struct {
+		summary bool
+		status  int
+	}{
+		{true, http.StatusOK}, {false, http.StatusOK},
+		{true, http.StatusForbidden}, {false, http.StatusForbidden},
+		{true, http.StatusOK}, {false, http.StatusTooManyRequests},
+		{true, http.StatusTooManyRequests}, {false, http.StatusTooManyRequests},
+	}
+	entries := readAuditEntries(t, auditPath)
+	if len(entries) != len(want) {
+		t.Fatalf("got %d audit entries, want %d: %+v", len(entries), len(want), entries)
+	}
+	for i, w := range want {
+		if e := entries[i]; e.Summary != w.summary || e.Status != w.status || e.Client != "ci" || e.SessionID != "s1" {
+			t.Errorf("audit entry %d: %+v, want %+v", i, e, w)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	stats.handler()(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, line := range []string{
+		`samplellama_summaries_total{model="llama3",result="error"} 2`,
+		`samplellama_summaries_total{model="llama3",result="ok"} 2`,
+	} {
+		if !strings.Contains(w.Body.String(), line+"\n") {
+			t.Errorf("metrics lack %s:\n%s", line, w.Body)
+		}
+	}
+}